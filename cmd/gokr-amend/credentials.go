@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+
+	"github.com/gokrazy/autoupdate/internal/secret"
+)
+
+// gitCredentials splits the credentials off the authenticated cloneURL. It
+// returns the URL without credentials, and environment variables which make
+// git (2.31 or newer) send the credentials as an HTTP Authorization header
+// instead. This way, the token appears neither in the process list of
+// (shared) runners nor in logged command lines or .git/config.
+func gitCredentials(cloneURL string) (string, []string, error) {
+	u, err := url.Parse(cloneURL)
+	if err != nil {
+		// url.Parse errors contain the (authenticated) URL.
+		return "", nil, errors.New(secret.Scrub(err.Error()))
+	}
+	if u.User == nil {
+		return cloneURL, nil, nil
+	}
+	password, _ := u.User.Password()
+	auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+	secret.Register(auth)
+	u.User = nil
+	return u.String(), []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic " + auth,
+	}, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	maxFileSizeMB = flag.Int("max_file_size_mb",
+		50,
+		"files larger than this many MiB in the amended commit are reported (GitHub warns about files above 50 MiB and rejects files above 100 MiB). 0 disables the check")
+
+	largeFileAction = flag.String("large_file_action",
+		"warn",
+		"what to do about files above -max_file_size_mb: warn (log and push anyway) or refuse (fail before pushing)")
+
+	generatedPaths = flag.String("generated_paths",
+		"",
+		"if non-empty, comma-separated list of .gitattributes path patterns of (binary) build artifacts, e.g. vmlinuz,*.dtb,lib/modules/**. They are marked linguist-generated -diff in .gitattributes of the pull request, so that GitHub collapses them in diffs and language statistics")
+)
+
+// generatedAttributes are set on -generated_paths.
+const generatedAttributes = "linguist-generated -diff"
+
+// ensureAttributes adds a line marking each of -generated_paths as generated
+// to .gitattributes in dir, unless a line for the pattern already exists.
+func ensureAttributes(dir string) error {
+	if *generatedPaths == "" {
+		return nil
+	}
+	fn := filepath.Join(dir, ".gitattributes")
+	b, err := os.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	b, added := renderAttributes(b)
+	if len(added) == 0 {
+		return nil
+	}
+	log.Printf("adding %d pattern(s) to .gitattributes: %q", len(added), added)
+	return os.WriteFile(fn, b, 0644)
+}
+
+// renderAttributes returns the .gitattributes content b with the lines
+// which ensureAttributes adds, and these lines.
+func renderAttributes(b []byte) ([]byte, []string) {
+	present := make(map[string]bool)
+	for _, line := range strings.Split(string(b), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			present[fields[0]] = true
+		}
+	}
+	var added []string
+	for _, pattern := range strings.Split(*generatedPaths, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" || present[pattern] {
+			continue
+		}
+		present[pattern] = true
+		added = append(added, pattern+" "+generatedAttributes)
+	}
+	if len(added) == 0 {
+		return b, nil
+	}
+	if len(b) > 0 && !bytes.HasSuffix(b, []byte("\n")) {
+		b = append(b, '\n')
+	}
+	b = append(b, strings.Join(added, "\n")+"\n"...)
+	return b, added
+}
+
+// checkLargeFiles reports the staged files in dir which exceed
+// -max_file_size_mb, and returns an error if -large_file_action=refuse.
+func checkLargeFiles(ctx context.Context, dir string) error {
+	if *maxFileSizeMB == 0 {
+		return nil
+	}
+	var stdout bytes.Buffer
+	diff := exec.CommandContext(ctx, "git", "diff", "--cached", "--name-only", "--diff-filter=AM", "-z")
+	diff.Dir = dir
+	diff.Stdout = &stdout
+	diff.Stderr = os.Stderr
+	if err := diff.Run(); err != nil {
+		return fmt.Errorf("%v: %v", diff.Args, err)
+	}
+	limit := int64(*maxFileSizeMB) * 1024 * 1024
+	var large []string
+	for _, name := range strings.Split(stdout.String(), "\x00") {
+		if name == "" {
+			continue
+		}
+		st, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if st.Size() > limit {
+			large = append(large, fmt.Sprintf("%s (%d MiB)", name, st.Size()>>20))
+		}
+	}
+	if len(large) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("%d file(s) above -max_file_size_mb=%d: %s", len(large), *maxFileSizeMB, strings.Join(large, ", "))
+	if *largeFileAction == "refuse" {
+		return fmt.Errorf("refusing to push %s", msg)
+	}
+	log.Printf("warning: %s", msg)
+	return nil
+}
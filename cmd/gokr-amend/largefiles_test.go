@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRenderAttributes(t *testing.T) {
+	orig := *generatedPaths
+	*generatedPaths = "vmlinuz, *.dtb,lib/modules/**"
+	defer func() { *generatedPaths = orig }()
+
+	for _, tt := range []struct {
+		name      string
+		in        string
+		want      string
+		wantAdded []string
+	}{
+		{
+			name: "missing",
+			in:   "",
+			want: "vmlinuz linguist-generated -diff\n*.dtb linguist-generated -diff\nlib/modules/** linguist-generated -diff\n",
+			wantAdded: []string{
+				"vmlinuz linguist-generated -diff",
+				"*.dtb linguist-generated -diff",
+				"lib/modules/** linguist-generated -diff",
+			},
+		},
+		{
+			name:      "partially present, without trailing newline",
+			in:        "*.sh text eol=lf\nvmlinuz -diff\n*.dtb binary",
+			want:      "*.sh text eol=lf\nvmlinuz -diff\n*.dtb binary\nlib/modules/** linguist-generated -diff\n",
+			wantAdded: []string{"lib/modules/** linguist-generated -diff"},
+		},
+		{
+			name: "present",
+			in:   "vmlinuz linguist-generated -diff\n*.dtb linguist-generated -diff\nlib/modules/** linguist-generated -diff\n",
+			want: "vmlinuz linguist-generated -diff\n*.dtb linguist-generated -diff\nlib/modules/** linguist-generated -diff\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, added := renderAttributes([]byte(tt.in))
+			if string(got) != tt.want {
+				t.Errorf("renderAttributes(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if !reflect.DeepEqual(added, tt.wantAdded) {
+				t.Errorf("renderAttributes(%q) added %q, want %q", tt.in, added, tt.wantAdded)
+			}
+		})
+	}
+}
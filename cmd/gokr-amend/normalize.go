@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	normalizeModes = flag.Bool("normalize_modes",
+		false,
+		"canonicalize the synced files for reproducible trees, so that re-running the same build results in no changes (and the nothing-to-amend fast path): files matching -executable_paths get mode 0755, all other files 0644, regardless of the umask and permissions of the build environment, and their modification times are set to SOURCE_DATE_EPOCH (or the UNIX epoch). Extended attributes are never copied")
+
+	executablePaths = flag.String("executable_paths",
+		"",
+		"for -normalize_modes: comma-separated list of path.Match patterns of executable files, e.g. *.sh,scripts/*. Patterns containing a slash are matched against the path within the repository, all others against the file name")
+)
+
+// checkExecutablePaths validates the -executable_paths patterns.
+func checkExecutablePaths() error {
+	if *executablePaths == "" {
+		return nil
+	}
+	for _, pattern := range strings.Split(*executablePaths, ",") {
+		if _, err := path.Match(strings.TrimSpace(pattern), ""); err != nil {
+			return fmt.Errorf("invalid -executable_paths pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+func executable(rel string) bool {
+	if *executablePaths == "" {
+		return false
+	}
+	for _, pattern := range strings.Split(*executablePaths, ",") {
+		pattern = strings.TrimSpace(pattern)
+		name := path.Base(rel)
+		if strings.Contains(pattern, "/") {
+			name = rel
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeMode returns the mode with which the regular file at rel (the
+// slash-separated path within the repository) is committed: mode itself,
+// or its canonical mode with -normalize_modes.
+func normalizeMode(rel string, mode fs.FileMode) fs.FileMode {
+	if !*normalizeModes || !mode.IsRegular() {
+		return mode
+	}
+	if executable(rel) {
+		return 0755
+	}
+	return 0644
+}
+
+// normalizedTime returns the modification time of synced files with
+// -normalize_modes.
+func normalizedTime() time.Time {
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		if sec, err := strconv.ParseInt(epoch, 10, 64); err == nil {
+			return time.Unix(sec, 0)
+		}
+	}
+	return time.Unix(0, 0)
+}
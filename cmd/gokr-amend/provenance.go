@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var (
+	expectedAuthor = flag.String("expected_author",
+		"",
+		"regular expression matched against the author (“name <email>”) of the pull request branch tip commit to identify commits created by the automation. Defaults to the GitHub user")
+
+	expectedMessage = flag.String("expected_message",
+		`^auto-update (\S+ )?to `,
+		"regular expression matched against the commit message of the pull request branch tip commit to identify commits created by the automation. The default matches the messages of all gokr-pull-* tools, e.g. “auto-update to linux-6.6.8.tar.xz” and “auto-update debian:bookworm-slim to sha256:…” (gokr-pull-debian-base)")
+
+	allowRewriteHuman = flag.Bool("allow_rewrite_human",
+		false,
+		"amend and force-push the pull request branch even if its tip commit does not look like it was created by the automation")
+)
+
+// verifyProvenance returns an error unless the tip commit of the clone in
+// dir was authored by the automation identity or carries an automation
+// commit message, so that manual fixes pushed to the pull request branch
+// are not destroyed by git commit --amend and git push -f.
+func verifyProvenance(ctx context.Context, dir, user string) error {
+	authorPattern := *expectedAuthor
+	if authorPattern == "" {
+		authorPattern = regexp.QuoteMeta(user)
+	}
+	authorRe, err := regexp.Compile(authorPattern)
+	if err != nil {
+		return fmt.Errorf("-expected_author: %v", err)
+	}
+	messageRe, err := regexp.Compile(*expectedMessage)
+	if err != nil {
+		return fmt.Errorf("-expected_message: %v", err)
+	}
+
+	var stdout bytes.Buffer
+	show := exec.CommandContext(ctx,
+		"git",
+		"log",
+		"-1",
+		"--format=%H%n%an <%ae>%n%B")
+	show.Dir = dir
+	show.Stdout = &stdout
+	show.Stderr = os.Stderr
+	if err := show.Run(); err != nil {
+		return fmt.Errorf("%v: %v", show.Args, err)
+	}
+	parts := strings.SplitN(stdout.String(), "\n", 3)
+	if got, want := len(parts), 3; got != want {
+		return fmt.Errorf("unexpected git log output: %q", stdout.String())
+	}
+	commit, author, message := parts[0], parts[1], parts[2]
+	if authorRe.MatchString(author) || messageRe.MatchString(message) {
+		return nil
+	}
+	if *allowRewriteHuman {
+		log.Printf("rewriting commit %s by %s (-allow_rewrite_human)", commit, author)
+		return nil
+	}
+	return fmt.Errorf("refusing to rewrite commit %s by %s: neither author matches %q nor message matches %q (use -allow_rewrite_human to override)",
+		commit, author, authorPattern, *expectedMessage)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-github/v35/github"
+)
+
+var errDiffers = errors.New("local files differ from branch")
+
+// gitBlobSHA returns the object ID git would assign to the file (or, for a
+// symlink, the link target) at fn.
+func gitBlobSHA(fn string, st fs.FileInfo) (string, error) {
+	h := sha1.New()
+	if st.Mode()&fs.ModeSymlink != 0 {
+		link, err := os.Readlink(fn)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "blob %d\x00%s", len(link), link)
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fmt.Fprintf(h, "blob %d\x00", st.Size())
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// gitMode returns the git tree entry mode for mode.
+func gitMode(mode fs.FileMode) string {
+	switch {
+	case mode&fs.ModeSymlink != 0:
+		return "120000"
+	case mode&0111 != 0:
+		return "100755"
+	default:
+		return "100644"
+	}
+}
+
+// unchangedOnBranch reports whether syncPaths(<clone of branch>, srcs) and
+// ensureAttributes would be a no-op, by comparing the git object IDs of the
+// local files against the tree of the branch head via the Git Data API. This saves the clone on
+// re-runs, where the pull request typically already contains the build
+// results.
+func unchangedOnBranch(ctx context.Context, client *github.Client, owner, repo, branch string, srcs []string) (bool, error) {
+	ref, _, err := client.Git.GetRef(ctx, owner, repo, "heads/"+branch)
+	if err != nil {
+		return false, err
+	}
+	tree, _, err := client.Git.GetTree(ctx, owner, repo, ref.GetObject().GetSHA(), true)
+	if err != nil {
+		return false, err
+	}
+	if tree.GetTruncated() {
+		log.Printf("tree of %s truncated, cannot compare without cloning", branch)
+		return false, nil
+	}
+	remote := make(map[string]*github.TreeEntry, len(tree.Entries))
+	for _, entry := range tree.Entries {
+		if entry.GetType() == "blob" {
+			remote[entry.GetPath()] = entry
+		}
+	}
+
+	if *generatedPaths != "" {
+		var attributes []byte
+		if entry, ok := remote[".gitattributes"]; ok {
+			attributes, _, err = client.Git.GetBlobRaw(ctx, owner, repo, entry.GetSHA())
+			if err != nil {
+				return false, err
+			}
+		}
+		if _, added := renderAttributes(attributes); len(added) > 0 {
+			log.Printf(".gitattributes on %s lacks %q (-generated_paths)", branch, added)
+			return false, nil
+		}
+	}
+
+	for _, src := range srcs {
+		target := filepath.Base(src)
+		if strings.HasSuffix(src, "/") || strings.HasSuffix(src, string(filepath.Separator)) {
+			target = ""
+		}
+		src = filepath.Clean(src)
+		local := make(map[string]bool)
+		err := filepath.WalkDir(src, func(fn string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(src, fn)
+			if err != nil {
+				return err
+			}
+			p := path.Join(target, filepath.ToSlash(rel))
+			local[p] = true
+			entry, ok := remote[p]
+			if !ok {
+				log.Printf("%s: not present on %s", p, branch)
+				return errDiffers
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if got, want := gitMode(normalizeMode(p, info.Mode())), entry.GetMode(); got != want {
+				log.Printf("%s: mode differs: local %s, %s %s", p, got, branch, want)
+				return errDiffers
+			}
+			sha, err := gitBlobSHA(fn, info)
+			if err != nil {
+				return err
+			}
+			if sha != entry.GetSHA() {
+				log.Printf("%s: content differs", p)
+				return errDiffers
+			}
+			return nil
+		})
+		if err == errDiffers {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if st, err := os.Lstat(src); err != nil {
+			return false, err
+		} else if !st.IsDir() {
+			continue
+		}
+		// syncPaths deletes files which are not present in a source
+		// directory.
+		prefix := target + "/"
+		for p := range remote {
+			if target != "" && !strings.HasPrefix(p, prefix) {
+				continue
+			}
+			if !local[p] {
+				log.Printf("%s: present on %s, but not locally", p, branch)
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var syncJobs = flag.Int("sync_jobs",
+	8,
+	"number of files to copy concurrently. A raspberrypi flavor modules tree contains thousands of small files")
+
+// copyAttempts is the number of times copying a file is attempted, to
+// ride out transient errors on network file systems of CI runners.
+const copyAttempts = 3
+
+// copyFile copies src to dest, which must not be a symlink (see syncEntry).
+func copyFile(dest, src string, mode fs.FileMode) error {
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Chmod(mode.Perm()); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// syncPaths is a portable equivalent of rsync --delete -a <srcs> <dest>: each
+// source is copied to dest/<basename> (or, when the source ends in a path
+// separator, its contents are copied into dest), and files within synced
+// directories which do not exist in the source are deleted. The .git
+// directory of dest is never deleted.
+func syncPaths(dest string, srcs []string) error {
+	for _, src := range srcs {
+		target := filepath.Join(dest, filepath.Base(src))
+		if strings.HasSuffix(src, "/") || strings.HasSuffix(src, string(filepath.Separator)) {
+			target = dest
+		}
+		if err := syncPath(dest, target, filepath.Clean(src)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncPath syncs src to dest, which is within the repository at root.
+func syncPath(root, dest, src string) error {
+	st, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return syncEntry(root, dest, src, st)
+	}
+
+	// Directories are created while walking (parents before children), all
+	// other entries are copied by a bounded pool of workers.
+	type entry struct {
+		dest, src string
+		info      fs.FileInfo
+	}
+	work := make(chan entry)
+	var (
+		wg      sync.WaitGroup
+		errMu   sync.Mutex
+		copyErr error
+	)
+	for i := 0; i < max(*syncJobs, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range work {
+				if err := syncEntryRetry(root, e.dest, e.src, e.info); err != nil {
+					errMu.Lock()
+					copyErr = errors.Join(copyErr, err)
+					errMu.Unlock()
+				}
+			}
+		}()
+	}
+	walkErr := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return syncEntry(root, filepath.Join(dest, rel), path, info)
+		}
+		work <- entry{dest: filepath.Join(dest, rel), src: path, info: info}
+		return nil
+	})
+	close(work)
+	wg.Wait()
+	if err := errors.Join(walkErr, copyErr); err != nil {
+		return err
+	}
+
+	// Delete files which are no longer present in src.
+	return filepath.WalkDir(dest, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dest, path)
+		if err != nil {
+			return err
+		}
+		if rel == ".git" {
+			return filepath.SkipDir
+		}
+		if _, err := os.Lstat(filepath.Join(src, rel)); os.IsNotExist(err) {
+			log.Printf("deleting %s", rel)
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+		} else if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func syncEntryRetry(root, dest, src string, st fs.FileInfo) error {
+	var err error
+	for attempt := 1; attempt <= copyAttempts; attempt++ {
+		if err = syncEntry(root, dest, src, st); err == nil {
+			return nil
+		}
+		if attempt < copyAttempts {
+			log.Printf("copying %s (attempt %d of %d): %v", src, attempt, copyAttempts, err)
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	return err
+}
+
+func syncEntry(root, dest, src string, st fs.FileInfo) error {
+	// Replace entries of a different type, in particular symlinks where src
+	// is a file: copyFile would follow them and overwrite their target,
+	// which may be outside of the repository.
+	if existing, err := os.Lstat(dest); err == nil && existing.Mode().Type() != st.Mode().Type() {
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+	}
+	switch {
+	case st.IsDir():
+		return os.MkdirAll(dest, 0755)
+
+	case st.Mode()&fs.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if existing, err := os.Readlink(dest); err == nil && existing == link {
+			return nil
+		}
+		os.Remove(dest)
+		return os.Symlink(link, dest)
+
+	default:
+		log.Printf("copying %s", src)
+		rel, err := filepath.Rel(root, dest)
+		if err != nil {
+			return err
+		}
+		if err := copyFile(dest, src, normalizeMode(filepath.ToSlash(rel), st.Mode())); err != nil {
+			return err
+		}
+		if *normalizeModes {
+			t := normalizedTime()
+			return os.Chtimes(dest, t, t)
+		}
+		return nil
+	}
+}
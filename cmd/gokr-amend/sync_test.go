@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncPathsReplacesSymlinks(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	dest := filepath.Join(tmp, "dest")
+	outside := filepath.Join(tmp, "outside")
+	for _, dir := range []string{
+		filepath.Join(src, "lib"),
+		dest,
+	} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for fn, content := range map[string]string{
+		filepath.Join(src, "vmlinuz"):       "kernel",
+		filepath.Join(src, "lib", "module"): "module",
+		outside:                             "must not be overwritten",
+	} {
+		if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Symlinks left in dest, e.g. by a previous version of the source.
+	if err := os.Symlink(outside, filepath.Join(dest, "vmlinuz")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(tmp, filepath.Join(dest, "lib")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := syncPaths(dest, []string{src + "/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "must not be overwritten"; got != want {
+		t.Errorf("symlink target overwritten: got %q, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "module")); !os.IsNotExist(err) {
+		t.Errorf("file created through directory symlink: %v", err)
+	}
+	for fn, want := range map[string]string{
+		"vmlinuz":    "kernel",
+		"lib/module": "module",
+	} {
+		path := filepath.Join(dest, filepath.FromSlash(fn))
+		st, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !st.Mode().IsRegular() {
+			t.Errorf("%s: got mode %v, want a regular file", fn, st.Mode())
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("%s: got %q, want %q", fn, b, want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// gokr-autoupdate bundles maintenance subcommands for the autoupdate tools.
+//
+// Usage:
+//
+//	gokr-autoupdate version
+//	gokr-autoupdate self-update [-dir=<dir>] [-check]
+//	gokr-autoupdate [-autoupdate_config=<file>] config check [-workflows=<dir>]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/gokrazy/autoupdate/internal/secret"
+	"github.com/gokrazy/autoupdate/internal/settings"
+	"github.com/gokrazy/autoupdate/internal/version"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"version", "print version information", func([]string) error {
+		fmt.Println("gokr-autoupdate", version.Read())
+		return nil
+	}},
+	{"self-update", "replace the installed autoupdate tools with the latest release", selfUpdate},
+	{"config", "check autoupdate.toml and the gokr-* invocations of the workflows for mistakes", configCommand},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "syntax: gokr-autoupdate <command> [flags]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.name, cmd.usage)
+	}
+	os.Exit(2)
+}
+
+var (
+	printVersion = flag.Bool("version",
+		false,
+		"print version information and exit")
+
+	autoupdateConfig = flag.String("autoupdate_config",
+		"autoupdate.toml",
+		"path to the autoupdate.toml configuration file shared by all tools (or a .json file of the same structure). A missing file is treated as empty")
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	secret.Install()
+	settings.SetPath(*autoupdateConfig)
+	version.MaybePrint(*printVersion)
+
+	if flag.NArg() < 1 {
+		usage()
+	}
+	for _, cmd := range commands {
+		if cmd.name != flag.Arg(0) {
+			continue
+		}
+		if err := cmd.run(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+	usage()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/autoupdate/internal/freeze"
+	"github.com/gokrazy/autoupdate/internal/notify"
+	"github.com/gokrazy/autoupdate/internal/secret"
+	"github.com/gokrazy/autoupdate/internal/settings"
+	"github.com/google/go-github/v35/github"
+)
+
+// invocation is a gokr-* command line found in a workflow file.
+type invocation struct {
+	pos   string // file:line
+	tool  string
+	flags map[string]string
+	args  []string
+}
+
+var (
+	toolRe      = regexp.MustCompile(`\b(gokr-[a-z-]+)\b(.*)`)
+	separatorRe = regexp.MustCompile(`&&|\|\||[;|]`)
+)
+
+// findInvocations returns the gokr-* command lines of the workflow files in
+// dir, joining lines continued with a trailing backslash.
+func findInvocations(dir string) ([]invocation, error) {
+	var fns []string
+	for _, pattern := range []string{"*.yml", "*.yaml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		fns = append(fns, matches...)
+	}
+	sort.Strings(fns)
+	var invocations []invocation
+	for _, fn := range fns {
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		var lineno, start int
+		var cmdline string
+		for scanner.Scan() {
+			lineno++
+			line := scanner.Text()
+			if cmdline == "" {
+				start = lineno
+			}
+			if strings.HasSuffix(line, `\`) {
+				cmdline += strings.TrimSuffix(line, `\`) + " "
+				continue
+			}
+			cmdline += line
+			for _, command := range separatorRe.Split(cmdline, -1) {
+				m := toolRe.FindStringSubmatch(command)
+				if m == nil {
+					continue
+				}
+				inv := invocation{
+					pos:   fmt.Sprintf("%s:%d", fn, start),
+					tool:  m[1],
+					flags: make(map[string]string),
+				}
+				for _, field := range strings.Fields(m[2]) {
+					if !strings.HasPrefix(field, "-") {
+						inv.args = append(inv.args, strings.Trim(field, `"'`))
+						continue
+					}
+					name, value, _ := strings.Cut(strings.TrimLeft(field, "-"), "=")
+					inv.flags[name] = strings.Trim(value, `"'`)
+				}
+				invocations = append(invocations, inv)
+			}
+			cmdline = ""
+		}
+		if err := scanner.Err(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.Close()
+	}
+	return invocations, nil
+}
+
+func oneOf(value string, valid ...string) bool {
+	for _, v := range valid {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// checkInvocation returns the problems of inv which can be found without
+// network access, and the labels it references.
+func checkInvocation(inv invocation) (problems, labels []string) {
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s: %s: %s", inv.pos, inv.tool, fmt.Sprintf(format, args...)))
+	}
+	if v, ok := inv.flags["flavor"]; ok && !oneOf(v, "vanilla", "raspberrypi") {
+		fail("invalid -flavor value %q: expected one of vanilla or raspberrypi", v)
+	}
+	if v, ok := inv.flags["forge"]; ok && !oneOf(v, "github", "gitea", "gitlab") {
+		fail("invalid -forge value %q: expected one of github, gitea or gitlab", v)
+	}
+	for _, name := range []string{"require_label", "set_label", "merged_label"} {
+		if v := inv.flags[name]; v != "" {
+			labels = append(labels, v)
+		}
+	}
+	if v := inv.flags["remove_labels"]; v != "" {
+		labels = append(labels, strings.Split(v, ",")...)
+	}
+
+	switch inv.tool {
+	case "gokr-rebuild-kernel":
+		if v, ok := inv.flags["cross"]; ok && !oneOf(v, "", "arm64") {
+			fail("invalid -cross value %q: expected one of 'arm64'", v)
+		}
+	case "gokr-boot":
+		if inv.flags["bootery_url"] == "" && inv.flags["direct_host"] == "" {
+			fail("-bootery_url (or -direct_host) is a required flag")
+		}
+	case "gokr-pull-eeprom":
+		if inv.flags["bootconf_path"] != "" && inv.flags["upstream_bootconf"] == "" {
+			fail("-bootconf_path requires -upstream_bootconf")
+		}
+	case "gokr-has-label":
+		if _, list := inv.flags["list"]; list {
+			break
+		}
+		if len(inv.args) == 0 {
+			fail("syntax: gokr-has-label <label> (or gokr-has-label -list)")
+		} else {
+			labels = append(labels, inv.args[0])
+		}
+	case "gokr-merge":
+		if inv.flags["require_label"] != "" && inv.flags["label_expression"] != "" {
+			fail("-require_label and -label_expression are mutually exclusive")
+		}
+		if inv.flags["require_label"] == "" && inv.flags["label_expression"] == "" && inv.flags["require_checklist"] == "" {
+			fail("one of -require_label, -label_expression or -require_checklist must be specified")
+		}
+	}
+	return problems, labels
+}
+
+// configCheck validates autoupdate.toml and the gokr-* invocations of the
+// repository's workflows, so that typos are caught before the automation
+// runs on a schedule.
+func configCheck(args []string) error {
+	fset := flag.NewFlagSet("config check", flag.ExitOnError)
+	workflows := fset.String("workflows",
+		".github/workflows",
+		"directory containing the GitHub Actions workflow files whose gokr-* invocations to check")
+	checkLabels := fset.Bool("check_labels",
+		true,
+		"verify that labels referenced by the workflows exist, via the GitHub API (using GH_USER, GH_AUTH_TOKEN and GITHUB_REPOSITORY if set)")
+	fset.Parse(args)
+
+	problems, err := settings.Check()
+	if err != nil {
+		return err
+	}
+	if err := notify.Check(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := freeze.Check(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	invocations, err := findInvocations(*workflows)
+	if err != nil {
+		return err
+	}
+	labelPos := make(map[string]string)
+	for _, inv := range invocations {
+		p, labels := checkInvocation(inv)
+		problems = append(problems, p...)
+		for _, l := range labels {
+			if _, ok := labelPos[l]; !ok {
+				labelPos[l] = inv.pos
+			}
+		}
+	}
+	log.Printf("checked %d gokr-* invocation(s) in %s", len(invocations), *workflows)
+
+	slug := os.Getenv("GITHUB_REPOSITORY")
+	owner, repo, ok := strings.Cut(slug, "/")
+	switch {
+	case !*checkLabels || len(labelPos) == 0:
+	case !ok:
+		log.Printf("GITHUB_REPOSITORY not set, not checking %d label(s)", len(labelPos))
+	default:
+		var client *github.Client
+		if token := secret.Get("GH_AUTH_TOKEN"); token != "" {
+			client = github.NewClient(&http.Client{
+				Transport: &github.BasicAuthTransport{
+					Username: os.Getenv("GH_USER"),
+					Password: token,
+				},
+			})
+		} else {
+			client = github.NewClient(nil)
+		}
+		names := make([]string, 0, len(labelPos))
+		for l := range labelPos {
+			names = append(names, l)
+		}
+		sort.Strings(names)
+		ctx := context.Background()
+		for _, l := range names {
+			_, resp, err := client.Issues.GetLabel(ctx, owner, repo, l)
+			if err != nil {
+				if resp != nil && resp.StatusCode == http.StatusNotFound {
+					problems = append(problems, fmt.Sprintf("%s: label %q does not exist in %s", labelPos[l], l, slug))
+					continue
+				}
+				return err
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problem(s) found:\n\t%s", len(problems), strings.Join(problems, "\n\t"))
+	}
+	log.Printf("configuration OK")
+	return nil
+}
+
+func configCommand(args []string) error {
+	if len(args) < 1 || args[0] != "check" {
+		return fmt.Errorf("syntax: gokr-autoupdate config check [flags]")
+	}
+	return configCheck(args[1:])
+}
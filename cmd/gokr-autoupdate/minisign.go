@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// verifyMinisign verifies sig, the content of a minisign(1) .minisig file,
+// for msg with pubKey, the base64-encoded public key (the second line of a
+// minisign.pub file).
+func verifyMinisign(pubKey string, msg, sig []byte) error {
+	pk, err := base64.StdEncoding.DecodeString(strings.TrimSpace(pubKey))
+	if err != nil {
+		return fmt.Errorf("public key: %v", err)
+	}
+	if len(pk) != 2+8+ed25519.PublicKeySize || string(pk[:2]) != "Ed" {
+		return errors.New("public key: not a minisign Ed25519 public key")
+	}
+	keyID, key := pk[2:10], ed25519.PublicKey(pk[10:])
+
+	lines := strings.Split(strings.ReplaceAll(string(sig), "\r\n", "\n"), "\n")
+	if len(lines) < 4 {
+		return fmt.Errorf("signature: got %d lines, want 4", len(lines))
+	}
+	s, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil {
+		return fmt.Errorf("signature: %v", err)
+	}
+	if len(s) != 2+8+ed25519.SignatureSize {
+		return errors.New("signature: not a minisign Ed25519 signature")
+	}
+	alg, sigKeyID, signature := string(s[:2]), s[2:10], s[10:]
+	if !bytes.Equal(sigKeyID, keyID) {
+		return fmt.Errorf("signature: made with key %X, want key %X", sigKeyID, keyID)
+	}
+	switch alg {
+	case "Ed":
+	case "ED": // pre-hashed, the default since minisign 0.10
+		h := blake2b.Sum512(msg)
+		msg = h[:]
+	default:
+		return fmt.Errorf("signature: unsupported algorithm %q", alg)
+	}
+	if !ed25519.Verify(key, msg, signature) {
+		return errors.New("signature verification failed")
+	}
+
+	const prefix = "trusted comment: "
+	if !strings.HasPrefix(lines[2], prefix) {
+		return errors.New("signature: missing trusted comment")
+	}
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil {
+		return fmt.Errorf("signature: %v", err)
+	}
+	if !ed25519.Verify(key, append(signature, strings.TrimPrefix(lines[2], prefix)...), global) {
+		return errors.New("signature verification of the trusted comment failed")
+	}
+	return nil
+}
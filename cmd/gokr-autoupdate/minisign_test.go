@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisign returns a minisign(1) public key and a .minisig file for msg,
+// signed with algorithm alg (Ed or ED).
+func minisign(t *testing.T, alg string, msg []byte) (pubKey string, sig []byte) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := []byte("01234567")
+	signed := msg
+	if alg == "ED" {
+		h := blake2b.Sum512(msg)
+		signed = h[:]
+	}
+	signature := ed25519.Sign(priv, signed)
+	const trustedComment = "timestamp:1700000000\tfile:SHA256SUMS"
+	global := ed25519.Sign(priv, append(append([]byte{}, signature...), trustedComment...))
+	pubKey = base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID...), pub...))
+	sig = []byte(strings.Join([]string{
+		"untrusted comment: signature from minisign secret key",
+		base64.StdEncoding.EncodeToString(append(append([]byte(alg), keyID...), signature...)),
+		"trusted comment: " + trustedComment,
+		base64.StdEncoding.EncodeToString(global),
+		"",
+	}, "\n"))
+	return pubKey, sig
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	msg := []byte("0123  gokr-boot_linux_amd64\n")
+	for _, alg := range []string{"Ed", "ED"} {
+		t.Run(alg, func(t *testing.T) {
+			pubKey, sig := minisign(t, alg, msg)
+			if err := verifyMinisign(pubKey, msg, sig); err != nil {
+				t.Fatalf("verifyMinisign: %v", err)
+			}
+			if err := verifyMinisign(pubKey, []byte("modified"), sig); err == nil {
+				t.Errorf("verifyMinisign(modified message) unexpectedly succeeded")
+			}
+			otherKey, _ := minisign(t, alg, msg)
+			if err := verifyMinisign(otherKey, msg, sig); err == nil {
+				t.Errorf("verifyMinisign(other key) unexpectedly succeeded")
+			}
+			tampered := strings.Replace(string(sig), "file:SHA256SUMS", "file:OTHER", 1)
+			if err := verifyMinisign(pubKey, msg, []byte(tampered)); err == nil {
+				t.Errorf("verifyMinisign(modified trusted comment) unexpectedly succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/gokrazy/autoupdate/internal/version"
+	"github.com/google/go-github/v35/github"
+	"golang.org/x/mod/semver"
+)
+
+// tools lists the binaries which self-update replaces, if installed.
+var tools = []string{
+	"gokr-amend",
+	"gokr-autoupdate",
+	"gokr-boot",
+	"gokr-fake-bootery",
+	"gokr-has-label",
+	"gokr-merge",
+	"gokr-pull-debian-base",
+	"gokr-pull-eeprom",
+	"gokr-pull-firmware",
+	"gokr-pull-go",
+	"gokr-pull-kernel",
+	"gokr-rebuild-kernel",
+	"gokr-tag-release",
+}
+
+// assetName returns the name of the release asset containing tool for the
+// running platform, e.g. gokr-boot_linux_arm64.
+func assetName(tool string) string {
+	name := tool + "_" + runtime.GOOS + "_" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+func download(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return nil, fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", u, got, want)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// parseChecksums parses the sha256sum(1) output format.
+func parseChecksums(b []byte) map[string]string {
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(string(b)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		sums[strings.TrimPrefix(fields[1], "*")] = fields[0]
+	}
+	return sums
+}
+
+// replaceFile atomically replaces path with content, keeping its permissions.
+// On Windows, which cannot replace a running executable but can rename it,
+// the previous file is moved aside to path.old instead.
+func replaceFile(path string, content []byte) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(st.Mode()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		old := path + ".old"
+		// Left over from the previous update, if any.
+		os.Remove(old)
+		if err := os.Rename(path, old); err != nil {
+			return err
+		}
+		if err := os.Rename(f.Name(), path); err != nil {
+			os.Rename(old, path)
+			return err
+		}
+		return nil
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func selfUpdate(args []string) error {
+	fset := flag.NewFlagSet("self-update", flag.ExitOnError)
+	dir := fset.String("dir",
+		"",
+		"directory containing the installed tools. Defaults to the directory of gokr-autoupdate")
+	repo := fset.String("repo",
+		"gokrazy/autoupdate",
+		"GitHub repository (owner/repo) whose latest release to install")
+	check := fset.Bool("check",
+		false,
+		"only report whether an update is available")
+	publicKey := fset.String("public_key",
+		"",
+		"minisign public key (base64, the second line of minisign.pub) with which the SHA256SUMS.minisig release asset must be signed. If empty, the binaries are only verified against the SHA256SUMS asset of the same release, which detects corrupted downloads, but not release assets modified by whoever can modify the release")
+	fset.Parse(args)
+
+	if *dir == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		*dir = filepath.Dir(exe)
+	}
+	parts := strings.Split(*repo, "/")
+	if got, want := len(parts), 2; got != want {
+		return fmt.Errorf("unexpected number of /-separated parts in %q: got %d, want %d", *repo, got, want)
+	}
+
+	ctx := context.Background()
+	client := github.NewClient(nil)
+	release, _, err := client.Repositories.GetLatestRelease(ctx, parts[0], parts[1])
+	if err != nil {
+		return err
+	}
+	current := version.Module()
+	latest := release.GetTagName()
+	log.Printf("installed version: %s, latest release: %s", current, latest)
+	if !semver.IsValid(current) {
+		// e.g. (devel) when built from a source checkout, which might well
+		// be newer than the latest release.
+		log.Printf("installed version %s is not a release, not updating", current)
+		return nil
+	}
+	if semver.Compare(current, latest) >= 0 {
+		log.Printf("already up to date")
+		return nil
+	}
+	if *check {
+		fmt.Printf("update available: %s -> %s\n", current, latest)
+		return nil
+	}
+
+	assets := make(map[string]*github.ReleaseAsset)
+	for _, a := range release.Assets {
+		assets[a.GetName()] = a
+	}
+	sumsAsset, ok := assets["SHA256SUMS"]
+	if !ok {
+		return fmt.Errorf("release %s has no SHA256SUMS asset, refusing to install unverified binaries", latest)
+	}
+	b, err := download(ctx, sumsAsset.GetBrowserDownloadURL())
+	if err != nil {
+		return err
+	}
+	if *publicKey != "" {
+		sigAsset, ok := assets["SHA256SUMS.minisig"]
+		if !ok {
+			return fmt.Errorf("release %s has no SHA256SUMS.minisig asset, refusing to install unsigned binaries", latest)
+		}
+		sig, err := download(ctx, sigAsset.GetBrowserDownloadURL())
+		if err != nil {
+			return err
+		}
+		if err := verifyMinisign(*publicKey, b, sig); err != nil {
+			return fmt.Errorf("SHA256SUMS of release %s: %v", latest, err)
+		}
+	} else {
+		log.Printf("-public_key not set: only verifying the binaries against SHA256SUMS, which does not prove that they are authentic")
+	}
+	sums := parseChecksums(b)
+
+	for _, tool := range tools {
+		installed := filepath.Join(*dir, tool)
+		if runtime.GOOS == "windows" {
+			installed += ".exe"
+		}
+		if _, err := os.Stat(installed); os.IsNotExist(err) {
+			continue // not installed
+		}
+		name := assetName(tool)
+		asset, ok := assets[name]
+		if !ok {
+			log.Printf("release %s has no asset %s, skipping", latest, name)
+			continue
+		}
+		want, ok := sums[name]
+		if !ok {
+			return fmt.Errorf("SHA256SUMS of release %s lacks an entry for %s", latest, name)
+		}
+		b, err := download(ctx, asset.GetBrowserDownloadURL())
+		if err != nil {
+			return err
+		}
+		h := sha256.Sum256(b)
+		if got := hex.EncodeToString(h[:]); got != want {
+			return fmt.Errorf("checksum mismatch for %s: got %s, want %s", name, got, want)
+		}
+		if err := replaceFile(installed, b); err != nil {
+			return err
+		}
+		log.Printf("updated %s to %s", installed, latest)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	analyzeBootLog = flag.Bool("analyze_boot_log",
+		true,
+		"fail the boot test if the boot log (even of a boot which the bootery reports as successful) shows a kernel panic, an oops or BUG, or a service which the gokrazy supervisor restarts in a loop. The offending excerpt is quoted in the pull request comment")
+
+	bootLogIgnore = flag.String("boot_log_ignore",
+		"",
+		"if non-empty, regular expression of boot log lines which -analyze_boot_log ignores, e.g. known-benign messages of a board")
+)
+
+var (
+	kernelPanicRe = regexp.MustCompile(`Kernel panic - not syncing`)
+	oopsRe        = regexp.MustCompile(`Oops: .*\[#[0-9]+\]`)
+	kernelBugRe   = regexp.MustCompile(`(^|\] )BUG: `)
+	restartRe     = regexp.MustCompile(`gokrazy: attempt ([0-9]+), starting (.+)`)
+)
+
+// restartLoopAttempts is the supervisor attempt from which on a service is
+// considered to be restarting in a loop.
+const restartLoopAttempts = 3
+
+// Lines of context around the offending line in bootLogError excerpts.
+const (
+	excerptBefore = 5
+	excerptAfter  = 25
+)
+
+// bootLogError is returned for boot logs which show a problem.
+type bootLogError struct {
+	host    string
+	problem string
+	excerpt string
+}
+
+func (e *bootLogError) Error() string {
+	return fmt.Sprintf("%s: boot log shows %s", e.host, e.problem)
+}
+
+func excerpt(lines []string, idx, before, after int) string {
+	from := max(idx-before, 0)
+	to := min(idx+after+1, len(lines))
+	return strings.Join(lines[from:to], "\n")
+}
+
+// analyze returns a *bootLogError for the first problem which bootlog of
+// host shows, or nil.
+func analyze(host, bootlog string) error {
+	var ignore *regexp.Regexp
+	if *bootLogIgnore != "" {
+		ignore = regexp.MustCompile(*bootLogIgnore) // validated in main
+	}
+	lines := strings.Split(bootlog, "\n")
+	for idx, line := range lines {
+		if ignore != nil && ignore.MatchString(line) {
+			continue
+		}
+		var problem string
+		before, after := excerptBefore, excerptAfter
+		switch {
+		case kernelPanicRe.MatchString(line):
+			problem = "a kernel panic"
+		case oopsRe.MatchString(line):
+			problem = "a kernel oops"
+		case kernelBugRe.MatchString(line):
+			problem = "a kernel BUG"
+		default:
+			matches := restartRe.FindStringSubmatch(line)
+			if matches == nil {
+				continue
+			}
+			if attempt, _ := strconv.Atoi(matches[1]); attempt < restartLoopAttempts {
+				continue
+			}
+			problem = fmt.Sprintf("a restart loop of %s", matches[2])
+			// The output of the earlier attempts explains the restarts.
+			before, after = excerptAfter, 0
+		}
+		return &bootLogError{
+			host:    host,
+			problem: problem,
+			excerpt: excerpt(lines, idx, before, after),
+		}
+	}
+	return nil
+}
+
+// testAndAnalyze is testBoot1, followed by -analyze_boot_log.
+func testAndAnalyze(ctx context.Context, hostname, newer string) (string, error) {
+	bootlog, err := testBoot1(ctx, hostname, newer)
+	if err != nil || !*analyzeBootLog || *eepromImage != "" {
+		return bootlog, err
+	}
+	if err := analyze(hostname, bootlog); err != nil {
+		log.Printf("%s", failureDetails(err))
+		return "", err
+	}
+	return bootlog, nil
+}
+
+// failureDetails returns Markdown describing err for pull request comments:
+// the boot log excerpt of a *bootLogError, or the error message.
+func failureDetails(err error) string {
+	var e *bootLogError
+	if errors.As(err, &e) {
+		return fmt.Sprintf("%s, excerpt:\n\n```\n%s\n```\n", e.Error(), strings.TrimSpace(e.excerpt))
+	}
+	return "```\n" + strings.TrimSpace(err.Error()) + "\n```\n"
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/artifactstore"
+)
+
+var artifactStore = flag.String("artifact_store",
+	"",
+	"if non-empty, artifact store (a directory, s3+https://<path-style bucket URL> or oci://<registry>/<repository>) to which the boot/root images (or, with -full_disk, the disk image) of each host are uploaded as <host>/<time>/<file name> before streaming them to the bootery, so that failed boots can be reproduced with the exact same images. Like -artifact_dir, but without a separate upload step")
+
+// imageStore is the -artifact_store, if any.
+var imageStore artifactstore.Store
+
+// keepImages saves the images which are about to be tested on hostname
+// (keyed by file name, e.g. boot.img) to -artifact_dir and -artifact_store.
+func keepImages(ctx context.Context, hostname string, images map[string]string) error {
+	names := make([]string, 0, len(images))
+	for name := range images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if *artifactDir != "" {
+		dir := filepath.Join(*artifactDir, hostname)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := copyFile(filepath.Join(dir, name), images[name]); err != nil {
+				return err
+			}
+		}
+		log.Printf("saved images to %s", dir)
+	}
+
+	if imageStore != nil {
+		prefix := hostname + "/" + time.Now().UTC().Format("20060102T150405Z") + "/"
+		for _, name := range names {
+			b, err := os.ReadFile(images[name])
+			if err != nil {
+				return err
+			}
+			u, err := imageStore.Put(ctx, prefix+name, b, "application/octet-stream")
+			if err != nil {
+				return err
+			}
+			log.Printf("stored %s of %s: %s", name, hostname, u)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/audit"
+	"github.com/gokrazy/autoupdate/internal/secret"
+)
+
+// artifactSink uploads boot logs as GitHub Actions workflow run artifacts
+// (one per host), using the same results service API as
+// actions/upload-artifact@v4. Unlike gists, this needs no additional token
+// scopes, but the runtime token is only exposed to actions, not to run:
+// steps. Wrap gokr-boot in an action, or export ACTIONS_RUNTIME_TOKEN and
+// ACTIONS_RESULTS_URL from e.g. actions/github-script.
+type artifactSink struct {
+	resultsURL string
+	token      string
+
+	// runID and jobID are the workflow run and job backend IDs, which are
+	// only available from the runtime token.
+	runID, jobID string
+}
+
+func newArtifactSink() (*artifactSink, error) {
+	s := &artifactSink{
+		resultsURL: strings.TrimSuffix(os.Getenv("ACTIONS_RESULTS_URL"), "/"),
+		token:      os.Getenv("ACTIONS_RUNTIME_TOKEN"),
+	}
+	if s.resultsURL == "" || s.token == "" {
+		return nil, fmt.Errorf("log sink artifact: ACTIONS_RESULTS_URL or ACTIONS_RUNTIME_TOKEN empty (not running within a GitHub Actions action?)")
+	}
+	secret.Register(s.token)
+	var err error
+	s.runID, s.jobID, err = backendIDs(s.token)
+	if err != nil {
+		return nil, fmt.Errorf("log sink artifact: %v", err)
+	}
+	return s, nil
+}
+
+// backendIDs extracts the workflow run and job backend IDs from the
+// Actions.Results scope of the runtime token. The signature is not verified:
+// the token is verified by the results service.
+func backendIDs(token string) (runID, jobID string, _ error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf("malformed JWT: got %d parts, want 3", len(parts))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", err
+	}
+	var claims struct {
+		Scp string `json:"scp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", "", err
+	}
+	for _, scope := range strings.Fields(claims.Scp) {
+		// Actions.Results:<run backend id>:<job backend id>
+		parts := strings.Split(scope, ":")
+		if len(parts) == 3 && parts[0] == "Actions.Results" {
+			return parts[1], parts[2], nil
+		}
+	}
+	return "", "", fmt.Errorf("runtime token has no Actions.Results scope")
+}
+
+// twirp calls method of the artifact service.
+func (s *artifactSink) twirp(ctx context.Context, method string, request, reply interface{}) error {
+	b, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	u := s.resultsURL + "/twirp/github.actions.results.api.v1.ArtifactService/" + method
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return fmt.Errorf("%s: unexpected HTTP status code: got %d (%s), want %d", method, got, strings.TrimSpace(string(body)), want)
+	}
+	return json.Unmarshal(body, reply)
+}
+
+// zipLog returns a zip archive containing bootlog as name, which is the
+// format in which artifacts are uploaded (and downloaded).
+func zipLog(name, bootlog string) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write([]byte(bootlog)); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *artifactSink) Store(ctx context.Context, host, bootlog string) (storedLog, error) {
+	// Artifact names must not contain colons (from the RFC 3339 timestamp).
+	name := strings.ReplaceAll(logName(host), ":", "")
+	content, err := zipLog(name+".txt", bootlog)
+	if err != nil {
+		return storedLog{}, err
+	}
+
+	var created struct {
+		Ok              bool   `json:"ok"`
+		SignedUploadURL string `json:"signed_upload_url"`
+	}
+	if err := s.twirp(ctx, "CreateArtifact", map[string]interface{}{
+		"workflow_run_backend_id":     s.runID,
+		"workflow_job_run_backend_id": s.jobID,
+		"name":                        name,
+		"version":                     4,
+	}, &created); err != nil {
+		return storedLog{}, err
+	}
+	if !created.Ok {
+		return storedLog{}, fmt.Errorf("CreateArtifact(%s) failed", name)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, created.SignedUploadURL, bytes.NewReader(content))
+	if err != nil {
+		return storedLog{}, err
+	}
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("Content-Type", "application/zip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return storedLog{}, err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return storedLog{}, fmt.Errorf("uploading artifact %s: unexpected HTTP status code: got %d (%s), want %d", name, resp.StatusCode, strings.TrimSpace(string(body)), http.StatusCreated)
+	}
+
+	h := sha256.Sum256(content)
+	var finalized struct {
+		Ok         bool   `json:"ok"`
+		ArtifactID string `json:"artifact_id"`
+	}
+	if err := s.twirp(ctx, "FinalizeArtifact", map[string]interface{}{
+		"workflow_run_backend_id":     s.runID,
+		"workflow_job_run_backend_id": s.jobID,
+		"name":                        name,
+		"size":                        strconv.Itoa(len(content)),
+		"hash":                        "sha256:" + hex.EncodeToString(h[:]),
+	}, &finalized); err != nil {
+		return storedLog{}, err
+	}
+	if !finalized.Ok {
+		return storedLog{}, fmt.Errorf("FinalizeArtifact(%s) failed", name)
+	}
+	artifactURL := runURL() + "/artifacts/" + finalized.ArtifactID
+	audit.Record(slug, "upload-artifact", artifactURL)
+	return storedLog{url: artifactURL}, nil
+}
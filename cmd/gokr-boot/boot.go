@@ -6,26 +6,33 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/gokrazy/autoupdate/internal/artifactstore"
+	"github.com/gokrazy/autoupdate/internal/audit"
 	"github.com/gokrazy/autoupdate/internal/cienv"
+	"github.com/gokrazy/autoupdate/internal/forge"
+	"github.com/gokrazy/autoupdate/internal/metrics"
+	"github.com/gokrazy/autoupdate/internal/notify"
+	"github.com/gokrazy/autoupdate/internal/secret"
+	"github.com/gokrazy/autoupdate/internal/settings"
+	"github.com/gokrazy/autoupdate/internal/version"
 	"github.com/gokrazy/internal/config"
-	"github.com/google/go-github/v35/github"
-	"github.com/google/renameio/v2"
 )
 
 var (
 	setLabel = flag.String("set_label",
 		"",
-		"if non-empty, name of a GitHub label to set on the pull request")
+		"if non-empty, name of a label to set on the pull request")
 
 	requireLabel = flag.String("require_label",
 		"",
@@ -38,102 +45,171 @@ var (
 	updateRootFlag = flag.Bool("update_root",
 		false,
 		"update bakery root file system, too? required for gokrazy/kernel with loadable kernel modules")
-)
 
-func createGist(ctx context.Context, client *github.Client, log string) (string, error) {
-	filename := "boot-log-" + time.Now().Format(time.RFC3339)
-	gist, _, err := client.Gists.Create(ctx,
-		&github.Gist{
-			Description: github.String("gokrazy boot log"),
-			Public:      github.Bool(false),
-			Files: map[github.GistFilename]github.GistFile{
-				github.GistFilename(filename): {Content: github.String(log)},
-			},
-		})
-	if err != nil {
-		return "", err
-	}
-	return *gist.HTMLURL, nil
-}
+	checkRun = flag.Bool("check_run",
+		false,
+		"report a check (GitHub: check run, Gitea/GitLab: commit status) on the pull request head with one annotation (pass/fail, duration) per bakery host. gokr-merge -verify_tested_head requires this check. On GitHub, the Checks API requires a GitHub App installation token or GITHUB_TOKEN (with checks: write); personal access tokens get HTTP 403")
 
-func writeImages(hostname string) (boot string, root string, _ error) {
-	log.Printf("writeImages(%s)", hostname)
-	bootf, err := ioutil.TempFile("", "gokr-boot")
-	if err != nil {
-		return "", "", err
-	}
-	bootf.Close()
-	rootf, err := ioutil.TempFile("", "gokr-root")
-	if err != nil {
-		return "", "", err
-	}
-	rootf.Close()
-	// Inject the hostname into the instance config.
-	cfg, err := config.ApplyInstanceFlag()
-	if err != nil {
-		return "", "", err
+	artifactDir = flag.String("artifact_dir",
+		"",
+		"if non-empty, copy the boot/root images of each host to <artifact_dir>/<host>/ before streaming them to the bootery, e.g. for uploading with actions/upload-artifact. See also -artifact_store")
+
+	sbomFlag = flag.Bool("sbom",
+		false,
+		"include a collapsible SBOM (kernel, firmware and Go packages, via gok sbom) of the tested image in the PR comment")
+
+	directHost = flag.String("direct_host",
+		"",
+		"if non-empty, address of a gokrazy device to push the boot/root images to directly via the gokrazy update protocol, instead of using a bootery")
+
+	matrixPath = flag.String("hardware_matrix",
+		"",
+		"if non-empty, path to a JSON file mapping PR labels and changed paths to hardware classes. Only hosts of the required classes are requested from the bootery. Metadata in the PR body is matched as kind:<kind> and flavor:<flavor> labels, but only for PRs opened by the automation user (GITHUB_USER)")
+
+	testFallback = flag.Bool("test_fallback",
+		false,
+		"after a successful boot of the new image, also boot the previous system partition to verify that A/B fallback still works")
+
+	telemetryMode = flag.String("telemetry",
+		"",
+		"if non-empty, fetch throttling/under-voltage telemetry from the bootery after booting and either \"warn\" (note it in the boot log) or \"fail\" the test when any condition is flagged")
+
+	logSinkFlag = flag.String("log_sink",
+		"gist",
+		"comma-separated list of sinks for boot logs: gist (private GitHub gist), comment (inline in the PR comment), file (in -log_dir), summary (GitHub Actions job summary), artifact (GitHub Actions workflow run artifact; requires ACTIONS_RUNTIME_TOKEN, i.e. running within an action), s3 (in -log_s3_url) or store (in -log_store)")
+
+	logDir = flag.String("log_dir",
+		"boot-logs",
+		"directory for the file log sink")
+
+	logS3URL = flag.String("log_s3_url",
+		"",
+		"path-style S3 bucket URL (with optional key prefix) for the s3 log sink, e.g. https://s3.eu-central-1.amazonaws.com/bucket/prefix. Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+
+	bootTimeout = flag.Duration("boot_timeout",
+		20*time.Minute,
+		"timeout for each request to the bootery (powering on bakeries, streaming an image and waiting for the boot, fetching logs, …), so that a hung bakery does not block CI forever. 0 disables the timeout")
+
+	logStore = flag.String("log_store",
+		"",
+		"artifact store for the store log sink: a directory, s3+https://<path-style bucket URL> or oci://<registry>/<repository> (credentials from REGISTRY_USER and REGISTRY_PASSWORD)")
+
+	auditLog = flag.String("audit_log",
+		"",
+		"if non-empty, path to a JSON Lines file to which every mutation (PRs opened, commits amended, labels changed, merges) is appended")
+
+	auditBranch = flag.String("audit_branch",
+		"",
+		"if non-empty, name of a branch in the target repository to which the audit log entries of each run are committed as a new file audit/<time>-<tool>-<pid>.jsonl")
+
+	auditS3 = flag.String("audit_s3",
+		"",
+		"if non-empty, path-style URL of an S3-compatible bucket, optionally followed by a key prefix (e.g. https://s3.eu-central-1.amazonaws.com/my-bucket/audit), to which the audit log entries of each run are uploaded as a new object <owner>/<repo>/<time>-<tool>-<pid>.jsonl. Objects are never overwritten, so the bucket can enforce retention with S3 Object Lock. Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+
+	printVersion = flag.Bool("version",
+		false,
+		"print version information and exit")
+
+	metricsListen = flag.String("metrics_listen",
+		"",
+		"if non-empty, host:port on which to serve Prometheus metrics at /metrics while the tool runs (e.g. :9090)")
+
+	metricsTextfile = flag.String("metrics_textfile",
+		"",
+		"if non-empty, path of a file (ending in .prom) to which the metrics are written whenever they change, for the textfile collector of the Prometheus node_exporter on the CI runner, e.g. /var/lib/node_exporter/textfile/gokr-boot.prom")
+
+	metricsPushgateway = flag.String("metrics_pushgateway",
+		"",
+		"if non-empty, URL of a Prometheus Pushgateway (e.g. http://pushgateway:9091) to which the metrics are pushed whenever they change, grouped by job=gokr-boot")
+
+	forgeKind = flag.String("forge",
+		"github",
+		"code forge hosting the repository. one of github, gitea or gitlab")
+
+	forgeURL = flag.String("forge_url",
+		"",
+		"base URL of the -forge=gitea or -forge=gitlab instance, e.g. https://gitlab.example.com")
+
+	tokenFile = flag.String("token_file",
+		"",
+		"if non-empty, path of a file containing the forge API token, instead of the GITHUB_AUTH_TOKEN or GH_AUTH_TOKEN environment variables. The variables can also name a file via GH_AUTH_TOKEN_FILE (e.g. a Docker secret) or be provided as systemd credentials")
+
+	autoupdateConfig = flag.String("autoupdate_config",
+		"autoupdate.toml",
+		"path to the autoupdate.toml configuration file shared by all tools (or a .json file of the same structure). A missing file is treated as empty")
+)
+
+// booteryContext returns a context for one request to the bootery, which is
+// cancelled with ctx or after -boot_timeout.
+func booteryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if *bootTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
-	cfg.Hostname = hostname
-	b, err := cfg.FormatForFile()
-	if err != nil {
-		return "", "", err
-	}
-	if err := renameio.WriteFile(config.InstanceConfigPath(), b, 0644); err != nil {
-		return "", "", err
-	}
-	cmd := exec.Command("gok",
-		"overwrite",
-		"--boot="+bootf.Name(),
-		"--root="+rootf.Name())
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return bootf.Name(), rootf.Name(), cmd.Run()
+	return context.WithTimeout(ctx, *bootTimeout)
 }
 
-func useBakeries(booteryURL, slug string) ([]string, error) {
+// useBakeries powers on the bakeries of slug and returns their hosts and,
+// if the bootery reports them, the device models of the hosts.
+func useBakeries(ctx context.Context, booteryURL, slug string, hardware []string) (hosts []string, models map[string]string, _ error) {
+	ctx, cancel := booteryContext(ctx)
+	defer cancel()
 	u, err := url.Parse(booteryURL)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	v := u.Query()
 	v.Set("slug", slug)
+	if len(hardware) > 0 {
+		v.Set("hardware", strings.Join(hardware, ","))
+	}
 	u.RawQuery = v.Encode()
-	req, err := http.NewRequest(http.MethodPut, u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	req.Header.Set("Content-Type", "application/octet-stream")
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set(featuresHeader, strings.Join(booteryFeatures, ","))
+	resp, err := booteryClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	defer resp.Body.Close()
 	if got, want := resp.StatusCode, http.StatusOK; got != want {
 		b, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("unexpected HTTP status code: got %d (%s), want %d", got, strings.TrimSpace(string(b)), want)
+		return nil, nil, fmt.Errorf("unexpected HTTP status code: got %d (%s), want %d", got, strings.TrimSpace(string(b)), want)
+	}
+	negotiatedFeatures = parseFeatures(resp.Header.Get(featuresHeader))
+	booteryAcceptsZstd = acceptsZstd(resp.Header)
+	if *compressImages && !booteryAcceptsZstd {
+		log.Printf("bootery does not accept zstd, uploading images uncompressed")
 	}
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	var useReply struct {
-		Hosts []string `json:"hosts"`
+		Hosts  []string          `json:"hosts"`
+		Models map[string]string `json:"models"` // featureModels
 	}
 	if err := json.Unmarshal(b, &useReply); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return useReply.Hosts, nil
+	return useReply.Hosts, useReply.Models, nil
 }
 
-func releaseBakeries(booteryURL string) error {
-	req, err := http.NewRequest(http.MethodPut, booteryURL, nil)
+func releaseBakeries(ctx context.Context, booteryURL string) error {
+	ctx, cancel := booteryContext(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, booteryURL, nil)
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/octet-stream")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := booteryClient.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	if got, want := resp.StatusCode, http.StatusOK; got != want {
 		b, _ := ioutil.ReadAll(resp.Body)
 		return fmt.Errorf("unexpected HTTP status code: got %d (%s), want %d", got, strings.TrimSpace(string(b)), want)
@@ -141,12 +217,9 @@ func releaseBakeries(booteryURL string) error {
 	return nil
 }
 
-func streamTo(img, booteryURL, hostname, newer string) (string, error) {
-	f, err := os.Open(img)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
+func streamTo(ctx context.Context, img, booteryURL, hostname, newer string) (string, error) {
+	ctx, cancel := booteryContext(ctx)
+	defer cancel()
 	u, err := url.Parse(booteryURL)
 	if err != nil {
 		return "", err
@@ -156,16 +229,42 @@ func streamTo(img, booteryURL, hostname, newer string) (string, error) {
 	if newer != "" {
 		v.Set("boot-newer", newer)
 	}
+	var body io.Reader
+	var length int64
+	if supports(featureUpload) && *uploadChunkSize > 0 {
+		id, err := uploadChunked(ctx, img, hostname)
+		if err != nil {
+			return "", err
+		}
+		v.Set("upload", id)
+	} else {
+		f, err := os.Open(img)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			return "", err
+		}
+		length = st.Size()
+		body = newProgressReader(f, img, 0, length)
+	}
 	u.RawQuery = v.Encode()
-	req, err := http.NewRequest(http.MethodPut, u.String(), f)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), body)
 	if err != nil {
 		return "", err
 	}
+	req.ContentLength = length
 	req.Header.Set("Content-Type", "application/octet-stream")
-	resp, err := http.DefaultClient.Do(req)
+	if body != nil && strings.HasSuffix(img, zstdSuffix) {
+		req.Header.Set("Content-Encoding", "zstd")
+	}
+	resp, err := booteryClient.Do(req)
 	if err != nil {
 		return "", err
 	}
+	defer resp.Body.Close()
 	if got, want := resp.StatusCode, http.StatusOK; got != want {
 		b, _ := ioutil.ReadAll(resp.Body)
 		return "", fmt.Errorf("unexpected HTTP status code: got %d (%s), want %d", got, strings.TrimSpace(string(b)), want)
@@ -174,154 +273,854 @@ func streamTo(img, booteryURL, hostname, newer string) (string, error) {
 	return string(b), err
 }
 
-func testBoot(bootImg, booteryURL, hostname, newer string) (string, error) {
-	return streamTo(bootImg, booteryURL, hostname, newer)
+// fallbackBoot asks the bootery to switch hostname back to its previous
+// system partition and boot it, returning the boot log.
+func fallbackBoot(ctx context.Context, booteryURL, hostname string) (string, error) {
+	ctx, cancel := booteryContext(ctx)
+	defer cancel()
+	u, err := url.Parse(booteryURL)
+	if err != nil {
+		return "", err
+	}
+	v := u.Query()
+	v.Set("hostname", hostname)
+	u.RawQuery = v.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := booteryClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("unexpected HTTP status code: got %d (%s), want %d", got, strings.TrimSpace(string(b)), want)
+	}
+	return string(b), nil
+}
+
+func testBoot(ctx context.Context, bootImg, booteryURL, hostname, newer string) (string, error) {
+	return streamTo(ctx, bootImg, booteryURL, hostname, newer)
 }
 
-func updateRoot(rootImg, booteryURL, hostname string) (string, error) {
-	return streamTo(rootImg, strings.TrimSuffix(booteryURL, "/testboot")+"/updateroot", hostname, "")
+func updateRoot(ctx context.Context, rootImg, booteryURL, hostname string) (string, error) {
+	return streamTo(ctx, rootImg, strings.TrimSuffix(booteryURL, "/testboot")+"/updateroot", hostname, "")
 }
 
-func ensureLabel(ctx context.Context, client *github.Client, owner, repo string, issueNum int, label string) error {
-	labels, _, err := client.Issues.ListLabelsByIssue(ctx, owner, repo, issueNum, nil)
+func ensureLabel(ctx context.Context, f forge.Forge, issueNum int, label string) error {
+	found, err := forge.HasLabel(ctx, f, issueNum, label)
 	if err != nil {
 		return err
 	}
-	for _, l := range labels {
-		if *l.Name == label {
-			return nil
-		}
+	if !found {
+		return fmt.Errorf("label %q not found on issue %d", label, issueNum)
 	}
-	return fmt.Errorf("label %q not found on issue %d", label, issueNum)
+	return nil
 }
 
-func addLabel(ctx context.Context, client *github.Client, owner, repo string, issueNum int, label string) error {
-	_, _, err := client.Issues.AddLabelsToIssue(ctx, owner, repo, issueNum, []string{label})
-	return err
+func addLabel(ctx context.Context, f forge.Forge, owner, repo string, issueNum int, label string) error {
+	if err := f.AddLabel(ctx, issueNum, label); err != nil {
+		return err
+	}
+	audit.Record(owner+"/"+repo, "add-label", fmt.Sprintf("#%d %s", issueNum, label))
+	return nil
 }
 
-func removeLabel(ctx context.Context, client *github.Client, owner, repo string, issueNum int, label string) error {
-	_, err := client.Issues.RemoveLabelForIssue(ctx, owner, repo, issueNum, label)
-	return err
+func removeLabel(ctx context.Context, f forge.Forge, owner, repo string, issueNum int, label string) error {
+	if err := f.RemoveLabel(ctx, issueNum, label); err != nil {
+		return err
+	}
+	audit.Record(owner+"/"+repo, "remove-label", fmt.Sprintf("#%d %s", issueNum, label))
+	return nil
 }
 
-func addComment(ctx context.Context, client *github.Client, owner, repo string, issueNum int, gistURL string) error {
-	_, _, err := client.Issues.CreateComment(ctx, owner, repo, issueNum, &github.IssueComment{
-		Body: github.String(fmt.Sprintf("Boot test successful, find the log at %s", gistURL)),
-	})
-	return err
+func addComment(ctx context.Context, f forge.Forge, owner, repo string, issueNum int, head string, logs []storedLog, suspect, sizes, sbom, dmesg string) error {
+	var urls, inline []string
+	for _, l := range logs {
+		if l.url != "" {
+			urls = append(urls, l.url)
+		}
+		if l.inline != "" {
+			inline = append(inline, l.inline)
+		}
+	}
+	body := "Boot test successful"
+	if head != "" {
+		body = fmt.Sprintf("Boot test of %s successful", head)
+	}
+	if len(urls) > 0 {
+		body += ", find the log at " + strings.Join(urls, ", ")
+	}
+	for _, l := range inline {
+		body += "\n\n" + l
+	}
+	if suspect != "" {
+		body += "\n\n" + suspect
+	}
+	if sizes != "" {
+		body += "\n\n" + sizes
+	}
+	if dmesg != "" {
+		body += "\n\n" + dmesg
+	}
+	if sbom != "" {
+		body += "\n\n" + sbom
+	}
+	commentURL, err := f.Comment(ctx, issueNum, body)
+	if err != nil {
+		return err
+	}
+	audit.Record(owner+"/"+repo, "add-comment", commentURL)
+	return nil
 }
 
-func testBoot1(hostname, newer string) (string, error) {
-	bootImg, rootImg, err := writeImages(hostname)
+func copyFile(dest, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func testBoot1(ctx context.Context, hostname, newer string) (string, error) {
+	if *eepromImage != "" {
+		deploys.start(ctx, hostname)
+		return testEEPROM(ctx, hostname)
+	}
+	if *fullDisk {
+		return testDisk(ctx, hostname, newer)
+	}
+
+	instance, _ := hostInstance(hostname)
+	bootImg, rootImg, cleanup, err := builder.build(instance, hostname)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	if *sizeStore != "" {
+		if err := measureImages(instance, bootImg, rootImg); err != nil {
+			return "", err
+		}
+	}
+
+	if err := keepImages(ctx, hostname, map[string]string{
+		"boot.img": bootImg,
+		"root.img": rootImg,
+	}); err != nil {
+		return "", err
+	}
+
+	note, err := alreadyTested(hostname, bootImg, rootImg)
+	if err != nil {
+		return "", err
+	}
+	if note != "" {
+		return note, nil
+	}
+
+	deploys.start(ctx, hostname)
+
+	if *directHost != "" {
+		target, err := newDirectTarget(*directHost)
+		if err != nil {
+			return "", err
+		}
+		bootlog, err := target.boot(bootImg, rootImg, *updateRootFlag)
+		if err != nil || !*testFallback {
+			return bootlog, err
+		}
+		log.Printf("testing fallback to the previous partition")
+		fallbacklog, err := target.fallback()
+		if err != nil {
+			return "", fmt.Errorf("fallback boot: %v", err)
+		}
+		return bootlog + fallbackSeparator + fallbacklog, nil
+	}
+
+	bootImg, rootImg, cleanupCompressed, err := maybeCompressImages(bootImg, rootImg)
 	if err != nil {
 		return "", err
 	}
-	defer os.Remove(bootImg)
-	defer os.Remove(rootImg)
+	defer cleanupCompressed()
 
 	if *updateRootFlag {
 		log.Printf("updating root file system")
-		if _, err := updateRoot(rootImg, *booteryURL, hostname); err != nil {
+		if _, err := withRetries(ctx, "updating the root file system", hostname, func() (string, error) {
+			return updateRoot(ctx, rootImg, *booteryURL, hostname)
+		}); err != nil {
 			return "", errors.New(strings.Replace(err.Error(), *booteryURL, "<bootery_url>", -1))
 		}
 	}
 
 	log.Printf("testing boot file system")
-	bootlog, err := testBoot(bootImg, strings.TrimSuffix(*booteryURL, "/testboot")+"/testboot1"+fmt.Sprintf("?update_root=%v", *updateRootFlag), hostname, newer)
+	testbootURL, err := withHostParams(strings.TrimSuffix(*booteryURL, "/testboot")+"/testboot1"+fmt.Sprintf("?update_root=%v", *updateRootFlag), hostname)
+	if err != nil {
+		return "", err
+	}
+	bootlog, err := withRetries(ctx, "boot test", hostname, func() (string, error) {
+		return testBoot(ctx, bootImg, testbootURL, hostname, newer)
+	})
 	if err != nil {
 		return "", errors.New(strings.Replace(err.Error(), *booteryURL, "<bootery_url>", -1))
 	}
+
+	if *telemetryMode != "" {
+		summary, err := checkTelemetry(ctx, strings.TrimSuffix(*booteryURL, "/testboot")+"/telemetry", hostname)
+		if err != nil {
+			return "", errors.New(strings.Replace(err.Error(), *booteryURL, "<bootery_url>", -1))
+		}
+		log.Print(summary)
+		bootlog += "\n\n" + summary + "\n"
+	}
+
+	if *testFallback {
+		log.Printf("testing fallback to the previous partition")
+		fallbacklog, err := fallbackBoot(ctx, strings.TrimSuffix(*booteryURL, "/testboot")+"/testfallback", hostname)
+		if err != nil {
+			return "", fmt.Errorf("fallback boot: %v", strings.Replace(err.Error(), *booteryURL, "<bootery_url>", -1))
+		}
+		bootlog += fallbackSeparator + fallbacklog
+	}
 	return bootlog, nil
 }
 
+const fallbackSeparator = "\n\n=== fallback boot (previous system partition) ===\n\n"
+
 var (
-	githubUser        = cienv.MustGetGithubUser()
-	authToken         = cienv.MustGetAuthToken()
-	slug              = cienv.MustGetSlug()
-	travisPullRequest = cienv.MustGetPullRequest()
+	githubUser        string
+	authToken         string
+	slug              string
+	travisPullRequest string
 )
 
 func main() {
 	flag.Parse()
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	secret.Install()
+	settings.SetPath(*autoupdateConfig)
+	audit.Configure(audit.Options{
+		Log:    *auditLog,
+		Branch: *auditBranch,
+		S3:     *auditS3,
+	})
+	version.MaybePrint(*printVersion)
+	metrics.Serve(metrics.Options{
+		Listen:      *metricsListen,
+		Textfile:    *metricsTextfile,
+		Pushgateway: *metricsPushgateway,
+	})
 
-	if *booteryURL == "" {
-		log.Fatal("-bootery_url is a required flag")
+	if err := run(); err != nil {
+		notify.Failed(context.Background(), slug, err)
+		log.Fatal(err)
 	}
+	notify.Succeeded(slug)
+}
 
-	if *requireLabel == "" {
-		log.Fatal("-require_label is a required flag")
+// run is main without log.Fatal, so that the deferred teardown (releasing
+// the bakeries, leaving the tailnet) runs when the boot test fails.
+func run() (retErr error) {
+	if !*dryRun {
+		githubUser = cienv.MustGetGithubUser()
+		authToken = cienv.MustGetAuthToken(*tokenFile)
+		slug = cienv.MustGetSlug()
 	}
+	travisPullRequest = cienv.GetPullRequest()
+	isPullRequest := travisPullRequest != ""
 
-	if *setLabel == "" {
-		log.Fatal("-set_label is a required flag")
+	if *booteryURL == "" && *directHost == "" {
+		return errors.New("-bootery_url (or -direct_host) is a required flag")
+	}
+	if *booteryURL != "" {
+		u, err := normalizeBooteryURL(*booteryURL)
+		if err != nil {
+			return err
+		}
+		*booteryURL = u
+	}
+
+	if *eepromImage != "" && *directHost != "" {
+		return errors.New("-eeprom_image requires a bootery, it cannot be combined with -direct_host")
+	}
+
+	if *fullDisk {
+		if err := checkFullDisk(); err != nil {
+			return err
+		}
+	}
+
+	if *hostParamsPath != "" {
+		if *directHost != "" {
+			return errors.New("-host_params requires a bootery, it cannot be combined with -direct_host")
+		}
+		var err error
+		hostParamsFile, err = readHostParams(*hostParamsPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := checkBootDeadline(); err != nil {
+		return err
+	}
+
+	if *instancesFlag != "" {
+		if *directHost != "" {
+			return errors.New("-instances requires a bootery, it cannot be combined with -direct_host")
+		}
+		var err error
+		instances, err = parseInstances(*instancesFlag)
+		if err != nil {
+			return err
+		}
+	}
+
+	var err error
+	builder, err = newImageBuilder()
+	if err != nil {
+		return err
+	}
+	if *sbomFlag && *imageBuilderFlag != "gok" {
+		return errors.New("-sbom requires -image_builder=gok")
+	}
+
+	if *requireLabel == "" && *checklistItem == "" && isPullRequest {
+		return errors.New("-require_label (or -checklist_item) is a required flag")
+	}
+
+	if *retries < 0 {
+		return fmt.Errorf("invalid -retries value %d: must not be negative", *retries)
+	}
+
+	if *redundancyVoting && *directHost != "" {
+		return errors.New("-redundancy_voting requires a bootery, it cannot be combined with -direct_host")
+	}
+
+	if *parallel < 1 {
+		return fmt.Errorf("invalid -parallel value %d: must be at least 1", *parallel)
+	}
+
+	if *telemetryMode != "" && *telemetryMode != "warn" && *telemetryMode != "fail" {
+		return fmt.Errorf("invalid -telemetry value %q: expected one of warn or fail", *telemetryMode)
+	}
+
+	if _, err := regexp.Compile(*bootLogIgnore); err != nil {
+		return fmt.Errorf("invalid -boot_log_ignore value: %v", err)
+	}
+
+	if *setLabel == "" && *checklistItem == "" && isPullRequest {
+		return errors.New("-set_label (or -checklist_item) is a required flag")
+	}
+
+	if err := addNotifySink(); err != nil {
+		return err
+	}
+
+	if *dryRun {
+		issueNum, err := dryRunIssue(isPullRequest)
+		if err != nil {
+			return err
+		}
+		if err := runDryRun(isPullRequest, issueNum); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if *tailscale {
+		if *booteryProxy != "" {
+			return errors.New("-tailscale and -bootery_proxy are mutually exclusive")
+		}
+		if *directHost != "" {
+			return errors.New("-tailscale requires a bootery, it cannot be combined with -direct_host")
+		}
+		proxy, stop, err := startTailscale(context.Background())
+		if err != nil {
+			return err
+		}
+		defer stop()
+		*booteryProxy = "socks5://" + proxy
+	}
+
+	booteryClient, err = newBooteryClient()
+	if err != nil {
+		return err
 	}
 
 	parts := strings.Split(slug, "/")
 	if got, want := len(parts), 2; got != want {
-		log.Fatalf("unexpected number of /-separated parts in %q: got %d, want %d", slug, got, want)
+		return fmt.Errorf("unexpected number of /-separated parts in %q: got %d, want %d", slug, got, want)
 	}
 
-	i, err := strconv.ParseInt(travisPullRequest, 0, 64)
-	if err != nil {
-		log.Fatalf("could not parse TRAVIS_PULL_REQUEST=%q as number: %v", os.Getenv("TRAVIS_PULL_REQUEST"), err)
+	// issueNum is the pull request (or, outside of pull requests, the
+	// -report_issue) to comment on. Zero means no comments.
+	issueNum := *reportIssue
+	if isPullRequest {
+		i, err := strconv.ParseInt(travisPullRequest, 0, 64)
+		if err != nil {
+			return fmt.Errorf("could not parse TRAVIS_PULL_REQUEST=%q as number: %v", os.Getenv("TRAVIS_PULL_REQUEST"), err)
+		}
+		issueNum = int(i)
+	} else {
+		log.Printf("not running for a pull request, testing the checked out branch")
 	}
-	issueNum := int(i)
 
-	client := github.NewClient(&http.Client{
-		Transport: &github.BasicAuthTransport{
-			Username: githubUser,
-			Password: authToken,
-		},
-	})
+	f, err := forge.New(*forgeKind, *forgeURL, parts[0], parts[1], githubUser, authToken)
+	if err != nil {
+		return err
+	}
+	// Commit the audit log however the run ends, in particular after a
+	// failed boot test.
+	defer func() {
+		if err := audit.Commit(context.Background(), forge.GitHubClient(f), parts[0], parts[1]); err != nil {
+			if retErr == nil {
+				retErr = err
+			} else {
+				log.Print(err)
+			}
+		}
+	}()
 
 	ctx := context.Background()
 
-	if err := ensureLabel(ctx, client, parts[0], parts[1], issueNum, *requireLabel); err != nil {
-		// Exit with exit code 0 if there is nothing to do.
-		log.Println(err.Error())
-		return
+	sinks, err := newLogSinks(*logSinkFlag, forge.GitHubClient(f))
+	if err != nil {
+		return err
+	}
+
+	var sizes artifactstore.Store
+	if *sizeStore != "" {
+		sizes, err = artifactstore.Open(*sizeStore)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *artifactStore != "" {
+		imageStore, err = artifactstore.Open(*artifactStore)
+		if err != nil {
+			return err
+		}
+	}
+
+	if isPullRequest && *requireLabel != "" {
+		if err := ensureLabel(ctx, f, issueNum, *requireLabel); err != nil {
+			// Exit with exit code 0 if there is nothing to do.
+			log.Println(err.Error())
+			return nil
+		}
+	}
+	if isPullRequest && *checklistItem != "" {
+		if err := ensureUnchecked(ctx, f, issueNum, *checklistItem); err != nil {
+			// Exit with exit code 0 if there is nothing to do.
+			log.Println(err.Error())
+			return nil
+		}
+	}
+
+	// head is the pull request head commit under test.
+	var head string
+	if isPullRequest {
+		head, err = testedHead(ctx, f, issueNum)
+		if err != nil {
+			return err
+		}
+		log.Printf("testing pull request head %s", head)
+
+		if err := loadTestedImages(ctx, f, issueNum); err != nil {
+			return err
+		}
+	}
+
+	if *deploymentPrefix != "" {
+		client := forge.GitHubClient(f)
+		if client == nil {
+			return errors.New("-deployment_environment_prefix requires -forge=github")
+		}
+		ref := head
+		if ref == "" {
+			ref = os.Getenv("GITHUB_SHA")
+		}
+		if ref == "" {
+			return errors.New("-deployment_environment_prefix: commit under test unknown (GITHUB_SHA empty)")
+		}
+		deploys = &deployments{
+			client: client,
+			owner:  parts[0],
+			repo:   parts[1],
+			ref:    ref,
+			ids:    make(map[string]int64),
+		}
 	}
 
 	// Subtract a second to ensure the gokrazy build timestamp is different
 	// (UNIX timestamps use seconds as their granularity).
 	newer := strconv.FormatInt(time.Now().Unix()-1, 10)
 
-	// Power on bakeries and expand slug into hostnames
-	booteryBase := strings.TrimSuffix(*booteryURL, "/testboot")
-	hosts, err := useBakeries(booteryBase+"/usebakeries", slug)
-	if err != nil {
-		log.Fatal(err)
+	var (
+		hosts  []string
+		models map[string]string
+	)
+	if *directHost != "" {
+		// Test the device of the instance config as-is.
+		cfg, err := config.ApplyInstanceFlag()
+		if err != nil {
+			return err
+		}
+		hosts = []string{cfg.Hostname}
+	} else {
+		var hardware []string
+		if *matrixPath != "" && isPullRequest {
+			matrix, err := readHardwareMatrix(*matrixPath)
+			if err != nil {
+				return err
+			}
+			labels, files, err := pullRequestLabelsAndFiles(ctx, f, issueNum, githubUser)
+			if err != nil {
+				return err
+			}
+			hardware = matrix.hardwareFor(labels, files)
+			log.Printf("hardware matrix: testing hardware classes %q", hardware)
+		}
+
+		// Power on bakeries and expand slug into hostnames
+		booteryBase := strings.TrimSuffix(*booteryURL, "/testboot")
+		hosts, models, err = useBakeries(ctx, booteryBase+"/usebakeries", slug, hardware)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := releaseBakeries(ctx, booteryBase+"/releasebakeries"); err != nil {
+				if retErr == nil {
+					retErr = err
+				} else {
+					log.Print(err)
+				}
+			}
+		}()
 	}
-	defer func() {
-		if err := releaseBakeries(booteryBase + "/releasebakeries"); err != nil {
-			log.Fatal(err)
+
+	if len(instances) > 0 {
+		var mapped []string
+		for _, host := range hosts {
+			instance, ok := hostInstance(host)
+			if !ok {
+				log.Printf("-instances: skipping host %s (no matching pattern)", host)
+				continue
+			}
+			log.Printf("-instances: testing host %s with instance %s", host, instance)
+			mapped = append(mapped, host)
 		}
-	}()
+		if len(mapped) == 0 {
+			return fmt.Errorf("-instances=%s matches none of the bakery hosts %q", *instancesFlag, hosts)
+		}
+		hosts = mapped
+	}
+
+	if *redundancyVoting {
+		if !supports(featureModels) {
+			log.Printf("-redundancy_voting: bootery does not report device models, testing every host on its own")
+		} else {
+			hosts = pairHosts(hosts, models)
+		}
+	}
+
+	if *maxHosts > 0 && len(hosts) > *maxHosts {
+		log.Printf("-max_hosts=%d: skipping hosts %q", *maxHosts, hosts[*maxHosts:])
+		hosts = hosts[:*maxHosts]
+	}
+	var deadline time.Time
+	if *maxDuration > 0 {
+		deadline = time.Now().Add(*maxDuration)
+	}
+
+	runCtx := ctx
+	stopWatching := func() {}
+	if isPullRequest {
+		runCtx, stopWatching = watchCancellation(ctx, f, issueNum)
+		defer stopWatching()
+	}
+
+	var summary *summaryComment
+	if *summaryCommentFlag && issueNum != 0 {
+		commit := head
+		if commit == "" {
+			commit = os.Getenv("GITHUB_SHA")
+		}
+		summary = newSummaryComment(f, parts[0], parts[1], issueNum, commit, hosts)
+	}
 
 	log.Printf("updating hosts %q", hosts)
-	for _, host := range hosts {
-		bootlog, err := testBoot1(host, newer)
+	started := time.Now()
+	var results []hostResult
+	var prNum int
+	if isPullRequest {
+		prNum = issueNum
+	}
+	reportResults := func() {
+		for _, r := range results {
+			deploys.finish(ctx, r.host, r.err)
+		}
+		if *reportURL != "" {
+			if err := postReport(*reportURL, prNum, started, results); err != nil {
+				log.Printf("posting results to -report_url: %v", err)
+			}
+		}
+		if *statusStore != "" && !isPullRequest {
+			if err := exportStatus(ctx, results); err != nil {
+				log.Printf("exporting results to -status_store: %v", err)
+			}
+		}
+		if !*checkRun || !isPullRequest {
+			return
+		}
+		if err := createCheckRun(ctx, f, parts[0], parts[1], issueNum, head, started, results); err != nil {
+			log.Printf("creating check run: %v", err)
+		}
+	}
+	var outcomes []bootOutcome
+	if *parallel > 1 && len(hosts) > 1 {
+		log.Printf("testing up to %d hosts in parallel", *parallel)
+		outcomes = testHosts(runCtx, deadline, hosts, newer)
+	}
+	for idx, host := range hosts {
+		var (
+			bootlog  string
+			err      error
+			duration time.Duration
+		)
+		if outcomes != nil {
+			bootlog, err, duration = outcomes[idx].bootlog, outcomes[idx].err, outcomes[idx].duration
+		} else {
+			hostStart := time.Now()
+			bootlog, err = testVoting(runCtx, deadline, host, newer)
+			duration = time.Since(hostStart)
+		}
+		results = append(results, hostResult{
+			host:     host,
+			err:      err,
+			duration: duration,
+		})
+		metrics.Inc(metrics.BootTests, "host", host, "result", results[len(results)-1].status())
+		if errors.Is(err, errCancelled) {
+			for jdx, skipped := range hosts[idx+1:] {
+				if outcomes != nil {
+					o := outcomes[idx+1+jdx]
+					results = append(results, hostResult{
+						host:     skipped,
+						err:      o.err,
+						duration: o.duration,
+					})
+					continue
+				}
+				results = append(results, hostResult{
+					host: skipped,
+					err:  fmt.Errorf("%w: %s not tested", errCancelled, skipped),
+				})
+			}
+			if summary != nil {
+				if err := summary.update(ctx, results, err.Error()); err != nil {
+					log.Printf("reporting partial results: %v", err)
+				}
+			} else if commentURL, err := f.Comment(ctx, issueNum, partialResults(err.Error(), results)); err != nil {
+				log.Printf("reporting partial results: %v", err)
+			} else {
+				audit.Record(parts[0]+"/"+parts[1], "add-comment", commentURL)
+			}
+			reportResults()
+			// Exit with exit code 0: the cancellation was requested. The
+			// deferred functions release the bakeries and commit the audit
+			// log.
+			log.Print(err)
+			return nil
+		}
 		if err != nil {
-			log.Fatal(err)
+			var u string
+			if isPullRequest {
+				u = f.PullRequestURL(issueNum)
+			}
+			notify.Send(ctx, notify.Event{
+				Kind:   notify.BootFailed,
+				Repo:   slug,
+				Title:  host,
+				URL:    u,
+				Detail: err.Error(),
+			})
+			if outcomes != nil {
+				// Process the results of the other hosts before failing,
+				// see -parallel.
+				continue
+			}
+			if errors.Is(err, errBudgetExceeded) {
+				// Report partial results instead of holding the bakeries
+				// indefinitely.
+				for _, skipped := range hosts[idx+1:] {
+					results = append(results, hostResult{
+						host: skipped,
+						err:  fmt.Errorf("%w: %s not tested", errBudgetExceeded, skipped),
+					})
+				}
+				reason := fmt.Sprintf("exceeded its budget (-max_duration=%v)", *maxDuration)
+				if summary != nil {
+					if err := summary.update(ctx, results, reason); err != nil {
+						log.Printf("reporting partial results: %v", err)
+					}
+				} else if issueNum != 0 {
+					if commentURL, err := f.Comment(ctx, issueNum, partialResults(reason, results)); err != nil {
+						log.Printf("reporting partial results: %v", err)
+					} else {
+						audit.Record(parts[0]+"/"+parts[1], "add-comment", commentURL)
+					}
+				}
+			} else if summary != nil {
+				if err := summary.update(ctx, results, ""); err != nil {
+					log.Printf("reporting failure: %v", err)
+				}
+			} else if issueNum != 0 && errors.As(err, new(*bootLogError)) {
+				// Quote the excerpt, which the job log might not retain.
+				if commentURL, err := f.Comment(ctx, issueNum, "Boot test failed: "+failureDetails(err)); err != nil {
+					log.Printf("reporting failure: %v", err)
+				} else {
+					audit.Record(parts[0]+"/"+parts[1], "add-comment", commentURL)
+				}
+			}
+			reportResults()
+			return err
 		}
 
-		gistURL, err := createGist(ctx, client, bootlog)
+		logs, err := storeLog(ctx, sinks, host, bootlog)
 		if err != nil {
-			log.Fatal(err)
+			return err
+		}
+
+		var sbom string
+		if *sbomFlag {
+			instance, _ := hostInstance(host)
+			sbom, err = imageSBOM(instance)
+			if err != nil {
+				return err
+			}
+		}
+
+		var dmesg string
+		if *dmesgDiff && *directHost == "" {
+			dmesg, err = dmesgReport(ctx, strings.TrimSuffix(*booteryURL, "/testboot")+"/dmesg", host)
+			if err != nil {
+				return err
+			}
+		}
+
+		var sizeDelta string
+		var sizeErr error
+		if sizes != nil && isPullRequest {
+			base := cienv.GetBaseBranch()
+			if base == "" {
+				base = "main"
+			}
+			instance, _ := hostInstance(host)
+			sizeDelta, sizeErr = sizeReport(ctx, sizes, base, instance)
+			if sizeErr != nil && !errors.Is(sizeErr, errSizeGrowth) {
+				return sizeErr
+			}
+			if sizeDelta != "" {
+				log.Print(sizeDelta)
+			}
 		}
 
-		if err := addComment(ctx, client, parts[0], parts[1], issueNum, gistURL); err != nil {
-			log.Fatal(err)
+		suspect := suspectReport(host)
+		if summary != nil {
+			summary.record(host, logs, suspect, sizeDelta, sbom, dmesg)
+			if err := summary.update(ctx, results, ""); err != nil {
+				return err
+			}
+		} else if issueNum != 0 {
+			if err := addComment(ctx, f, parts[0], parts[1], issueNum, head, logs, suspect, sizeDelta, sbom, dmesg); err != nil {
+				return err
+			}
+		}
+		if sizeErr != nil {
+			reportResults()
+			return sizeErr
 		}
 	}
+	stopWatching()
+	reportResults()
 
-	if err := addLabel(ctx, client, parts[0], parts[1], issueNum, *setLabel); err != nil {
-		log.Fatal(err)
+	if failed := failedHosts(results); len(failed) > 0 {
+		// Only reached with -parallel: sequential runs fail on the first
+		// failing host.
+		var reason string
+		if budgetExceeded(results) {
+			reason = fmt.Sprintf("exceeded its budget (-max_duration=%v)", *maxDuration)
+		}
+		if summary != nil {
+			if err := summary.update(ctx, results, reason); err != nil {
+				log.Printf("reporting failures: %v", err)
+			}
+		} else if issueNum != 0 {
+			if commentURL, err := f.Comment(ctx, issueNum, failureSummary(results)); err != nil {
+				log.Printf("reporting failures: %v", err)
+			} else {
+				audit.Record(parts[0]+"/"+parts[1], "add-comment", commentURL)
+			}
+		}
+		return fmt.Errorf("boot test failed on %d of %d host(s): %s", len(failed), len(results), strings.Join(failed, ", "))
 	}
 
-	if err := removeLabel(ctx, client, parts[0], parts[1], issueNum, *requireLabel); err != nil {
-		log.Fatal(err)
+	var prURL string
+	if isPullRequest {
+		prURL = f.PullRequestURL(issueNum)
+	}
+	notifySucceeded(ctx, prURL, results)
+
+	if sizes != nil && !isPullRequest {
+		if branch := cienv.GetBranch(); branch != "" {
+			if err := recordSizes(ctx, sizes, branch); err != nil {
+				return err
+			}
+		} else {
+			log.Printf("-size_store: branch unknown, not recording image sizes")
+		}
+	}
+
+	if isPullRequest {
+		if err := recordTestedImages(ctx, f, parts[0], parts[1], issueNum); err != nil {
+			return err
+		}
+
+		if *setLabel != "" {
+			if err := addLabel(ctx, f, parts[0], parts[1], issueNum, *setLabel); err != nil {
+				return err
+			}
+		}
+
+		if *requireLabel != "" {
+			if err := removeLabel(ctx, f, parts[0], parts[1], issueNum, *requireLabel); err != nil {
+				return err
+			}
+		}
+
+		if *checklistItem != "" {
+			if err := tickItem(ctx, f, parts[0], parts[1], issueNum, *checklistItem); err != nil {
+				return err
+			}
+		}
 	}
+
+	return nil
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var bootDeadline = flag.Duration("boot_deadline",
+	0,
+	"if non-zero, how long the bootery waits for a host to boot (e.g. 5m for devices which take longer than the bootery default, such as a CM4 booting from NVMe or hosts with slow SD cards). Passed as the deadline query parameter to booteries which announce the deadline feature. Can be set per host with the boot_deadline field of -host_params rules. With -direct_host, replaces the default of 5m to wait for the device to come back. Must be shorter than -boot_timeout")
+
+// rebootDeadline returns how long -direct_host devices are given to come
+// back after a reboot.
+func rebootDeadline() time.Duration {
+	if *bootDeadline > 0 {
+		return *bootDeadline
+	}
+	return 5 * time.Minute
+}
+
+// bootDeadlineFor returns the boot deadline of hostname: that of the last
+// matching -host_params rule which sets one, or -boot_deadline. Zero means
+// the bootery default.
+func bootDeadlineFor(hostname string) time.Duration {
+	deadline := *bootDeadline
+	if hostParamsFile == nil {
+		return deadline
+	}
+	for _, r := range hostParamsFile.Rules {
+		if r.BootDeadline == "" || !matchesAny(r.Hosts, hostname) {
+			continue
+		}
+		deadline, _ = time.ParseDuration(r.BootDeadline) // validated by readHostParams
+	}
+	return deadline
+}
+
+// checkBootDeadline verifies that the boot deadlines leave the bootery time
+// to reply before -boot_timeout cancels the request.
+func checkBootDeadline() error {
+	deadlines := []time.Duration{*bootDeadline}
+	if hostParamsFile != nil {
+		for _, r := range hostParamsFile.Rules {
+			if r.BootDeadline != "" {
+				d, _ := time.ParseDuration(r.BootDeadline) // validated by readHostParams
+				deadlines = append(deadlines, d)
+			}
+		}
+	}
+	for _, d := range deadlines {
+		if d < 0 {
+			return fmt.Errorf("invalid boot deadline %v: must not be negative", d)
+		}
+		if *bootTimeout > 0 && d >= *bootTimeout {
+			return fmt.Errorf("boot deadline %v must be shorter than -boot_timeout=%v", d, *bootTimeout)
+		}
+	}
+	return nil
+}
+
+// addBootDeadline adds the boot deadline of hostname (in seconds) to the
+// query values v, if any and if the bootery supports it.
+func addBootDeadline(v url.Values, hostname string) {
+	deadline := bootDeadlineFor(hostname)
+	if deadline == 0 {
+		return
+	}
+	if !supports(featureDeadline) {
+		log.Printf("bootery does not support the %s feature, not passing the boot deadline of %v to %s", featureDeadline, deadline, hostname)
+		return
+	}
+	v.Set("deadline", strconv.FormatInt(int64(deadline.Round(time.Second)/time.Second), 10))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gokrazy/autoupdate/internal/secret"
+)
+
+var (
+	booteryCert = flag.String("bootery_cert",
+		"",
+		"if non-empty, path of a PEM-encoded client certificate to present to the bootery (mutual TLS). Requires -bootery_key")
+
+	booteryKey = flag.String("bootery_key",
+		"",
+		"path of the PEM-encoded private key of -bootery_cert")
+
+	booteryCA = flag.String("bootery_ca",
+		"",
+		"if non-empty, path of a PEM-encoded CA certificate bundle with which to verify the bootery server certificate, instead of the system roots")
+
+	booteryToken = flag.String("bootery_token",
+		"",
+		"if non-empty, bearer token with which to authenticate to the bootery. Defaults to the BOOTERY_TOKEN environment variable (or BOOTERY_TOKEN_FILE, or a systemd credential), which is preferable as flags are visible in the process list")
+)
+
+// booteryTLSConfig returns the TLS configuration for bootery requests, or
+// nil if neither -bootery_cert nor -bootery_ca are set.
+func booteryTLSConfig() (*tls.Config, error) {
+	if *booteryCert == "" && *booteryKey == "" && *booteryCA == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{}
+	if *booteryCert != "" || *booteryKey != "" {
+		if *booteryCert == "" || *booteryKey == "" {
+			return nil, fmt.Errorf("-bootery_cert and -bootery_key must be specified together")
+		}
+		cert, err := tls.LoadX509KeyPair(*booteryCert, *booteryKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if *booteryCA != "" {
+		b, err := os.ReadFile(*booteryCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("-bootery_ca %s: no certificates found", *booteryCA)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// tokenTransport adds a static bearer token to each request.
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(req)
+}
+
+// newBooteryClient returns the client for all bootery requests, which
+// authenticates with a client certificate, bearer token or OIDC ID token
+// (see -bootery_oidc_audience), as configured.
+func newBooteryClient() (*http.Client, error) {
+	token := *booteryToken
+	if token == "" {
+		token = secret.Get("BOOTERY_TOKEN")
+	} else {
+		secret.Register(token)
+	}
+	if token != "" && *oidcAudience != "" {
+		return nil, fmt.Errorf("-bootery_token (or BOOTERY_TOKEN) and -bootery_oidc_audience are mutually exclusive")
+	}
+
+	base, err := booteryTransport()
+	if err != nil {
+		return nil, err
+	}
+	if base == http.DefaultTransport && token == "" && *oidcAudience == "" {
+		return http.DefaultClient, nil
+	}
+
+	switch {
+	case token != "":
+		return &http.Client{Transport: &tokenTransport{token: token, base: base}}, nil
+	case *oidcAudience != "":
+		t := &oidcTransport{audience: *oidcAudience, base: base}
+		// Fail early instead of after building the images.
+		if _, err := t.currentToken(); err != nil {
+			return nil, fmt.Errorf("obtaining OIDC token: %v", err)
+		}
+		return &http.Client{Transport: t}, nil
+	}
+	return &http.Client{Transport: base}, nil
+}
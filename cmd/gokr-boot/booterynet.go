@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var booteryProxy = flag.String("bootery_proxy",
+	"",
+	"if non-empty, URL of an HTTP, HTTPS or SOCKS5 proxy through which to connect to the bootery, e.g. socks5://localhost:1080 (ssh -D 1080 jumphost, or tailscaled --socks5-server). If empty, the standard HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are honored")
+
+// unescapedZoneRe matches the zone of an IPv6 literal host which is not
+// percent-encoded as URLs require, e.g. [fe80::1%eth0].
+var unescapedZoneRe = regexp.MustCompile(`(\[[0-9A-Fa-f:.]+)%([^2][^\]]*|2[^5][^\]]*)\]`)
+
+// normalizeBooteryURL validates the -bootery_url raw and returns it with
+// the zone of a link-local IPv6 literal host percent-encoded.
+func normalizeBooteryURL(raw string) (string, error) {
+	raw = unescapedZoneRe.ReplaceAllString(raw, "$1%25$2]")
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid -bootery_url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("invalid -bootery_url %q: expected an http:// or https:// URL", raw)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid -bootery_url %q: no host", raw)
+	}
+	if strings.Count(u.Host, ":") > 1 && !strings.HasPrefix(u.Host, "[") {
+		// Without brackets, the port cannot be told apart from the address.
+		return "", fmt.Errorf("invalid -bootery_url %q: IPv6 addresses must be enclosed in brackets, e.g. http://[fd7a:115c:a1e0::1]:8037/testboot", raw)
+	}
+	return u.String(), nil
+}
+
+// booteryTransport returns the transport for bootery requests, using
+// -bootery_proxy and the TLS configuration of booteryTLSConfig.
+func booteryTransport() (http.RoundTripper, error) {
+	tlsConfig, err := booteryTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil && *booteryProxy == "" {
+		return http.DefaultTransport, nil
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		t.TLSClientConfig = tlsConfig
+	}
+	if *booteryProxy != "" {
+		proxy, err := url.Parse(*booteryProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -bootery_proxy: %v", err)
+		}
+		switch proxy.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("invalid -bootery_proxy %q: expected one of http://, https://, socks5:// or socks5h://", *booteryProxy)
+		}
+		t.Proxy = http.ProxyURL(proxy)
+	}
+	return t, nil
+}
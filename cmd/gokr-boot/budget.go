@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	maxDuration = flag.Duration("max_duration",
+		0,
+		"if non-zero, maximum time a run may hold bakery hardware (e.g. 30m). Once exceeded, e.g. because a device wedged, the remaining hosts are skipped and the partial results are reported")
+
+	maxHosts = flag.Int("max_hosts",
+		0,
+		"if non-zero, test at most this many of the bakery hosts")
+)
+
+var errBudgetExceeded = errors.New("budget exceeded")
+
+// bootTest tests one host. It is a variable so that tests can replace it.
+var bootTest = testAndAnalyze
+
+// testBootWithin is like testAndAnalyze, but cancels the boot test at
+// deadline (if non-zero) or once ctx is cancelled (see watchCancellation).
+// It returns only once the boot test returned, so that the caller does not
+// report results or release the bakeries while an image is still being
+// uploaded or booted.
+func testBootWithin(ctx context.Context, deadline time.Time, hostname, newer string) (string, error) {
+	if ctx.Err() != nil {
+		return "", context.Cause(ctx)
+	}
+	if !deadline.IsZero() {
+		if time.Until(deadline) <= 0 {
+			return "", fmt.Errorf("%w: %s not tested", errBudgetExceeded, hostname)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadlineCause(ctx, deadline,
+			fmt.Errorf("%w: %s did not finish within -max_duration=%v", errBudgetExceeded, hostname, *maxDuration))
+		defer cancel()
+	}
+	bootlog, err := bootTest(ctx, hostname, newer)
+	if err != nil && ctx.Err() != nil {
+		// The error is a consequence of the cancellation.
+		return "", context.Cause(ctx)
+	}
+	return bootlog, err
+}
+
+// partialResults renders a PR comment summarizing the results of a run
+// which ended early, e.g. because it exceeded its budget.
+func partialResults(reason string, results []hostResult) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Boot test %s, partial results:\n\n", reason)
+	b.WriteString("| host | result | duration |\n|---|---|---|\n")
+	for _, r := range results {
+		fmt.Fprintf(&b, "| %s | %s | %v |\n", r.host, r.status(), r.duration.Round(time.Second))
+	}
+	return b.String()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubBootTest replaces bootTest with f for the duration of the test.
+func stubBootTest(t *testing.T, f func(ctx context.Context, hostname, newer string) (string, error)) {
+	t.Helper()
+	orig := bootTest
+	bootTest = f
+	t.Cleanup(func() { bootTest = orig })
+}
+
+func TestTestBootWithinWaitsForBootTest(t *testing.T) {
+	var returned atomic.Bool
+	stubBootTest(t, func(ctx context.Context, hostname, newer string) (string, error) {
+		<-ctx.Done()
+		// Tearing down, e.g. aborting an image upload, takes a while.
+		time.Sleep(10 * time.Millisecond)
+		returned.Store(true)
+		return "", ctx.Err()
+	})
+	_, err := testBootWithin(context.Background(), time.Now().Add(10*time.Millisecond), "rpi4", "")
+	if !errors.Is(err, errBudgetExceeded) {
+		t.Errorf("testBootWithin = %v, want %v", err, errBudgetExceeded)
+	}
+	if !returned.Load() {
+		t.Errorf("testBootWithin returned before the boot test")
+	}
+}
+
+func TestTestBootWithin(t *testing.T) {
+	errBoot := errors.New("boot failed")
+	cancelled, cancel := context.WithCancelCause(context.Background())
+	cancel(errCancelled)
+	for _, tt := range []struct {
+		name     string
+		ctx      context.Context
+		deadline time.Time
+		result   error
+		want     error
+		wantRun  bool
+	}{
+		{
+			name:    "no deadline",
+			ctx:     context.Background(),
+			wantRun: true,
+		},
+		{
+			name:     "within deadline",
+			ctx:      context.Background(),
+			deadline: time.Now().Add(time.Hour),
+			wantRun:  true,
+		},
+		{
+			name:     "failed within deadline",
+			ctx:      context.Background(),
+			deadline: time.Now().Add(time.Hour),
+			result:   errBoot,
+			want:     errBoot,
+			wantRun:  true,
+		},
+		{
+			name:     "deadline passed",
+			ctx:      context.Background(),
+			deadline: time.Now().Add(-time.Minute),
+			want:     errBudgetExceeded,
+		},
+		{
+			name: "cancelled",
+			ctx:  cancelled,
+			want: errCancelled,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := false
+			stubBootTest(t, func(ctx context.Context, hostname, newer string) (string, error) {
+				ran = true
+				return "bootlog", tt.result
+			})
+			_, err := testBootWithin(tt.ctx, tt.deadline, "rpi4", "")
+			if !errors.Is(err, tt.want) || (err == nil) != (tt.want == nil) {
+				t.Errorf("testBootWithin = %v, want %v", err, tt.want)
+			}
+			if ran != tt.wantRun {
+				t.Errorf("boot test ran: %v, want %v", ran, tt.wantRun)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/forge"
+)
+
+var cancelPollInterval = flag.Duration("cancel_poll_interval",
+	1*time.Minute,
+	"for pull requests: how often to check whether the PR was closed or -require_label was removed while the boot test is running. If so, the run is cancelled and the bakeries are released. 0 disables the check")
+
+var errCancelled = errors.New("cancelled")
+
+// watchCancellation returns a context which is cancelled (with a cause
+// wrapping errCancelled) once pull request issueNum is closed or loses
+// -require_label. Call the returned function to stop watching.
+func watchCancellation(ctx context.Context, f forge.Forge, issueNum int) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := func() { cancel(nil) }
+	if *cancelPollInterval == 0 {
+		return ctx, stop
+	}
+	go func() {
+		ticker := time.NewTicker(*cancelPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			reason, err := cancellationReason(ctx, f, issueNum)
+			if err != nil {
+				// Transient API errors must not abort the run.
+				log.Printf("checking for cancellation: %v", err)
+				continue
+			}
+			if reason != "" {
+				log.Printf("cancelling boot test: %s", reason)
+				cancel(fmt.Errorf("%w: %s", errCancelled, reason))
+				return
+			}
+		}
+	}()
+	return ctx, stop
+}
+
+// cancellationReason returns why the boot test of pull request issueNum
+// should be cancelled, or the empty string if it should continue.
+func cancellationReason(ctx context.Context, f forge.Forge, issueNum int) (string, error) {
+	open, err := f.IsOpen(ctx, issueNum)
+	if err != nil {
+		return "", err
+	}
+	if !open {
+		return "pull request was closed", nil
+	}
+	if *requireLabel == "" {
+		return "", nil
+	}
+	found, err := forge.HasLabel(ctx, f, issueNum, *requireLabel)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return fmt.Sprintf("label %q was removed", *requireLabel), nil
+	}
+	return "", nil
+}
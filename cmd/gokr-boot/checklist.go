@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/gokrazy/autoupdate/internal/audit"
+	"github.com/gokrazy/autoupdate/internal/forge"
+	"github.com/gokrazy/autoupdate/internal/prmeta"
+)
+
+var checklistItem = flag.String("checklist_item",
+	"",
+	"if non-empty, name of a checklist item in the pull request body (e.g. boot-tested, as generated by gokr-pull-kernel): the PR is only tested while the item is unticked, and the item is ticked once the boot test passed. Alternative to -require_label and -set_label, robust to label renames")
+
+// ensureUnchecked returns an error unless the body of pull request issueNum
+// carries metadata and an unticked checklist item.
+func ensureUnchecked(ctx context.Context, f forge.Forge, issueNum int, item string) error {
+	body, err := f.Body(ctx, issueNum)
+	if err != nil {
+		return err
+	}
+	if _, err := prmeta.Parse(body); err != nil {
+		return fmt.Errorf("issue %d: %v", issueNum, err)
+	}
+	ticked, ok := prmeta.Checklist(body)[item]
+	if !ok {
+		return fmt.Errorf("checklist item %q not found on issue %d", item, issueNum)
+	}
+	if ticked {
+		return fmt.Errorf("checklist item %q already ticked on issue %d", item, issueNum)
+	}
+	return nil
+}
+
+func tickItem(ctx context.Context, f forge.Forge, owner, repo string, issueNum int, item string) error {
+	body, err := f.Body(ctx, issueNum)
+	if err != nil {
+		return err
+	}
+	body, err = prmeta.Tick(body, item)
+	if err != nil {
+		return err
+	}
+	if err := f.SetBody(ctx, issueNum, body); err != nil {
+		return err
+	}
+	audit.Record(owner+"/"+repo, "tick-checklist-item", fmt.Sprintf("#%d %s", issueNum, item))
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/audit"
+	"github.com/gokrazy/autoupdate/internal/forge"
+)
+
+// hostResult is the outcome of testing one bakery host.
+type hostResult struct {
+	host     string
+	err      error
+	duration time.Duration
+}
+
+func (r hostResult) status() string {
+	if errors.Is(r.err, errBudgetExceeded) {
+		return "budget exceeded"
+	}
+	if errors.Is(r.err, errCancelled) {
+		return "cancelled"
+	}
+	if r.err != nil {
+		return "failed"
+	}
+	return "passed"
+}
+
+// createCheckRun reports a completed check on head, the tested commit of the
+// pull request (even if newer commits were pushed in the meantime), with one
+// annotation per tested host, so that the PR Checks tab shows the hardware
+// matrix at a glance.
+func createCheckRun(ctx context.Context, f forge.Forge, owner, repo string, issueNum int, head string, started time.Time, results []hostResult) error {
+	success := true
+	var summary strings.Builder
+	fmt.Fprintf(&summary, "Tested commit: %s\n\n", head)
+	summary.WriteString("| host | result | duration |\n|---|---|---|\n")
+	annotations := make([]forge.Annotation, 0, len(results))
+	for _, r := range results {
+		msg := fmt.Sprintf("%s: %s in %v", r.host, r.status(), r.duration.Round(time.Second))
+		if r.err != nil {
+			success = false
+			msg += ": " + r.err.Error()
+		}
+		fmt.Fprintf(&summary, "| %s | %s | %v |\n", r.host, r.status(), r.duration.Round(time.Second))
+		annotations = append(annotations, forge.Annotation{
+			Title:   r.host,
+			Message: msg,
+			Failure: r.err != nil,
+		})
+	}
+	conclusion := "success"
+	if !success {
+		conclusion = "failure"
+	}
+
+	checkURL, err := f.ReportCheck(ctx, issueNum, forge.Check{
+		Name:        "gokr-boot",
+		Success:     success,
+		StartedAt:   started,
+		Title:       fmt.Sprintf("boot test on %d host(s): %s", len(results), conclusion),
+		Summary:     summary.String(),
+		Annotations: annotations,
+		HeadSHA:     head,
+	})
+	if err != nil {
+		return err
+	}
+	audit.Record(owner+"/"+repo, "create-check-run", checkURL)
+	return nil
+}
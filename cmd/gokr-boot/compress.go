@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var compressImages = flag.Bool("compress_images",
+	false,
+	"compress images with zstd (requires the zstd tool) before uploading them to the bootery, if the bootery announces support via Accept-Encoding: zstd in its /usebakeries reply. Significantly reduces upload time over slow links, at the cost of some CPU time")
+
+// booteryAcceptsZstd is whether the bootery announced support for zstd
+// request bodies in reply to /usebakeries.
+var booteryAcceptsZstd bool
+
+// acceptsZstd reports whether the Accept-Encoding header of a bootery reply
+// lists zstd.
+func acceptsZstd(h http.Header) bool {
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			enc, _, _ = strings.Cut(enc, ";")
+			if strings.EqualFold(strings.TrimSpace(enc), "zstd") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// zstdSuffix marks compressed images, which streamTo uploads with
+// Content-Encoding: zstd.
+const zstdSuffix = ".zst"
+
+// compressImage compresses img into a temporary file (ending in zstdSuffix)
+// and returns its path.
+func compressImage(img string) (string, error) {
+	f, err := os.CreateTemp("", "gokr-boot-*"+zstdSuffix)
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	zstd := exec.Command("zstd", "-q", "-f", "-T0", "-o", f.Name(), img)
+	zstd.Stderr = os.Stderr
+	if err := zstd.Run(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("%v: %v", zstd.Args, err)
+	}
+	if before, after, err := sizes(img, f.Name()); err == nil {
+		log.Printf("compressed %s from %d to %d MiB", img, before>>20, after>>20)
+	}
+	return f.Name(), nil
+}
+
+func sizes(a, b string) (int64, int64, error) {
+	sa, err := os.Stat(a)
+	if err != nil {
+		return 0, 0, err
+	}
+	sb, err := os.Stat(b)
+	if err != nil {
+		return 0, 0, err
+	}
+	return sa.Size(), sb.Size(), nil
+}
+
+// maybeCompressImages returns the images to upload: compressed copies of
+// bootImg and rootImg if -compress_images is set and the bootery supports
+// zstd, or the images themselves otherwise.
+func maybeCompressImages(bootImg, rootImg string) (boot, root string, cleanup func(), _ error) {
+	if !*compressImages || !booteryAcceptsZstd {
+		return bootImg, rootImg, func() {}, nil
+	}
+	boot, err := compressImage(bootImg)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if !*updateRootFlag {
+		return boot, rootImg, func() { os.Remove(boot) }, nil
+	}
+	root, err = compressImage(rootImg)
+	if err != nil {
+		os.Remove(boot)
+		return "", "", nil, err
+	}
+	return boot, root, func() {
+		os.Remove(boot)
+		os.Remove(root)
+	}, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/google/go-github/v35/github"
+)
+
+var deploymentPrefix = flag.String("deployment_environment_prefix",
+	"",
+	"if non-empty, create a GitHub deployment per bakery host in environment <prefix><host> (e.g. hw/ results in hw/rpi4b), with status in_progress while the image is uploaded and booted, and success or failure afterwards. The tests then show up in the deployment history of the repository and can gate required environments. Requires -forge=github")
+
+// deployments tracks the GitHub deployment of each tested host. A nil
+// *deployments (-deployment_environment_prefix unset) does nothing.
+type deployments struct {
+	client      *github.Client
+	owner, repo string
+	ref         string // commit under test
+
+	mu  sync.Mutex
+	ids map[string]int64 // by host, until finished
+}
+
+// deploys is set in main if -deployment_environment_prefix is non-empty.
+var deploys *deployments
+
+// runURL returns the URL of the GitHub Actions workflow run.
+func runURL() string {
+	return os.Getenv("GITHUB_SERVER_URL") + "/" + os.Getenv("GITHUB_REPOSITORY") + "/actions/runs/" + os.Getenv("GITHUB_RUN_ID")
+}
+
+// start creates a deployment of d.ref to the environment of host and marks
+// it in_progress. Errors are only logged, as deployments merely mirror the
+// test results.
+func (d *deployments) start(ctx context.Context, host string) {
+	if d == nil {
+		return
+	}
+	env := *deploymentPrefix + host
+	deployment, _, err := d.client.Repositories.CreateDeployment(ctx, d.owner, d.repo, &github.DeploymentRequest{
+		Ref:              github.String(d.ref),
+		Task:             github.String("boot-test"),
+		AutoMerge:        github.Bool(false),
+		RequiredContexts: &[]string{}, // the boot test itself is a check
+		Environment:      github.String(env),
+		Description:      github.String("gokr-boot hardware test on " + host),
+	})
+	if err != nil {
+		log.Printf("creating deployment to %s: %v", env, err)
+		return
+	}
+	d.mu.Lock()
+	d.ids[host] = deployment.GetID()
+	d.mu.Unlock()
+	d.setStatus(ctx, host, deployment.GetID(), "in_progress")
+}
+
+// finish sets the final status of the deployment of host, if any.
+func (d *deployments) finish(ctx context.Context, host string, err error) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	id, ok := d.ids[host]
+	delete(d.ids, host)
+	d.mu.Unlock()
+	if !ok {
+		return
+	}
+	state := "success"
+	switch {
+	case errors.Is(err, errCancelled), errors.Is(err, errBudgetExceeded):
+		state = "error"
+	case err != nil:
+		state = "failure"
+	}
+	d.setStatus(ctx, host, id, state)
+}
+
+func (d *deployments) setStatus(ctx context.Context, host string, id int64, state string) {
+	_, _, err := d.client.Repositories.CreateDeploymentStatus(ctx, d.owner, d.repo, id, &github.DeploymentStatusRequest{
+		State:        github.String(state),
+		LogURL:       github.String(runURL()),
+		Description:  github.String("boot test " + state),
+		AutoInactive: github.Bool(state == "success"),
+	})
+	if err != nil {
+		log.Printf("setting deployment status of %s to %s: %v", host, state, err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/internal/config"
+)
+
+// directTarget is a gokrazy device which is updated directly via the gokrazy
+// update protocol, without a bootery.
+type directTarget struct {
+	baseURL  string // e.g. http://10.0.0.76
+	password string
+}
+
+func newDirectTarget(addr string) (*directTarget, error) {
+	cfg, err := config.ApplyInstanceFlag()
+	if err != nil {
+		return nil, err
+	}
+	update, err := cfg.Update.WithFallbackToHostSpecific(cfg.Hostname)
+	if err != nil {
+		return nil, err
+	}
+	if update.HTTPPassword == "" {
+		return nil, fmt.Errorf("instance %s has no HTTP password configured, cannot update %s", cfg.Hostname, addr)
+	}
+	port := update.HTTPPort
+	if port == "" {
+		port = "80"
+	}
+	return &directTarget{
+		baseURL:  "http://" + net.JoinHostPort(addr, port),
+		password: update.HTTPPassword,
+	}, nil
+}
+
+// directClient is used for requests to -direct_host devices, so that a
+// device which stops responding does not block CI forever. The timeout
+// leaves enough time to upload an image.
+var directClient = &http.Client{Timeout: 10 * time.Minute}
+
+// directStatusTimeout is the timeout of requests without an image, e.g. the
+// status requests of awaitReboot, which are repeated anyway.
+const directStatusTimeout = 10 * time.Second
+
+func (d *directTarget) do(method, path, img string) (string, error) {
+	ctx := context.Background()
+	var body io.Reader
+	if img != "" {
+		f, err := os.Open(img)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		body = f
+	} else {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, directStatusTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, d.baseURL+path, body)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth("gokrazy", d.password)
+	req.Header.Set("Accept", "application/json")
+	resp, err := directClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("%s %s: unexpected HTTP status code: got %d (%s), want %d", method, path, got, strings.TrimSpace(string(b)), want)
+	}
+	return string(b), nil
+}
+
+// awaitReboot waits until the device went down and came back up.
+func (d *directTarget) awaitReboot(timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	wentDown := false
+	for time.Now().Before(deadline) {
+		status, err := d.do(http.MethodGet, "/", "")
+		if err != nil {
+			wentDown = true
+		} else if wentDown {
+			return status, nil
+		}
+		time.Sleep(1 * time.Second)
+	}
+	return "", fmt.Errorf("device %s did not come back within %v", d.baseURL, timeout)
+}
+
+// boot pushes the root and boot images to the device, switches to the new
+// partitions, reboots and waits for the device to come back. The returned log
+// records each step along with the device status after the reboot.
+func (d *directTarget) boot(bootImg, rootImg string, updateRoot bool) (string, error) {
+	var bootlog strings.Builder
+	step := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		log.Print(msg)
+		fmt.Fprintf(&bootlog, "%s %s\n", time.Now().Format(time.RFC3339), msg)
+	}
+	if updateRoot {
+		step("updating root file system")
+		if _, err := d.do(http.MethodPut, "/update/root", rootImg); err != nil {
+			return "", err
+		}
+	}
+	step("updating boot file system")
+	if _, err := d.do(http.MethodPut, "/update/boot", bootImg); err != nil {
+		return "", err
+	}
+	// Only the root file system is A/B partitioned: without a new root
+	// image, switching would boot the stale inactive partition.
+	if updateRoot {
+		step("switching to the new partition")
+		if _, err := d.do(http.MethodPost, "/update/switch", ""); err != nil {
+			return "", err
+		}
+	}
+	step("rebooting")
+	if _, err := d.do(http.MethodPost, "/reboot", ""); err != nil {
+		return "", err
+	}
+	status, err := d.awaitReboot(rebootDeadline())
+	if err != nil {
+		return "", err
+	}
+	step("device is back up")
+	bootlog.WriteString("\nstatus after reboot:\n")
+	bootlog.WriteString(status)
+	return bootlog.String(), nil
+}
+
+// fallback switches the device back to its previous system partition (which
+// gokrazy alternates between on every update) and reboots it.
+func (d *directTarget) fallback() (string, error) {
+	if _, err := d.do(http.MethodPost, "/update/switch", ""); err != nil {
+		return "", err
+	}
+	if _, err := d.do(http.MethodPost, "/reboot", ""); err != nil {
+		return "", err
+	}
+	return d.awaitReboot(rebootDeadline())
+}
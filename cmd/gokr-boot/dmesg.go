@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var dmesgDiff = flag.Bool("dmesg_diff",
+	false,
+	"fetch the kernel log of the previous (known-good) and the new boot from the bootery (not supported with -direct_host) and include new warnings/errors and missing driver messages in the PR comment")
+
+// fetchDmesg returns the kernel log of the current or previous boot of
+// hostname from the bootery's /dmesg endpoint.
+func fetchDmesg(ctx context.Context, booteryURL, hostname, boot string) (string, error) {
+	ctx, cancel := booteryContext(ctx)
+	defer cancel()
+	u, err := url.Parse(booteryURL)
+	if err != nil {
+		return "", err
+	}
+	v := u.Query()
+	v.Set("hostname", hostname)
+	v.Set("boot", boot)
+	u.RawQuery = v.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := booteryClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("unexpected HTTP status code: got %d (%s), want %d", got, strings.TrimSpace(string(b)), want)
+	}
+	return string(b), nil
+}
+
+var (
+	dmesgTimestampRe = regexp.MustCompile(`^\[\s*[0-9.]+\]\s*`)
+	// Addresses and numbers differ between boots (and kernel versions)
+	// without being meaningful.
+	dmesgNumberRe = regexp.MustCompile(`\b(0x[0-9a-fA-F]+|[0-9a-fA-F]{8,}|[0-9]+)\b`)
+
+	dmesgProblemRe = regexp.MustCompile(`(?i)\b(warn(ing)?|err(or)?|fail(ed|ure)?|bug|oops|call trace|timed out)\b`)
+	dmesgDriverRe  = regexp.MustCompile(`(?i)\b(driver|registered|probed?|initiali[sz]ed|detected|found)\b`)
+)
+
+// normalizeDmesg returns the set of lines of a kernel log, with timestamps
+// removed and numbers replaced by N.
+func normalizeDmesg(dmesg string) (lines []string, set map[string]bool) {
+	set = make(map[string]bool)
+	for _, line := range strings.Split(dmesg, "\n") {
+		line = dmesgTimestampRe.ReplaceAllString(strings.TrimSpace(line), "")
+		line = dmesgNumberRe.ReplaceAllString(line, "N")
+		if line == "" || set[line] {
+			continue
+		}
+		set[line] = true
+		lines = append(lines, line)
+	}
+	return lines, set
+}
+
+// diffDmesg returns the warning/error lines which only occur in the new
+// kernel log, and the driver lines which only occur in the old one.
+func diffDmesg(old, new string) (problems, missing []string) {
+	oldLines, oldSet := normalizeDmesg(old)
+	newLines, newSet := normalizeDmesg(new)
+	for _, line := range newLines {
+		if !oldSet[line] && dmesgProblemRe.MatchString(line) {
+			problems = append(problems, line)
+		}
+	}
+	for _, line := range oldLines {
+		if !newSet[line] && dmesgDriverRe.MatchString(line) {
+			missing = append(missing, line)
+		}
+	}
+	return problems, missing
+}
+
+// dmesgReport returns a collapsible Markdown section for the PR comment
+// describing the kernel log differences on hostname.
+func dmesgReport(ctx context.Context, booteryURL, hostname string) (string, error) {
+	old, err := fetchDmesg(ctx, booteryURL, hostname, "previous")
+	if err != nil {
+		return "", fmt.Errorf("fetching previous dmesg: %v", err)
+	}
+	new, err := fetchDmesg(ctx, booteryURL, hostname, "current")
+	if err != nil {
+		return "", fmt.Errorf("fetching current dmesg: %v", err)
+	}
+	problems, missing := diffDmesg(old, new)
+	if len(problems) == 0 && len(missing) == 0 {
+		return fmt.Sprintf("dmesg of %s: no new warnings or errors, no missing driver messages", hostname), nil
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "<details><summary>dmesg of %s: %d new warning/error line(s), %d missing driver line(s)</summary>\n\n```diff\n", hostname, len(problems), len(missing))
+	for _, line := range problems {
+		fmt.Fprintf(&b, "+ %s\n", line)
+	}
+	for _, line := range missing {
+		fmt.Fprintf(&b, "- %s\n", line)
+	}
+	b.WriteString("```\n</details>\n")
+	return b.String(), nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+)
+
+var (
+	dryRun = flag.Bool("dry_run",
+		false,
+		"build the images for each host (see -dry_run_hosts) and print what would be uploaded to the bootery and which labels, comments and checks would be set, without contacting the bootery or the forge. Forge credentials are not required")
+
+	dryRunHosts = flag.String("dry_run_hosts",
+		"",
+		"comma-separated list of hostnames to build images for with -dry_run, standing in for the bakery hosts which the bootery would return. Defaults to the hostname of the instance config")
+)
+
+func imageSize(fn string) string {
+	st, err := os.Stat(fn)
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("%d MiB", st.Size()>>20)
+}
+
+// dryRunHost builds the images of hostname and prints how they would be
+// tested.
+func dryRunHost(hostname string) error {
+	instance, _ := hostInstance(hostname)
+	if *fullDisk {
+		img, cleanup, err := buildDisk(instance, hostname)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		testdiskURL, err := withHostParams(strings.TrimSuffix(*booteryURL, "/testboot")+"/testdisk", hostname)
+		if err != nil {
+			return err
+		}
+		log.Printf("dry run: would boot-test %s: upload the full disk image (%s) to %s", hostname, imageSize(img), testdiskURL)
+		return nil
+	}
+	bootImg, rootImg, cleanup, err := builder.build(instance, hostname)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if *directHost != "" {
+		log.Printf("dry run: would update %s directly (boot image: %s, root image: %s)", *directHost, imageSize(bootImg), imageSize(rootImg))
+		return nil
+	}
+	if *updateRootFlag {
+		log.Printf("dry run: would upload the root image (%s) of %s to %s/updateroot", imageSize(rootImg), hostname, strings.TrimSuffix(*booteryURL, "/testboot"))
+	}
+	testbootURL, err := withHostParams(strings.TrimSuffix(*booteryURL, "/testboot")+"/testboot1"+fmt.Sprintf("?update_root=%v", *updateRootFlag), hostname)
+	if err != nil {
+		return err
+	}
+	log.Printf("dry run: would boot-test %s: upload the boot image (%s) to %s", hostname, imageSize(bootImg), testbootURL)
+	if *compressImages {
+		log.Printf("dry run: would zstd-compress the images if the bootery accepts zstd")
+	}
+	return nil
+}
+
+// runDryRun implements -dry_run. issueNum is the pull request (or
+// -report_issue) which would be commented on, or zero.
+func runDryRun(isPullRequest bool, issueNum int) error {
+	var hosts []string
+	if *dryRunHosts != "" {
+		hosts = strings.Split(*dryRunHosts, ",")
+	} else {
+		cfg, err := config.ApplyInstanceFlag()
+		if err != nil {
+			return err
+		}
+		hosts = []string{cfg.Hostname}
+	}
+	// Assume the bootery supports all features, so that e.g.
+	// -host_params are shown.
+	for _, f := range booteryFeatures {
+		negotiatedFeatures[f] = true
+	}
+
+	for _, host := range hosts {
+		if _, ok := hostInstance(host); !ok {
+			log.Printf("dry run: -instances: would skip host %s (no matching pattern)", host)
+			continue
+		}
+		if err := dryRunHost(host); err != nil {
+			return fmt.Errorf("%s: %v", host, err)
+		}
+		if *deploymentPrefix != "" {
+			log.Printf("dry run: would report a deployment to environment %s%s", *deploymentPrefix, host)
+		}
+	}
+
+	if *redundancyVoting {
+		log.Printf("dry run: -redundancy_voting: would repeat failed tests on an identical device, if the bootery reports device models")
+	}
+
+	if issueNum != 0 && *summaryCommentFlag {
+		log.Printf("dry run: would post (or update) a summary comment on #%d with the results (log sinks: %s)", issueNum, *logSinkFlag)
+	} else if issueNum != 0 {
+		log.Printf("dry run: would comment on #%d with the results (log sinks: %s)", issueNum, *logSinkFlag)
+	}
+	if *notifyURL != "" {
+		log.Printf("dry run: would post %s events to -notify_url (format %s)", *notifyEvents, *notifyFormat)
+	}
+	if !isPullRequest {
+		return nil
+	}
+	log.Printf("dry run: would record the image content hashes in a comment on #%d", issueNum)
+	if !*force {
+		log.Printf("dry run: would skip hosts whose images already passed the boot test in an earlier run for #%d", issueNum)
+	}
+	if *checkRun {
+		log.Printf("dry run: would create a gokr-boot check run")
+	}
+	if *setLabel != "" {
+		log.Printf("dry run: would add label %q", *setLabel)
+	}
+	if *requireLabel != "" {
+		log.Printf("dry run: would remove label %q", *requireLabel)
+	}
+	if *checklistItem != "" {
+		log.Printf("dry run: would tick checklist item %q", *checklistItem)
+	}
+	return nil
+}
+
+// dryRunIssue returns the issue which runDryRun reports on, without
+// contacting the forge.
+func dryRunIssue(isPullRequest bool) (int, error) {
+	if !isPullRequest {
+		return *reportIssue, nil
+	}
+	i, err := strconv.ParseInt(travisPullRequest, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse pull request %q as number: %v", travisPullRequest, err)
+	}
+	return int(i), nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var eepromImage = flag.String("eeprom_image",
+	"",
+	"if non-empty, path to a candidate Raspberry Pi EEPROM image (pieeprom.bin) to test instead of booting gokrazy images: the bootery flashes it onto the (sacrificial) bakery hosts, the bootloader version reported by vcgencmd after the reboot is verified and the previous EEPROM is restored on failure")
+
+// eepromRequest sends a request to the bootery's /eeprom/<action> endpoint
+// for hostname and returns the reply body.
+func eepromRequest(ctx context.Context, method, action, hostname string, body []byte) (string, error) {
+	ctx, cancel := booteryContext(ctx)
+	defer cancel()
+	u, err := url.Parse(strings.TrimSuffix(*booteryURL, "/testboot") + "/eeprom/" + action)
+	if err != nil {
+		return "", err
+	}
+	v := u.Query()
+	v.Set("hostname", hostname)
+	u.RawQuery = v.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	resp, err := booteryClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("%s: unexpected HTTP status code: got %d (%s), want %d", action, got, strings.TrimSpace(string(b)), want)
+	}
+	return string(b), nil
+}
+
+var (
+	buildTimestampRe      = regexp.MustCompile(`BUILD_TIMESTAMP=([0-9]+)`)
+	bootloaderTimestampRe = regexp.MustCompile(`(?m)^timestamp ([0-9]+)`)
+)
+
+// bootloaderTimestamp extracts the timestamp line of vcgencmd
+// bootloader_version output.
+func bootloaderTimestamp(version string) (string, error) {
+	matches := bootloaderTimestampRe.FindStringSubmatch(version)
+	if matches == nil {
+		return "", fmt.Errorf("no timestamp found in bootloader version %q", version)
+	}
+	return matches[1], nil
+}
+
+// testEEPROM flashes -eeprom_image onto hostname via the bootery and verifies
+// that the bootloader runs the new version after the reboot. On failure, the
+// bootery is asked to restore the previous EEPROM.
+func testEEPROM(ctx context.Context, hostname string) (_ string, err error) {
+	img, err := os.ReadFile(*eepromImage)
+	if err != nil {
+		return "", err
+	}
+	// The expected version is only known if the image embeds its build
+	// timestamp. Otherwise, the version must merely change.
+	var want string
+	if matches := buildTimestampRe.FindSubmatch(img); matches != nil {
+		want = string(matches[1])
+	}
+
+	before, err := eepromRequest(ctx, http.MethodGet, "version", hostname, nil)
+	if err != nil {
+		return "", err
+	}
+	beforeTimestamp, err := bootloaderTimestamp(before)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		log.Printf("EEPROM test on %s failed, restoring the previous EEPROM", hostname)
+		if _, rerr := eepromRequest(context.WithoutCancel(ctx), http.MethodPut, "restore", hostname, nil); rerr != nil {
+			err = errors.Join(err, fmt.Errorf("restoring previous EEPROM: %v", rerr))
+		}
+	}()
+
+	log.Printf("flashing %s onto %s", *eepromImage, hostname)
+	flashlog, err := eepromRequest(ctx, http.MethodPut, "flash", hostname, img)
+	if err != nil {
+		return "", err
+	}
+	after, err := eepromRequest(ctx, http.MethodGet, "version", hostname, nil)
+	if err != nil {
+		return "", err
+	}
+	afterTimestamp, err := bootloaderTimestamp(after)
+	if err != nil {
+		return "", err
+	}
+	bootlog := "=== bootloader version before ===\n" + before +
+		"\n=== flash ===\n" + flashlog +
+		"\n=== bootloader version after ===\n" + after
+	if want != "" && afterTimestamp != want {
+		return "", fmt.Errorf("%s: bootloader timestamp after flashing: got %s, want %s", hostname, afterTimestamp, want)
+	}
+	if want == "" && afterTimestamp == beforeTimestamp {
+		return "", fmt.Errorf("%s: bootloader timestamp unchanged (%s) after flashing", hostname, afterTimestamp)
+	}
+	return bootlog, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+var (
+	fullDisk = flag.Bool("full_disk",
+		false,
+		"test full disk images (gok overwrite --full) instead of separate boot/root images, e.g. for x86 targets booting via EFI or MBR: the bootery writes the image onto the whole disk of the bakery host via its /testdisk endpoint. Requires -image_builder=gok, or -disk_image")
+
+	fullDiskBytes = flag.Int64("full_disk_bytes",
+		2<<30,
+		"size in bytes of the -full_disk image (gok --target_storage_bytes). Must not exceed the disk size of the bakery hosts")
+
+	diskImage = flag.String("disk_image",
+		"",
+		"for -full_disk: path of a prebuilt full disk image to test instead of building one with gok. The same image is tested on every host, so it must not depend on the hostname")
+)
+
+// checkFullDisk validates the flags which are incompatible with -full_disk.
+func checkFullDisk() error {
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"-direct_host", *directHost != ""},
+		{"-eeprom_image", *eepromImage != ""},
+		{"-update_root", *updateRootFlag},
+		{"-test_fallback", *testFallback},
+		{"-size_store", *sizeStore != ""},
+		{"-sbom", *sbomFlag},
+	} {
+		if f.set {
+			return fmt.Errorf("-full_disk cannot be combined with %s", f.name)
+		}
+	}
+	if *diskImage == "" && *imageBuilderFlag != "gok" {
+		return fmt.Errorf("-full_disk requires -image_builder=gok (or -disk_image)")
+	}
+	if *fullDiskBytes <= 0 {
+		return fmt.Errorf("invalid -full_disk_bytes value %d: must be positive", *fullDiskBytes)
+	}
+	return nil
+}
+
+// buildDisk returns the path of the full disk image for hostname (built
+// from instance). The returned function removes any temporary files and
+// must be called once the image is no longer needed.
+func buildDisk(instance, hostname string) (string, func(), error) {
+	if *diskImage != "" {
+		if _, err := os.Stat(*diskImage); err != nil {
+			return "", nil, err
+		}
+		return *diskImage, func() {}, nil
+	}
+	b := builder.(*gokBuilder)
+	f, err := ioutil.TempFile("", "gokr-disk")
+	if err != nil {
+		return "", nil, err
+	}
+	f.Close()
+	b.mu.Lock()
+	err = writeDisk(instance, hostname, f.Name())
+	b.mu.Unlock()
+	if err != nil {
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+	return f.Name(), func() { os.Remove(f.Name()) }, nil
+}
+
+func writeDisk(instance, hostname, disk string) error {
+	log.Printf("writeDisk(%s, %s)", instance, hostname)
+	if err := injectHostname(instance, hostname); err != nil {
+		return err
+	}
+	return gokOverwrite(instance,
+		"--full="+disk,
+		fmt.Sprintf("--target_storage_bytes=%d", *fullDiskBytes))
+}
+
+// testDisk writes a full disk image onto hostname via the bootery's
+// /testdisk endpoint and returns the boot log.
+func testDisk(ctx context.Context, hostname, newer string) (string, error) {
+	instance, _ := hostInstance(hostname)
+	img, cleanup, err := buildDisk(instance, hostname)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	if err := keepImages(ctx, hostname, map[string]string{
+		"disk.img": img,
+	}); err != nil {
+		return "", err
+	}
+
+	deploys.start(ctx, hostname)
+
+	if *compressImages && booteryAcceptsZstd {
+		compressed, err := compressImage(img)
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(compressed)
+		img = compressed
+	}
+
+	log.Printf("testing full disk image")
+	testdiskURL, err := withHostParams(strings.TrimSuffix(*booteryURL, "/testboot")+"/testdisk", hostname)
+	if err != nil {
+		return "", err
+	}
+	bootlog, err := withRetries(ctx, "disk boot test", hostname, func() (string, error) {
+		return streamTo(ctx, img, testdiskURL, hostname, newer)
+	})
+	if err != nil {
+		return "", errors.New(strings.Replace(err.Error(), *booteryURL, "<bootery_url>", -1))
+	}
+
+	if *telemetryMode != "" {
+		summary, err := checkTelemetry(ctx, strings.TrimSuffix(*booteryURL, "/testboot")+"/telemetry", hostname)
+		if err != nil {
+			return "", errors.New(strings.Replace(err.Error(), *booteryURL, "<bootery_url>", -1))
+		}
+		log.Print(summary)
+		bootlog += "\n\n" + summary + "\n"
+	}
+	return bootlog, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var hostParamsPath = flag.String("host_params",
+	"",
+	"if non-empty, path of a JSON file with per-host parameters (environment variables and feature flags, e.g. the expected console device or peripherals to probe) which are passed to the bootery with each boot test. Only booteries which announce the params feature receive them")
+
+// Optional features of the bootery protocol. gokr-boot sends the features
+// it supports as a comma-separated list in the featuresHeader of the
+// /usebakeries request, and booteries reply with those they support, too.
+// Booteries can thus implement each feature independently. Old booteries do
+// not reply with the header, i.e. support none of them.
+const (
+	// featureParams adds the params query parameter to /testboot1 (and
+	// /testdisk) requests, a JSON encoded hostParams object.
+	featureParams = "params"
+
+	// featureUpload adds chunked uploads to /upload (see uploadChunked):
+	// /testboot1 and /updateroot requests then have no body, but refer to
+	// the uploaded image with the upload query parameter.
+	featureUpload = "upload"
+
+	// featureModels adds the models field to the /usebakeries reply,
+	// mapping hosts to their device model (see -redundancy_voting).
+	featureModels = "models"
+
+	// featureDeadline adds the deadline query parameter to /testboot1 and
+	// /testdisk requests, the time in seconds the bootery waits for the
+	// host to boot (see -boot_deadline).
+	featureDeadline = "deadline"
+)
+
+// booteryFeatures are the features gokr-boot supports.
+var booteryFeatures = []string{featureParams, featureUpload, featureModels, featureDeadline}
+
+const featuresHeader = "X-Bootery-Features"
+
+// negotiatedFeatures are the features of booteryFeatures which the bootery
+// announced in reply to /usebakeries.
+var negotiatedFeatures = make(map[string]bool)
+
+// supports reports whether the bootery supports feature.
+func supports(feature string) bool {
+	return negotiatedFeatures[feature]
+}
+
+// hostParams are passed to the bootery for one host.
+type hostParams struct {
+	// Env are environment variables, e.g. {"CONSOLE": "ttyAMA0"}.
+	Env map[string]string `json:"env,omitempty"`
+
+	// Features are feature flags, e.g. ["probe-usb", "probe-hdmi"].
+	Features []string `json:"features,omitempty"`
+}
+
+// hostParamsConfig is the content of the -host_params file, e.g.:
+//
+//	{
+//	  "rules": [
+//	    {"hosts": ["*"], "env": {"BOOT_TIMEOUT": "90s"}},
+//	    {"hosts": ["rpi5-*"], "env": {"CONSOLE": "ttyAMA10"}, "features": ["probe-pcie"]},
+//	    {"hosts": ["cm4-nvme"], "boot_deadline": "5m"}
+//	  ]
+//	}
+//
+// All rules matching a host apply, in order: later rules override
+// environment variables and the boot deadline of earlier rules, and
+// features accumulate.
+type hostParamsConfig struct {
+	Rules []struct {
+		// Hosts are path.Match patterns matched against the hostname.
+		Hosts []string `json:"hosts"`
+
+		// BootDeadline, if non-empty, overrides -boot_deadline (e.g. 5m).
+		// It is passed separately, not as part of hostParams.
+		BootDeadline string `json:"boot_deadline,omitempty"`
+
+		hostParams
+	} `json:"rules"`
+}
+
+// hostParamsFile is the parsed -host_params file, if any.
+var hostParamsFile *hostParamsConfig
+
+func readHostParams(fn string) (*hostParamsConfig, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var c hostParamsConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	for _, r := range c.Rules {
+		for _, pattern := range r.Hosts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: invalid hosts pattern %q: %v", fn, pattern, err)
+			}
+		}
+		if r.BootDeadline != "" {
+			if _, err := time.ParseDuration(r.BootDeadline); err != nil {
+				return nil, fmt.Errorf("%s: invalid boot_deadline %q: %v", fn, r.BootDeadline, err)
+			}
+		}
+	}
+	return &c, nil
+}
+
+// paramsFor returns the parameters of hostname, and whether any rule
+// matched.
+func (c *hostParamsConfig) paramsFor(hostname string) (hostParams, bool) {
+	var (
+		p        hostParams
+		matched  bool
+		features = make(map[string]bool)
+	)
+	for _, r := range c.Rules {
+		if !matchesAny(r.Hosts, hostname) {
+			continue
+		}
+		matched = true
+		for k, v := range r.Env {
+			if p.Env == nil {
+				p.Env = make(map[string]string)
+			}
+			p.Env[k] = v
+		}
+		for _, f := range r.Features {
+			if !features[f] {
+				features[f] = true
+				p.Features = append(p.Features, f)
+			}
+		}
+	}
+	sort.Strings(p.Features)
+	return p, matched
+}
+
+// parseFeatures returns the features of booteryFeatures announced in the
+// value of the featuresHeader of a bootery reply. Features which gokr-boot
+// does not know are ignored.
+func parseFeatures(header string) map[string]bool {
+	features := make(map[string]bool)
+	for _, f := range strings.Split(header, ",") {
+		f = strings.TrimSpace(f)
+		for _, known := range booteryFeatures {
+			if strings.EqualFold(f, known) {
+				features[known] = true
+			}
+		}
+	}
+	return features
+}
+
+// withHostParams returns the /testboot1 (or /testdisk) URL u with the
+// parameters and the boot deadline of hostname added, if any and if the
+// bootery supports them.
+func withHostParams(u, hostname string) (string, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	v := parsed.Query()
+	addBootDeadline(v, hostname)
+	if hostParamsFile != nil {
+		if p, ok := hostParamsFile.paramsFor(hostname); ok {
+			if !supports(featureParams) {
+				log.Printf("bootery does not support the %s feature, not passing -host_params to %s", featureParams, hostname)
+			} else {
+				b, err := json.Marshal(p)
+				if err != nil {
+					return "", err
+				}
+				v.Set("params", string(b))
+			}
+		}
+	}
+	parsed.RawQuery = v.Encode()
+	return parsed.String(), nil
+}
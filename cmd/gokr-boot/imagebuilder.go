@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/google/renameio/v2"
+)
+
+var (
+	imageBuilderFlag = flag.String("image_builder",
+		"gok",
+		"how to obtain the boot/root images: gok (gok overwrite, with the bakery hostname injected into the instance config), prebuilt (the -boot_image and -root_image files, e.g. built by an earlier CI step) or remote (downloaded from -builder_url)")
+
+	bootImage = flag.String("boot_image",
+		"",
+		"for -image_builder=prebuilt: path of the boot image to test")
+
+	rootImage = flag.String("root_image",
+		"",
+		"for -image_builder=prebuilt: path of the root image to test")
+
+	builderURL = flag.String("builder_url",
+		"",
+		"for -image_builder=remote: URL from which the images are downloaded via GET, with query parameters hostname, instance and part (boot or root)")
+)
+
+// An imageBuilder produces the boot and root images to test on a bakery.
+type imageBuilder interface {
+	// build returns the paths of the boot and root images for hostname
+	// (built from instance). The returned function removes any temporary
+	// files and must be called once the images are no longer needed.
+	build(instance, hostname string) (boot string, root string, cleanup func(), _ error)
+}
+
+// builder is set in main according to -image_builder.
+var builder imageBuilder
+
+// newImageBuilder returns the imageBuilder selected by -image_builder.
+func newImageBuilder() (imageBuilder, error) {
+	switch *imageBuilderFlag {
+	case "gok":
+		return &gokBuilder{}, nil
+	case "prebuilt":
+		if *bootImage == "" || *rootImage == "" {
+			return nil, fmt.Errorf("-image_builder=prebuilt requires -boot_image and -root_image")
+		}
+		return &prebuiltBuilder{boot: *bootImage, root: *rootImage}, nil
+	case "remote":
+		if *builderURL == "" {
+			return nil, fmt.Errorf("-image_builder=remote requires -builder_url")
+		}
+		return &remoteBuilder{url: *builderURL}, nil
+	default:
+		return nil, fmt.Errorf("unknown -image_builder %q: expected one of gok, prebuilt or remote", *imageBuilderFlag)
+	}
+}
+
+func tempImages() (boot string, root string, cleanup func(), _ error) {
+	bootf, err := ioutil.TempFile("", "gokr-boot")
+	if err != nil {
+		return "", "", nil, err
+	}
+	bootf.Close()
+	rootf, err := ioutil.TempFile("", "gokr-root")
+	if err != nil {
+		os.Remove(bootf.Name())
+		return "", "", nil, err
+	}
+	rootf.Close()
+	return bootf.Name(), rootf.Name(), func() {
+		os.Remove(bootf.Name())
+		os.Remove(rootf.Name())
+	}, nil
+}
+
+// gokBuilder builds the images with gok overwrite.
+type gokBuilder struct {
+	// mu serializes builds (see -parallel), as the hostname is injected
+	// into the shared instance config.
+	mu sync.Mutex
+}
+
+func (b *gokBuilder) build(instance, hostname string) (boot string, root string, cleanup func(), _ error) {
+	boot, root, cleanup, err := tempImages()
+	if err != nil {
+		return "", "", nil, err
+	}
+	b.mu.Lock()
+	err = writeImages(instance, hostname, boot, root)
+	b.mu.Unlock()
+	if err != nil {
+		cleanup()
+		return "", "", nil, err
+	}
+	return boot, root, cleanup, nil
+}
+
+func writeImages(instance, hostname, boot, root string) error {
+	log.Printf("writeImages(%s, %s)", instance, hostname)
+	if err := injectHostname(instance, hostname); err != nil {
+		return err
+	}
+	return gokOverwrite(instance,
+		"--boot="+boot,
+		"--root="+root)
+}
+
+// injectHostname sets the hostname in the config of instance.
+func injectHostname(instance, hostname string) error {
+	cfg, err := readInstanceConfig(instance)
+	if err != nil {
+		return err
+	}
+	cfg.Hostname = hostname
+	b, err := cfg.FormatForFile()
+	if err != nil {
+		return err
+	}
+	return renameio.WriteFile(instanceConfigPath(instance), b, 0644)
+}
+
+// gokOverwrite runs gok overwrite for instance with args.
+func gokOverwrite(instance string, args ...string) error {
+	args = append(append([]string{"overwrite"}, gokInstanceArgs(instance)...), args...)
+	cmd := exec.Command("gok", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// prebuiltBuilder uses images which were built elsewhere. The same images
+// are tested on every host, so they must not depend on the hostname.
+type prebuiltBuilder struct {
+	boot, root string
+}
+
+func (b *prebuiltBuilder) build(instance, hostname string) (boot string, root string, cleanup func(), _ error) {
+	for _, fn := range []string{b.boot, b.root} {
+		if _, err := os.Stat(fn); err != nil {
+			return "", "", nil, err
+		}
+	}
+	return b.boot, b.root, func() {}, nil
+}
+
+// remoteBuilder downloads the images from a build service.
+type remoteBuilder struct {
+	url string
+}
+
+func (b *remoteBuilder) build(instance, hostname string) (boot string, root string, cleanup func(), _ error) {
+	boot, root, cleanup, err := tempImages()
+	if err != nil {
+		return "", "", nil, err
+	}
+	for _, part := range []struct {
+		name string
+		dest string
+	}{
+		{"boot", boot},
+		{"root", root},
+	} {
+		if err := b.fetch(instance, hostname, part.name, part.dest); err != nil {
+			cleanup()
+			return "", "", nil, err
+		}
+	}
+	return boot, root, cleanup, nil
+}
+
+func (b *remoteBuilder) fetch(instance, hostname, part, dest string) error {
+	u, err := url.Parse(b.url)
+	if err != nil {
+		return err
+	}
+	v := u.Query()
+	v.Set("hostname", hostname)
+	if instance != "" {
+		v.Set("instance", instance)
+	}
+	v.Set("part", part)
+	u.RawQuery = v.Encode()
+	log.Printf("downloading %s image from %s", part, u)
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s image: unexpected HTTP status code: got %d (%s), want %d", part, got, strings.TrimSpace(string(b)), want)
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gokrazy/autoupdate/internal/audit"
+	"github.com/gokrazy/autoupdate/internal/forge"
+)
+
+var force = flag.Bool("force",
+	false,
+	"boot-test all hosts of a pull request, even those whose images (boot image and, with -update_root, root image) are identical to images which already passed the boot test on the same host in an earlier run, e.g. after a re-push which did not change the image content. The content hashes of tested images are recorded in a comment of the automation user on the pull request. Note that images are only identical if the image build is reproducible")
+
+var (
+	// testedImages are the content hashes of the images which passed the
+	// boot test in earlier runs for the pull request, keyed by host. nil
+	// outside of pull requests.
+	testedImages map[string]string
+
+	imageHashesMu sync.Mutex
+	// imageHashes are the content hashes of the images built in this run,
+	// keyed by host.
+	imageHashes = make(map[string]string)
+)
+
+// imageHash returns the content hash of the images uploaded for a boot
+// test: the boot image and, with -update_root, the root image.
+func imageHash(bootImg, rootImg string) (string, error) {
+	h := sha256.New()
+	files := []string{bootImg}
+	if *updateRootFlag {
+		files = append(files, rootImg)
+	}
+	for _, fn := range files {
+		f, err := os.Open(fn)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// alreadyTested returns a note for the boot log if the images of hostname
+// already passed the boot test on hostname in an earlier run, or the empty
+// string if they need to be tested.
+func alreadyTested(hostname, bootImg, rootImg string) (string, error) {
+	if testedImages == nil {
+		return "", nil
+	}
+	hash, err := imageHash(bootImg, rootImg)
+	if err != nil {
+		return "", err
+	}
+	imageHashesMu.Lock()
+	imageHashes[hostname] = hash
+	imageHashesMu.Unlock()
+	if *force || testedImages[hostname] != hash {
+		return "", nil
+	}
+	note := fmt.Sprintf("%s: images %s already passed the boot test in an earlier run, skipping the upload (see -force)", hostname, hash)
+	log.Print(note)
+	return note + "\n", nil
+}
+
+// testedImagesMarker identifies the comment in which the content hashes of
+// tested images are recorded. Only comments of the automation user are
+// considered (see forge.Forge.BotComment): a hash in the pull request body,
+// which its author can edit, would allow skipping the boot test.
+const testedImagesMarker = "<!-- gokr-boot tested-images -->"
+
+var testedImageRe = regexp.MustCompile("(?m)^- `([^`]+)`: `(sha256:[0-9a-f]+)`$")
+
+// loadTestedImages reads the content hashes of the images which passed the
+// boot test from the tested images comment on pull request issueNum.
+func loadTestedImages(ctx context.Context, f forge.Forge, issueNum int) error {
+	body, err := f.BotComment(ctx, issueNum, testedImagesMarker)
+	if err != nil {
+		return err
+	}
+	testedImages = make(map[string]string)
+	for _, matches := range testedImageRe.FindAllStringSubmatch(body, -1) {
+		testedImages[matches[1]] = matches[2]
+	}
+	return nil
+}
+
+// testedImagesComment returns the body of the tested images comment for
+// images (content hashes keyed by host).
+func testedImagesComment(images map[string]string) string {
+	hosts := make([]string, 0, len(images))
+	for host := range images {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	var b strings.Builder
+	b.WriteString(testedImagesMarker + "\n")
+	b.WriteString("Images which passed the boot test. gokr-boot skips hosts whose images are unchanged (see -force):\n\n")
+	for _, host := range hosts {
+		fmt.Fprintf(&b, "- `%s`: `%s`\n", host, images[host])
+	}
+	return b.String()
+}
+
+// recordTestedImages records the content hashes of the images which passed
+// the boot test in this run in the tested images comment on pull request
+// issueNum, in addition to those of hosts which were not tested in this run.
+func recordTestedImages(ctx context.Context, f forge.Forge, owner, repo string, issueNum int) error {
+	if len(imageHashes) == 0 {
+		return nil
+	}
+	images := make(map[string]string)
+	for host, hash := range testedImages {
+		images[host] = hash
+	}
+	suspectsMu.Lock()
+	for host, hash := range imageHashes {
+		if _, ok := suspects[host]; ok {
+			// Only the identical device passed, see -redundancy_voting.
+			continue
+		}
+		images[host] = hash
+	}
+	suspectsMu.Unlock()
+	if _, err := f.UpsertComment(ctx, issueNum, testedImagesMarker, testedImagesComment(images)); err != nil {
+		return err
+	}
+	audit.Record(owner+"/"+repo, "record-tested-images", fmt.Sprintf("#%d %d host(s)", issueNum, len(imageHashes)))
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+)
+
+var instancesFlag = flag.String("instances",
+	"",
+	"if non-empty, comma-separated list of <instance>=<hostname pattern> mappings (e.g. router=router-*,sensor=sensor-*) to build and test several gokrazy instances (multi-device images) in one run. Each bakery host is tested with the image of the first instance whose path.Match pattern matches its hostname; hosts matching no pattern are skipped")
+
+type instanceMapping struct {
+	instance string
+	pattern  string
+}
+
+// instances is the parsed -instances flag. If empty, all hosts are tested
+// with the image of the default instance (gok's -instance).
+var instances []instanceMapping
+
+func parseInstances(spec string) ([]instanceMapping, error) {
+	var mappings []instanceMapping
+	for _, entry := range strings.Split(spec, ",") {
+		instance, pattern, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || instance == "" || pattern == "" {
+			return nil, fmt.Errorf("invalid -instances entry %q: expected <instance>=<hostname pattern>", entry)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid -instances pattern %q: %v", pattern, err)
+		}
+		mappings = append(mappings, instanceMapping{instance: instance, pattern: pattern})
+	}
+	return mappings, nil
+}
+
+// hostInstance returns the instance whose image hostname is tested with, or
+// "" for the default instance. ok is false if -instances is set, but no
+// pattern matches hostname.
+func hostInstance(hostname string) (instance string, ok bool) {
+	if len(instances) == 0 {
+		return "", true
+	}
+	for _, m := range instances {
+		if matched, _ := path.Match(m.pattern, hostname); matched {
+			return m.instance, true
+		}
+	}
+	return "", false
+}
+
+// instanceConfigPath returns the path of the config.json of instance, or of
+// the default instance if instance is empty.
+func instanceConfigPath(instance string) string {
+	if instance == "" {
+		return config.InstanceConfigPath()
+	}
+	return filepath.Join(instanceflag.ParentDir(), instance, "config.json")
+}
+
+// readInstanceConfig reads the config of instance (see instanceConfigPath)
+// and applies its environment.
+func readInstanceConfig(instance string) (*config.Struct, error) {
+	cfg, err := config.ReadFromFile(instanceConfigPath(instance))
+	if err != nil {
+		return nil, err
+	}
+	cfg.ApplyEnvironment()
+	return cfg, nil
+}
+
+// gokInstanceArgs returns the gok arguments which select instance.
+func gokInstanceArgs(instance string) []string {
+	if instance == "" {
+		return nil
+	}
+	return []string{"--instance=" + instance}
+}
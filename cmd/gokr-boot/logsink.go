@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/artifactstore"
+	"github.com/gokrazy/autoupdate/internal/audit"
+	"github.com/google/go-github/v35/github"
+)
+
+// storedLog references a boot log stored by a logSink.
+type storedLog struct {
+	// url links to the log, if the sink makes it available under a URL.
+	url string
+
+	// inline is Markdown to embed into the PR comment, if any.
+	inline string
+}
+
+// A logSink stores the boot log of a bakery host.
+type logSink interface {
+	Store(ctx context.Context, host, bootlog string) (storedLog, error)
+}
+
+func logName(host string) string {
+	return "boot-log-" + host + "-" + time.Now().Format(time.RFC3339)
+}
+
+// gistSink stores boot logs as private GitHub gists.
+type gistSink struct {
+	client *github.Client
+}
+
+func (s *gistSink) Store(ctx context.Context, host, bootlog string) (storedLog, error) {
+	gistURL, err := createGist(ctx, s.client, bootlog)
+	if err != nil {
+		return storedLog{}, err
+	}
+	return storedLog{url: gistURL}, nil
+}
+
+func createGist(ctx context.Context, client *github.Client, log string) (string, error) {
+	filename := "boot-log-" + time.Now().Format(time.RFC3339)
+	gist, _, err := client.Gists.Create(ctx,
+		&github.Gist{
+			Description: github.String("gokrazy boot log"),
+			Public:      github.Bool(false),
+			Files: map[github.GistFilename]github.GistFile{
+				github.GistFilename(filename): {Content: github.String(log)},
+			},
+		})
+	if err != nil {
+		return "", err
+	}
+	audit.Record(slug, "create-gist", *gist.HTMLURL)
+	return *gist.HTMLURL, nil
+}
+
+// maxInlineLog limits the size of boot logs embedded into PR comments, which
+// GitHub limits to 65536 characters.
+const maxInlineLog = 50000
+
+func inlineLog(host, bootlog string) string {
+	if len(bootlog) > maxInlineLog {
+		bootlog = "[…]\n" + bootlog[len(bootlog)-maxInlineLog:]
+	}
+	return fmt.Sprintf("<details><summary>boot log of %s</summary>\n\n```\n%s\n```\n</details>\n", host, strings.TrimSpace(bootlog))
+}
+
+// commentSink embeds boot logs into the PR comment.
+type commentSink struct{}
+
+func (s *commentSink) Store(ctx context.Context, host, bootlog string) (storedLog, error) {
+	return storedLog{inline: inlineLog(host, bootlog)}, nil
+}
+
+// fileSink writes boot logs into a local directory.
+type fileSink struct {
+	dir string
+}
+
+func (s *fileSink) Store(ctx context.Context, host, bootlog string) (storedLog, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return storedLog{}, err
+	}
+	fn := filepath.Join(s.dir, strings.ReplaceAll(logName(host), ":", "")+".txt")
+	if err := os.WriteFile(fn, []byte(bootlog), 0644); err != nil {
+		return storedLog{}, err
+	}
+	return storedLog{}, nil
+}
+
+// summarySink appends boot logs to the GitHub Actions job summary and links
+// to the workflow run.
+type summarySink struct{}
+
+func (s *summarySink) Store(ctx context.Context, host, bootlog string) (storedLog, error) {
+	fn := os.Getenv("GITHUB_STEP_SUMMARY")
+	if fn == "" {
+		return storedLog{}, fmt.Errorf("summary log sink: GITHUB_STEP_SUMMARY empty (not running on GitHub Actions?)")
+	}
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return storedLog{}, err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(inlineLog(host, bootlog)); err != nil {
+		return storedLog{}, err
+	}
+	if err := f.Close(); err != nil {
+		return storedLog{}, err
+	}
+	return storedLog{url: runURL()}, nil
+}
+
+// storeSink uploads boot logs to an artifact store (S3-compatible bucket,
+// OCI registry, …).
+type storeSink struct {
+	store artifactstore.Store
+}
+
+func (s *storeSink) Store(ctx context.Context, host, bootlog string) (storedLog, error) {
+	u, err := s.store.Put(ctx, logName(host)+".txt", []byte(bootlog), "text/plain; charset=utf-8")
+	if err != nil {
+		return storedLog{}, err
+	}
+	if !strings.HasPrefix(u, "http") {
+		// e.g. an OCI reference, which browsers cannot open
+		return storedLog{inline: fmt.Sprintf("boot log of %s: `%s`\n", host, u)}, nil
+	}
+	return storedLog{url: u}, nil
+}
+
+// newLogSinks returns the sinks listed in the comma-separated spec.
+func newLogSinks(spec string, client *github.Client) ([]logSink, error) {
+	var sinks []logSink
+	for _, name := range strings.Split(spec, ",") {
+		switch strings.TrimSpace(name) {
+		case "gist":
+			if client == nil {
+				return nil, fmt.Errorf("log sink gist requires -forge=github")
+			}
+			sinks = append(sinks, &gistSink{client: client})
+		case "comment":
+			sinks = append(sinks, &commentSink{})
+		case "file":
+			sinks = append(sinks, &fileSink{dir: *logDir})
+		case "summary":
+			sinks = append(sinks, &summarySink{})
+		case "artifact":
+			sink, err := newArtifactSink()
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		case "s3":
+			if *logS3URL == "" {
+				return nil, fmt.Errorf("log sink s3 requires -log_s3_url")
+			}
+			store, err := artifactstore.Open("s3+" + *logS3URL)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, &storeSink{store: store})
+		case "store":
+			if *logStore == "" {
+				return nil, fmt.Errorf("log sink store requires -log_store")
+			}
+			store, err := artifactstore.Open(*logStore)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, &storeSink{store: store})
+		default:
+			return nil, fmt.Errorf("unknown log sink %q: expected one of gist, comment, file, summary, artifact, s3 or store", name)
+		}
+	}
+	return sinks, nil
+}
+
+// storeLog stores bootlog in all sinks.
+func storeLog(ctx context.Context, sinks []logSink, host, bootlog string) ([]storedLog, error) {
+	var stored []storedLog
+	for _, s := range sinks {
+		l, err := s.Store(ctx, host, bootlog)
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, l)
+	}
+	return stored, nil
+}
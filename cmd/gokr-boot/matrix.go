@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/autoupdate/internal/forge"
+	"github.com/gokrazy/autoupdate/internal/prmeta"
+)
+
+// hardwareMatrix maps pull request labels and changed paths to the hardware
+// classes which need to be tested, e.g.:
+//
+//	{
+//	  "rules": [
+//	    {"paths": ["*.dtb", "overlays/*"], "hardware": ["rpi3", "rpi4", "rpi5"]},
+//	    {"paths": ["config.addendum.txt"], "labels": ["x86"], "hardware": ["pc"]}
+//	  ],
+//	  "default": ["rpi4"]
+//	}
+type hardwareMatrix struct {
+	Rules []struct {
+		// Labels match if any of them is set on the pull request. Metadata
+		// in the pull request body is available as pseudo-labels such as
+		// kind:kernel or flavor:raspberrypi (see prmeta.Facts), but only
+		// for pull requests opened by the automation user (GITHUB_USER):
+		// other authors could narrow the tested hardware by editing the
+		// body.
+		Labels []string `json:"labels,omitempty"`
+
+		// Paths are path.Match patterns, matched against the full path and
+		// the base name of each file changed by the pull request.
+		Paths []string `json:"paths,omitempty"`
+
+		Hardware []string `json:"hardware"`
+	} `json:"rules"`
+
+	// Default lists the hardware classes to test when no rule matches. If
+	// empty, all hosts of the bakery are tested.
+	Default []string `json:"default,omitempty"`
+}
+
+func readHardwareMatrix(fn string) (*hardwareMatrix, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var m hardwareMatrix
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func matchesAny(patterns []string, fn string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, fn); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(fn)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hardwareFor returns the hardware classes required for a pull request with
+// the specified labels and changed files.
+func (m *hardwareMatrix) hardwareFor(labels, files []string) []string {
+	classes := make(map[string]bool)
+	for _, rule := range m.Rules {
+		matched := false
+		for _, l := range labels {
+			for _, want := range rule.Labels {
+				if l == want {
+					matched = true
+				}
+			}
+		}
+		for _, fn := range files {
+			if matchesAny(rule.Paths, fn) {
+				matched = true
+			}
+		}
+		if !matched {
+			continue
+		}
+		for _, h := range rule.Hardware {
+			classes[h] = true
+		}
+	}
+	if len(classes) == 0 {
+		return m.Default
+	}
+	result := make([]string, 0, len(classes))
+	for h := range classes {
+		result = append(result, h)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// pullRequestLabelsAndFiles returns the labels and changed file paths of the
+// pull request. The facts of the pull request body are only included if
+// automationUser opened the pull request.
+func pullRequestLabelsAndFiles(ctx context.Context, f forge.Forge, issueNum int, automationUser string) (labels, files []string, _ error) {
+	labels, err := f.Labels(ctx, issueNum)
+	if err != nil {
+		return nil, nil, err
+	}
+	author, err := f.Author(ctx, issueNum)
+	if err != nil {
+		return nil, nil, err
+	}
+	if strings.EqualFold(author, automationUser) {
+		body, err := f.Body(ctx, issueNum)
+		if err != nil {
+			return nil, nil, err
+		}
+		labels = append(labels, prmeta.Facts(body)...)
+	} else {
+		log.Printf("PR was not opened by %s, not trusting the facts in its body", automationUser)
+	}
+	files, err = f.ChangedFiles(ctx, issueNum)
+	if err != nil {
+		return nil, nil, err
+	}
+	return labels, files, nil
+}
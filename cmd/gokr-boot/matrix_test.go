@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const testMatrix = `{
+  "rules": [
+    {"paths": ["*.dtb", "overlays/*"], "hardware": ["rpi3", "rpi4", "rpi5"]},
+    {"paths": ["config.addendum.txt"], "labels": ["x86"], "hardware": ["pc"]},
+    {"labels": ["flavor:raspberrypi"], "hardware": ["rpi4"]}
+  ],
+  "default": ["rpi4"]
+}`
+
+func TestHardwareFor(t *testing.T) {
+	var m hardwareMatrix
+	if err := json.Unmarshal([]byte(testMatrix), &m); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name   string
+		labels []string
+		files  []string
+		want   []string
+	}{
+		{
+			name: "no rule matches",
+			files: []string{
+				"vmlinuz",
+			},
+			want: []string{"rpi4"},
+		},
+		{
+			name: "base name matches",
+			files: []string{
+				"dist/bcm2711-rpi-4-b.dtb",
+			},
+			want: []string{"rpi3", "rpi4", "rpi5"},
+		},
+		{
+			name: "directory matches",
+			files: []string{
+				"overlays/disable-bt.dtbo",
+			},
+			want: []string{"rpi3", "rpi4", "rpi5"},
+		},
+		{
+			name:   "label matches",
+			labels: []string{"automated", "x86"},
+			want:   []string{"pc"},
+		},
+		{
+			name:   "fact matches",
+			labels: []string{"kind:kernel", "flavor:raspberrypi"},
+			want:   []string{"rpi4"},
+		},
+		{
+			name:   "several rules match",
+			labels: []string{"x86"},
+			files: []string{
+				"bcm2712-rpi-5-b.dtb",
+			},
+			want: []string{"pc", "rpi3", "rpi4", "rpi5"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.hardwareFor(tt.labels, tt.files); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hardwareFor(%q, %q) = %q, want %q", tt.labels, tt.files, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHardwareForWithoutDefault(t *testing.T) {
+	m := hardwareMatrix{}
+	if got := m.hardwareFor([]string{"x86"}, []string{"vmlinuz"}); got != nil {
+		t.Errorf("hardwareFor = %q, want nil (all hosts)", got)
+	}
+}
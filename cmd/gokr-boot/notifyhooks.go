@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/notify"
+	"github.com/gokrazy/autoupdate/internal/secret"
+)
+
+var (
+	notifyURL = flag.String("notify_url",
+		"",
+		"if non-empty, URL to which the boot test result (success, or the failure of each host) is posted, in addition to the pull request comment and the sinks of the notify section of autoupdate.toml. See -notify_format")
+
+	notifyFormat = flag.String("notify_format",
+		"webhook",
+		"payload format for -notify_url: slack posts a Slack incoming webhook message (also accepted by Mattermost and Matrix hookshot webhooks), matrix sends a message to -notify_matrix_room via the client-server API of the homeserver at -notify_url (with the access token from $NOTIFY_MATRIX_TOKEN), webhook posts the event as JSON along with the message text")
+
+	notifyMatrixRoom = flag.String("notify_matrix_room",
+		"",
+		"for -notify_format=matrix: ID of the room to send messages to, e.g. !abc:matrix.org")
+
+	notifyEvents = flag.String("notify_events",
+		notify.BootSucceeded+","+notify.BootFailed,
+		"comma-separated list of event kinds which are posted to -notify_url")
+)
+
+// addNotifySink adds the sink configured by -notify_url to the notify
+// sinks.
+func addNotifySink() error {
+	if *notifyURL == "" {
+		return nil
+	}
+	// Incoming webhook URLs contain a token.
+	secret.Register(*notifyURL)
+	sc := notify.SinkConfig{
+		Type: *notifyFormat,
+		URL:  *notifyURL,
+	}
+	switch *notifyFormat {
+	case "slack", "webhook":
+	case "matrix":
+		sc.Room = *notifyMatrixRoom
+		sc.Token = secret.Get("NOTIFY_MATRIX_TOKEN")
+	default:
+		return fmt.Errorf("invalid -notify_format value %q: expected one of slack, matrix or webhook", *notifyFormat)
+	}
+	for _, kind := range strings.Split(*notifyEvents, ",") {
+		switch kind = strings.TrimSpace(kind); kind {
+		case notify.BootSucceeded, notify.BootFailed, notify.Error:
+			sc.Events = append(sc.Events, kind)
+		default:
+			return fmt.Errorf("invalid -notify_events kind %q: expected one of %s, %s or %s", kind, notify.BootSucceeded, notify.BootFailed, notify.Error)
+		}
+	}
+	return notify.AddSink(sc)
+}
+
+// notifySucceeded sends a boot-succeeded event listing the tested hosts.
+func notifySucceeded(ctx context.Context, u string, results []hostResult) {
+	hosts := make([]string, 0, len(results))
+	for _, r := range results {
+		hosts = append(hosts, fmt.Sprintf("%s (%v)", r.host, r.duration.Round(time.Second)))
+	}
+	notify.Send(ctx, notify.Event{
+		Kind:   notify.BootSucceeded,
+		Repo:   slug,
+		URL:    u,
+		Detail: strings.Join(hosts, ", "),
+	})
+}
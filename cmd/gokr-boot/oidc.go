@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/secret"
+)
+
+var oidcAudience = flag.String("bootery_oidc_audience",
+	"",
+	"if non-empty, authenticate to the bootery with a GitHub Actions OIDC ID token for this audience (requires the id-token: write workflow permission), so that bootery operators can authorize specific repositories and branches via the token claims")
+
+// booteryClient is used for all requests to the bootery.
+var booteryClient = http.DefaultClient
+
+// fetchOIDCToken requests a GitHub Actions OIDC ID token for audience.
+func fetchOIDCToken(audience string) (string, error) {
+	requestURL := os.Getenv("ACTIONS_ID_TOKEN_REQUEST_URL")
+	requestToken := os.Getenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN")
+	if requestURL == "" || requestToken == "" {
+		return "", fmt.Errorf("ACTIONS_ID_TOKEN_REQUEST_URL or ACTIONS_ID_TOKEN_REQUEST_TOKEN empty (missing id-token: write permission?)")
+	}
+	secret.Register(requestToken)
+	u, err := url.Parse(requestURL)
+	if err != nil {
+		return "", err
+	}
+	v := u.Query()
+	v.Set("audience", audience)
+	u.RawQuery = v.Encode()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+requestToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("unexpected HTTP status code: got %d (%s), want %d", got, strings.TrimSpace(string(b)), want)
+	}
+	var reply struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(b, &reply); err != nil {
+		return "", err
+	}
+	secret.Register(reply.Value)
+	return reply.Value, nil
+}
+
+// tokenExpiry returns the exp claim of the JWT token. The signature is not
+// verified: the token was just obtained from GitHub and is verified by the
+// bootery.
+func tokenExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("malformed JWT: got %d parts, want 3", len(parts))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, err
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(claims.Exp, 0), nil
+}
+
+// oidcTransport adds a GitHub Actions OIDC ID token as bearer token to each
+// request, refreshing it shortly before it expires (boot tests can take
+// longer than the token lifetime).
+type oidcTransport struct {
+	audience string
+	base     http.RoundTripper
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (t *oidcTransport) currentToken() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Until(t.expiry) > time.Minute {
+		return t.token, nil
+	}
+	token, err := fetchOIDCToken(t.audience)
+	if err != nil {
+		return "", err
+	}
+	expiry, err := tokenExpiry(token)
+	if err != nil {
+		return "", err
+	}
+	t.token, t.expiry = token, expiry
+	return token, nil
+}
+
+func (t *oidcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.currentToken()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var parallel = flag.Int("parallel",
+	1,
+	"number of bakery hosts to test concurrently. With -parallel > 1, the images are streamed to and booted on several hosts at once (gok builds still run one at a time), and a failing host does not stop the tests of the others: the run fails at the end with a per-host summary")
+
+// bootOutcome is the result of testBootWithin for one host.
+type bootOutcome struct {
+	bootlog  string
+	err      error
+	duration time.Duration
+}
+
+// testHosts tests hosts, up to -parallel at a time, and returns the outcomes
+// in the order of hosts.
+func testHosts(ctx context.Context, deadline time.Time, hosts []string, newer string) []bootOutcome {
+	outcomes := make([]bootOutcome, len(hosts))
+	sem := make(chan struct{}, *parallel)
+	var wg sync.WaitGroup
+	for idx, host := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			start := time.Now()
+			bootlog, err := testVoting(ctx, deadline, host, newer)
+			outcomes[idx] = bootOutcome{
+				bootlog:  bootlog,
+				err:      err,
+				duration: time.Since(start),
+			}
+		}()
+	}
+	wg.Wait()
+	return outcomes
+}
+
+// tableEscaper makes error messages fit into a Markdown table cell.
+var tableEscaper = strings.NewReplacer("\n", " ", "|", "\\|", "`", "'")
+
+// failureSummary renders a PR comment listing the result of every host of a
+// run in which some hosts failed.
+func failureSummary(results []hostResult) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Boot test failed on %d of %d host(s):\n\n", len(failedHosts(results)), len(results))
+	b.WriteString("| host | result | duration | error |\n|---|---|---|---|\n")
+	for _, r := range results {
+		var msg string
+		if r.err != nil {
+			msg = "`" + tableEscaper.Replace(r.err.Error()) + "`"
+		}
+		fmt.Fprintf(&b, "| %s | %s | %v | %s |\n", r.host, r.status(), r.duration.Round(time.Second), msg)
+	}
+	for _, r := range results {
+		if errors.As(r.err, new(*bootLogError)) {
+			b.WriteString("\n" + failureDetails(r.err))
+		}
+	}
+	return b.String()
+}
+
+// failedHosts returns the hosts of results whose test failed.
+func failedHosts(results []hostResult) []string {
+	var failed []string
+	for _, r := range results {
+		if r.err != nil {
+			failed = append(failed, r.host)
+		}
+	}
+	return failed
+}
+
+// budgetExceeded reports whether any host of results exceeded -max_duration.
+func budgetExceeded(results []hostResult) bool {
+	for _, r := range results {
+		if errors.Is(r.err, errBudgetExceeded) {
+			return true
+		}
+	}
+	return false
+}
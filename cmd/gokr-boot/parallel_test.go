@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTestHosts(t *testing.T) {
+	orig := *parallel
+	*parallel = 2
+	defer func() { *parallel = orig }()
+
+	errBoot := errors.New("kernel panic")
+	var (
+		mu               sync.Mutex
+		running, maxSeen int
+	)
+	stubBootTest(t, func(ctx context.Context, hostname, newer string) (string, error) {
+		mu.Lock()
+		running++
+		if running > maxSeen {
+			maxSeen = running
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+		switch hostname {
+		case "fails":
+			return "", errBoot
+		case "wedged":
+			<-ctx.Done()
+			return "", ctx.Err()
+		}
+		// Take long enough for the hosts to overlap.
+		time.Sleep(20 * time.Millisecond)
+		return "booted " + hostname, nil
+	})
+
+	hosts := []string{"rpi3", "fails", "wedged", "rpi5-slow"}
+	start := time.Now()
+	outcomes := testHosts(context.Background(), start.Add(200*time.Millisecond), hosts, "")
+	if got, want := len(outcomes), len(hosts); got != want {
+		t.Fatalf("testHosts returned %d outcomes, want %d", got, want)
+	}
+	if maxSeen > *parallel {
+		t.Errorf("%d hosts tested concurrently, want at most %d", maxSeen, *parallel)
+	}
+	if maxSeen < 2 {
+		t.Errorf("hosts were not tested concurrently")
+	}
+
+	results := make([]hostResult, len(hosts))
+	for idx, o := range outcomes {
+		results[idx] = hostResult{host: hosts[idx], err: o.err, duration: o.duration}
+	}
+	for idx, want := range []struct {
+		bootlog string
+		err     error
+	}{
+		{"booted rpi3", nil},
+		{"", errBoot},
+		{"", errBudgetExceeded},
+		{"booted rpi5-slow", nil},
+	} {
+		got := outcomes[idx]
+		if got.bootlog != want.bootlog || !errors.Is(got.err, want.err) || (got.err == nil) != (want.err == nil) {
+			t.Errorf("outcome of %s = (%q, %v), want (%q, %v)", hosts[idx], got.bootlog, got.err, want.bootlog, want.err)
+		}
+	}
+	if got, want := failedHosts(results), []string{"fails", "wedged"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("failedHosts = %q, want %q", got, want)
+	}
+	if !budgetExceeded(results) {
+		t.Errorf("budgetExceeded = false, want true")
+	}
+	summary := failureSummary(results)
+	for _, want := range []string{
+		"Boot test failed on 2 of 4 host(s)",
+		"| fails | failed |",
+		"| wedged | budget exceeded |",
+		"kernel panic",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("failureSummary does not contain %q:\n%s", want, summary)
+		}
+	}
+}
+
+func TestBudgetExceeded(t *testing.T) {
+	errBoot := errors.New("boot failed")
+	for _, tt := range []struct {
+		name       string
+		results    []hostResult
+		want       bool
+		wantFailed []string
+	}{
+		{
+			name: "none",
+			want: false,
+		},
+		{
+			name: "all passed",
+			results: []hostResult{
+				{host: "rpi4"},
+				{host: "rpi5"},
+			},
+			want: false,
+		},
+		{
+			name: "failed",
+			results: []hostResult{
+				{host: "rpi4", err: errBoot},
+				{host: "rpi5"},
+			},
+			want:       false,
+			wantFailed: []string{"rpi4"},
+		},
+		{
+			name: "budget exceeded",
+			results: []hostResult{
+				{host: "rpi4"},
+				{host: "rpi5", err: fmt.Errorf("%w: rpi5 not tested", errBudgetExceeded)},
+			},
+			want:       true,
+			wantFailed: []string{"rpi5"},
+		},
+		{
+			name: "failed and budget exceeded",
+			results: []hostResult{
+				{host: "rpi4", err: errBoot},
+				{host: "rpi5", err: fmt.Errorf("%w: rpi5 did not finish", errBudgetExceeded)},
+			},
+			want:       true,
+			wantFailed: []string{"rpi4", "rpi5"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := budgetExceeded(tt.results); got != tt.want {
+				t.Errorf("budgetExceeded = %v, want %v", got, tt.want)
+			}
+			if got := failedHosts(tt.results); !reflect.DeepEqual(got, tt.wantFailed) {
+				t.Errorf("failedHosts = %q, want %q", got, tt.wantFailed)
+			}
+		})
+	}
+}
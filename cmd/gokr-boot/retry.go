@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	retries = flag.Int("retries",
+		0,
+		"how often to retry streaming an image to the bootery (boot file system, -update_root) per host before reporting a failure, e.g. after a flaky power-on or network hiccup. Note that an image which genuinely fails to boot is also tested 1+retries times")
+
+	retryBackoff = flag.Duration("retry_backoff",
+		30*time.Second,
+		"how long to wait before the first retry (see -retries). The wait doubles with every further retry")
+)
+
+// withRetries calls fn until it succeeds, -retries retries failed or ctx is
+// done. what describes fn in log messages and the returned error.
+func withRetries(ctx context.Context, what, hostname string, fn func() (string, error)) (string, error) {
+	backoff := *retryBackoff
+	for attempt := 0; ; attempt++ {
+		result, err := fn()
+		if err == nil {
+			return result, nil
+		}
+		if attempt >= *retries || ctx.Err() != nil {
+			if attempt > 0 {
+				return "", fmt.Errorf("%s on %s failed after %d attempts: %v", what, hostname, attempt+1, err)
+			}
+			return "", err
+		}
+		log.Printf("%s on %s failed (attempt %d of %d): %v, retrying in %v", what, hostname, attempt+1, *retries+1, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return "", context.Cause(ctx)
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// imageSBOM returns a Markdown section (collapsed by default) describing
+// the image that was just built: the kernel, firmware and Go packages from
+// the config of instance (see instanceConfigPath), followed by the SBOM as
+// printed by gok sbom.
+func imageSBOM(instance string) (string, error) {
+	cfg, err := readInstanceConfig(instance)
+	if err != nil {
+		return "", err
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command("gok", append([]string{"sbom", "--format=json"}, gokInstanceArgs(instance)...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+
+	var b strings.Builder
+	b.WriteString("<details><summary>SBOM of the tested image</summary>\n\n")
+	if cfg.KernelPackage != nil {
+		fmt.Fprintf(&b, "* kernel: `%s`\n", *cfg.KernelPackage)
+	}
+	if cfg.FirmwarePackage != nil {
+		fmt.Fprintf(&b, "* firmware: `%s`\n", *cfg.FirmwarePackage)
+	}
+	if cfg.EEPROMPackage != nil {
+		fmt.Fprintf(&b, "* eeprom: `%s`\n", *cfg.EEPROMPackage)
+	}
+	for _, pkg := range cfg.Packages {
+		fmt.Fprintf(&b, "* package: `%s`\n", pkg)
+	}
+	fmt.Fprintf(&b, "\n```json\n%s\n```\n</details>\n", strings.TrimSpace(stdout.String()))
+	return b.String(), nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Flags for runs which are not triggered by a pull request (e.g. on a
+// schedule or via workflow_dispatch), which test the checked out branch
+// without any label logic.
+var (
+	reportIssue = flag.Int("report_issue",
+		0,
+		"for runs outside of pull requests: if non-zero, number of an issue (GitHub, Gitea) to comment the boot test results on")
+
+	reportURL = flag.String("report_url",
+		"",
+		"if non-empty, URL of a dashboard to POST the boot test results (JSON) to")
+)
+
+// runReport is the JSON document sent to -report_url.
+type runReport struct {
+	Repo        string       `json:"repo"`
+	Ref         string       `json:"ref,omitempty"`
+	SHA         string       `json:"sha,omitempty"`
+	PullRequest int          `json:"pull_request,omitempty"`
+	Started     time.Time    `json:"started"`
+	Success     bool         `json:"success"`
+	Hosts       []hostReport `json:"hosts"`
+}
+
+type hostReport struct {
+	Host     string `json:"host"`
+	Status   string `json:"status"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+func postReport(u string, pr int, started time.Time, results []hostResult) error {
+	report := runReport{
+		Repo:        slug,
+		Ref:         os.Getenv("GITHUB_REF"),
+		SHA:         os.Getenv("GITHUB_SHA"),
+		PullRequest: pr,
+		Started:     started,
+		Success:     true,
+	}
+	for _, r := range results {
+		h := hostReport{
+			Host:     r.host,
+			Status:   r.status(),
+			Duration: r.duration.Round(time.Second).String(),
+		}
+		if r.err != nil {
+			report.Success = false
+			h.Error = r.err.Error()
+		}
+		report.Hosts = append(report.Hosts, h)
+	}
+	b, err := json.Marshal(&report)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(u, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected HTTP status code: got %d (%s), want 2xx", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
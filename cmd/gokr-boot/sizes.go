@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gokrazy/autoupdate/internal/artifactstore"
+	"github.com/gokrazy/internal/humanize"
+)
+
+var (
+	sizeStore = flag.String("size_store",
+		"",
+		"if non-empty, artifact store (a directory, s3+https://<path-style bucket URL> or oci://<registry>/<repository>) in which runs outside of pull requests (e.g. pushes to main) record the boot/root image sizes of their branch. Pull request runs add the size delta compared to the base branch to the PR comment")
+
+	maxSizeGrowth = flag.Float64("max_size_growth",
+		0,
+		"if positive, fail pull requests whose boot or root image grows by more than this many percent compared to the size recorded for the base branch in -size_store")
+)
+
+// imageSizes are the sizes (in bytes) of the images built for an instance.
+type imageSizes struct {
+	Boot int64 `json:"boot"`
+	Root int64 `json:"root"`
+}
+
+var (
+	sizesMu sync.Mutex
+	// measuredSizes maps instance names ("" for the default instance) to the
+	// sizes of the images built in this run.
+	measuredSizes = make(map[string]imageSizes)
+)
+
+// measureImages records the sizes of the images built for instance.
+func measureImages(instance, bootImg, rootImg string) error {
+	var sizes imageSizes
+	for _, img := range []struct {
+		fn   string
+		size *int64
+	}{
+		{bootImg, &sizes.Boot},
+		{rootImg, &sizes.Root},
+	} {
+		st, err := os.Stat(img.fn)
+		if err != nil {
+			return err
+		}
+		*img.size = st.Size()
+	}
+	sizesMu.Lock()
+	defer sizesMu.Unlock()
+	measuredSizes[instance] = sizes
+	return nil
+}
+
+func sizesKey(branch, instance string) string {
+	if instance == "" {
+		instance = "default"
+	}
+	return "image-sizes/" + branch + "/" + instance + ".json"
+}
+
+// recordSizes stores the sizes measured in this run as the sizes of branch.
+func recordSizes(ctx context.Context, store artifactstore.Store, branch string) error {
+	sizesMu.Lock()
+	defer sizesMu.Unlock()
+	for instance, sizes := range measuredSizes {
+		b, err := json.Marshal(sizes)
+		if err != nil {
+			return err
+		}
+		if _, err := store.Put(ctx, sizesKey(branch, instance), b, "application/json"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errSizeGrowth is returned by sizeReport when an image grew by more than
+// -max_size_growth.
+var errSizeGrowth = errors.New("image size grew beyond -max_size_growth")
+
+func formatDelta(name string, base, cur int64) string {
+	delta := cur - base
+	sign := "+"
+	if delta < 0 {
+		sign = "-"
+		delta = -delta
+	}
+	line := fmt.Sprintf("%s: %s (%s%s", name, humanize.Bytes(uint64(cur)), sign, humanize.Bytes(uint64(delta)))
+	if base > 0 {
+		line += fmt.Sprintf(", %s%.1f%%", sign, float64(delta)*100/float64(base))
+	}
+	return line + ")"
+}
+
+// growth returns by how many percent cur exceeds base.
+func growth(base, cur int64) float64 {
+	if base == 0 {
+		return 0
+	}
+	return float64(cur-base) * 100 / float64(base)
+}
+
+// sizeReport returns a line describing the image sizes of instance compared
+// to the sizes recorded for branch, or the empty string if no images were
+// measured for instance. The error wraps errSizeGrowth if an image grew by more
+// than -max_size_growth.
+func sizeReport(ctx context.Context, store artifactstore.Store, branch, instance string) (string, error) {
+	sizesMu.Lock()
+	cur, ok := measuredSizes[instance]
+	sizesMu.Unlock()
+	if !ok {
+		return "", nil // e.g. -eeprom_image
+	}
+	b, err := store.Get(ctx, sizesKey(branch, instance))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Sprintf("Image sizes: no sizes recorded for %s yet", branch), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var base imageSizes
+	if err := json.Unmarshal(b, &base); err != nil {
+		return "", fmt.Errorf("%s: %v", sizesKey(branch, instance), err)
+	}
+	report := fmt.Sprintf("Image sizes compared to %s: %s, %s",
+		branch,
+		formatDelta("boot", base.Boot, cur.Boot),
+		formatDelta("root", base.Root, cur.Root))
+	if *maxSizeGrowth > 0 {
+		var exceeded []string
+		if g := growth(base.Boot, cur.Boot); g > *maxSizeGrowth {
+			exceeded = append(exceeded, fmt.Sprintf("boot image grew by %.1f%%", g))
+		}
+		if g := growth(base.Root, cur.Root); g > *maxSizeGrowth {
+			exceeded = append(exceeded, fmt.Sprintf("root image grew by %.1f%%", g))
+		}
+		if len(exceeded) > 0 {
+			return report, fmt.Errorf("%w (%.1f%%): %s", errSizeGrowth, *maxSizeGrowth, strings.Join(exceeded, ", "))
+		}
+	}
+	return report, nil
+}
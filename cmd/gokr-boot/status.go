@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/artifactstore"
+)
+
+var statusStore = flag.String("status_store",
+	"",
+	"if non-empty, artifact store (a directory, e.g. a GitHub Pages checkout, s3+https://<path-style bucket URL> or oci://<registry>/<repository>) to which runs outside of pull requests export the latest boot test status per hardware (bakery host) and repository as a static status page: status.json and index.html. Several repositories can share one store")
+
+// statusEntry is the latest boot test result of one host for one
+// repository.
+type statusEntry struct {
+	Status   string    `json:"status"`
+	Time     time.Time `json:"time"`
+	Duration string    `json:"duration"`
+	Ref      string    `json:"ref,omitempty"`
+	SHA      string    `json:"sha,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// statusPage is the content of status.json: repository → host → status.
+type statusPage map[string]map[string]statusEntry
+
+var statusTmpl = template.Must(template.New("index.html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>gokrazy boot test status</title>
+<style>
+body { font-family: sans-serif; }
+td, th { padding: 0.25em 0.5em; border: 1px solid #ccc; }
+.passed { background-color: #cfc; }
+.failed { background-color: #fcc; }
+</style>
+</head>
+<body>
+<h1>gokrazy boot test status</h1>
+<p>Latest boot test result per hardware and repository, updated {{ .Updated.Format "2006-01-02 15:04 MST" }}. Also available as <a href="status.json">status.json</a>.</p>
+<table>
+<tr><th>hardware</th>{{ range .Repos }}<th>{{ . }}</th>{{ end }}</tr>
+{{ range $host := .Hosts }}<tr><th>{{ $host }}</th>{{ range $repo := $.Repos }}{{ with index $.Status $repo $host }}<td class="{{ .Status }}" title="{{ .Error }}">{{ .Status }}<br><small>{{ .Time.Format "2006-01-02" }}{{ if .SHA }} {{ .ShortSHA }}{{ end }}</small></td>{{ else }}<td></td>{{ end }}{{ end }}</tr>
+{{ end }}</table>
+</body>
+</html>
+`))
+
+// statusCell is a statusEntry as rendered in index.html.
+type statusCell struct {
+	statusEntry
+	ShortSHA string
+}
+
+func renderStatusPage(page statusPage, updated time.Time) ([]byte, error) {
+	hostSet := make(map[string]bool)
+	cells := make(map[string]map[string]*statusCell)
+	repos := make([]string, 0, len(page))
+	for repo, hosts := range page {
+		repos = append(repos, repo)
+		cells[repo] = make(map[string]*statusCell)
+		for host, e := range hosts {
+			hostSet[host] = true
+			c := &statusCell{statusEntry: e, ShortSHA: e.SHA}
+			if len(c.ShortSHA) > 7 {
+				c.ShortSHA = c.ShortSHA[:7]
+			}
+			cells[repo][host] = c
+		}
+	}
+	sort.Strings(repos)
+	hosts := make([]string, 0, len(hostSet))
+	for host := range hostSet {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	var buf bytes.Buffer
+	if err := statusTmpl.Execute(&buf, struct {
+		Updated time.Time
+		Repos   []string
+		Hosts   []string
+		Status  map[string]map[string]*statusCell
+	}{
+		Updated: updated,
+		Repos:   repos,
+		Hosts:   hosts,
+		Status:  cells,
+	}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// exportStatus merges results into the status page in -status_store.
+//
+// Concurrent runs (e.g. of different repositories) might overwrite each
+// other's update, which the next run of the affected repository corrects.
+func exportStatus(ctx context.Context, results []hostResult) error {
+	store, err := artifactstore.Open(*statusStore)
+	if err != nil {
+		return err
+	}
+	page := make(statusPage)
+	b, err := store.Get(ctx, "status.json")
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &page); err != nil {
+			return fmt.Errorf("status.json: %v", err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		// first run, start with an empty status page
+	default:
+		return err
+	}
+	now := time.Now()
+	if page[slug] == nil {
+		page[slug] = make(map[string]statusEntry)
+	}
+	for _, r := range results {
+		if errors.Is(r.err, errBudgetExceeded) {
+			// The host was not tested, keep its previous result.
+			continue
+		}
+		e := statusEntry{
+			Status:   r.status(),
+			Time:     now,
+			Duration: r.duration.Round(time.Second).String(),
+			Ref:      os.Getenv("GITHUB_REF"),
+			SHA:      os.Getenv("GITHUB_SHA"),
+		}
+		if r.err != nil {
+			e.Error = r.err.Error()
+		}
+		page[slug][r.host] = e
+	}
+	b, err = json.MarshalIndent(page, "", "  ")
+	if err != nil {
+		return err
+	}
+	html, err := renderStatusPage(page, now)
+	if err != nil {
+		return err
+	}
+	if _, err := store.Put(ctx, "status.json", append(b, '\n'), "application/json"); err != nil {
+		return err
+	}
+	if _, err := store.Put(ctx, "index.html", html, "text/html; charset=utf-8"); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/audit"
+	"github.com/gokrazy/autoupdate/internal/forge"
+)
+
+var summaryCommentFlag = flag.Bool("summary_comment",
+	false,
+	"instead of one comment per host (and separate comments for failures), post a single comment with a table of all hosts and their results, with the details of each host in collapsible sections. The comment is updated in place as hosts finish, and when the run for the same commit is retried")
+
+// maxCommentSize stays below the limit of 65536 characters which GitHub
+// imposes on comments.
+const maxCommentSize = 60000
+
+// hostDetails are the Markdown sections which addComment would post for a
+// host, collected into the summary comment instead.
+type hostDetails struct {
+	urls     []string
+	sections []string
+}
+
+// summaryComment is the single comment of -summary_comment.
+type summaryComment struct {
+	f           forge.Forge
+	owner, repo string
+	issueNum    int
+	commit      string
+	hosts       []string
+	details     map[string]hostDetails
+}
+
+func newSummaryComment(f forge.Forge, owner, repo string, issueNum int, commit string, hosts []string) *summaryComment {
+	return &summaryComment{
+		f:        f,
+		owner:    owner,
+		repo:     repo,
+		issueNum: issueNum,
+		commit:   commit,
+		hosts:    hosts,
+		details:  make(map[string]hostDetails),
+	}
+}
+
+// marker identifies the comment to update. Runs for a different commit post
+// a new comment, so that earlier results remain visible.
+func (s *summaryComment) marker() string {
+	if s.commit == "" {
+		return "<!-- gokr-boot summary -->"
+	}
+	return "<!-- gokr-boot summary " + s.commit + " -->"
+}
+
+// record adds the logs and reports of a successfully tested host.
+func (s *summaryComment) record(host string, logs []storedLog, suspect, sizes, sbom, dmesg string) {
+	var d hostDetails
+	for _, l := range logs {
+		if l.url != "" {
+			d.urls = append(d.urls, l.url)
+		}
+		if l.inline != "" {
+			d.sections = append(d.sections, l.inline)
+		}
+	}
+	for _, section := range []string{suspect, sizes, dmesg, sbom} {
+		if section != "" {
+			d.sections = append(d.sections, section)
+		}
+	}
+	s.details[host] = d
+}
+
+func (s *summaryComment) body(results []hostResult, reason string) string {
+	tested := make(map[string]hostResult)
+	for _, r := range results {
+		tested[r.host] = r
+	}
+	failed := len(failedHosts(results))
+
+	var b strings.Builder
+	b.WriteString(s.marker() + "\n")
+	what := "Boot test"
+	if s.commit != "" {
+		what = "Boot test of " + s.commit
+	}
+	switch {
+	case reason != "":
+		fmt.Fprintf(&b, "%s %s, partial results:\n\n", what, reason)
+	case failed > 0:
+		fmt.Fprintf(&b, "%s failed on %d of %d host(s):\n\n", what, failed, len(s.hosts))
+	case len(results) < len(s.hosts):
+		fmt.Fprintf(&b, "%s in progress, %d of %d host(s) tested:\n\n", what, len(results), len(s.hosts))
+	default:
+		fmt.Fprintf(&b, "%s successful on %d host(s):\n\n", what, len(s.hosts))
+	}
+
+	b.WriteString("| host | result | duration | log |\n|---|---|---|---|\n")
+	for _, host := range s.hosts {
+		r, ok := tested[host]
+		if !ok {
+			fmt.Fprintf(&b, "| %s | pending | | |\n", host)
+			continue
+		}
+		var links []string
+		for idx, u := range s.details[host].urls {
+			links = append(links, fmt.Sprintf("[%d](%s)", idx+1, u))
+		}
+		fmt.Fprintf(&b, "| %s | %s | %v | %s |\n", host, r.status(), r.duration.Round(time.Second), strings.Join(links, " "))
+	}
+
+	for _, host := range s.hosts {
+		r, ok := tested[host]
+		if !ok {
+			continue
+		}
+		var content string
+		if r.err != nil {
+			content = failureDetails(r.err)
+		} else {
+			content = strings.Join(s.details[host].sections, "\n\n")
+		}
+		if content == "" {
+			continue
+		}
+		section := fmt.Sprintf("\n<details><summary>%s: %s</summary>\n\n%s\n</details>\n", host, r.status(), content)
+		if b.Len()+len(section) > maxCommentSize {
+			section = fmt.Sprintf("\n<details><summary>%s: %s</summary>\n\nomitted, the comment would exceed the size limit\n</details>\n", host, r.status())
+		}
+		b.WriteString(section)
+	}
+	return b.String()
+}
+
+// update posts (or updates) the comment with the results so far. reason, if
+// non-empty, explains why the results are partial.
+func (s *summaryComment) update(ctx context.Context, results []hostResult, reason string) error {
+	commentURL, err := s.f.UpsertComment(ctx, s.issueNum, s.marker(), s.body(results, reason))
+	if err != nil {
+		return err
+	}
+	audit.Record(s.owner+"/"+s.repo, "upsert-comment", commentURL)
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/secret"
+)
+
+var (
+	tailscale = flag.Bool("tailscale",
+		false,
+		"connect to the bootery through a tailnet: start tailscaled in userspace-networking mode (requires the tailscale and tailscaled programs, but no root privileges or TUN device) as an ephemeral node and use its SOCKS5 proxy for all bootery connections. The node authenticates with TS_AUTHKEY (or TS_AUTHKEY_FILE, or a systemd credential) and is logged out after the run")
+
+	tailscaleHostname = flag.String("tailscale_hostname",
+		"",
+		"hostname of the -tailscale node. Defaults to gokr-boot-<GITHUB_RUN_ID>, or gokr-boot")
+)
+
+// tailscaleUpTimeout bounds how long joining the tailnet may take.
+const tailscaleUpTimeout = 2 * time.Minute
+
+// freeLocalPort returns a currently unused TCP port on the loopback
+// interface.
+func freeLocalPort() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
+
+// startTailscale joins the tailnet and returns the address of the SOCKS5
+// proxy through which tailnet hosts are reachable, and a function which
+// leaves the tailnet again.
+func startTailscale(ctx context.Context) (proxy string, stop func(), _ error) {
+	authKey := secret.Get("TS_AUTHKEY")
+	if authKey == "" {
+		return "", nil, fmt.Errorf("-tailscale requires TS_AUTHKEY (an ephemeral, pre-authorized auth key)")
+	}
+	hostname := *tailscaleHostname
+	if hostname == "" {
+		hostname = "gokr-boot"
+		if id := os.Getenv("GITHUB_RUN_ID"); id != "" {
+			hostname += "-" + id
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "gokr-boot-tailscale")
+	if err != nil {
+		return "", nil, err
+	}
+	// Pass the auth key as a file, as command lines are visible to other
+	// users of the machine.
+	keyFile := filepath.Join(dir, "authkey")
+	if err := os.WriteFile(keyFile, []byte(authKey), 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	proxy, err = freeLocalPort()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	socket := filepath.Join(dir, "tailscaled.sock")
+
+	tailscaled := exec.Command("tailscaled",
+		"--tun=userspace-networking",
+		"--state=mem:", // ephemeral: nothing to clean up on disk
+		"--statedir="+dir,
+		"--socket="+socket,
+		"--socks5-server="+proxy)
+	tailscaled.Stdout = secret.Writer(os.Stderr)
+	tailscaled.Stderr = secret.Writer(os.Stderr)
+	setParentDeathSignal(tailscaled)
+	if err := tailscaled.Start(); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, fmt.Errorf("starting tailscaled: %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- tailscaled.Wait() }()
+
+	stop = func() {
+		logout := exec.Command("tailscale", "--socket="+socket, "logout")
+		logout.Stderr = os.Stderr
+		if err := logout.Run(); err != nil {
+			log.Printf("tailscale logout: %v", err)
+		}
+		tailscaled.Process.Signal(os.Interrupt)
+		select {
+		case <-exited:
+		case <-time.After(10 * time.Second):
+			tailscaled.Process.Kill()
+			<-exited
+		}
+		os.RemoveAll(dir)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tailscaleUpTimeout)
+	defer cancel()
+	for {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		select {
+		case err := <-exited:
+			os.RemoveAll(dir)
+			return "", nil, fmt.Errorf("tailscaled exited: %v", err)
+		case <-ctx.Done():
+			stop()
+			return "", nil, fmt.Errorf("tailscaled did not create %s within %v", socket, tailscaleUpTimeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	up := exec.CommandContext(ctx, "tailscale",
+		"--socket="+socket,
+		"up",
+		"--auth-key=file:"+keyFile,
+		"--hostname="+hostname,
+		"--accept-routes")
+	up.Stdout = secret.Writer(os.Stderr)
+	up.Stderr = secret.Writer(os.Stderr)
+	log.Printf("joining tailnet as %s", hostname)
+	err = up.Run()
+	// The node is logged in (or failed to), so the auth key is no longer
+	// needed: do not leave it on disk for the duration of the run.
+	os.Remove(keyFile)
+	if err != nil {
+		stop()
+		return "", nil, fmt.Errorf("tailscale up: %v", err)
+	}
+	return proxy, stop, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// telemetry is the reply of the bootery's /telemetry endpoint, which reports
+// vcgencmd-equivalent values of a host after it booted.
+type telemetry struct {
+	// Throttled is the output of vcgencmd get_throttled, e.g. 0x50005.
+	Throttled string `json:"throttled"`
+
+	// Temperature is the SoC temperature in degrees Celsius.
+	Temperature float64 `json:"temperature,omitempty"`
+}
+
+// throttledBits describes the bits of vcgencmd get_throttled, see
+// https://www.raspberrypi.com/documentation/computers/os.html#get_throttled
+var throttledBits = []struct {
+	bit  uint
+	desc string
+}{
+	{0, "under-voltage detected"},
+	{1, "arm frequency capped"},
+	{2, "currently throttled"},
+	{3, "soft temperature limit active"},
+	{16, "under-voltage has occurred"},
+	{17, "arm frequency capping has occurred"},
+	{18, "throttling has occurred"},
+	{19, "soft temperature limit has occurred"},
+}
+
+// problems returns a description of each throttling condition that is set.
+func (t *telemetry) problems() ([]string, error) {
+	if t.Throttled == "" {
+		return nil, nil
+	}
+	v, err := strconv.ParseUint(strings.TrimPrefix(t.Throttled, "throttled="), 0, 32)
+	if err != nil {
+		return nil, fmt.Errorf("parsing throttled value %q: %v", t.Throttled, err)
+	}
+	var problems []string
+	for _, b := range throttledBits {
+		if v&(1<<b.bit) != 0 {
+			problems = append(problems, b.desc)
+		}
+	}
+	return problems, nil
+}
+
+func fetchTelemetry(ctx context.Context, booteryURL, hostname string) (*telemetry, error) {
+	ctx, cancel := booteryContext(ctx)
+	defer cancel()
+	u, err := url.Parse(booteryURL)
+	if err != nil {
+		return nil, err
+	}
+	v := u.Query()
+	v.Set("hostname", hostname)
+	u.RawQuery = v.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := booteryClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return nil, fmt.Errorf("unexpected HTTP status code: got %d (%s), want %d", got, strings.TrimSpace(string(b)), want)
+	}
+	var t telemetry
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// checkTelemetry fetches the telemetry of hostname and returns a summary for
+// the boot log. Depending on -telemetry, throttling conditions either result
+// in a warning within the summary or in an error.
+func checkTelemetry(ctx context.Context, booteryURL, hostname string) (string, error) {
+	t, err := fetchTelemetry(ctx, booteryURL, hostname)
+	if err != nil {
+		return "", err
+	}
+	problems, err := t.problems()
+	if err != nil {
+		return "", err
+	}
+	summary := fmt.Sprintf("telemetry: throttled=%s, temperature=%.1f°C", t.Throttled, t.Temperature)
+	if len(problems) == 0 {
+		return summary, nil
+	}
+	if *telemetryMode == "fail" {
+		return "", fmt.Errorf("%s: %s (results are invalid, check the bakery power supply and cooling)", hostname, strings.Join(problems, ", "))
+	}
+	return summary + "\nWARNING: " + strings.Join(problems, ", "), nil
+}
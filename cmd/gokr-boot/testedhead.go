@@ -0,0 +1,17 @@
+package main
+
+import (
+	"context"
+
+	"github.com/gokrazy/autoupdate/internal/cienv"
+	"github.com/gokrazy/autoupdate/internal/forge"
+)
+
+// testedHead returns the commit ID of the pull request head which is being
+// tested: the commit CI checked out if known, otherwise the current head.
+func testedHead(ctx context.Context, f forge.Forge, issueNum int) (string, error) {
+	if sha := cienv.GetHeadSHA(); sha != "" {
+		return sha, nil
+	}
+	return f.HeadSHA(ctx, issueNum)
+}
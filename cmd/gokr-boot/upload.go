@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var uploadChunkSize = flag.Int64("upload_chunk_size",
+	32<<20,
+	"size in bytes of the chunks in which images are uploaded to booteries which announce the upload feature. An upload interrupted by a dropped connection resumes after the last completed chunk on retry (see -retries). 0 uploads images in a single request")
+
+// progressInterval is how often uploads log their progress.
+const progressInterval = 10 * time.Second
+
+// progressReader logs how much of an upload was read.
+type progressReader struct {
+	r     io.Reader
+	what  string
+	done  int64
+	total int64
+	last  time.Time
+}
+
+func newProgressReader(r io.Reader, what string, done, total int64) *progressReader {
+	return &progressReader{r: r, what: what, done: done, total: total, last: time.Now()}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	if time.Since(p.last) >= progressInterval {
+		p.last = time.Now()
+		log.Printf("uploading %s: %d of %d MiB (%d%%)", p.what, p.done>>20, p.total>>20, 100*p.done/max(p.total, 1))
+	}
+	return n, err
+}
+
+var (
+	uploadIDsMu sync.Mutex
+	uploadIDs   = make(map[string]string) // image path, size and mtime → upload ID
+)
+
+// uploadID returns an identifier of the content of img, with which the
+// bootery can recognize (and resume) earlier uploads of the same image.
+func uploadID(img string) (string, error) {
+	uploadIDsMu.Lock()
+	defer uploadIDsMu.Unlock()
+	f, err := os.Open(img)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	// Temporary image files are removed after each test, so their names
+	// can be reused for different content.
+	key := fmt.Sprintf("%s %d %d", img, st.Size(), st.ModTime().UnixNano())
+	if id, ok := uploadIDs[key]; ok {
+		return id, nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(h.Sum(nil))
+	uploadIDs[key] = id
+	return id, nil
+}
+
+// confirmedOffset returns the number of bytes the bootery confirmed to have
+// received, based on the reply to a chunk upload or status request: 308
+// Permanent Redirect (as in resumable uploads of e.g. Google Cloud Storage)
+// with a Range header of the received bytes, or 200 OK once complete.
+func confirmedOffset(resp *http.Response, total int64) (int64, error) {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return total, nil
+	case http.StatusPermanentRedirect:
+		r := resp.Header.Get("Range")
+		if r == "" {
+			return 0, nil // nothing received yet
+		}
+		_, last, ok := strings.Cut(strings.TrimPrefix(r, "bytes="), "-")
+		if !ok {
+			return 0, fmt.Errorf("malformed Range header %q", r)
+		}
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("malformed Range header %q: %v", r, err)
+		}
+		return n + 1, nil
+	default:
+		b, _ := ioutil.ReadAll(resp.Body)
+		return 0, fmt.Errorf("unexpected HTTP status code: got %d (%s), want %d or %d", resp.StatusCode, strings.TrimSpace(string(b)), http.StatusPermanentRedirect, http.StatusOK)
+	}
+}
+
+// putRange uploads content (bytes start to start+len-1 of total, of an
+// upload with the specified Content-Encoding) to uploadURL and returns the
+// confirmed offset. A nil content queries the upload status.
+func putRange(ctx context.Context, uploadURL, encoding string, content io.Reader, start, length, total int64) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, uploadURL, content)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if encoding != "" {
+		// The encoding applies to the assembled upload, not to the chunk.
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if content == nil {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+	} else {
+		req.ContentLength = length
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, total))
+	}
+	resp, err := booteryClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return confirmedOffset(resp, total)
+}
+
+// uploadChunked uploads img to the bootery in chunks of -upload_chunk_size
+// bytes, resuming where an earlier attempt left off, and returns the upload
+// ID with which /testboot1 and /updateroot refer to it.
+func uploadChunked(ctx context.Context, img, hostname string) (string, error) {
+	id, err := uploadID(img)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(img)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	total := st.Size()
+
+	u, err := url.Parse(strings.TrimSuffix(*booteryURL, "/testboot") + "/upload")
+	if err != nil {
+		return "", err
+	}
+	v := u.Query()
+	v.Set("hostname", hostname)
+	v.Set("upload", id)
+	u.RawQuery = v.Encode()
+	uploadURL := u.String()
+	var encoding string
+	if strings.HasSuffix(img, zstdSuffix) {
+		encoding = "zstd"
+	}
+
+	offset, err := putRange(ctx, uploadURL, encoding, nil, 0, 0, total)
+	if err != nil {
+		return "", fmt.Errorf("querying upload status: %v", err)
+	}
+	if offset > 0 {
+		log.Printf("resuming upload of %s at %d of %d MiB", img, offset>>20, total>>20)
+	}
+	progress := newProgressReader(nil, img, offset, total)
+	for offset < total {
+		n := min(*uploadChunkSize, total-offset)
+		progress.r = io.NewSectionReader(f, offset, n)
+		confirmed, err := putRange(ctx, uploadURL, encoding, progress, offset, n, total)
+		if err != nil {
+			return "", fmt.Errorf("uploading bytes %d-%d of %s: %v", offset, offset+n-1, img, err)
+		}
+		if confirmed <= offset {
+			return "", fmt.Errorf("uploading bytes %d-%d of %s: bootery confirmed only %d bytes", offset, offset+n-1, img, confirmed)
+		}
+		offset = confirmed
+		progress.done = offset
+	}
+	log.Printf("uploaded %s (%d MiB)", img, total>>20)
+	return id, nil
+}
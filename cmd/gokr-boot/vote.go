@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var redundancyVoting = flag.Bool("redundancy_voting",
+	false,
+	"pair up bakery hosts of the same device model (as reported by booteries which announce the models feature) and, when the boot test fails on the first device of a pair, repeat it on the second one: the test only fails if both devices fail. A failure on just one of the devices is reported as a suspected infrastructure problem (e.g. a failing SD card) instead of failing the run")
+
+// votingPartners maps the first host of each pair of identical devices to
+// the second one, which is only tested if the first one fails.
+var votingPartners = make(map[string]string)
+
+var (
+	suspectsMu sync.Mutex
+	// suspects maps the first host of a pair to its failure, if the second
+	// device of the pair passed.
+	suspects = make(map[string]error)
+)
+
+// pairHosts pairs up hosts of the same model (models maps hosts to their
+// model, see /usebakeries) in votingPartners. It returns the hosts to test,
+// i.e. without the second host of each pair.
+func pairHosts(hosts []string, models map[string]string) []string {
+	waiting := make(map[string]string) // model → unpaired host
+	result := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		model := models[host]
+		if model == "" {
+			result = append(result, host)
+			continue
+		}
+		if first, ok := waiting[model]; ok {
+			log.Printf("-redundancy_voting: pairing %s with %s (model %s)", first, host, model)
+			votingPartners[first] = host
+			delete(waiting, model)
+			continue
+		}
+		waiting[model] = host
+		result = append(result, host)
+	}
+	for model, host := range waiting {
+		log.Printf("-redundancy_voting: no identical device for %s (model %s), testing it on its own", host, model)
+	}
+	return result
+}
+
+// testVoting is testBootWithin, which repeats the test of a failed host on
+// its partner, if any (see -redundancy_voting). If the partner passes, its
+// boot log is returned and the failure is recorded in suspects.
+func testVoting(ctx context.Context, deadline time.Time, hostname, newer string) (string, error) {
+	bootlog, err := testBootWithin(ctx, deadline, hostname, newer)
+	partner, ok := votingPartners[hostname]
+	if err == nil || !ok || errors.Is(err, errBudgetExceeded) || errors.Is(err, errCancelled) {
+		return bootlog, err
+	}
+	log.Printf("%s failed, repeating the test on the identical device %s: %v", hostname, partner, err)
+	partnerLog, partnerErr := testBootWithin(ctx, deadline, partner, newer)
+	if errors.Is(partnerErr, errBudgetExceeded) || errors.Is(partnerErr, errCancelled) {
+		return "", partnerErr
+	}
+	if partnerErr != nil {
+		return "", fmt.Errorf("%w (the identical device %s failed, too: %v)", err, partner, partnerErr)
+	}
+	log.Printf("%s passed: suspecting an infrastructure problem of %s", partner, hostname)
+	suspectsMu.Lock()
+	defer suspectsMu.Unlock()
+	suspects[hostname] = err
+	return partnerLog, nil
+}
+
+// suspectReport returns a Markdown note for pull request comments if the
+// test of host only passed on its partner, or the empty string.
+func suspectReport(host string) string {
+	suspectsMu.Lock()
+	defer suspectsMu.Unlock()
+	err, ok := suspects[host]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("⚠️ The boot test failed on %s, but passed on the identical device %s (whose boot log is shown). Suspecting an infrastructure problem of %s, e.g. a failing SD card:\n\n%s", host, votingPartners[host], host, failureDetails(err))
+}
@@ -0,0 +1,538 @@
+// gokr-fake-bootery is a stand-in for the bootery which downstream
+// repositories can run in CI to validate their gokr-boot workflow wiring
+// (labels, flags, comment formatting) without touching real hardware.
+//
+// Example:
+//
+//	gokr-fake-bootery -listen=localhost:8037 -hosts=fake-rpi4=rpi4,fake-pc=pc &
+//	gokr-boot -bootery_url=http://localhost:8037/testboot -require_label=please-boot …
+//
+// Boots of the hosts listed in -fail_hosts fail, all others succeed with a
+// synthetic boot log, which shows the host parameters and boot deadline
+// gokr-boot passed. The optional protocol features (see -features), chunked
+// uploads, zstd-compressed images, device models (for gokr-boot
+// -redundancy_voting) and full disk images (/testdisk) are simulated, too.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/version"
+)
+
+var (
+	listen = flag.String("listen",
+		"localhost:8037",
+		"host:port to listen on")
+
+	hostsFlag = flag.String("hosts",
+		"fake-rpi4=rpi4",
+		"comma-separated list of simulated bakery hosts, each optionally followed by =<hardware class>. Hosts of the same hardware class are reported as the same device model, e.g. fake-rpi4a=rpi4,fake-rpi4b=rpi4 for gokr-boot -redundancy_voting")
+
+	failHosts = flag.String("fail_hosts",
+		"",
+		"comma-separated list of hosts whose boots fail")
+
+	bootDelay = flag.Duration("boot_delay",
+		2*time.Second,
+		"simulated duration of each boot. Boots fail if gokr-boot passes a shorter boot deadline (see gokr-boot -boot_deadline)")
+
+	featuresFlag = flag.String("features",
+		"params,upload,models,deadline",
+		"comma-separated list of optional protocol features to announce in the X-Bootery-Features reply header (of those which gokr-boot requests): params, upload, models and deadline. Empty simulates an old bootery")
+
+	zstdFlag = flag.Bool("zstd",
+		true,
+		"announce support for zstd-compressed images (Accept-Encoding: zstd)")
+
+	printVersion = flag.Bool("version",
+		false,
+		"print version information and exit")
+)
+
+const featuresHeader = "X-Bootery-Features"
+
+// zstdMagic starts every zstd frame.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+type fakeHost struct {
+	name     string
+	hardware string
+	fail     bool
+}
+
+// upload is an image uploaded in chunks to /upload. Only the start of the
+// image is kept, which is all that checkImage looks at.
+type upload struct {
+	head     []byte
+	received int64
+	total    int64
+	encoding string
+}
+
+type bootery struct {
+	hosts    []fakeHost
+	features map[string]bool
+
+	mu      sync.Mutex
+	eeprom  map[string]string // hostname → bootloader timestamp
+	prev    map[string]string // hostname → timestamp before the last flash
+	uploads map[string]*upload
+}
+
+func (b *bootery) host(r *http.Request) (*fakeHost, error) {
+	name := r.URL.Query().Get("hostname")
+	for idx := range b.hosts {
+		if b.hosts[idx].name == name {
+			return &b.hosts[idx], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown hostname %q", name)
+}
+
+// handle wraps a handler which returns an error, replying with HTTP status
+// 500 and the error message like the bootery does.
+func handle(method string, h func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s", r.Method, r.URL)
+		if r.Method != method {
+			http.Error(w, fmt.Sprintf("method not allowed: got %s, want %s", r.Method, method), http.StatusMethodNotAllowed)
+			return
+		}
+		if err := h(w, r); err != nil {
+			log.Printf("%s: %v", r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func (b *bootery) useBakeries(w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Query().Get("slug") == "" {
+		return fmt.Errorf("slug parameter missing")
+	}
+	wanted := make(map[string]bool)
+	if hw := r.URL.Query().Get("hardware"); hw != "" {
+		for _, class := range strings.Split(hw, ",") {
+			wanted[class] = true
+		}
+	}
+	var requested []string
+	for _, f := range strings.Split(r.Header.Get(featuresHeader), ",") {
+		if f = strings.TrimSpace(f); b.features[f] {
+			requested = append(requested, f)
+		}
+	}
+	if len(requested) > 0 {
+		w.Header().Set(featuresHeader, strings.Join(requested, ","))
+	}
+	if *zstdFlag {
+		w.Header().Set("Accept-Encoding", "zstd")
+	}
+	reply := struct {
+		Hosts  []string          `json:"hosts"`
+		Models map[string]string `json:"models,omitempty"`
+	}{
+		Hosts: []string{},
+	}
+	if b.features["models"] {
+		reply.Models = make(map[string]string)
+	}
+	for _, h := range b.hosts {
+		if len(wanted) == 0 || wanted[h.hardware] {
+			reply.Hosts = append(reply.Hosts, h.name)
+			if reply.Models != nil && h.hardware != "" {
+				reply.Models[h.name] = h.hardware
+			}
+		}
+	}
+	return json.NewEncoder(w).Encode(&reply)
+}
+
+// checkImage verifies that the start of an image (head) looks like a (boot
+// or root) file system image as written by gokr-packer, or a zstd frame if
+// the image is zstd-encoded.
+func checkImage(head []byte, encoding string) error {
+	if len(head) == 0 {
+		return fmt.Errorf("empty image")
+	}
+	switch encoding {
+	case "":
+	case "zstd":
+		if !*zstdFlag {
+			return fmt.Errorf("zstd-compressed image, but -zstd=false")
+		}
+		if !bytes.HasPrefix(head, zstdMagic) {
+			return fmt.Errorf("Content-Encoding: zstd, but the image does not start with a zstd frame")
+		}
+	default:
+		return fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+	return nil
+}
+
+// readImage reads and checks the image of a /testboot1, /updateroot or
+// /testdisk request: the request body or, with the upload query parameter,
+// a completed chunked upload. It returns a description for the boot log.
+func (b *bootery) readImage(r *http.Request) (string, error) {
+	if id := r.URL.Query().Get("upload"); id != "" {
+		if !b.features["upload"] {
+			return "", fmt.Errorf("upload parameter, but the upload feature is not announced")
+		}
+		b.mu.Lock()
+		u, ok := b.uploads[id]
+		b.mu.Unlock()
+		if !ok {
+			return "", fmt.Errorf("unknown upload %q", id)
+		}
+		if u.received != u.total {
+			return "", fmt.Errorf("upload %q incomplete: received %d of %d bytes", id, u.received, u.total)
+		}
+		if err := checkImage(u.head, u.encoding); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d byte %s (chunked upload)", u.total, describeEncoding(u.encoding)), nil
+	}
+	var head bytes.Buffer
+	n, err := io.Copy(&head, io.LimitReader(r.Body, 512))
+	if err != nil {
+		return "", err
+	}
+	rest, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return "", err
+	}
+	encoding := r.Header.Get("Content-Encoding")
+	if err := checkImage(head.Bytes(), encoding); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d byte %s", n+rest, describeEncoding(encoding)), nil
+}
+
+func describeEncoding(encoding string) string {
+	if encoding == "" {
+		return "uncompressed"
+	}
+	return encoding + "-compressed"
+}
+
+var contentRangeRe = regexp.MustCompile(`^bytes (?:\*|([0-9]+)-([0-9]+))/([0-9]+)$`)
+
+// upload implements resumable chunked uploads: each request carries a
+// Content-Range of the bytes it contains (or bytes */<total> to query the
+// status), and is answered with 308 Permanent Redirect and a Range header
+// of the received bytes, or with 200 OK once the upload is complete.
+func (b *bootery) upload(w http.ResponseWriter, r *http.Request) error {
+	if !b.features["upload"] {
+		return fmt.Errorf("the upload feature is not announced")
+	}
+	if _, err := b.host(r); err != nil {
+		return err
+	}
+	id := r.URL.Query().Get("upload")
+	if id == "" {
+		return fmt.Errorf("upload parameter missing")
+	}
+	matches := contentRangeRe.FindStringSubmatch(r.Header.Get("Content-Range"))
+	if matches == nil {
+		return fmt.Errorf("invalid Content-Range %q", r.Header.Get("Content-Range"))
+	}
+	total, _ := strconv.ParseInt(matches[3], 10, 64)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	u, ok := b.uploads[id]
+	if !ok || u.total != total {
+		u = &upload{total: total}
+		b.uploads[id] = u
+	}
+	if enc := r.Header.Get("Content-Encoding"); enc != "" {
+		u.encoding = enc
+	}
+	if matches[1] != "" {
+		start, _ := strconv.ParseInt(matches[1], 10, 64)
+		end, _ := strconv.ParseInt(matches[2], 10, 64)
+		if start != u.received {
+			return fmt.Errorf("chunk starts at byte %d, but %d bytes were received", start, u.received)
+		}
+		if end < start || end >= total {
+			return fmt.Errorf("invalid Content-Range %q", r.Header.Get("Content-Range"))
+		}
+		var chunk bytes.Buffer
+		n, err := io.Copy(&chunk, io.LimitReader(r.Body, end-start+1))
+		if err != nil {
+			// Keep the bytes received so far, like a dropped connection.
+			return err
+		}
+		if room := 512 - len(u.head); room > 0 {
+			u.head = append(u.head, chunk.Bytes()[:min(int64(room), n)]...)
+		}
+		u.received += n
+	}
+	if u.received == u.total {
+		return nil // 200 OK
+	}
+	if u.received > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", u.received-1))
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+	return nil
+}
+
+// bootParams returns lines for the boot log showing the host parameters
+// and boot deadline of a /testboot1 or /testdisk request, and whether the
+// simulated boot takes longer than the deadline.
+func (b *bootery) bootParams(r *http.Request) (string, bool, error) {
+	var lines strings.Builder
+	if params := r.URL.Query().Get("params"); params != "" {
+		if !b.features["params"] {
+			return "", false, fmt.Errorf("params parameter, but the params feature is not announced")
+		}
+		var p struct {
+			Env      map[string]string `json:"env"`
+			Features []string          `json:"features"`
+		}
+		if err := json.Unmarshal([]byte(params), &p); err != nil {
+			return "", false, fmt.Errorf("invalid params parameter: %v", err)
+		}
+		fmt.Fprintf(&lines, "gokr-fake-bootery: host parameters: env=%v features=%q\n", p.Env, p.Features)
+	}
+	exceeded := false
+	if deadline := r.URL.Query().Get("deadline"); deadline != "" {
+		if !b.features["deadline"] {
+			return "", false, fmt.Errorf("deadline parameter, but the deadline feature is not announced")
+		}
+		secs, err := strconv.Atoi(deadline)
+		if err != nil || secs <= 0 {
+			return "", false, fmt.Errorf("invalid deadline parameter %q: expected a positive number of seconds", deadline)
+		}
+		fmt.Fprintf(&lines, "gokr-fake-bootery: boot deadline: %ds\n", secs)
+		exceeded = time.Duration(secs)*time.Second < *bootDelay
+	}
+	return lines.String(), exceeded, nil
+}
+
+func (b *bootery) testBoot(w http.ResponseWriter, r *http.Request) error {
+	h, err := b.host(r)
+	if err != nil {
+		return err
+	}
+	img, err := b.readImage(r)
+	if err != nil {
+		return err
+	}
+	params, exceeded, err := b.bootParams(r)
+	if err != nil {
+		return err
+	}
+	time.Sleep(*bootDelay)
+	if h.fail {
+		return fmt.Errorf("%s did not boot within the timeout (simulated failure)", h.name)
+	}
+	if exceeded {
+		return fmt.Errorf("%s did not boot within the deadline (-boot_delay=%v)", h.name, *bootDelay)
+	}
+	fmt.Fprintf(w, "gokr-fake-bootery: received %s boot image for %s (update_root=%s, boot-newer=%q)\n",
+		img, h.name, r.URL.Query().Get("update_root"), r.URL.Query().Get("boot-newer"))
+	io.WriteString(w, params)
+	fmt.Fprintf(w, "[    0.000000] Booting Linux on physical CPU 0x0000000000 [0x410fd083]\n")
+	fmt.Fprintf(w, "[    2.345678] gokrazy: fake boot of %s successful\n", h.name)
+	return nil
+}
+
+func (b *bootery) testDisk(w http.ResponseWriter, r *http.Request) error {
+	h, err := b.host(r)
+	if err != nil {
+		return err
+	}
+	img, err := b.readImage(r)
+	if err != nil {
+		return err
+	}
+	params, exceeded, err := b.bootParams(r)
+	if err != nil {
+		return err
+	}
+	time.Sleep(*bootDelay)
+	if h.fail {
+		return fmt.Errorf("%s did not boot from disk within the timeout (simulated failure)", h.name)
+	}
+	if exceeded {
+		return fmt.Errorf("%s did not boot within the deadline (-boot_delay=%v)", h.name, *bootDelay)
+	}
+	fmt.Fprintf(w, "gokr-fake-bootery: wrote %s disk image onto %s (boot-newer=%q)\n",
+		img, h.name, r.URL.Query().Get("boot-newer"))
+	io.WriteString(w, params)
+	fmt.Fprintf(w, "[    0.000000] Linux version 6.6.0 (fake) SMP PREEMPT_DYNAMIC\n")
+	fmt.Fprintf(w, "[    2.345678] gokrazy: fake boot of %s successful\n", h.name)
+	return nil
+}
+
+func (b *bootery) updateRoot(w http.ResponseWriter, r *http.Request) error {
+	h, err := b.host(r)
+	if err != nil {
+		return err
+	}
+	img, err := b.readImage(r)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "gokr-fake-bootery: received %s root image for %s\n", img, h.name)
+	return nil
+}
+
+func (b *bootery) testFallback(w http.ResponseWriter, r *http.Request) error {
+	h, err := b.host(r)
+	if err != nil {
+		return err
+	}
+	time.Sleep(*bootDelay)
+	fmt.Fprintf(w, "gokr-fake-bootery: %s booted its previous system partition\n", h.name)
+	return nil
+}
+
+func (b *bootery) telemetry(w http.ResponseWriter, r *http.Request) error {
+	if _, err := b.host(r); err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"throttled":   "0x0",
+		"temperature": 42.0,
+	})
+}
+
+func (b *bootery) dmesg(w http.ResponseWriter, r *http.Request) error {
+	h, err := b.host(r)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "[    0.000000] Booting Linux on physical CPU 0x0000000000 [0x410fd083]\n")
+	if r.URL.Query().Get("boot") == "current" && h.fail {
+		fmt.Fprintf(w, "[    1.234567] fake-driver: probe failed with error -22\n")
+	}
+	return nil
+}
+
+var buildTimestampRe = regexp.MustCompile(`BUILD_TIMESTAMP=([0-9]+)`)
+
+func (b *bootery) eepromVersion(w http.ResponseWriter, r *http.Request) error {
+	h, err := b.host(r)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ts, ok := b.eeprom[h.name]
+	if !ok {
+		ts = "1700000000"
+	}
+	fmt.Fprintf(w, "%s\nversion 0000000000000000000000000000000000000000 (release)\ntimestamp %s\n",
+		time.Unix(0, 0).UTC().Format("2006/01/02 15:04:05"), ts)
+	return nil
+}
+
+func (b *bootery) eepromFlash(w http.ResponseWriter, r *http.Request) error {
+	h, err := b.host(r)
+	if err != nil {
+		return err
+	}
+	img, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if h.fail {
+		return fmt.Errorf("%s: flashing EEPROM failed (simulated failure)", h.name)
+	}
+	ts := fmt.Sprint(time.Now().Unix())
+	if matches := buildTimestampRe.FindSubmatch(img); matches != nil {
+		ts = string(matches[1])
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if old, ok := b.eeprom[h.name]; ok {
+		b.prev[h.name] = old
+	}
+	b.eeprom[h.name] = ts
+	fmt.Fprintf(w, "gokr-fake-bootery: flashed %d byte EEPROM image onto %s\n", len(img), h.name)
+	return nil
+}
+
+func (b *bootery) eepromRestore(w http.ResponseWriter, r *http.Request) error {
+	h, err := b.host(r)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if old, ok := b.prev[h.name]; ok {
+		b.eeprom[h.name] = old
+	} else {
+		delete(b.eeprom, h.name)
+	}
+	fmt.Fprintf(w, "gokr-fake-bootery: restored previous EEPROM of %s\n", h.name)
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	version.MaybePrint(*printVersion)
+
+	fail := make(map[string]bool)
+	if *failHosts != "" {
+		for _, h := range strings.Split(*failHosts, ",") {
+			fail[h] = true
+		}
+	}
+	b := &bootery{
+		features: make(map[string]bool),
+		eeprom:   make(map[string]string),
+		prev:     make(map[string]string),
+		uploads:  make(map[string]*upload),
+	}
+	for _, f := range strings.Split(*featuresFlag, ",") {
+		switch f = strings.TrimSpace(f); f {
+		case "":
+		case "params", "upload", "models", "deadline":
+			b.features[f] = true
+		default:
+			log.Fatalf("invalid -features entry %q: expected one of params, upload, models or deadline", f)
+		}
+	}
+	for _, spec := range strings.Split(*hostsFlag, ",") {
+		name, hardware, _ := strings.Cut(spec, "=")
+		b.hosts = append(b.hosts, fakeHost{
+			name:     name,
+			hardware: hardware,
+			fail:     fail[name],
+		})
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) error { return nil }
+	mux := http.NewServeMux()
+	mux.Handle("/usebakeries", handle(http.MethodPut, b.useBakeries))
+	mux.Handle("/releasebakeries", handle(http.MethodPut, ok))
+	mux.Handle("/testboot", handle(http.MethodPut, b.testBoot))
+	mux.Handle("/testboot1", handle(http.MethodPut, b.testBoot))
+	mux.Handle("/updateroot", handle(http.MethodPut, b.updateRoot))
+	mux.Handle("/upload", handle(http.MethodPut, b.upload))
+	mux.Handle("/testdisk", handle(http.MethodPut, b.testDisk))
+	mux.Handle("/testfallback", handle(http.MethodPut, b.testFallback))
+	mux.Handle("/telemetry", handle(http.MethodGet, b.telemetry))
+	mux.Handle("/dmesg", handle(http.MethodGet, b.dmesg))
+	mux.Handle("/eeprom/version", handle(http.MethodGet, b.eepromVersion))
+	mux.Handle("/eeprom/flash", handle(http.MethodPut, b.eepromFlash))
+	mux.Handle("/eeprom/restore", handle(http.MethodPut, b.eepromRestore))
+	log.Printf("fake bootery listening on http://%s/testboot with hosts %v", *listen, b.hosts)
+	log.Fatal(http.ListenAndServe(*listen, mux))
+}
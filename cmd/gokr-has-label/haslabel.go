@@ -4,44 +4,64 @@ import (
 	"context"
 	"flag"
 	"log"
-	"net/http"
 	"os"
 	"strconv"
 	"strings"
 
 	"github.com/gokrazy/autoupdate/internal/cienv"
-	"github.com/google/go-github/v35/github"
+	"github.com/gokrazy/autoupdate/internal/forge"
+	"github.com/gokrazy/autoupdate/internal/secret"
+	"github.com/gokrazy/autoupdate/internal/version"
 )
 
-func hasLabel(ctx context.Context, client *github.Client, owner, repo string, issueNum int, label string) bool {
-	labels, _, err := client.Issues.ListLabelsByIssue(ctx, owner, repo, issueNum, nil)
+func hasLabel(ctx context.Context, f forge.Forge, issueNum int, label string) bool {
+	found, err := forge.HasLabel(ctx, f, issueNum, label)
 	if err != nil {
 		log.Print(err)
 		return false
 	}
-	for _, l := range labels {
-		if *l.Name == label {
-			log.Printf("gokr-has-label %s? %v", label, true)
-			return true
-		}
-	}
-	log.Printf("gokr-has-label %s? %v", label, false)
-	return false
+	log.Printf("gokr-has-label %s? %v", label, found)
+	return found
 }
 
 var (
-	githubUser        = cienv.MustGetGithubUser()
-	authToken         = cienv.MustGetAuthToken()
-	slug              = cienv.MustGetSlug()
-	travisPullRequest = cienv.MustGetPullRequest()
+	githubUser        string
+	authToken         string
+	slug              string
+	travisPullRequest string
+)
+
+var (
+	printVersion = flag.Bool("version",
+		false,
+		"print version information and exit")
+
+	forgeKind = flag.String("forge",
+		"github",
+		"code forge hosting the repository. one of github, gitea or gitlab")
+
+	forgeURL = flag.String("forge_url",
+		"",
+		"base URL of the -forge=gitea or -forge=gitlab instance, e.g. https://gitlab.example.com")
+
+	tokenFile = flag.String("token_file",
+		"",
+		"if non-empty, path of a file containing the forge API token, instead of the GITHUB_AUTH_TOKEN or GH_AUTH_TOKEN environment variables. The variables can also name a file via GH_AUTH_TOKEN_FILE (e.g. a Docker secret) or be provided as systemd credentials")
 )
 
 func main() {
 	flag.Parse()
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	secret.Install()
+	version.MaybePrint(*printVersion)
 
-	if flag.NArg() < 1 {
-		log.Fatal("syntax: gokr-has-label <label>")
+	githubUser = cienv.MustGetGithubUser()
+	authToken = cienv.MustGetAuthToken(*tokenFile)
+	slug = cienv.MustGetSlug()
+	travisPullRequest = cienv.MustGetPullRequest()
+
+	if flag.NArg() < 1 && !*list {
+		log.Fatal("syntax: gokr-has-label <label> (or gokr-has-label -list)")
 	}
 
 	parts := strings.Split(slug, "/")
@@ -55,17 +75,32 @@ func main() {
 	}
 	issueNum := int(i)
 
-	client := github.NewClient(&http.Client{
-		Transport: &github.BasicAuthTransport{
-			Username: githubUser,
-			Password: authToken,
-		},
-	})
+	f, err := forge.New(*forgeKind, *forgeURL, parts[0], parts[1], githubUser, authToken)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	ctx := context.Background()
 
-	if hasLabel(ctx, client, parts[0], parts[1], issueNum, flag.Arg(0)) {
+	if *list {
+		if err := printLabels(ctx, f, issueNum); err != nil {
+			log.Fatal(err)
+		}
 		os.Exit(0)
 	}
-	os.Exit(1)
+
+	checkSetterMode := *allowedUsers != "" || *allowedTeam != ""
+	client := forge.GitHubClient(f)
+	if checkSetterMode && client == nil {
+		log.Fatal("-allowed_users and -allowed_team require -forge=github")
+	}
+
+	label := flag.Arg(0)
+	if !hasLabel(ctx, f, issueNum, label) {
+		os.Exit(1)
+	}
+	if checkSetterMode && !checkSetter(ctx, f, client, issueNum, label) {
+		os.Exit(1)
+	}
+	os.Exit(0)
 }
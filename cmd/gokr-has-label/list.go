@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/gokrazy/autoupdate/internal/forge"
+)
+
+var list = flag.Bool("list",
+	false,
+	"instead of checking for a label, print all labels of the PR as JSON (with who applied them and when, on GitHub) to stdout, for consumption by policy scripts")
+
+// labelList is the output of -list.
+type labelList struct {
+	Repo   string            `json:"repo"`
+	PR     int               `json:"pr"`
+	Labels []forge.LabelInfo `json:"labels"`
+}
+
+func printLabels(ctx context.Context, f forge.Forge, issueNum int) error {
+	labels, err := forge.ListLabels(ctx, f, issueNum)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(labelList{
+		Repo:   slug,
+		PR:     issueNum,
+		Labels: labels,
+	})
+}
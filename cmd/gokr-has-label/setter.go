@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gokrazy/autoupdate/internal/forge"
+	"github.com/google/go-github/v35/github"
+)
+
+var (
+	allowedUsers = flag.String("allowed_users",
+		"",
+		"if non-empty, comma-separated list of GitHub logins who may set the label. The label only counts if it was (last) applied by one of them or by a member of -allowed_team")
+
+	allowedTeam = flag.String("allowed_team",
+		"",
+		"if non-empty, GitHub team (<org>/<team-slug>) whose members may set the label. Requires a token with read:org scope")
+)
+
+// labelSetter returns the login of the user who most recently applied label
+// to the issue, according to the issue events API.
+func labelSetter(ctx context.Context, f forge.Forge, issueNum int, label string) (string, error) {
+	labels, err := forge.ListLabels(ctx, f, issueNum)
+	if err != nil {
+		return "", err
+	}
+	for _, l := range labels {
+		if l.Name == label && l.SetBy != "" {
+			return l.SetBy, nil
+		}
+	}
+	return "", fmt.Errorf("no labeled event found for label %q", label)
+}
+
+// setterAllowed reports whether login is on -allowed_users or an active
+// member of -allowed_team.
+func setterAllowed(ctx context.Context, client *github.Client, login string) (bool, error) {
+	if *allowedUsers != "" {
+		for _, u := range strings.Split(*allowedUsers, ",") {
+			if strings.EqualFold(strings.TrimSpace(u), login) {
+				return true, nil
+			}
+		}
+	}
+	if *allowedTeam == "" {
+		return false, nil
+	}
+	org, team, ok := strings.Cut(*allowedTeam, "/")
+	if !ok {
+		return false, fmt.Errorf("invalid -allowed_team value %q: expected <org>/<team-slug>", *allowedTeam)
+	}
+	membership, resp, err := client.Teams.GetTeamMembershipBySlug(ctx, org, team, login)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return membership.GetState() == "active", nil
+}
+
+// checkSetter verifies that label was applied by an allowed user, so that
+// drive-by contributors cannot self-approve e.g. hardware tests.
+func checkSetter(ctx context.Context, f forge.Forge, client *github.Client, issueNum int, label string) bool {
+	setter, err := labelSetter(ctx, f, issueNum, label)
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	allowed, err := setterAllowed(ctx, client, setter)
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	log.Printf("label %s set by %s, allowed? %v", label, setter, allowed)
+	return allowed
+}
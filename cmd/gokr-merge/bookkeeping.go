@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/gokrazy/autoupdate/internal/audit"
+	"github.com/gokrazy/autoupdate/internal/forge"
+)
+
+var (
+	mergedLabel = flag.String("merged_label",
+		"",
+		"if non-empty, name of a label to set on the PR after merging it, e.g. merged-by-bot")
+
+	removeLabels = flag.String("remove_labels",
+		"",
+		"comma-separated list of (workflow) labels to remove from the PR after merging it, e.g. please-boot,boot-tested")
+
+	milestoneRegexp = flag.String("milestone_regexp",
+		"",
+		"if non-empty, regular expression matched against the PR title to derive the milestone to set after merging: the first submatch (or the entire match) names the milestone, e.g. 'auto-update to v?(\\d+\\.\\d+)'. The milestone is created if needed")
+)
+
+// postMerge applies the label and milestone bookkeeping configured via
+// flags to the merged pull request, so that downstream repositories can
+// generate release notes from PR metadata.
+func postMerge(ctx context.Context, f forge.Forge, issueNum int) error {
+	var milestoneRe *regexp.Regexp
+	if *milestoneRegexp != "" {
+		var err error
+		milestoneRe, err = regexp.Compile(*milestoneRegexp)
+		if err != nil {
+			return fmt.Errorf("-milestone_regexp: %v", err)
+		}
+	}
+
+	if err := unhold(ctx, f, issueNum); err != nil {
+		return err
+	}
+
+	pr := fmt.Sprintf("#%d", issueNum)
+	if *mergedLabel != "" {
+		if err := f.AddLabel(ctx, issueNum, *mergedLabel); err != nil {
+			return err
+		}
+		audit.Record(slug, "add-label", pr+" "+*mergedLabel)
+	}
+
+	if *removeLabels != "" {
+		labels, err := f.Labels(ctx, issueNum)
+		if err != nil {
+			return err
+		}
+		present := make(map[string]bool, len(labels))
+		for _, l := range labels {
+			present[l] = true
+		}
+		for _, l := range strings.Split(*removeLabels, ",") {
+			if !present[l] {
+				continue
+			}
+			if err := f.RemoveLabel(ctx, issueNum, l); err != nil {
+				return err
+			}
+			audit.Record(slug, "remove-label", pr+" "+l)
+		}
+	}
+
+	if milestoneRe != nil {
+		title, err := f.Title(ctx, issueNum)
+		if err != nil {
+			return err
+		}
+		matches := milestoneRe.FindStringSubmatch(title)
+		if matches == nil {
+			log.Printf("PR title %q does not match -milestone_regexp, not setting a milestone", title)
+			return nil
+		}
+		milestone := matches[0]
+		if len(matches) > 1 {
+			milestone = matches[1]
+		}
+		if err := f.SetMilestone(ctx, issueNum, milestone); err != nil {
+			return err
+		}
+		audit.Record(slug, "set-milestone", pr+" "+milestone)
+	}
+	return nil
+}
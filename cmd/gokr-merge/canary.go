@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/audit"
+	"github.com/gokrazy/autoupdate/internal/forge"
+	"github.com/gokrazy/autoupdate/internal/notify"
+	"github.com/google/go-github/v35/github"
+)
+
+var (
+	promoteFlag = flag.Bool("promote",
+		false,
+		"instead of merging a pull request, promote the head of -canary_branch to -stable_branch once all -canaries ran it for -canary_soak, implementing staged rollouts: the fleet tracks the stable branch, the canaries track the canary branch. Run this periodically (e.g. from a workflow with an hourly schedule trigger), as each run checks the canaries only once: it exits with status 2 while the soak is not done, and with status 3 once -canary_timeout passed. Requires -forge=github")
+
+	stableBranch = flag.String("stable_branch",
+		"stable",
+		"for -promote: branch into which soaked commits are merged")
+
+	canaryBranch = flag.String("canary_branch",
+		"main",
+		"for -promote: branch which the -canaries track")
+
+	canaries = flag.String("canaries",
+		"",
+		"for -promote: comma-separated list of canary status URLs. Each must reply with a JSON object {\"commit\": \"<commit the device runs>\", \"since\": \"<RFC 3339 time it has been running since>\"}, e.g. served by a program on the canary device or by the bootery")
+
+	canarySoak = flag.Duration("canary_soak",
+		24*time.Hour,
+		"for -promote: how long all -canaries need to run the head of -canary_branch (without rebooting) before it is merged into -stable_branch")
+
+	canaryTimeout = flag.Duration("canary_timeout",
+		48*time.Hour,
+		"for -promote: give up (exit with status 3) if the canaries have not soaked the head of -canary_branch within this duration after it was committed")
+)
+
+// canaryStatus is the reply of a canary status URL.
+type canaryStatus struct {
+	Commit string    `json:"commit"`
+	Since  time.Time `json:"since"`
+}
+
+func fetchCanaryStatus(ctx context.Context, u string) (canaryStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return canaryStatus{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return canaryStatus{}, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return canaryStatus{}, err
+	}
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return canaryStatus{}, fmt.Errorf("unexpected HTTP status code: got %d (%s), want %d", got, strings.TrimSpace(string(b)), want)
+	}
+	var st canaryStatus
+	if err := json.Unmarshal(b, &st); err != nil {
+		return canaryStatus{}, err
+	}
+	return st, nil
+}
+
+// canariesSoaked reports whether all canaries have been running commit for
+// at least soak, logging the state of each canary.
+func canariesSoaked(ctx context.Context, urls []string, commit string, soak time.Duration, now time.Time) bool {
+	soaked := true
+	for _, u := range urls {
+		st, err := fetchCanaryStatus(ctx, u)
+		if err != nil {
+			// e.g. the canary is rebooting into the new commit
+			log.Printf("canary %s: %v", u, err)
+			soaked = false
+			continue
+		}
+		if st.Commit != commit {
+			log.Printf("canary %s: runs %s, waiting for %s", u, st.Commit, commit)
+			soaked = false
+			continue
+		}
+		ran := now.Sub(st.Since)
+		if ran < soak {
+			log.Printf("canary %s: runs %s for %v of %v", u, commit, ran.Round(time.Minute), soak)
+			soaked = false
+			continue
+		}
+		log.Printf("canary %s: ran %s for %v", u, commit, ran.Round(time.Minute))
+	}
+	return soaked
+}
+
+var (
+	// errNotSoaked is returned by promote while the canaries are still
+	// soaking the head of -canary_branch.
+	errNotSoaked = errors.New("canaries did not soak the head commit yet")
+
+	// errCanaryTimeout is returned by promote if the canaries did not soak
+	// the head of -canary_branch within -canary_timeout.
+	errCanaryTimeout = errors.New("canaries did not soak the head commit in time")
+)
+
+// promote merges the head of -canary_branch into -stable_branch if the
+// -canaries soaked it. It checks the canaries once and returns errNotSoaked
+// if they did not soak it yet, so that promotion does not hold a CI job for
+// the whole -canary_soak.
+func promote(ctx context.Context, f forge.Forge) error {
+	client := forge.GitHubClient(f)
+	if client == nil {
+		return fmt.Errorf("-promote requires -forge=github")
+	}
+	if *canaries == "" {
+		return fmt.Errorf("-promote requires -canaries")
+	}
+	owner, repo, _ := strings.Cut(slug, "/")
+	ref, _, err := client.Git.GetRef(ctx, owner, repo, "heads/"+*canaryBranch)
+	if err != nil {
+		return err
+	}
+	commit := ref.GetObject().GetSHA()
+
+	comparison, _, err := client.Repositories.CompareCommits(ctx, owner, repo, *stableBranch, commit)
+	if err != nil {
+		return err
+	}
+	if st := comparison.GetStatus(); st == "identical" || st == "behind" {
+		log.Printf("%s already contains %s", *stableBranch, commit)
+		return nil
+	}
+
+	urls := strings.Split(*canaries, ",")
+	log.Printf("checking whether %d canaries ran %s for %v", len(urls), commit, *canarySoak)
+	now := time.Now()
+	if !canariesSoaked(ctx, urls, commit, *canarySoak, now) {
+		c, _, err := client.Git.GetCommit(ctx, owner, repo, commit)
+		if err != nil {
+			return err
+		}
+		if committed := c.GetCommitter().GetDate(); now.Sub(committed) > *canaryTimeout {
+			return fmt.Errorf("%w: %s was committed at %v (-canary_timeout=%v)", errCanaryTimeout, commit, committed, *canaryTimeout)
+		}
+		return errNotSoaked
+	}
+
+	merged, resp, err := client.Repositories.Merge(ctx, owner, repo, &github.RepositoryMergeRequest{
+		Base:          github.String(*stableBranch),
+		Head:          github.String(commit),
+		CommitMessage: github.String(fmt.Sprintf("promote %s after %v canary soak", commit, *canarySoak)),
+	})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		log.Printf("%s already contains %s", *stableBranch, commit)
+		return nil
+	}
+	audit.Record(slug, "merge-branch", *stableBranch+" "+merged.GetSHA())
+	log.Printf("promoted %s to %s", commit, *stableBranch)
+	return nil
+}
+
+// runPromote is main for -promote.
+func runPromote() {
+	parts := strings.Split(slug, "/")
+	if got, want := len(parts), 2; got != want {
+		log.Fatalf("unexpected number of /-separated parts in %q: got %d, want %d", slug, got, want)
+	}
+	ctx := context.Background()
+	f, err := forge.New(*forgeKind, *forgeURL, parts[0], parts[1], githubUser, authToken)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = promote(ctx, f)
+	if commitErr := audit.Commit(ctx, forge.GitHubClient(f), parts[0], parts[1]); commitErr != nil {
+		log.Print(commitErr)
+	}
+	if errors.Is(err, errNotSoaked) {
+		log.Print(err)
+		os.Exit(2) // not soaked yet, check again in the next run
+	}
+	if err != nil {
+		notify.Failed(ctx, slug, err)
+		if errors.Is(err, errCanaryTimeout) {
+			log.Print(err)
+			os.Exit(3) // canaries did not soak the head commit
+		}
+		log.Fatal(err)
+	}
+	notify.Succeeded(slug)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gokrazy/autoupdate/internal/audit"
+	"github.com/gokrazy/autoupdate/internal/cienv"
+	"github.com/google/go-github/v35/github"
+)
+
+var (
+	commentCommands = flag.Bool("comment_commands",
+		false,
+		"run from a workflow triggered by issue_comment events and react to slash commands in pull request comments: /merge merges the pull request at its head at the time of the command if it passes the usual checks (labels, checklist, freeze calendar; with -verify_tested_head also that this head was boot-tested), /retest dispatches -retest_workflow on the pull request branch. Only users with write access to the repository (or those listed in -command_users) may issue commands. Neither command supports pull requests from forks. Requires -forge=github")
+
+	retestWorkflow = flag.String("retest_workflow",
+		"",
+		"file name of the workflow (e.g. boot.yml) which /retest dispatches on the pull request branch. The workflow must have a workflow_dispatch trigger")
+
+	commandUsers = flag.String("command_users",
+		"",
+		"if non-empty, comma-separated list of GitHub users who may issue -comment_commands, instead of all users with write access to the repository")
+)
+
+// parseCommand returns the slash command (e.g. /merge) in the first line of
+// a comment body, or the empty string.
+func parseCommand(body string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(body), "\n")
+	fields := strings.Fields(line)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return ""
+	}
+	return fields[0]
+}
+
+// authorized reports whether user may issue comment commands.
+func authorized(ctx context.Context, client *github.Client, owner, repo, user string) (bool, error) {
+	if *commandUsers != "" {
+		for _, u := range strings.Split(*commandUsers, ",") {
+			if strings.EqualFold(strings.TrimSpace(u), user) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	level, _, err := client.Repositories.GetPermissionLevel(ctx, owner, repo, user)
+	if err != nil {
+		return false, err
+	}
+	switch level.GetPermission() {
+	case "admin", "maintain", "write":
+		return true, nil
+	}
+	return false, nil
+}
+
+// react acknowledges the command comment with a reaction, e.g. +1. Errors
+// are only logged, as the reaction is merely feedback.
+func react(ctx context.Context, client *github.Client, owner, repo string, commentID int64, reaction string) {
+	if _, _, err := client.Reactions.CreateIssueCommentReaction(ctx, owner, repo, commentID, reaction); err != nil {
+		log.Printf("reacting to comment %d: %v", commentID, err)
+	}
+}
+
+// mergeTarget is the pull request which /merge merges.
+type mergeTarget struct {
+	issueNum int
+	branch   string
+	base     string
+	// head is the head commit of the pull request when the command was
+	// issued: the merge fails if commits were pushed since.
+	head string
+}
+
+// runCommentCommand handles the comment which triggered the run. It returns
+// the pull request to merge for /merge, or nil if there is nothing further
+// to do.
+func runCommentCommand(ctx context.Context, client *github.Client, owner, repo string) (*mergeTarget, error) {
+	comment, ok := cienv.GetIssueComment()
+	if !ok {
+		return nil, fmt.Errorf("-comment_commands: not running for a newly created comment (issue_comment event)")
+	}
+	if !comment.IsPullRequest {
+		log.Printf("comment on issue #%d, not a pull request, ignoring", comment.Issue)
+		return nil, nil
+	}
+	cmd := parseCommand(comment.Body)
+	if cmd != "/merge" && cmd != "/retest" {
+		log.Printf("comment %d contains no command, ignoring", comment.ID)
+		return nil, nil
+	}
+	ok, err := authorized(ctx, client, owner, repo, comment.Author)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		log.Printf("%s is not authorized to issue %s", comment.Author, cmd)
+		react(ctx, client, owner, repo, comment.ID, "-1")
+		return nil, nil
+	}
+	log.Printf("%s issued %s on #%d", comment.Author, cmd, comment.Issue)
+
+	pr, _, err := client.PullRequests.Get(ctx, owner, repo, comment.Issue)
+	if err != nil {
+		return nil, err
+	}
+	if pr.GetState() != "open" {
+		log.Printf("pull request #%d is %s, ignoring %s", comment.Issue, pr.GetState(), cmd)
+		react(ctx, client, owner, repo, comment.ID, "confused")
+		return nil, nil
+	}
+
+	switch cmd {
+	case "/retest":
+		if *retestWorkflow == "" {
+			react(ctx, client, owner, repo, comment.ID, "confused")
+			return nil, fmt.Errorf("/retest requires -retest_workflow")
+		}
+		branch := pr.GetHead().GetRef()
+		if pr.GetHead().GetRepo().GetFullName() != owner+"/"+repo {
+			// Dispatched workflows run in this repository, which does not
+			// contain branches of forks.
+			react(ctx, client, owner, repo, comment.ID, "confused")
+			return nil, fmt.Errorf("/retest: pull request #%d is from a fork", comment.Issue)
+		}
+		if _, err := client.Actions.CreateWorkflowDispatchEventByFileName(ctx, owner, repo, *retestWorkflow, github.CreateWorkflowDispatchEventRequest{
+			Ref: branch,
+		}); err != nil {
+			return nil, err
+		}
+		log.Printf("dispatched workflow %s on %s", *retestWorkflow, branch)
+		audit.Record(owner+"/"+repo, "dispatch-workflow", *retestWorkflow+" "+branch)
+		react(ctx, client, owner, repo, comment.ID, "+1")
+		return nil, nil
+
+	default: // /merge
+		if pr.GetHead().GetRepo().GetFullName() != owner+"/"+repo {
+			// Deleting the merged branch would delete the branch of the
+			// same name in this repository.
+			react(ctx, client, owner, repo, comment.ID, "confused")
+			return nil, fmt.Errorf("/merge: pull request #%d is from a fork", comment.Issue)
+		}
+		react(ctx, client, owner, repo, comment.ID, "+1")
+		return &mergeTarget{
+			issueNum: comment.Issue,
+			branch:   pr.GetHead().GetRef(),
+			base:     pr.GetBase().GetRef(),
+			head:     pr.GetHead().GetSHA(),
+		}, nil
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/audit"
+	"github.com/gokrazy/autoupdate/internal/forge"
+	"github.com/gokrazy/autoupdate/internal/freeze"
+)
+
+var heldLabel = flag.String("held_label",
+	"merge-held",
+	"label set on PRs which are held (instead of merged) because a window of the freeze calendar (\"freeze\" section of autoupdate.toml) is active. The explanatory comment is only added while the label is absent, and the label is removed once the PR is merged")
+
+// holdForFreeze returns whether the pull request needs to be held because a
+// freeze window is active. The first time a pull request is held, it is
+// labeled with -held_label and a comment explains why.
+func holdForFreeze(ctx context.Context, f forge.Forge, issueNum int, now time.Time) (bool, error) {
+	reasons, err := freeze.Active(now)
+	if err != nil {
+		return false, err
+	}
+	if len(reasons) == 0 {
+		return false, nil
+	}
+	if *heldLabel != "" {
+		held, err := forge.HasLabel(ctx, f, issueNum, *heldLabel)
+		if err != nil {
+			return false, err
+		}
+		if held {
+			return true, nil
+		}
+		if err := f.AddLabel(ctx, issueNum, *heldLabel); err != nil {
+			return false, err
+		}
+		audit.Record(slug, "add-label", fmt.Sprintf("#%d %s", issueNum, *heldLabel))
+	}
+	body := fmt.Sprintf("Not merging automatically: the freeze calendar is active (%s). This pull request will be merged once the freeze is over.",
+		strings.Join(reasons, ", "))
+	commentURL, err := f.Comment(ctx, issueNum, body)
+	if err != nil {
+		return false, err
+	}
+	audit.Record(slug, "add-comment", commentURL)
+	return true, nil
+}
+
+// unhold removes -held_label from a pull request which was held before.
+func unhold(ctx context.Context, f forge.Forge, issueNum int) error {
+	if *heldLabel == "" {
+		return nil
+	}
+	held, err := forge.HasLabel(ctx, f, issueNum, *heldLabel)
+	if err != nil || !held {
+		return err
+	}
+	if err := f.RemoveLabel(ctx, issueNum, *heldLabel); err != nil {
+		return err
+	}
+	audit.Record(slug, "remove-label", fmt.Sprintf("#%d %s", issueNum, *heldLabel))
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// labelExpr is a compiled boolean label expression, which reports whether
+// it holds for the specified set of pull request labels.
+type labelExpr func(labels map[string]bool) bool
+
+// parseLabelExpr compiles a boolean expression over label names, e.g.
+//
+//	boot-tested && !do-not-merge && (kernel || firmware)
+//
+// Operators are ! (not), && (and) and || (or), in decreasing order of
+// precedence, and parentheses. Label names which contain spaces or
+// operator characters can be double-quoted: "needs review".
+func parseLabelExpr(s string) (labelExpr, error) {
+	p := &labelExprParser{input: s}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return nil, fmt.Errorf("label expression %q: unexpected %q at offset %d", s, p.input[p.pos:], p.pos)
+	}
+	return expr, nil
+}
+
+type labelExprParser struct {
+	input string
+	pos   int
+}
+
+func (p *labelExprParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// consume skips whitespace and, if the input continues with tok, consumes
+// it.
+func (p *labelExprParser) consume(tok string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.input[p.pos:], tok) {
+		p.pos += len(tok)
+		return true
+	}
+	return false
+}
+
+func (p *labelExprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("label expression %q: offset %d: %s", p.input, p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *labelExprParser) parseOr() (labelExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.consume("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(labels map[string]bool) bool { return l(labels) || right(labels) }
+	}
+	return left, nil
+}
+
+func (p *labelExprParser) parseAnd() (labelExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.consume("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(labels map[string]bool) bool { return l(labels) && right(labels) }
+	}
+	return left, nil
+}
+
+func (p *labelExprParser) parseUnary() (labelExpr, error) {
+	if p.consume("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(labels map[string]bool) bool { return !operand(labels) }, nil
+	}
+	if p.consume("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.consume(")") {
+			return nil, p.errorf("expected )")
+		}
+		return expr, nil
+	}
+	label, err := p.parseLabel()
+	if err != nil {
+		return nil, err
+	}
+	return func(labels map[string]bool) bool { return labels[label] }, nil
+}
+
+func (p *labelExprParser) parseLabel() (string, error) {
+	p.skipSpace()
+	if p.consume(`"`) {
+		end := strings.IndexByte(p.input[p.pos:], '"')
+		if end == -1 {
+			return "", p.errorf("unterminated quoted label")
+		}
+		label := p.input[p.pos : p.pos+end]
+		p.pos += end + 1
+		return label, nil
+	}
+	start := p.pos
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		if unicode.IsSpace(rune(c)) || strings.IndexByte(`!&|()"`, c) > -1 {
+			break
+		}
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected label name")
+	}
+	return p.input[start:p.pos], nil
+}
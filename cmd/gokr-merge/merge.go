@@ -3,62 +3,155 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"log"
-	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/gokrazy/autoupdate/internal/audit"
 	"github.com/gokrazy/autoupdate/internal/cienv"
-	"github.com/google/go-github/v35/github"
+	"github.com/gokrazy/autoupdate/internal/forge"
+	"github.com/gokrazy/autoupdate/internal/metrics"
+	"github.com/gokrazy/autoupdate/internal/notify"
+	"github.com/gokrazy/autoupdate/internal/prmeta"
+	"github.com/gokrazy/autoupdate/internal/secret"
+	"github.com/gokrazy/autoupdate/internal/settings"
+	"github.com/gokrazy/autoupdate/internal/version"
 )
 
 var (
 	requireLabel = flag.String("require_label",
 		"",
 		"name of the required label before the PR will be merged")
+
+	baseBranch = flag.String("base_branch",
+		"",
+		"if non-empty, only merge PRs targeting this branch (e.g. main)")
+
+	labelExpression = flag.String("label_expression",
+		"",
+		"boolean expression over the PR labels which must hold before the PR will be merged, e.g. 'boot-tested && !do-not-merge && (kernel || firmware)'. Alternative to -require_label. Metadata in the PR body (see gokr-pull-kernel) is available as kind:<kind>, flavor:<flavor> and checked:<checklist item>, but only for PRs opened by the automation user (GITHUB_USER), as other authors can edit the body")
+
+	requireChecklist = flag.String("require_checklist",
+		"",
+		"comma-separated list of checklist items in the PR body (e.g. boot-tested, as ticked by gokr-boot -checklist_item) which must be ticked before the PR will be merged. PRs which were not opened by the automation user (GITHUB_USER) are never merged with -require_checklist, as their author could tick the items")
+
+	auditLog = flag.String("audit_log",
+		"",
+		"if non-empty, path to a JSON Lines file to which every mutation (PRs opened, commits amended, labels changed, merges) is appended")
+
+	auditBranch = flag.String("audit_branch",
+		"",
+		"if non-empty, name of a branch in the target repository to which the audit log entries of each run are committed as a new file audit/<time>-<tool>-<pid>.jsonl")
+
+	auditS3 = flag.String("audit_s3",
+		"",
+		"if non-empty, path-style URL of an S3-compatible bucket, optionally followed by a key prefix (e.g. https://s3.eu-central-1.amazonaws.com/my-bucket/audit), to which the audit log entries of each run are uploaded as a new object <owner>/<repo>/<time>-<tool>-<pid>.jsonl. Objects are never overwritten, so the bucket can enforce retention with S3 Object Lock. Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+
+	printVersion = flag.Bool("version",
+		false,
+		"print version information and exit")
+
+	metricsListen = flag.String("metrics_listen",
+		"",
+		"if non-empty, host:port on which to serve Prometheus metrics at /metrics while the tool runs (e.g. :9090)")
+
+	metricsTextfile = flag.String("metrics_textfile",
+		"",
+		"if non-empty, path of a file (ending in .prom) to which the metrics are written whenever they change, for the textfile collector of the Prometheus node_exporter on the CI runner, e.g. /var/lib/node_exporter/textfile/gokr-merge.prom")
+
+	metricsPushgateway = flag.String("metrics_pushgateway",
+		"",
+		"if non-empty, URL of a Prometheus Pushgateway (e.g. http://pushgateway:9091) to which the metrics are pushed whenever they change, grouped by job=gokr-merge")
+
+	forgeKind = flag.String("forge",
+		"github",
+		"code forge hosting the repository. one of github, gitea or gitlab")
+
+	forgeURL = flag.String("forge_url",
+		"",
+		"base URL of the -forge=gitea or -forge=gitlab instance, e.g. https://gitlab.example.com")
+
+	tokenFile = flag.String("token_file",
+		"",
+		"if non-empty, path of a file containing the forge API token, instead of the GITHUB_AUTH_TOKEN or GH_AUTH_TOKEN environment variables. The variables can also name a file via GH_AUTH_TOKEN_FILE (e.g. a Docker secret) or be provided as systemd credentials")
+
+	autoupdateConfig = flag.String("autoupdate_config",
+		"autoupdate.toml",
+		"path to the autoupdate.toml configuration file shared by all tools (or a .json file of the same structure). A missing file is treated as empty")
 )
 
-func ensureLabel(ctx context.Context, client *github.Client, owner, repo string, issueNum int, label string) (bool, error) {
-	labels, _, err := client.Issues.ListLabelsByIssue(ctx, owner, repo, issueNum, nil)
+// openedByAutomation reports whether pull request issueNum was opened by the
+// automation user (GITHUB_USER), whose pull request bodies are trusted.
+func openedByAutomation(ctx context.Context, f forge.Forge, issueNum int) (bool, error) {
+	author, err := f.Author(ctx, issueNum)
 	if err != nil {
-		return true, err
+		return false, err
 	}
-	for _, l := range labels {
-		if *l.Name == label {
-			return true, nil
-		}
-	}
-	return false, nil
-}
-
-func merge(ctx context.Context, client *github.Client, owner, repo string, issueNum int) error {
-	_, _, err := client.PullRequests.Merge(ctx, owner, repo, issueNum, "automatically merged", &github.PullRequestOptions{
-		MergeMethod: "squash",
-	})
-	return err
+	return strings.EqualFold(author, githubUser), nil
 }
 
-func deleteRef(ctx context.Context, client *github.Client, owner, repo string, ref string) error {
-	_, err := client.Git.DeleteRef(ctx, owner, repo, ref)
-	return err
+func merge(ctx context.Context, f forge.Forge, issueNum int, sha string) error {
+	return f.Merge(ctx, issueNum, "automatically merged", sha)
 }
 
 var (
-	githubUser              = cienv.MustGetGithubUser()
-	authToken               = cienv.MustGetAuthToken()
-	slug                    = cienv.MustGetSlug()
-	travisPullRequest       = cienv.MustGetPullRequest()
-	travisPullRequestBranch = cienv.MustGetPullRequestBranch()
+	githubUser              string
+	authToken               string
+	slug                    string
+	travisPullRequest       string
+	travisPullRequestBranch string
 )
 
 func main() {
 	flag.Parse()
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	secret.Install()
+	settings.SetPath(*autoupdateConfig)
+	audit.Configure(audit.Options{
+		Log:    *auditLog,
+		Branch: *auditBranch,
+		S3:     *auditS3,
+	})
+	version.MaybePrint(*printVersion)
+	metrics.Serve(metrics.Options{
+		Listen:      *metricsListen,
+		Textfile:    *metricsTextfile,
+		Pushgateway: *metricsPushgateway,
+	})
+
+	githubUser = cienv.MustGetGithubUser()
+	authToken = cienv.MustGetAuthToken(*tokenFile)
+	slug = cienv.MustGetSlug()
+	if *promoteFlag {
+		// Promotion runs on its own schedule, independently of pull
+		// requests.
+		runPromote()
+		return
+	}
+	if !*commentCommands {
+		// With -comment_commands, the pull request is determined from the
+		// comment instead.
+		travisPullRequest = cienv.MustGetPullRequest()
+		travisPullRequestBranch = cienv.MustGetPullRequestBranch()
+	}
 
-	if *requireLabel == "" {
-		log.Fatal("-require_label is a required flag")
+	if *requireLabel != "" && *labelExpression != "" {
+		log.Fatal("-require_label and -label_expression are mutually exclusive")
+	}
+	if *requireLabel == "" && *labelExpression == "" && *requireChecklist == "" {
+		log.Fatal("one of -require_label, -label_expression or -require_checklist must be specified")
+	}
+	var expr labelExpr
+	if *labelExpression != "" {
+		var err error
+		expr, err = parseLabelExpr(*labelExpression)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	parts := strings.Split(slug, "/")
@@ -68,31 +161,172 @@ func main() {
 
 	ctx := context.Background()
 
-	client := github.NewClient(&http.Client{
-		Transport: &github.BasicAuthTransport{
-			Username: githubUser,
-			Password: authToken,
-		},
-	})
+	f, err := forge.New(*forgeKind, *forgeURL, parts[0], parts[1], githubUser, authToken)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	base := cienv.GetBaseBranch()
+	// commandHead is the pull request head at the time of the /merge
+	// command, if any.
+	var commandHead string
+	if *commentCommands {
+		client := forge.GitHubClient(f)
+		if client == nil {
+			log.Fatal("-comment_commands requires -forge=github")
+		}
+		target, err := runCommentCommand(ctx, client, parts[0], parts[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if target == nil {
+			// The run ends here, e.g. after /retest. For /merge, the audit
+			// log is committed after merging.
+			if err := audit.Commit(ctx, client, parts[0], parts[1]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		travisPullRequest = strconv.Itoa(target.issueNum)
+		travisPullRequestBranch = target.branch
+		base = target.base
+		commandHead = target.head
+	}
 
 	issueNum, err := strconv.ParseInt(travisPullRequest, 0, 64)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	found, err := ensureLabel(ctx, client, parts[0], parts[1], int(issueNum), *requireLabel)
+	if *baseBranch != "" {
+		if base != *baseBranch {
+			log.Printf("PR targets branch %q, not -base_branch=%q", base, *baseBranch)
+			os.Exit(2) // not targeting the base branch
+		}
+	}
+
+	// The checklist and metadata in the PR body are only trusted if the
+	// automation user opened the PR: other authors can edit the body, e.g.
+	// tick the boot-tested item themselves.
+	var (
+		body    string
+		trusted bool
+	)
+	if expr != nil || *requireChecklist != "" {
+		trusted, err = openedByAutomation(ctx, f, int(issueNum))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if trusted {
+			body, err = f.Body(ctx, int(issueNum))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if *requireChecklist != "" {
+		if !trusted {
+			log.Printf("PR was not opened by %s, not trusting its checklist", githubUser)
+			os.Exit(2) // checklist not trustworthy
+		}
+		if _, err := prmeta.Parse(body); err != nil {
+			log.Print(err)
+			os.Exit(2) // no metadata, e.g. a PR opened by hand
+		}
+		checklist := prmeta.Checklist(body)
+		for _, item := range strings.Split(*requireChecklist, ",") {
+			if !checklist[item] {
+				log.Printf("checklist item %q not ticked", item)
+				os.Exit(2) // checklist item not ticked
+			}
+		}
+	}
+
+	if expr != nil {
+		labels, err := f.Labels(ctx, int(issueNum))
+		if err != nil {
+			log.Fatal(err)
+		}
+		labels = append(labels, prmeta.Facts(body)...)
+		set := make(map[string]bool, len(labels))
+		for _, l := range labels {
+			set[l] = true
+		}
+		if !expr(set) {
+			log.Printf("label expression %q does not hold for labels %q", *labelExpression, labels)
+			os.Exit(2) // label expression not satisfied
+		}
+	} else if *requireLabel != "" {
+		found, err := forge.HasLabel(ctx, f, int(issueNum), *requireLabel)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !found {
+			os.Exit(2) // label not present
+		}
+	}
+
+	var head string
+	if *verifyTestedHead {
+		head, err = testedHead(ctx, f, int(issueNum))
+		if err != nil {
+			if errors.Is(err, errUntested) {
+				log.Print(err)
+				os.Exit(2) // head not boot-tested
+			}
+			log.Fatal(err)
+		}
+		if commandHead != "" && head != commandHead {
+			log.Printf("boot-tested head %s is not the head %s at the time of the /merge command", head, commandHead)
+			os.Exit(2) // head changed since the command
+		}
+	} else {
+		head = commandHead
+	}
+
+	held, err := holdForFreeze(ctx, f, int(issueNum), time.Now())
 	if err != nil {
 		log.Fatal(err)
 	}
-	if !found {
-		os.Exit(2) // label not present
+	if held {
+		log.Printf("freeze calendar active, holding PR")
+		if err := audit.Commit(ctx, forge.GitHubClient(f), parts[0], parts[1]); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(2) // held during freeze
+	}
+
+	if err := merge(ctx, f, int(issueNum), head); err != nil {
+		notify.Failed(ctx, slug, err)
+		log.Fatal(err)
+	}
+	audit.Record(slug, "merge", "#"+travisPullRequest)
+	notify.Send(ctx, notify.Event{
+		Kind: notify.Merged,
+		Repo: slug,
+		URL:  f.PullRequestURL(int(issueNum)),
+	})
+	notify.Succeeded(slug)
+
+	// The PR is merged at this point, so still clean up and commit the
+	// audit log if the bookkeeping fails.
+	bookkeepingErr := postMerge(ctx, f, int(issueNum))
+	if bookkeepingErr != nil {
+		log.Printf("post-merge bookkeeping: %v", bookkeepingErr)
 	}
 
-	if err := merge(ctx, client, parts[0], parts[1], int(issueNum)); err != nil {
+	if err := f.DeleteBranch(ctx, travisPullRequestBranch); err != nil {
 		log.Fatal(err)
 	}
+	audit.Record(slug, "delete-ref", "heads/"+travisPullRequestBranch)
 
-	if err := deleteRef(ctx, client, parts[0], parts[1], "heads/"+travisPullRequestBranch); err != nil {
+	if err := audit.Commit(ctx, forge.GitHubClient(f), parts[0], parts[1]); err != nil {
 		log.Fatal(err)
 	}
+
+	if bookkeepingErr != nil {
+		os.Exit(1)
+	}
+
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/gokrazy/autoupdate/internal/forge"
+)
+
+var (
+	verifyTestedHead = flag.Bool("verify_tested_head",
+		false,
+		"only merge the PR if its head passed the gokr-boot check (see gokr-boot -check_run), i.e. refuse to merge commits pushed after the hardware test ran. The merge itself is also made conditional on the head, so that a push racing with gokr-merge fails the merge")
+
+	bootCheckApp = flag.Int64("boot_check_app_id",
+		15368,
+		"with -verify_tested_head on GitHub, ID of the GitHub App as which gokr-boot -check_run reports its check: 15368 (GitHub Actions) if gokr-boot runs with GITHUB_TOKEN, or the ID of your GitHub App. Check runs of the same name created by other apps are ignored, so that other workflows cannot pass the check")
+)
+
+// bootCheckName is the name of the check which gokr-boot -check_run reports.
+const bootCheckName = "gokr-boot"
+
+// errUntested is returned by testedHead if the head of the pull request was
+// not boot-tested.
+var errUntested = errors.New("pull request head was not boot-tested")
+
+// testedHead returns the head of pull request issueNum if the gokr-boot
+// check passed on it, and an error wrapping errUntested otherwise. The check
+// is verified instead of a record in the pull request body, which the pull
+// request author could edit.
+func testedHead(ctx context.Context, f forge.Forge, issueNum int) (string, error) {
+	head, err := f.HeadSHA(ctx, issueNum)
+	if err != nil {
+		return "", err
+	}
+	passed, err := f.CheckPassed(ctx, head, bootCheckName, *bootCheckApp)
+	if err != nil {
+		return "", err
+	}
+	if !passed {
+		return "", fmt.Errorf("%w: no passed %s check on head %s", errUntested, bootCheckName, head)
+	}
+	return head, nil
+}
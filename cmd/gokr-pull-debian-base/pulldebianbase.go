@@ -0,0 +1,328 @@
+// gokr-pull-debian-base opens pull requests which bump the pinned digest of
+// the Debian base image used for kernel builds (see the base-image.txt file
+// of gokr-rebuild-kernel), so that builds run in a reproducible environment
+// while still receiving security updates via reviewed pull requests.
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/audit"
+	"github.com/gokrazy/autoupdate/internal/cienv"
+	"github.com/gokrazy/autoupdate/internal/dedup"
+	"github.com/gokrazy/autoupdate/internal/metrics"
+	"github.com/gokrazy/autoupdate/internal/notify"
+	"github.com/gokrazy/autoupdate/internal/ratelimit"
+	"github.com/gokrazy/autoupdate/internal/secret"
+	"github.com/gokrazy/autoupdate/internal/settings"
+	"github.com/gokrazy/autoupdate/internal/version"
+	"github.com/google/go-github/v35/github"
+)
+
+var (
+	image = flag.String("image",
+		"debian:bookworm",
+		"Docker Hub image (name:tag) whose digest to track")
+
+	updaterPath = flag.String("updater_path",
+		"_build/base-image.txt",
+		"file in which to update the pinned image reference (image@sha256:…)")
+
+	auditLog = flag.String("audit_log",
+		"",
+		"if non-empty, path to a JSON Lines file to which every mutation (PRs opened, commits amended, labels changed, merges) is appended")
+
+	auditBranch = flag.String("audit_branch",
+		"",
+		"if non-empty, name of a branch in the target repository to which the audit log entries of each run are committed as a new file audit/<time>-<tool>-<pid>.jsonl")
+
+	auditS3 = flag.String("audit_s3",
+		"",
+		"if non-empty, path-style URL of an S3-compatible bucket, optionally followed by a key prefix (e.g. https://s3.eu-central-1.amazonaws.com/my-bucket/audit), to which the audit log entries of each run are uploaded as a new object <owner>/<repo>/<time>-<tool>-<pid>.jsonl. Objects are never overwritten, so the bucket can enforce retention with S3 Object Lock. Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+
+	printVersion = flag.Bool("version",
+		false,
+		"print version information and exit")
+
+	metricsListen = flag.String("metrics_listen",
+		"",
+		"if non-empty, host:port on which to serve Prometheus metrics at /metrics while the tool runs (e.g. :9090)")
+
+	metricsTextfile = flag.String("metrics_textfile",
+		"",
+		"if non-empty, path of a file (ending in .prom) to which the metrics are written whenever they change, for the textfile collector of the Prometheus node_exporter on the CI runner, e.g. /var/lib/node_exporter/textfile/gokr-pull-debian-base.prom")
+
+	metricsPushgateway = flag.String("metrics_pushgateway",
+		"",
+		"if non-empty, URL of a Prometheus Pushgateway (e.g. http://pushgateway:9091) to which the metrics are pushed whenever they change, grouped by job=gokr-pull-debian-base")
+
+	dedupWindow = flag.Duration("dedup_window",
+		14*24*time.Hour,
+		"pull requests for the same upstream version which were closed (merged or not, e.g. as superseded) within this duration prevent opening a new one. 0 disables the check for closed pull requests")
+
+	ratelimitMaxWait = flag.Duration("ratelimit_max_wait",
+		0,
+		"if the remaining GitHub API quota does not suffice for the estimated number of requests, wait up to this long for the quota to reset instead of aborting")
+
+	tokenFile = flag.String("token_file",
+		"",
+		"if non-empty, path of a file containing the forge API token, instead of the GITHUB_AUTH_TOKEN or GH_AUTH_TOKEN environment variables. The variables can also name a file via GH_AUTH_TOKEN_FILE (e.g. a Docker secret) or be provided as systemd credentials")
+
+	autoupdateConfig = flag.String("autoupdate_config",
+		"autoupdate.toml",
+		"path to the autoupdate.toml configuration file shared by all tools (or a .json file of the same structure). A missing file is treated as empty")
+)
+
+// getDigest returns the current manifest digest of ref (name:tag) on Docker
+// Hub, e.g. sha256:0123….
+func getDigest(ctx context.Context, ref string) (string, error) {
+	name, tag, ok := strings.Cut(ref, ":")
+	if !ok {
+		return "", fmt.Errorf("malformed -image %q: expected name:tag", ref)
+	}
+	if !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+
+	tokenURL := "https://auth.docker.io/token?service=registry.docker.io&scope=" + url.QueryEscape("repository:"+name+":pull")
+	resp, err := http.Get(tokenURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", tokenURL, got, want)
+	}
+	var token struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	manifestURL := "https://registry-1.docker.io/v2/" + name + "/manifests/" + tag
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	// Request the multi-platform index, whose digest is what docker pull
+	// image@digest resolves on every platform.
+	req.Header.Add("Accept", "application/vnd.oci.image.index.v1+json")
+	req.Header.Add("Accept", "application/vnd.docker.distribution.manifest.list.v2+json")
+	mresp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	mresp.Body.Close()
+	if got, want := mresp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", manifestURL, got, want)
+	}
+	digest := mresp.Header.Get("Docker-Content-Digest")
+	if !strings.HasPrefix(digest, "sha256:") {
+		return "", fmt.Errorf("%s: unexpected Docker-Content-Digest %q", manifestURL, digest)
+	}
+	return digest, nil
+}
+
+// updateRequests is the number of GitHub API requests updateBase makes (ref,
+// commit, tree, blob, new tree, new commit, new ref, pull request).
+const updateRequests = 8 + dedup.Requests
+
+func updateBase(ctx context.Context, client *github.Client, owner, repo string) error {
+	if err := ratelimit.Preflight(ctx, client, updateRequests, *ratelimitMaxWait); err != nil {
+		return err
+	}
+
+	pollStart := time.Now()
+	digest, err := getDigest(ctx, *image)
+	metrics.Poll(pollStart, err)
+	if err != nil {
+		return err
+	}
+	pinned := *image + "@" + digest
+	log.Printf("current image: %s", pinned)
+
+	lastRef, _, err := client.Git.GetRef(ctx, owner, repo, "heads/main")
+	if err != nil {
+		return err
+	}
+
+	lastCommit, _, err := client.Git.GetCommit(ctx, owner, repo, *lastRef.Object.SHA)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("lastCommit = %+v", lastCommit)
+
+	baseTree, _, err := client.Git.GetTree(ctx, owner, repo, *lastCommit.SHA, true)
+	if err != nil {
+		return err
+	}
+	log.Printf("baseTree = %+v", baseTree)
+
+	var updaterSHA string
+	for _, entry := range baseTree.Entries {
+		if *entry.Path == *updaterPath {
+			updaterSHA = *entry.SHA
+			break
+		}
+	}
+
+	if updaterSHA == "" {
+		return fmt.Errorf("%s not found in %s/%s", *updaterPath, owner, repo)
+	}
+
+	updaterBlob, _, err := client.Git.GetBlob(ctx, owner, repo, updaterSHA)
+	if err != nil {
+		return err
+	}
+
+	updaterContent, err := base64.StdEncoding.DecodeString(*updaterBlob.Content)
+	if err != nil {
+		return err
+	}
+
+	imageRe := regexp.MustCompile(regexp.QuoteMeta(*image) + `(@sha256:[0-9a-f]{64})?`)
+	matches := imageRe.FindStringSubmatch(string(updaterContent))
+	if matches == nil {
+		return fmt.Errorf("regexp %v resulted in no matches", imageRe)
+	}
+	if matches[0] == pinned {
+		log.Printf("already at latest digest")
+		return nil
+	}
+	newContent := imageRe.ReplaceAllLiteral(updaterContent, []byte(pinned))
+
+	entries := []*github.TreeEntry{
+		{
+			Path:    github.String(*updaterPath),
+			Mode:    github.String("100644"),
+			Type:    github.String("blob"),
+			Content: github.String(string(newContent)),
+		},
+	}
+
+	short := strings.TrimPrefix(digest, "sha256:")[:12]
+	dup, err := dedup.Check(ctx, client, owner, repo, "pull-base-"+short, short, *dedupWindow)
+	if err != nil {
+		return err
+	}
+	if dup != "" {
+		log.Printf("not proposing %s again: %s", short, dup)
+		return nil
+	}
+
+	newTree, _, err := client.Git.CreateTree(ctx, owner, repo, *baseTree.SHA, entries)
+	if err != nil {
+		return err
+	}
+	log.Printf("newTree = %+v", newTree)
+
+	newCommit, _, err := client.Git.CreateCommit(ctx, owner, repo, &github.Commit{
+		Message: github.String("auto-update " + *image + " to " + digest),
+		Tree:    newTree,
+		Parents: []*github.Commit{lastCommit},
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("newCommit = %+v", newCommit)
+
+	newRef, _, err := client.Git.CreateRef(ctx, owner, repo, &github.Reference{
+		Ref: github.String("refs/heads/pull-base-" + short),
+		Object: &github.GitObject{
+			SHA: newCommit.SHA,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("newRef = %+v", newRef)
+	audit.Record(owner+"/"+repo, "create-ref", *newRef.Ref)
+
+	pr, _, err := client.PullRequests.Create(ctx, owner, repo, &github.NewPullRequest{
+		Title: github.String("auto-update " + *image + " to " + short),
+		Head:  github.String("pull-base-" + short),
+		Base:  github.String("main"),
+		Body:  github.String("Pins `" + pinned + "`."),
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("pr = %+v", pr)
+	audit.Record(owner+"/"+repo, "open-pull-request", pr.GetHTMLURL())
+	notify.Send(ctx, notify.Event{
+		Kind:  notify.PullRequestOpened,
+		Repo:  owner + "/" + repo,
+		Title: pr.GetTitle(),
+		URL:   pr.GetHTMLURL(),
+	})
+
+	return nil
+}
+
+var (
+	githubUser string
+	authToken  string
+	slug       string
+)
+
+func main() {
+	flag.Parse()
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	secret.Install()
+	settings.SetPath(*autoupdateConfig)
+	audit.Configure(audit.Options{
+		Log:    *auditLog,
+		Branch: *auditBranch,
+		S3:     *auditS3,
+	})
+	version.MaybePrint(*printVersion)
+	metrics.Serve(metrics.Options{
+		Listen:      *metricsListen,
+		Textfile:    *metricsTextfile,
+		Pushgateway: *metricsPushgateway,
+	})
+
+	githubUser = cienv.MustGetGithubUser()
+	authToken = cienv.MustGetAuthToken(*tokenFile)
+	slug = cienv.MustGetSlug()
+
+	parts := strings.Split(slug, "/")
+	if got, want := len(parts), 2; got != want {
+		log.Fatalf("unexpected number of /-separated parts in %q: got %d, want %d", slug, got, want)
+	}
+
+	ctx := context.Background()
+
+	client := github.NewClient(&http.Client{
+		Transport: &github.BasicAuthTransport{
+			Username: githubUser,
+			Password: authToken,
+		},
+	})
+
+	err := updateBase(ctx, client, parts[0], parts[1])
+	ratelimit.Report(ctx, client)
+	if err != nil {
+		notify.Failed(ctx, parts[0]+"/"+parts[1], err)
+		log.Fatal(err)
+	}
+	notify.Succeeded(parts[0] + "/" + parts[1])
+
+	if err := audit.Commit(ctx, client, parts[0], parts[1]); err != nil {
+		log.Fatal(err)
+	}
+}
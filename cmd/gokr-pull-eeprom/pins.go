@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/google/go-github/v35/github"
+)
+
+var (
+	upstreamRecovery = flag.String("upstream_recovery",
+		"firmware-2711/latest/recovery.bin",
+		"path of the recovery.bin in github.com/raspberrypi/rpi-eeprom which a const recoveryRef = \"<commit>\" declaration in the updater pins")
+
+	upstreamBootconf = flag.String("upstream_bootconf",
+		"",
+		"if non-empty, path of the default boot.conf in github.com/raspberrypi/rpi-eeprom, which a const bootconfRef = \"<commit>\" declaration in the updater pins and -bootconf_path mirrors")
+
+	bootconfPath = flag.String("bootconf_path",
+		"",
+		"if non-empty, path of a copy of the -upstream_bootconf file in the repository, which is updated in the same pull request. Requires -upstream_bootconf")
+)
+
+// pins are declarations in the updater source which pin an upstream file to
+// the commit which last changed it, so that the recovery.bin and boot.conf
+// defaults are updated together with the EEPROM image. Pins which the
+// updater does not declare are left alone.
+var pins = []struct {
+	re       *regexp.Regexp
+	decl     string
+	upstream *string
+}{
+	{regexp.MustCompile(`const recoveryRef = "([0-9a-f]+)"`), "const recoveryRef = %q", upstreamRecovery},
+	{regexp.MustCompile(`const bootconfRef = "([0-9a-f]+)"`), "const bootconfRef = %q", upstreamBootconf},
+}
+
+// bootconfRequests is the number of GitHub API requests made for
+// -upstream_bootconf and -bootconf_path (commits, upstream contents).
+func bootconfRequests() int {
+	if *upstreamBootconf == "" {
+		return 0
+	}
+	return 2
+}
+
+// latestFileCommit returns the SHA of the most recent rpi-eeprom commit
+// touching path.
+func latestFileCommit(ctx context.Context, client *github.Client, path string) (string, error) {
+	commits, _, err := client.Repositories.ListCommits(ctx, "raspberrypi", "rpi-eeprom", &github.CommitsListOptions{
+		Path: path,
+		ListOptions: github.ListOptions{
+			Page:    1,
+			PerPage: 1,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if got, want := len(commits), 1; got != want {
+		return "", fmt.Errorf("unexpected number of commits for file %q: got %d, want %d", path, got, want)
+	}
+	log.Printf("at %s (%v): %s", commits[0].GetSHA(), commits[0].GetCommit().GetCommitter().GetDate(), path)
+	return commits[0].GetSHA(), nil
+}
+
+// updatePins updates the pins declared in the updater source content to
+// the commits in fileCommits (keyed by upstream path).
+func updatePins(content []byte, fileCommits map[string]string) ([]byte, error) {
+	for _, p := range pins {
+		if !p.re.Match(content) {
+			continue
+		}
+		if *p.upstream == "" {
+			return nil, fmt.Errorf("updater declares %v, but the corresponding -upstream_* flag is empty", p.re)
+		}
+		commit, ok := fileCommits[*p.upstream]
+		if !ok {
+			return nil, fmt.Errorf("%s not found in github.com/raspberrypi/rpi-eeprom", *p.upstream)
+		}
+		content = p.re.ReplaceAllLiteral(content, []byte(fmt.Sprintf(p.decl, commit)))
+	}
+	return content, nil
+}
+
+// bootconfEntry returns a tree entry replacing -bootconf_path with the
+// -upstream_bootconf file at commit, or nil if it is already up to date.
+func bootconfEntry(ctx context.Context, client *github.Client, baseTree *github.Tree, commit string) (*github.TreeEntry, error) {
+	if *upstreamBootconf == "" {
+		return nil, fmt.Errorf("-bootconf_path requires -upstream_bootconf")
+	}
+	upstream, _, _, err := client.Repositories.GetContents(ctx, "raspberrypi", "rpi-eeprom", *upstreamBootconf, &github.RepositoryContentGetOptions{
+		Ref: commit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if upstream == nil {
+		return nil, fmt.Errorf("%s is not a file", *upstreamBootconf)
+	}
+	content, err := upstream.GetContent()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range baseTree.Entries {
+		if entry.GetPath() != *bootconfPath {
+			continue
+		}
+		// Compare git blob hashes instead of fetching the current content.
+		if entry.GetSHA() == upstream.GetSHA() {
+			return nil, nil
+		}
+	}
+	return &github.TreeEntry{
+		Path:    github.String(*bootconfPath),
+		Mode:    github.String("100644"),
+		Type:    github.String("blob"),
+		Content: github.String(content),
+	}, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"flag"
@@ -8,27 +9,48 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"regexp"
 	"strings"
+	"time"
 
+	"github.com/gokrazy/autoupdate/internal/audit"
+	"github.com/gokrazy/autoupdate/internal/cienv"
+	"github.com/gokrazy/autoupdate/internal/dedup"
+	"github.com/gokrazy/autoupdate/internal/metrics"
+	"github.com/gokrazy/autoupdate/internal/notify"
+	"github.com/gokrazy/autoupdate/internal/ratelimit"
+	"github.com/gokrazy/autoupdate/internal/secret"
+	"github.com/gokrazy/autoupdate/internal/settings"
+	"github.com/gokrazy/autoupdate/internal/version"
 	"github.com/google/go-github/v35/github"
 )
 
 // getUpstreamCommit returns the SHA of the most recent
-// github.com/raspberrypi/firmware git commit which touches
-// boot/*.{elf,bin,dat}.
-func getUpstreamCommit(ctx context.Context, client *github.Client) (string, error) {
+// github.com/raspberrypi/rpi-eeprom git commit which touches
+// firmware-2711/latest/*.bin, and the SHA of the most recent commit touching
+// each of these files (e.g. recovery.bin).
+func getUpstreamCommit(ctx context.Context, client *github.Client) (string, map[string]string, error) {
 	_, dirContents, _, err := client.Repositories.GetContents(ctx, "raspberrypi", "rpi-eeprom", "firmware-2711/latest", &github.RepositoryContentGetOptions{})
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	var latestCommit *github.RepositoryCommit
-
+	var files []*github.RepositoryContent
 	for _, c := range dirContents {
 		if !strings.HasSuffix(*c.Name, ".bin") {
 			continue
 		}
+		files = append(files, c)
+	}
+
+	// One ListCommits request per file, plus the requests of updateEeprom.
+	if err := ratelimit.Preflight(ctx, client, len(files)+updateRequests+bootconfRequests(), *ratelimitMaxWait); err != nil {
+		return "", nil, err
+	}
+
+	var latestCommit *github.RepositoryCommit
+	fileCommits := make(map[string]string)
+
+	for _, c := range files {
 		commits, _, err := client.Repositories.ListCommits(ctx, "raspberrypi", "rpi-eeprom", &github.CommitsListOptions{
 			Path: *c.Path,
 			ListOptions: github.ListOptions{
@@ -37,10 +59,10 @@ func getUpstreamCommit(ctx context.Context, client *github.Client) (string, erro
 			},
 		})
 		if err != nil {
-			return "", err
+			return "", nil, err
 		}
 		if got, want := len(commits), 1; got != want {
-			return "", fmt.Errorf("unexpected number of commits for file %q: got %d, want %d", *c.Path, got, want)
+			return "", nil, fmt.Errorf("unexpected number of commits for file %q: got %d, want %d", *c.Path, got, want)
 		}
 		// NOTE that the assumption is that
 		// https://github.com/raspberrypi/firmware uses correct commit
@@ -49,20 +71,31 @@ func getUpstreamCommit(ctx context.Context, client *github.Client) (string, erro
 		if latestCommit == nil || commits[0].Commit.Committer.Date.After(*latestCommit.Commit.Committer.Date) {
 			latestCommit = commits[0]
 		}
+		fileCommits[*c.Path] = *commits[0].SHA
 		log.Printf("at %s (%v): %s", *commits[0].SHA, *commits[0].Commit.Committer.Date, *c.Path)
 	}
 
 	log.Printf("picked %s as most recent upstream firmware commit", *latestCommit.SHA)
-	return *latestCommit.SHA, nil
+	return *latestCommit.SHA, fileCommits, nil
 }
 
+// updateRequests is the number of GitHub API requests updateEeprom makes after
+// determining the upstream commit (ref, commit, tree, blob, new tree, new
+// commit, new ref, pull request). See also bootconfRequests.
+const updateRequests = 8 + dedup.Requests
+
 func updateEeprom(ctx context.Context, client *github.Client, owner, repo string) error {
-	upstreamCommit, err := getUpstreamCommit(ctx, client)
+	pollStart := time.Now()
+	upstreamCommit, fileCommits, err := getUpstreamCommit(ctx, client)
+	if err == nil && *upstreamBootconf != "" {
+		fileCommits[*upstreamBootconf], err = latestFileCommit(ctx, client, *upstreamBootconf)
+	}
+	metrics.Poll(pollStart, err)
 	if err != nil {
 		return err
 	}
 
-	lastRef, _, err := client.Git.GetRef(ctx, owner, repo, "heads/main")
+	lastRef, _, err := client.Git.GetRef(ctx, owner, repo, "heads/"+*baseBranch)
 	if err != nil {
 		return err
 	}
@@ -80,19 +113,16 @@ func updateEeprom(ctx context.Context, client *github.Client, owner, repo string
 	}
 	log.Printf("baseTree = %+v", baseTree)
 
-	var (
-		updaterSHA  string
-		updaterPath = "cmd/gokr-update-eeprom/eeprom.go"
-	)
+	var updaterSHA string
 	for _, entry := range baseTree.Entries {
-		if *entry.Path == updaterPath {
+		if *entry.Path == *updaterPath {
 			updaterSHA = *entry.SHA
 			break
 		}
 	}
 
 	if updaterSHA == "" {
-		return fmt.Errorf("%s not found in %s/%s", updaterPath, owner, repo)
+		return fmt.Errorf("%s not found in %s/%s", *updaterPath, owner, repo)
 	}
 
 	updaterBlob, _, err := client.Git.GetBlob(ctx, owner, repo, updaterSHA)
@@ -105,25 +135,49 @@ func updateEeprom(ctx context.Context, client *github.Client, owner, repo string
 		return err
 	}
 
-	eepromRefRe := regexp.MustCompile(`const eepromRef = "([0-9a-f]+)"`)
-	matches := eepromRefRe.FindStringSubmatch(string(updaterContent))
-	if matches == nil {
-		return fmt.Errorf("regexp %v resulted in no matches", eepromRefRe)
+	eepromRefRe, err := compileRefRegexp()
+	if err != nil {
+		return err
 	}
-	if matches[1] == upstreamCommit {
-		log.Printf("already at latest commit")
-		return nil
+	newContent, err := replaceRef(eepromRefRe, updaterContent, upstreamCommit)
+	if err != nil {
+		return fmt.Errorf("%s: %v", *updaterPath, err)
+	}
+	newContent, err = updatePins(newContent, fileCommits)
+	if err != nil {
+		return err
 	}
-	newContent := eepromRefRe.ReplaceAllLiteral(updaterContent,
-		[]byte(fmt.Sprintf(`const eepromRef = "%s"`, upstreamCommit)))
 
-	entries := []*github.TreeEntry{
-		{
-			Path:    github.String(updaterPath),
+	var entries []*github.TreeEntry
+	if !bytes.Equal(newContent, updaterContent) {
+		entries = append(entries, &github.TreeEntry{
+			Path:    github.String(*updaterPath),
 			Mode:    github.String("100644"),
 			Type:    github.String("blob"),
 			Content: github.String(string(newContent)),
-		},
+		})
+	}
+	if *bootconfPath != "" {
+		entry, err := bootconfEntry(ctx, client, baseTree, fileCommits[*upstreamBootconf])
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		log.Printf("already at latest commit")
+		return nil
+	}
+
+	dup, err := dedup.Check(ctx, client, owner, repo, "pull-"+upstreamCommit, upstreamCommit, *dedupWindow)
+	if err != nil {
+		return err
+	}
+	if dup != "" {
+		log.Printf("not proposing %s again: %s", upstreamCommit, dup)
+		return nil
 	}
 
 	newTree, _, err := client.Git.CreateTree(ctx, owner, repo, *baseTree.SHA, entries)
@@ -152,34 +206,101 @@ func updateEeprom(ctx context.Context, client *github.Client, owner, repo string
 		return err
 	}
 	log.Printf("newRef = %+v", newRef)
+	audit.Record(owner+"/"+repo, "create-ref", *newRef.Ref)
 
 	pr, _, err := client.PullRequests.Create(ctx, owner, repo, &github.NewPullRequest{
 		Title: github.String("auto-update to " + upstreamCommit),
 		Head:  github.String("pull-" + upstreamCommit),
-		Base:  github.String("main"),
+		Base:  github.String(*baseBranch),
 	})
 	if err != nil {
 		return err
 	}
 
 	log.Printf("pr = %+v", pr)
+	audit.Record(owner+"/"+repo, "open-pull-request", pr.GetHTMLURL())
+	notify.Send(ctx, notify.Event{
+		Kind:  notify.PullRequestOpened,
+		Repo:  owner + "/" + repo,
+		Title: pr.GetTitle(),
+		URL:   pr.GetHTMLURL(),
+	})
 
 	return nil
 }
 
+var (
+	auditLog = flag.String("audit_log",
+		"",
+		"if non-empty, path to a JSON Lines file to which every mutation (PRs opened, commits amended, labels changed, merges) is appended")
+
+	auditBranch = flag.String("audit_branch",
+		"",
+		"if non-empty, name of a branch in the target repository to which the audit log entries of each run are committed as a new file audit/<time>-<tool>-<pid>.jsonl")
+
+	auditS3 = flag.String("audit_s3",
+		"",
+		"if non-empty, path-style URL of an S3-compatible bucket, optionally followed by a key prefix (e.g. https://s3.eu-central-1.amazonaws.com/my-bucket/audit), to which the audit log entries of each run are uploaded as a new object <owner>/<repo>/<time>-<tool>-<pid>.jsonl. Objects are never overwritten, so the bucket can enforce retention with S3 Object Lock. Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+
+	printVersion = flag.Bool("version",
+		false,
+		"print version information and exit")
+
+	metricsListen = flag.String("metrics_listen",
+		"",
+		"if non-empty, host:port on which to serve Prometheus metrics at /metrics while the tool runs (e.g. :9090)")
+
+	metricsTextfile = flag.String("metrics_textfile",
+		"",
+		"if non-empty, path of a file (ending in .prom) to which the metrics are written whenever they change, for the textfile collector of the Prometheus node_exporter on the CI runner, e.g. /var/lib/node_exporter/textfile/gokr-pull-eeprom.prom")
+
+	metricsPushgateway = flag.String("metrics_pushgateway",
+		"",
+		"if non-empty, URL of a Prometheus Pushgateway (e.g. http://pushgateway:9091) to which the metrics are pushed whenever they change, grouped by job=gokr-pull-eeprom")
+
+	dedupWindow = flag.Duration("dedup_window",
+		14*24*time.Hour,
+		"pull requests for the same upstream version which were closed (merged or not, e.g. as superseded) within this duration prevent opening a new one. 0 disables the check for closed pull requests")
+
+	ratelimitMaxWait = flag.Duration("ratelimit_max_wait",
+		0,
+		"if the remaining GitHub API quota does not suffice for the estimated number of requests, wait up to this long for the quota to reset instead of aborting")
+
+	tokenFile = flag.String("token_file",
+		"",
+		"if non-empty, path of a file containing the forge API token, instead of the GITHUB_AUTH_TOKEN or GH_AUTH_TOKEN environment variables. The variables can also name a file via GH_AUTH_TOKEN_FILE (e.g. a Docker secret) or be provided as systemd credentials")
+
+	autoupdateConfig = flag.String("autoupdate_config",
+		"autoupdate.toml",
+		"path to the autoupdate.toml configuration file shared by all tools (or a .json file of the same structure). A missing file is treated as empty")
+)
+
 func main() {
 	flag.Parse()
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	secret.Install()
+	settings.SetPath(*autoupdateConfig)
+	audit.Configure(audit.Options{
+		Log:    *auditLog,
+		Branch: *auditBranch,
+		S3:     *auditS3,
+	})
+	version.MaybePrint(*printVersion)
+	metrics.Serve(metrics.Options{
+		Listen:      *metricsListen,
+		Textfile:    *metricsTextfile,
+		Pushgateway: *metricsPushgateway,
+	})
 
 	for _, name := range []string{
 		"GITHUB_REPOSITORY",
 		"GH_USER",
-		"GH_AUTH_TOKEN",
 	} {
 		if os.Getenv(name) == "" {
 			log.Fatalf("required environment variable %q empty", name)
 		}
 	}
+	authToken := cienv.MustGetAuthToken(*tokenFile)
 
 	slug := os.Getenv("GITHUB_REPOSITORY")
 
@@ -193,11 +314,19 @@ func main() {
 	client := github.NewClient(&http.Client{
 		Transport: &github.BasicAuthTransport{
 			Username: os.Getenv("GH_USER"),
-			Password: os.Getenv("GH_AUTH_TOKEN"),
+			Password: authToken,
 		},
 	})
 
-	if err := updateEeprom(ctx, client, parts[0], parts[1]); err != nil {
+	err := updateEeprom(ctx, client, parts[0], parts[1])
+	ratelimit.Report(ctx, client)
+	if err != nil {
+		notify.Failed(ctx, parts[0]+"/"+parts[1], err)
+		log.Fatal(err)
+	}
+	notify.Succeeded(parts[0] + "/" + parts[1])
+
+	if err := audit.Commit(ctx, client, parts[0], parts[1]); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"regexp"
+)
+
+var (
+	updaterPath = flag.String("updater_path",
+		"cmd/gokr-update-eeprom/eeprom.go",
+		"path of the file (in the target repository) which references the EEPROM commit")
+
+	baseBranch = flag.String("base_branch",
+		"main",
+		"branch of the target repository to propose updates against")
+
+	refRegexp = flag.String("ref_regexp",
+		`const eepromRef = "([0-9a-f]+)"`,
+		"regular expression matching the EEPROM commit reference in -updater_path. The first capture group of each match is replaced with the new commit")
+)
+
+// compileRefRegexp returns the compiled -ref_regexp.
+func compileRefRegexp() (*regexp.Regexp, error) {
+	re, err := regexp.Compile(*refRegexp)
+	if err != nil {
+		return nil, fmt.Errorf("-ref_regexp: %v", err)
+	}
+	if re.NumSubexp() < 1 {
+		return nil, fmt.Errorf("-ref_regexp %v has no capture group for the EEPROM commit", re)
+	}
+	return re, nil
+}
+
+// replaceRef returns content with the first capture group of every match of
+// re replaced with commit.
+func replaceRef(re *regexp.Regexp, content []byte, commit string) ([]byte, error) {
+	var (
+		buf   bytes.Buffer
+		last  int
+		found bool
+	)
+	for _, m := range re.FindAllSubmatchIndex(content, -1) {
+		if m[2] < 0 {
+			continue // capture group did not participate in the match
+		}
+		found = true
+		buf.Write(content[last:m[2]])
+		buf.WriteString(commit)
+		last = m[3]
+	}
+	if !found {
+		return nil, fmt.Errorf("regexp %v resulted in no matches", re)
+	}
+	buf.Write(content[last:])
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v35/github"
+)
+
+// historyDepth is the number of most recent commits of the default branch
+// whose order is used to determine which of the per-path commits is the
+// newest.
+const historyDepth = 100
+
+type graphQLCommit struct {
+	OID           string    `json:"oid"`
+	CommittedDate time.Time `json:"committedDate"`
+}
+
+type graphQLHistory struct {
+	Nodes []graphQLCommit `json:"nodes"`
+}
+
+// latestCommit returns the most recent github.com/raspberrypi/firmware
+// commit touching any of paths using a single GraphQL query.
+//
+// Instead of relying on monotonic committer dates, the per-path commits are
+// ordered by their position in the (topologically ordered) history of the
+// default branch. Committer dates are only consulted for commits older than
+// historyDepth.
+//
+// If until is non-zero, only commits committed at or before until are
+// considered.
+func latestCommit(ctx context.Context, client *github.Client, paths []string, until time.Time) (string, error) {
+	var (
+		params  = []string{"$owner: String!", "$name: String!"}
+		aliases []string
+		vars    = map[string]interface{}{
+			"owner": "raspberrypi",
+			"name":  "firmware",
+		}
+		untilArg string
+	)
+	if !until.IsZero() {
+		params = append(params, "$until: GitTimestamp!")
+		vars["until"] = until.UTC().Format(time.RFC3339)
+		untilArg = ", until: $until"
+	}
+	for idx, p := range paths {
+		params = append(params, fmt.Sprintf("$p%d: String!", idx))
+		aliases = append(aliases, fmt.Sprintf("p%d: history(first: 1, path: $p%d%s) { nodes { oid committedDate } }", idx, idx, untilArg))
+		vars[fmt.Sprintf("p%d", idx)] = p
+	}
+	query := fmt.Sprintf(`query(%s) {
+  repository(owner: $owner, name: $name) {
+    defaultBranchRef {
+      target {
+        ... on Commit {
+          all: history(first: %d) { nodes { oid } }
+          %s
+        }
+      }
+    }
+  }
+}`, strings.Join(params, ", "), historyDepth, strings.Join(aliases, "\n          "))
+
+	req, err := client.NewRequest("POST", "graphql", map[string]interface{}{
+		"query":     query,
+		"variables": vars,
+	})
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Data struct {
+			Repository struct {
+				DefaultBranchRef struct {
+					Target map[string]json.RawMessage `json:"target"`
+				} `json:"defaultBranchRef"`
+			} `json:"repository"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if _, err := client.Do(ctx, req, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Errors) > 0 {
+		return "", fmt.Errorf("GraphQL query failed: %s", resp.Errors[0].Message)
+	}
+	target := resp.Data.Repository.DefaultBranchRef.Target
+
+	var all graphQLHistory
+	if err := json.Unmarshal(target["all"], &all); err != nil {
+		return "", err
+	}
+	position := make(map[string]int)
+	for idx, c := range all.Nodes {
+		position[c.OID] = idx
+	}
+	// newer reports whether commit a is more recent than commit b.
+	newer := func(a, b graphQLCommit) bool {
+		pa, aok := position[a.OID]
+		pb, bok := position[b.OID]
+		switch {
+		case aok && bok:
+			return pa < pb
+		case aok != bok:
+			return aok
+		default:
+			return a.CommittedDate.After(b.CommittedDate)
+		}
+	}
+
+	var latest *graphQLCommit
+	for idx, p := range paths {
+		var h graphQLHistory
+		if err := json.Unmarshal(target[fmt.Sprintf("p%d", idx)], &h); err != nil {
+			return "", err
+		}
+		if got, want := len(h.Nodes), 1; got != want {
+			return "", fmt.Errorf("unexpected number of commits for path %q: got %d, want %d", p, got, want)
+		}
+		c := h.Nodes[0]
+		log.Printf("at %s (%v): %s", c.OID, c.CommittedDate, p)
+		if latest == nil || newer(c, *latest) {
+			latest = &c
+		}
+	}
+	if latest == nil {
+		return "", fmt.Errorf("no paths to track")
+	}
+	return latest.OID, nil
+}
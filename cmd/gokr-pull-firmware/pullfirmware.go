@@ -7,59 +7,162 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"regexp"
+	"path"
 	"strings"
+	"time"
 
+	"github.com/gokrazy/autoupdate/internal/audit"
 	"github.com/gokrazy/autoupdate/internal/cienv"
+	"github.com/gokrazy/autoupdate/internal/dedup"
+	"github.com/gokrazy/autoupdate/internal/metrics"
+	"github.com/gokrazy/autoupdate/internal/notify"
+	"github.com/gokrazy/autoupdate/internal/ratelimit"
+	"github.com/gokrazy/autoupdate/internal/secret"
+	"github.com/gokrazy/autoupdate/internal/settings"
+	"github.com/gokrazy/autoupdate/internal/version"
 	"github.com/google/go-github/v35/github"
 )
 
-// getUpstreamCommit returns the SHA of the most recent
-// github.com/raspberrypi/firmware git commit which touches
-// boot/*.{elf,bin,dat}.
-func getUpstreamCommit(ctx context.Context, client *github.Client) (string, error) {
-	_, dirContents, _, err := client.Repositories.GetContents(ctx, "raspberrypi", "firmware", "boot", &github.RepositoryContentGetOptions{})
-	if err != nil {
-		return "", err
-	}
+var (
+	watch = flag.String("watch",
+		"boot/*.elf,boot/*.bin,boot/*.dat",
+		"comma-separated list of github.com/raspberrypi/firmware paths to track. Entries are path.Match patterns (e.g. boot/bcm2712*.dtb), or directories ending in / (e.g. boot/overlays/) to track all files within")
+
+	auditLog = flag.String("audit_log",
+		"",
+		"if non-empty, path to a JSON Lines file to which every mutation (PRs opened, commits amended, labels changed, merges) is appended")
+
+	auditBranch = flag.String("audit_branch",
+		"",
+		"if non-empty, name of a branch in the target repository to which the audit log entries of each run are committed as a new file audit/<time>-<tool>-<pid>.jsonl")
 
-	var latestCommit *github.RepositoryCommit
+	auditS3 = flag.String("audit_s3",
+		"",
+		"if non-empty, path-style URL of an S3-compatible bucket, optionally followed by a key prefix (e.g. https://s3.eu-central-1.amazonaws.com/my-bucket/audit), to which the audit log entries of each run are uploaded as a new object <owner>/<repo>/<time>-<tool>-<pid>.jsonl. Objects are never overwritten, so the bucket can enforce retention with S3 Object Lock. Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
 
-	for _, c := range dirContents {
-		if !strings.HasSuffix(*c.Name, ".elf") &&
-			!strings.HasSuffix(*c.Name, ".bin") &&
-			!strings.HasSuffix(*c.Name, ".dat") {
+	printVersion = flag.Bool("version",
+		false,
+		"print version information and exit")
+
+	metricsListen = flag.String("metrics_listen",
+		"",
+		"if non-empty, host:port on which to serve Prometheus metrics at /metrics while the tool runs (e.g. :9090)")
+
+	metricsTextfile = flag.String("metrics_textfile",
+		"",
+		"if non-empty, path of a file (ending in .prom) to which the metrics are written whenever they change, for the textfile collector of the Prometheus node_exporter on the CI runner, e.g. /var/lib/node_exporter/textfile/gokr-pull-firmware.prom")
+
+	metricsPushgateway = flag.String("metrics_pushgateway",
+		"",
+		"if non-empty, URL of a Prometheus Pushgateway (e.g. http://pushgateway:9091) to which the metrics are pushed whenever they change, grouped by job=gokr-pull-firmware")
+
+	dedupWindow = flag.Duration("dedup_window",
+		14*24*time.Hour,
+		"pull requests for the same upstream version which were closed (merged or not, e.g. as superseded) within this duration prevent opening a new one. 0 disables the check for closed pull requests")
+
+	ratelimitMaxWait = flag.Duration("ratelimit_max_wait",
+		0,
+		"if the remaining GitHub API quota does not suffice for the estimated number of requests, wait up to this long for the quota to reset instead of aborting")
+
+	tokenFile = flag.String("token_file",
+		"",
+		"if non-empty, path of a file containing the forge API token, instead of the GITHUB_AUTH_TOKEN or GH_AUTH_TOKEN environment variables. The variables can also name a file via GH_AUTH_TOKEN_FILE (e.g. a Docker secret) or be provided as systemd credentials")
+
+	autoupdateConfig = flag.String("autoupdate_config",
+		"autoupdate.toml",
+		"path to the autoupdate.toml configuration file shared by all tools (or a .json file of the same structure). A missing file is treated as empty")
+)
+
+// watchedPaths returns the paths matching the -watch patterns, i.e. files
+// and directories whose most recent commit is tracked.
+func watchedPaths(ctx context.Context, client *github.Client) ([]string, error) {
+	var paths []string
+	listings := make(map[string][]*github.RepositoryContent)
+	for _, pattern := range strings.Split(*watch, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if strings.HasSuffix(pattern, "/") {
+			paths = append(paths, strings.TrimSuffix(pattern, "/"))
 			continue
 		}
-		commits, _, err := client.Repositories.ListCommits(ctx, "raspberrypi", "firmware", &github.CommitsListOptions{
-			Path: *c.Path,
-			ListOptions: github.ListOptions{
-				Page:    1,
-				PerPage: 1,
-			},
-		})
-		if err != nil {
-			return "", err
+		dir := path.Dir(pattern)
+		dirContents, ok := listings[dir]
+		if !ok {
+			var err error
+			_, dirContents, _, err = client.Repositories.GetContents(ctx, "raspberrypi", "firmware", dir, &github.RepositoryContentGetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			listings[dir] = dirContents
 		}
-		if got, want := len(commits), 1; got != want {
-			return "", fmt.Errorf("unexpected number of commits for file %q: got %d, want %d", *c.Path, got, want)
+		var matched int
+		for _, c := range dirContents {
+			if c.GetType() != "file" {
+				continue
+			}
+			ok, err := path.Match(pattern, c.GetPath())
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			paths = append(paths, c.GetPath())
+			matched++
 		}
-		// NOTE that the assumption is that
-		// https://github.com/raspberrypi/firmware uses correct commit
-		// dates. In case they stop doing that, we’ll need to list all
-		// commits to find which commit is newer.
-		if latestCommit == nil || commits[0].Commit.Committer.Date.After(*latestCommit.Commit.Committer.Date) {
-			latestCommit = commits[0]
+		if matched == 0 {
+			return nil, fmt.Errorf("-watch pattern %q matches no files (did the upstream layout change?)", pattern)
 		}
-		log.Printf("at %s (%v): %s", *commits[0].SHA, *commits[0].Commit.Committer.Date, *c.Path)
+	}
+	return paths, nil
+}
+
+// getUpstreamCommit returns the SHA of the most recent
+// github.com/raspberrypi/firmware git commit which touches any of the paths
+// selected by -watch.
+func getUpstreamCommit(ctx context.Context, client *github.Client) (string, error) {
+	files, err := watchedPaths(ctx, client)
+	if err != nil {
+		return "", err
 	}
 
-	log.Printf("picked %s as most recent upstream firmware commit", *latestCommit.SHA)
-	return *latestCommit.SHA, nil
+	if err := ratelimit.Preflight(ctx, client, updateRequests, *ratelimitMaxWait); err != nil {
+		return "", err
+	}
+
+	var until time.Time
+	if *minAge > 0 {
+		until = time.Now().Add(-*minAge)
+	}
+	latest, err := latestCommit(ctx, client, files, until)
+	if err != nil {
+		return "", err
+	}
+	if *minAge > 0 {
+		log.Printf("picked %s as most recent upstream firmware commit at least %v old", latest, *minAge)
+	} else {
+		log.Printf("picked %s as most recent upstream firmware commit", latest)
+	}
+	return latest, nil
 }
 
+// updateRequests is the number of GitHub API requests updateFirmware makes after
+// determining the upstream commit (ref, commit, tree, blob, new tree, new
+// commit, new ref, pull request).
+const updateRequests = 8 + dedup.Requests
+
 func updateFirmware(ctx context.Context, client *github.Client, owner, repo string) error {
+	allowed, reason, err := scheduleAllows(ctx, client, owner, repo, time.Now())
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		log.Printf("not proposing an update: %s", reason)
+		return nil
+	}
+
+	pollStart := time.Now()
 	upstreamCommit, err := getUpstreamCommit(ctx, client)
+	metrics.Poll(pollStart, err)
 	if err != nil {
 		return err
 	}
@@ -82,10 +185,11 @@ func updateFirmware(ctx context.Context, client *github.Client, owner, repo stri
 	}
 	log.Printf("baseTree = %+v", baseTree)
 
-	var (
-		updaterSHA  string
-		updaterPath = "cmd/gokr-update-firmware/firmware.go"
-	)
+	updaterPath, refRe, err := updater()
+	if err != nil {
+		return err
+	}
+	var updaterSHA string
 	for _, entry := range baseTree.Entries {
 		if *entry.Path == updaterPath {
 			updaterSHA = *entry.SHA
@@ -107,17 +211,14 @@ func updateFirmware(ctx context.Context, client *github.Client, owner, repo stri
 		return err
 	}
 
-	firmwareRefRe := regexp.MustCompile(`const firmwareRef = "([0-9a-f]+)"`)
-	matches := firmwareRefRe.FindStringSubmatch(string(updaterContent))
-	if matches == nil {
-		return fmt.Errorf("regexp %v resulted in no matches", firmwareRefRe)
+	current, newContent, err := replaceRef(refRe, updaterContent, upstreamCommit)
+	if err != nil {
+		return fmt.Errorf("%s: %v", updaterPath, err)
 	}
-	if matches[1] == upstreamCommit {
+	if current == upstreamCommit {
 		log.Printf("already at latest commit")
 		return nil
 	}
-	newContent := firmwareRefRe.ReplaceAllLiteral(updaterContent,
-		[]byte(fmt.Sprintf(`const firmwareRef = "%s"`, upstreamCommit)))
 
 	entries := []*github.TreeEntry{
 		{
@@ -128,6 +229,15 @@ func updateFirmware(ctx context.Context, client *github.Client, owner, repo stri
 		},
 	}
 
+	dup, err := dedup.Check(ctx, client, owner, repo, "pull-"+upstreamCommit, upstreamCommit, *dedupWindow)
+	if err != nil {
+		return err
+	}
+	if dup != "" {
+		log.Printf("not proposing %s again: %s", upstreamCommit, dup)
+		return nil
+	}
+
 	newTree, _, err := client.Git.CreateTree(ctx, owner, repo, *baseTree.SHA, entries)
 	if err != nil {
 		return err
@@ -135,7 +245,7 @@ func updateFirmware(ctx context.Context, client *github.Client, owner, repo stri
 	log.Printf("newTree = %+v", newTree)
 
 	newCommit, _, err := client.Git.CreateCommit(ctx, owner, repo, &github.Commit{
-		Message: github.String("auto-update to https://github.com/raspberrypi/firmware/commit/" + upstreamCommit),
+		Message: github.String(firmwareMessagePrefix + upstreamCommit),
 		Tree:    newTree,
 		Parents: []*github.Commit{lastCommit},
 	})
@@ -154,6 +264,7 @@ func updateFirmware(ctx context.Context, client *github.Client, owner, repo stri
 		return err
 	}
 	log.Printf("newRef = %+v", newRef)
+	audit.Record(owner+"/"+repo, "create-ref", *newRef.Ref)
 
 	pr, _, err := client.PullRequests.Create(ctx, owner, repo, &github.NewPullRequest{
 		Title: github.String("auto-update to " + upstreamCommit),
@@ -165,19 +276,49 @@ func updateFirmware(ctx context.Context, client *github.Client, owner, repo stri
 	}
 
 	log.Printf("pr = %+v", pr)
+	audit.Record(owner+"/"+repo, "open-pull-request", pr.GetHTMLURL())
+	notify.Send(ctx, notify.Event{
+		Kind:  notify.PullRequestOpened,
+		Repo:  owner + "/" + repo,
+		Title: pr.GetTitle(),
+		URL:   pr.GetHTMLURL(),
+	})
 
 	return nil
 }
 
 var (
-	githubUser = cienv.MustGetGithubUser()
-	authToken  = cienv.MustGetAuthToken()
-	slug       = cienv.MustGetSlug()
+	githubUser string
+	authToken  string
+	slug       string
 )
 
 func main() {
 	flag.Parse()
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	secret.Install()
+	settings.SetPath(*autoupdateConfig)
+	audit.Configure(audit.Options{
+		Log:    *auditLog,
+		Branch: *auditBranch,
+		S3:     *auditS3,
+	})
+	version.MaybePrint(*printVersion)
+	metrics.Serve(metrics.Options{
+		Listen:      *metricsListen,
+		Textfile:    *metricsTextfile,
+		Pushgateway: *metricsPushgateway,
+	})
+
+	githubUser = cienv.MustGetGithubUser()
+	authToken = cienv.MustGetAuthToken(*tokenFile)
+	slug = cienv.MustGetSlug()
+
+	if *weekdays != "" {
+		if _, err := parseWeekdays(*weekdays); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	parts := strings.Split(slug, "/")
 	if got, want := len(parts), 2; got != want {
@@ -193,7 +334,15 @@ func main() {
 		},
 	})
 
-	if err := updateFirmware(ctx, client, parts[0], parts[1]); err != nil {
+	err := updateFirmware(ctx, client, parts[0], parts[1])
+	ratelimit.Report(ctx, client)
+	if err != nil {
+		notify.Failed(ctx, parts[0]+"/"+parts[1], err)
+		log.Fatal(err)
+	}
+	notify.Succeeded(parts[0] + "/" + parts[1])
+
+	if err := audit.Commit(ctx, client, parts[0], parts[1]); err != nil {
 		log.Fatal(err)
 	}
 }
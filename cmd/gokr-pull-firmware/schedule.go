@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v35/github"
+)
+
+var (
+	minAge = flag.Duration("min_age",
+		0,
+		"only propose firmware commits which are at least this old (e.g. 72h), so that rapid-fire upstream changes are batched into one pull request")
+
+	weekdays = flag.String("weekdays",
+		"",
+		"if non-empty, comma-separated list of weekdays (e.g. mon,thu) on which pull requests are opened, at most one per day (UTC). On other days, gokr-pull-firmware exits without doing anything")
+)
+
+// parseWeekdays parses the -weekdays flag value.
+func parseWeekdays(s string) (map[time.Weekday]bool, error) {
+	days := make(map[time.Weekday]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		found := false
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			long := strings.ToLower(d.String())
+			if name == long || name == long[:3] {
+				days[d] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid weekday %q in -weekdays", name)
+		}
+	}
+	return days, nil
+}
+
+// firmwareMessagePrefix starts the commit message of firmware updates,
+// followed by the upstream commit. It distinguishes them from other
+// auto-updates (e.g. of gokr-pull-eeprom) in the same repository, whose
+// pull request titles look alike.
+const firmwareMessagePrefix = "auto-update to https://github.com/raspberrypi/firmware/commit/"
+
+var commitHashRe = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// isFirmwareUpdate reports whether pr was opened by gokr-pull-firmware.
+func isFirmwareUpdate(ctx context.Context, client *github.Client, owner, repo string, pr *github.PullRequest) (bool, error) {
+	upstreamCommit := strings.TrimPrefix(pr.GetTitle(), "auto-update to ")
+	if !commitHashRe.MatchString(upstreamCommit) || pr.GetHead().GetRef() != "pull-"+upstreamCommit {
+		return false, nil
+	}
+	head, _, err := client.Git.GetCommit(ctx, owner, repo, pr.GetHead().GetSHA())
+	if err != nil {
+		return false, err
+	}
+	return strings.HasPrefix(head.GetMessage(), firmwareMessagePrefix+upstreamCommit), nil
+}
+
+// scheduleAllows returns whether a pull request may be opened now according
+// to -weekdays, and the reason if not: today is not one of the configured
+// weekdays, or a pull request was already opened today.
+func scheduleAllows(ctx context.Context, client *github.Client, owner, repo string, now time.Time) (bool, string, error) {
+	if *weekdays == "" {
+		return true, "", nil
+	}
+	days, err := parseWeekdays(*weekdays)
+	if err != nil {
+		return false, "", err
+	}
+	now = now.UTC()
+	if !days[now.Weekday()] {
+		return false, fmt.Sprintf("%s is not one of -weekdays=%s", now.Weekday(), *weekdays), nil
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	prs, _, err := client.PullRequests.List(ctx, owner, repo, &github.PullRequestListOptions{
+		State:       "all",
+		Sort:        "created",
+		Direction:   "desc",
+		ListOptions: github.ListOptions{PerPage: 20},
+	})
+	if err != nil {
+		return false, "", err
+	}
+	for _, pr := range prs {
+		if pr.GetCreatedAt().Before(today) {
+			break
+		}
+		firmware, err := isFirmwareUpdate(ctx, client, owner, repo, pr)
+		if err != nil {
+			return false, "", err
+		}
+		if firmware {
+			return false, fmt.Sprintf("already opened %s today", pr.GetHTMLURL()), nil
+		}
+	}
+	return true, "", nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"regexp"
+
+	"github.com/gokrazy/autoupdate/internal/settings"
+)
+
+var (
+	updaterPathFlag = flag.String("updater_path",
+		"",
+		"path of the file (in the target repository) which references the firmware commit. Defaults to updater_path in the pull-firmware section of autoupdate.toml, or to "+defaultUpdaterPath)
+
+	refRegexpFlag = flag.String("ref_regexp",
+		"",
+		"regular expression matching the firmware commit reference in -updater_path. The first capture group of each match is replaced with the new commit. Defaults to ref_regexp in the pull-firmware section of autoupdate.toml, or to "+defaultRefRegexp)
+)
+
+const (
+	defaultUpdaterPath = "cmd/gokr-update-firmware/firmware.go"
+	defaultRefRegexp   = `const firmwareRef = "([0-9a-f]+)"`
+)
+
+// pullFirmwareConfig is the pull-firmware section of autoupdate.toml, for
+// target repositories whose layout differs from gokrazy/firmware.
+type pullFirmwareConfig struct {
+	UpdaterPath string `json:"updater_path"`
+	RefRegexp   string `json:"ref_regexp"`
+}
+
+// updater returns the path of the file to update and the regular expression
+// matching the firmware commit reference within. Flags take precedence over
+// autoupdate.toml.
+func updater() (string, *regexp.Regexp, error) {
+	cfg := pullFirmwareConfig{
+		UpdaterPath: defaultUpdaterPath,
+		RefRegexp:   defaultRefRegexp,
+	}
+	if err := settings.Section("pull-firmware", &cfg); err != nil {
+		return "", nil, err
+	}
+	if *updaterPathFlag != "" {
+		cfg.UpdaterPath = *updaterPathFlag
+	}
+	if *refRegexpFlag != "" {
+		cfg.RefRegexp = *refRegexpFlag
+	}
+	re, err := regexp.Compile(cfg.RefRegexp)
+	if err != nil {
+		return "", nil, fmt.Errorf("ref_regexp: %v", err)
+	}
+	if re.NumSubexp() < 1 {
+		return "", nil, fmt.Errorf("ref_regexp %v has no capture group for the firmware commit", re)
+	}
+	return cfg.UpdaterPath, re, nil
+}
+
+// replaceRef returns the firmware commit currently referenced in content
+// (the first capture group of the first match of re), and content with the
+// first capture group of every match replaced with commit.
+func replaceRef(re *regexp.Regexp, content []byte, commit string) (string, []byte, error) {
+	var (
+		buf     bytes.Buffer
+		last    int
+		current string
+		found   bool
+	)
+	for _, m := range re.FindAllSubmatchIndex(content, -1) {
+		if m[2] < 0 {
+			continue // capture group did not participate in the match
+		}
+		if !found {
+			current = string(content[m[2]:m[3]])
+			found = true
+		}
+		buf.Write(content[last:m[2]])
+		buf.WriteString(commit)
+		last = m[3]
+	}
+	if !found {
+		return "", nil, fmt.Errorf("regexp %v resulted in no matches", re)
+	}
+	buf.Write(content[last:])
+	return current, buf.Bytes(), nil
+}
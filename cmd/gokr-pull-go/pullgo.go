@@ -0,0 +1,320 @@
+// gokr-pull-go opens pull requests which bump the Go version pinned in a
+// downstream repository (the go.mod toolchain directive and other build
+// configuration) to the latest stable Go release.
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/audit"
+	"github.com/gokrazy/autoupdate/internal/cienv"
+	"github.com/gokrazy/autoupdate/internal/dedup"
+	"github.com/gokrazy/autoupdate/internal/metrics"
+	"github.com/gokrazy/autoupdate/internal/notify"
+	"github.com/gokrazy/autoupdate/internal/ratelimit"
+	"github.com/gokrazy/autoupdate/internal/secret"
+	"github.com/gokrazy/autoupdate/internal/settings"
+	"github.com/gokrazy/autoupdate/internal/version"
+	"github.com/google/go-github/v35/github"
+)
+
+var (
+	paths = flag.String("paths",
+		"go.mod",
+		"comma-separated list of files in which to update the Go version. In go.mod files, the toolchain directive is updated; in all other files, matches of -version_regexp are replaced")
+
+	versionRegexp = flag.String("version_regexp",
+		`\bgo1\.[0-9]+(\.[0-9]+)?\b`,
+		"regular expression matching the Go version (e.g. go1.22.3) in files other than go.mod")
+
+	auditLog = flag.String("audit_log",
+		"",
+		"if non-empty, path to a JSON Lines file to which every mutation (PRs opened, commits amended, labels changed, merges) is appended")
+
+	auditBranch = flag.String("audit_branch",
+		"",
+		"if non-empty, name of a branch in the target repository to which the audit log entries of each run are committed as a new file audit/<time>-<tool>-<pid>.jsonl")
+
+	auditS3 = flag.String("audit_s3",
+		"",
+		"if non-empty, path-style URL of an S3-compatible bucket, optionally followed by a key prefix (e.g. https://s3.eu-central-1.amazonaws.com/my-bucket/audit), to which the audit log entries of each run are uploaded as a new object <owner>/<repo>/<time>-<tool>-<pid>.jsonl. Objects are never overwritten, so the bucket can enforce retention with S3 Object Lock. Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+
+	printVersion = flag.Bool("version",
+		false,
+		"print version information and exit")
+
+	metricsListen = flag.String("metrics_listen",
+		"",
+		"if non-empty, host:port on which to serve Prometheus metrics at /metrics while the tool runs (e.g. :9090)")
+
+	metricsTextfile = flag.String("metrics_textfile",
+		"",
+		"if non-empty, path of a file (ending in .prom) to which the metrics are written whenever they change, for the textfile collector of the Prometheus node_exporter on the CI runner, e.g. /var/lib/node_exporter/textfile/gokr-pull-go.prom")
+
+	metricsPushgateway = flag.String("metrics_pushgateway",
+		"",
+		"if non-empty, URL of a Prometheus Pushgateway (e.g. http://pushgateway:9091) to which the metrics are pushed whenever they change, grouped by job=gokr-pull-go")
+
+	dedupWindow = flag.Duration("dedup_window",
+		14*24*time.Hour,
+		"pull requests for the same upstream version which were closed (merged or not, e.g. as superseded) within this duration prevent opening a new one. 0 disables the check for closed pull requests")
+
+	ratelimitMaxWait = flag.Duration("ratelimit_max_wait",
+		0,
+		"if the remaining GitHub API quota does not suffice for the estimated number of requests, wait up to this long for the quota to reset instead of aborting")
+
+	tokenFile = flag.String("token_file",
+		"",
+		"if non-empty, path of a file containing the forge API token, instead of the GITHUB_AUTH_TOKEN or GH_AUTH_TOKEN environment variables. The variables can also name a file via GH_AUTH_TOKEN_FILE (e.g. a Docker secret) or be provided as systemd credentials")
+
+	autoupdateConfig = flag.String("autoupdate_config",
+		"autoupdate.toml",
+		"path to the autoupdate.toml configuration file shared by all tools (or a .json file of the same structure). A missing file is treated as empty")
+)
+
+var toolchainRe = regexp.MustCompile(`(?m)^toolchain go[0-9][^\s]*$`)
+
+// getLatestGo returns the latest stable Go release, e.g. go1.22.3.
+func getLatestGo(ctx context.Context) (string, error) {
+	resp, err := http.Get("https://go.dev/dl/?mode=json")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("unexpected HTTP status code: got %d, want %d", got, want)
+	}
+	var releases []struct {
+		Version string `json:"version"`
+		Stable  bool   `json:"stable"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&releases); err != nil {
+		return "", err
+	}
+	// The list is ordered from newest to oldest.
+	for _, release := range releases {
+		if release.Stable {
+			return release.Version, nil
+		}
+	}
+	return "", fmt.Errorf("malformed go.dev/dl response: no stable release found")
+}
+
+// updateContent returns content with the Go version replaced by goVersion.
+func updateContent(fn string, content []byte, goVersion string) ([]byte, error) {
+	if fn == "go.mod" || strings.HasSuffix(fn, "/go.mod") {
+		if !toolchainRe.Match(content) {
+			return nil, fmt.Errorf("%s: no toolchain directive found", fn)
+		}
+		return toolchainRe.ReplaceAllLiteral(content, []byte("toolchain "+goVersion)), nil
+	}
+	re, err := regexp.Compile(*versionRegexp)
+	if err != nil {
+		return nil, err
+	}
+	if !re.Match(content) {
+		return nil, fmt.Errorf("%s: regexp %v resulted in no matches", fn, re)
+	}
+	return re.ReplaceAllLiteral(content, []byte(goVersion)), nil
+}
+
+// updateRequests is the number of GitHub API requests updateGo makes, not
+// counting the one blob request per file (ref, commit, tree, new tree, new
+// commit, new ref, pull request).
+const updateRequests = 7 + dedup.Requests
+
+func updateGo(ctx context.Context, client *github.Client, owner, repo string) error {
+	files := strings.Split(*paths, ",")
+	if err := ratelimit.Preflight(ctx, client, updateRequests+len(files), *ratelimitMaxWait); err != nil {
+		return err
+	}
+
+	pollStart := time.Now()
+	goVersion, err := getLatestGo(ctx)
+	metrics.Poll(pollStart, err)
+	if err != nil {
+		return err
+	}
+	log.Printf("latest Go release: %s", goVersion)
+
+	lastRef, _, err := client.Git.GetRef(ctx, owner, repo, "heads/main")
+	if err != nil {
+		return err
+	}
+
+	lastCommit, _, err := client.Git.GetCommit(ctx, owner, repo, *lastRef.Object.SHA)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("lastCommit = %+v", lastCommit)
+
+	baseTree, _, err := client.Git.GetTree(ctx, owner, repo, *lastCommit.SHA, true)
+	if err != nil {
+		return err
+	}
+	log.Printf("baseTree = %+v", baseTree)
+
+	var entries []*github.TreeEntry
+	for _, fn := range files {
+		fn = strings.TrimSpace(fn)
+		var entry *github.TreeEntry
+		for _, e := range baseTree.Entries {
+			if *e.Path == fn {
+				entry = e
+				break
+			}
+		}
+		if entry == nil {
+			return fmt.Errorf("%s not found in %s/%s", fn, owner, repo)
+		}
+
+		blob, _, err := client.Git.GetBlob(ctx, owner, repo, *entry.SHA)
+		if err != nil {
+			return err
+		}
+
+		content, err := base64.StdEncoding.DecodeString(*blob.Content)
+		if err != nil {
+			return err
+		}
+
+		newContent, err := updateContent(fn, content, goVersion)
+		if err != nil {
+			return err
+		}
+		if string(newContent) == string(content) {
+			continue
+		}
+		entries = append(entries, &github.TreeEntry{
+			Path:    github.String(fn),
+			Mode:    entry.Mode,
+			Type:    github.String("blob"),
+			Content: github.String(string(newContent)),
+		})
+	}
+	if len(entries) == 0 {
+		log.Printf("already at latest Go release")
+		return nil
+	}
+
+	dup, err := dedup.Check(ctx, client, owner, repo, "pull-"+goVersion, goVersion, *dedupWindow)
+	if err != nil {
+		return err
+	}
+	if dup != "" {
+		log.Printf("not proposing %s again: %s", goVersion, dup)
+		return nil
+	}
+
+	newTree, _, err := client.Git.CreateTree(ctx, owner, repo, *baseTree.SHA, entries)
+	if err != nil {
+		return err
+	}
+	log.Printf("newTree = %+v", newTree)
+
+	newCommit, _, err := client.Git.CreateCommit(ctx, owner, repo, &github.Commit{
+		Message: github.String("auto-update to " + goVersion),
+		Tree:    newTree,
+		Parents: []*github.Commit{lastCommit},
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("newCommit = %+v", newCommit)
+
+	newRef, _, err := client.Git.CreateRef(ctx, owner, repo, &github.Reference{
+		Ref: github.String("refs/heads/pull-" + goVersion),
+		Object: &github.GitObject{
+			SHA: newCommit.SHA,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("newRef = %+v", newRef)
+	audit.Record(owner+"/"+repo, "create-ref", *newRef.Ref)
+
+	pr, _, err := client.PullRequests.Create(ctx, owner, repo, &github.NewPullRequest{
+		Title: github.String("auto-update to " + goVersion),
+		Head:  github.String("pull-" + goVersion),
+		Base:  github.String("main"),
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("pr = %+v", pr)
+	audit.Record(owner+"/"+repo, "open-pull-request", pr.GetHTMLURL())
+	notify.Send(ctx, notify.Event{
+		Kind:  notify.PullRequestOpened,
+		Repo:  owner + "/" + repo,
+		Title: pr.GetTitle(),
+		URL:   pr.GetHTMLURL(),
+	})
+
+	return nil
+}
+
+var (
+	githubUser string
+	authToken  string
+	slug       string
+)
+
+func main() {
+	flag.Parse()
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	secret.Install()
+	settings.SetPath(*autoupdateConfig)
+	audit.Configure(audit.Options{
+		Log:    *auditLog,
+		Branch: *auditBranch,
+		S3:     *auditS3,
+	})
+	version.MaybePrint(*printVersion)
+	metrics.Serve(metrics.Options{
+		Listen:      *metricsListen,
+		Textfile:    *metricsTextfile,
+		Pushgateway: *metricsPushgateway,
+	})
+
+	githubUser = cienv.MustGetGithubUser()
+	authToken = cienv.MustGetAuthToken(*tokenFile)
+	slug = cienv.MustGetSlug()
+
+	parts := strings.Split(slug, "/")
+	if got, want := len(parts), 2; got != want {
+		log.Fatalf("unexpected number of /-separated parts in %q: got %d, want %d", slug, got, want)
+	}
+
+	ctx := context.Background()
+
+	client := github.NewClient(&http.Client{
+		Transport: &github.BasicAuthTransport{
+			Username: githubUser,
+			Password: authToken,
+		},
+	})
+
+	err := updateGo(ctx, client, parts[0], parts[1])
+	ratelimit.Report(ctx, client)
+	if err != nil {
+		notify.Failed(ctx, parts[0]+"/"+parts[1], err)
+		log.Fatal(err)
+	}
+	notify.Succeeded(parts[0] + "/" + parts[1])
+
+	if err := audit.Commit(ctx, client, parts[0], parts[1]); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/audit"
+	"github.com/google/go-github/v35/github"
+)
+
+var (
+	dispatchWorkflow = flag.String("dispatch_workflow",
+		"",
+		"if non-empty, file name of a workflow (e.g. kernel-build.yml) in the downstream repository to dispatch against the candidate branch. The pull request is only opened if the workflow run succeeds")
+
+	dispatchTimeout = flag.Duration("dispatch_timeout",
+		2*time.Hour,
+		"how long to wait for the -dispatch_workflow run to complete")
+)
+
+// awaitBuild dispatches -dispatch_workflow on branch and waits for the
+// resulting workflow run to complete.
+func awaitBuild(ctx context.Context, client *github.Client, owner, repo, branch string) error {
+	dispatched := time.Now().Add(-1 * time.Minute) // allow for clock skew
+	if _, err := client.Actions.CreateWorkflowDispatchEventByFileName(ctx, owner, repo, *dispatchWorkflow, github.CreateWorkflowDispatchEventRequest{
+		Ref: branch,
+	}); err != nil {
+		return err
+	}
+	log.Printf("dispatched workflow %s on %s, awaiting completion", *dispatchWorkflow, branch)
+
+	deadline := time.Now().Add(*dispatchTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(30 * time.Second)
+		runs, _, err := client.Actions.ListWorkflowRunsByFileName(ctx, owner, repo, *dispatchWorkflow, &github.ListWorkflowRunsOptions{
+			Branch: branch,
+			Event:  "workflow_dispatch",
+		})
+		if err != nil {
+			return err
+		}
+		for _, run := range runs.WorkflowRuns {
+			if run.GetCreatedAt().Before(dispatched) {
+				continue
+			}
+			if run.GetStatus() != "completed" {
+				log.Printf("workflow run %s: %s", run.GetHTMLURL(), run.GetStatus())
+				break
+			}
+			if got, want := run.GetConclusion(), "success"; got != want {
+				return fmt.Errorf("downstream build %s: unexpected conclusion: got %q, want %q", run.GetHTMLURL(), got, want)
+			}
+			log.Printf("downstream build %s succeeded", run.GetHTMLURL())
+			return nil
+		}
+	}
+	return fmt.Errorf("downstream build of %s did not complete within %v", branch, *dispatchTimeout)
+}
+
+// deleteBranch removes a candidate branch whose downstream build failed, so
+// that the next run can retry from scratch.
+func deleteBranch(ctx context.Context, client *github.Client, owner, repo, branch string) {
+	if _, err := client.Git.DeleteRef(ctx, owner, repo, "heads/"+branch); err != nil {
+		log.Printf("deleting branch %s: %v", branch, err)
+		return
+	}
+	audit.Record(owner+"/"+repo, "delete-ref", "heads/"+branch)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/go-github/v35/github"
+)
+
+var configAddendum = flag.String("config_addendum",
+	"",
+	"if non-empty, path of the kernel config addendum (e.g. _build/config.addendum.txt). CONFIG_ symbols it references which are not defined by the Kconfig files of the new kernel are reported in a pull request comment, including symbols which were likely renamed")
+
+// kconfigSymbols maps Kconfig symbols (without CONFIG_ prefix) to the
+// Kconfig file (relative to the kernel source root) defining them.
+type kconfigSymbols map[string]string
+
+// fetchKconfig downloads the kernel source at upstreamURL, unpacking only
+// its Kconfig files, and returns all symbols they define.
+func fetchKconfig(upstreamURL string) (kconfigSymbols, error) {
+	tmp, err := os.MkdirTemp("", "gokr-pull-kernel-kconfig")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	log.Printf("downloading %s to read its Kconfig files", upstreamURL)
+	resp, err := http.Get(upstreamURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return nil, fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", upstreamURL, got, want)
+	}
+	mode := "xzf"
+	if strings.HasSuffix(upstreamURL, ".tar.xz") {
+		mode = "xJf"
+	}
+	untar := exec.Command("tar", mode, "-", "--strip-components=1", "-C", tmp, "--wildcards", "*Kconfig*")
+	untar.Stdin = resp.Body
+	untar.Stderr = os.Stderr
+	if err := untar.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %v", untar.Args, err)
+	}
+	// Drain the body so that trailing data does not result in an error.
+	io.Copy(io.Discard, resp.Body)
+
+	symbols := make(kconfigSymbols)
+	err = filepath.WalkDir(tmp, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasPrefix(d.Name(), "Kconfig") {
+			return nil
+		}
+		rel, err := filepath.Rel(tmp, path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 || (fields[0] != "config" && fields[0] != "menuconfig") {
+				continue
+			}
+			if _, ok := symbols[fields[1]]; !ok {
+				symbols[fields[1]] = filepath.ToSlash(rel)
+			}
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return symbols, nil
+}
+
+// addendumSymbolRe matches both CONFIG_FOO=y and # CONFIG_FOO is not set.
+var addendumSymbolRe = regexp.MustCompile(`(?m)^\s*(?:#\s*)?CONFIG_([A-Za-z0-9_]+)(?:=|\s+is not set)`)
+
+// addendumSymbols returns the symbols (without CONFIG_ prefix) referenced by
+// the config addendum, in order of their first occurrence.
+func addendumSymbols(addendum []byte) []string {
+	var symbols []string
+	seen := make(map[string]bool)
+	for _, m := range addendumSymbolRe.FindAllSubmatch(addendum, -1) {
+		sym := string(m[1])
+		if seen[sym] {
+			continue
+		}
+		seen[sym] = true
+		symbols = append(symbols, sym)
+	}
+	return symbols
+}
+
+// staleSymbol is a config addendum symbol which the new kernel does not
+// define.
+type staleSymbol struct {
+	name string
+	// removed is true if the previous kernel still defined the symbol (as
+	// opposed to the addendum being stale for longer).
+	removed bool
+	// candidates are symbols which the new kernel added to the Kconfig file
+	// which defined the symbol before, i.e. likely renames.
+	candidates []string
+}
+
+// staleSymbols returns the symbols referenced by addendum which are not
+// defined in newSyms.
+func staleSymbols(addendum []byte, oldSyms, newSyms kconfigSymbols) []staleSymbol {
+	added := make(map[string][]string) // Kconfig file → added symbols
+	for sym, file := range newSyms {
+		if _, ok := oldSyms[sym]; !ok {
+			added[file] = append(added[file], sym)
+		}
+	}
+	var stale []staleSymbol
+	for _, sym := range addendumSymbols(addendum) {
+		if _, ok := newSyms[sym]; ok {
+			continue
+		}
+		s := staleSymbol{name: sym}
+		if file, ok := oldSyms[sym]; ok {
+			s.removed = true
+			s.candidates = append(s.candidates, added[file]...)
+			sort.Strings(s.candidates)
+		}
+		stale = append(stale, s)
+	}
+	return stale
+}
+
+// kconfigReport renders stale as Markdown for a pull request comment.
+func kconfigReport(configAddendum, oldVersion, newVersion string, stale []staleSymbol) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "### Config addendum\n\n`%s` references symbols which %s does not define:\n\n", configAddendum, newVersion)
+	for _, s := range stale {
+		switch {
+		case !s.removed:
+			fmt.Fprintf(&b, "- `CONFIG_%s` (already undefined in %s)\n", s.name, oldVersion)
+		case len(s.candidates) > 0:
+			var renames []string
+			for _, c := range s.candidates {
+				renames = append(renames, "`CONFIG_"+c+"`")
+			}
+			fmt.Fprintf(&b, "- `CONFIG_%s` was removed, possibly renamed to %s\n", s.name, strings.Join(renames, " or "))
+		default:
+			fmt.Fprintf(&b, "- `CONFIG_%s` was removed\n", s.name)
+		}
+	}
+	return b.String()
+}
+
+// checkConfigAddendum compares the -config_addendum symbols against the
+// Kconfig files of the kernels at oldURL and newURL and returns a report,
+// or the empty string if all symbols are still defined.
+func checkConfigAddendum(ctx context.Context, client *github.Client, owner, repo string, baseTree *github.Tree, oldURL, newURL string) (string, error) {
+	addendum, err := fetchFile(ctx, client, owner, repo, baseTree, *configAddendum)
+	if err != nil {
+		return "", err
+	}
+	newSyms, err := fetchKconfig(newURL)
+	if err != nil {
+		return "", err
+	}
+	oldSyms := make(kconfigSymbols)
+	if oldURL != "" {
+		oldSyms, err = fetchKconfig(oldURL)
+		if err != nil {
+			return "", err
+		}
+	}
+	stale := staleSymbols(addendum, oldSyms, newSyms)
+	if len(stale) == 0 {
+		log.Printf("all %s symbols are defined in %s", *configAddendum, filepath.Base(newURL))
+		return "", nil
+	}
+	return kconfigReport(*configAddendum, filepath.Base(oldURL), filepath.Base(newURL), stale), nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-github/v35/github"
+)
+
+var patchSeries = flag.String("patch_series",
+	"",
+	"if non-empty, path of the downstream patch series file (e.g. _build/series). Its patches are test-applied to the new kernel source and the result is reported in the pull request body")
+
+// patchResult is the outcome of test-applying one downstream patch.
+type patchResult struct {
+	name   string
+	err    error
+	output string
+}
+
+// fetchFile returns the contents of the file fn in baseTree.
+func fetchFile(ctx context.Context, client *github.Client, owner, repo string, baseTree *github.Tree, fn string) ([]byte, error) {
+	for _, entry := range baseTree.Entries {
+		if entry.GetPath() != fn {
+			continue
+		}
+		blob, _, err := client.Git.GetBlob(ctx, owner, repo, entry.GetSHA())
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.DecodeString(blob.GetContent())
+	}
+	return nil, fmt.Errorf("%s not found in %s/%s", fn, owner, repo)
+}
+
+// fetchSeries returns the patches listed in -patch_series, in order, keyed
+// by file name.
+func fetchSeries(ctx context.Context, client *github.Client, owner, repo string, baseTree *github.Tree) ([]string, map[string][]byte, error) {
+	fetch := func(fn string) ([]byte, error) {
+		return fetchFile(ctx, client, owner, repo, baseTree, fn)
+	}
+	series, err := fetch(*patchSeries)
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	contents := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimSpace(string(series)), "\n") {
+		name = strings.TrimSpace(name)
+		if name == "" || strings.HasPrefix(name, "#") {
+			continue
+		}
+		b, err := fetch(path.Join(path.Dir(*patchSeries), name))
+		if err != nil {
+			return nil, nil, err
+		}
+		names = append(names, name)
+		contents[name] = b
+	}
+	return names, contents, nil
+}
+
+// checkPatches downloads and unpacks the kernel source at upstreamURL into a
+// temporary directory and applies the patches in order.
+func checkPatches(upstreamURL string, names []string, contents map[string][]byte) ([]patchResult, error) {
+	tmp, err := os.MkdirTemp("", "gokr-pull-kernel")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	log.Printf("downloading %s to test-apply %d patches", upstreamURL, len(names))
+	resp, err := http.Get(upstreamURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return nil, fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", upstreamURL, got, want)
+	}
+	mode := "xzf"
+	if strings.HasSuffix(upstreamURL, ".tar.xz") {
+		mode = "xJf"
+	}
+	untar := exec.Command("tar", mode, "-", "--strip-components=1", "-C", tmp)
+	untar.Stdin = resp.Body
+	untar.Stderr = os.Stderr
+	if err := untar.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %v", untar.Args, err)
+	}
+	// Drain the body so that trailing data does not result in an error.
+	io.Copy(io.Discard, resp.Body)
+
+	results := make([]patchResult, 0, len(names))
+	for _, name := range names {
+		patch := exec.Command("patch", "-p1", "--forward", "--batch")
+		patch.Dir = tmp
+		patch.Stdin = strings.NewReader(string(contents[name]))
+		out, err := patch.CombinedOutput()
+		results = append(results, patchResult{
+			name:   filepath.Base(name),
+			err:    err,
+			output: string(out),
+		})
+	}
+	return results, nil
+}
+
+// patchReport renders results as Markdown for the pull request body.
+func patchReport(results []patchResult) string {
+	var b strings.Builder
+	b.WriteString("### Downstream patches\n\n")
+	for _, r := range results {
+		if r.err == nil {
+			fmt.Fprintf(&b, "- ✅ `%s` applies cleanly\n", r.name)
+			continue
+		}
+		fmt.Fprintf(&b, "- ⚠️ `%s` is likely to conflict:\n\n  ```\n", r.name)
+		for _, line := range strings.Split(strings.TrimSpace(r.output), "\n") {
+			fmt.Fprintf(&b, "  %s\n", line)
+		}
+		b.WriteString("  ```\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gokrazy/autoupdate/internal/prmeta"
+	"github.com/google/go-github/v35/github"
+)
+
+// upstreamHash returns an identifier of the upstream source: the SHA-256
+// hash published in kernel.org's sha256sums.asc for vanilla kernels, or
+// the commit of the tag for raspberrypi kernels.
+func upstreamHash(ctx context.Context, client *github.Client, flavor, upstreamURL string) (string, error) {
+	switch flavor {
+	case "raspberrypi":
+		tag := strings.TrimSuffix(path.Base(upstreamURL), ".tar.gz")
+		ref, _, err := client.Git.GetRef(ctx, "raspberrypi", "linux", "tags/"+tag)
+		if err != nil {
+			return "", err
+		}
+		return "git:" + ref.GetObject().GetSHA(), nil
+
+	default:
+		sumsURL := upstreamURL[:strings.LastIndex(upstreamURL, "/")] + "/sha256sums.asc"
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, sumsURL, nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			return "", fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", sumsURL, got, want)
+		}
+		// The file is a clearsigned sha256sum(1) listing.
+		name := path.Base(upstreamURL)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 2 && fields[1] == name {
+				return "sha256:" + fields[0], nil
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("%s lists no hash for %s", sumsURL, name)
+	}
+}
+
+// updateMetadata describes the update from oldURL (if known) to
+// upstreamURL. The upstream hash is only determined for released versions,
+// i.e. unless preview (see -stable_queue).
+func updateMetadata(ctx context.Context, client *github.Client, flavor, oldURL, upstreamURL string, preview bool) (prmeta.Metadata, error) {
+	m := prmeta.Metadata{
+		Kind:        "kernel",
+		Flavor:      flavor,
+		Version:     path.Base(upstreamURL),
+		UpstreamURL: upstreamURL,
+	}
+	if oldURL != "" {
+		m.PreviousVersion = path.Base(oldURL)
+		m.PreviousURL = oldURL
+	}
+	if preview {
+		return m, nil
+	}
+	hash, err := upstreamHash(ctx, client, flavor, upstreamURL)
+	if err != nil {
+		return prmeta.Metadata{}, fmt.Errorf("determining upstream hash: %v", err)
+	}
+	m.UpstreamHash = hash
+	return m, nil
+}
+
+// pullRequestBody returns the body of the update pull request: text (e.g.
+// the patch report), followed by the pipeline checklist and metadata m for
+// gokr-boot and gokr-merge.
+func pullRequestBody(m prmeta.Metadata, text string) (string, error) {
+	return prmeta.Body(text, m, []string{prmeta.BootTested})
+}
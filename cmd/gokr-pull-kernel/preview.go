@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gokrazy/autoupdate/internal/audit"
+	"github.com/gokrazy/autoupdate/internal/prmeta"
+	"github.com/google/go-github/v35/github"
+)
+
+var stableQueue = flag.Bool("stable_queue",
+	false,
+	"(vanilla flavor only) if the stable-queue repository has patches queued for the next point release of the tracked series, open a draft pull request for that release ahead of time, listing the queued patches. Once the release is out, the draft is marked as ready for review (trigger CI on the ready_for_review pull request event)")
+
+// stableQueueURL is the cgit plain-file view of the stable-queue
+// repository, in which the patches for the next point release of each
+// series are collected in queue-<series>/.
+const stableQueueURL = "https://git.kernel.org/pub/scm/linux/kernel/git/stable/stable-queue.git/plain/"
+
+// previewRequests is the number of GitHub API requests markPreviewReady
+// makes (open pull requests, GraphQL mutation, pull request edit).
+const previewRequests = 3
+
+// previewManifestRequests is the number of GitHub API requests
+// updatePreviewManifest makes (ref, commit, tree, blob, new tree, new
+// commit, ref update).
+const previewManifestRequests = 7
+
+// nextPointRelease returns the series (e.g. 6.6) of the kernel.org source
+// upstreamURL (e.g. …/linux-6.6.7.tar.xz) and the URL under which its next
+// point release (…/linux-6.6.8.tar.xz) will be published.
+func nextPointRelease(upstreamURL string) (series, next string, _ error) {
+	base := path.Base(upstreamURL)
+	v := strings.TrimSuffix(strings.TrimPrefix(base, "linux-"), ".tar.xz")
+	parts := strings.Split(v, ".")
+	if len(parts) != 2 && len(parts) != 3 {
+		return "", "", fmt.Errorf("cannot parse kernel version from %s", base)
+	}
+	point := 0
+	if len(parts) == 3 {
+		var err error
+		point, err = strconv.Atoi(parts[2])
+		if err != nil {
+			return "", "", fmt.Errorf("cannot parse kernel version from %s: %v", base, err)
+		}
+	}
+	series = parts[0] + "." + parts[1]
+	next = fmt.Sprintf("linux-%s.%d.tar.xz", series, point+1)
+	return series, strings.TrimSuffix(upstreamURL, base) + next, nil
+}
+
+// queuedPatches returns the names of the patches queued for the next point
+// release of series, or nil if there are none.
+func queuedPatches(ctx context.Context, series string) ([]string, error) {
+	u := stableQueueURL + "queue-" + series + "/series"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil // nothing queued (yet)
+	}
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return nil, fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", u, got, want)
+	}
+	var patches []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patches = append(patches, line)
+	}
+	return patches, scanner.Err()
+}
+
+// previewBody returns the body of a draft pull request for the unreleased
+// upstreamURL. There is no upstream hash yet; markPreviewReady replaces the
+// body once the release is out.
+func previewBody(flavor, upstreamURL string, queued []string) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Preview of %s, which is not released yet. %d patch(es) are queued in [stable-queue](%s):\n\n",
+		path.Base(upstreamURL), len(queued), stableQueueURL)
+	for _, p := range queued {
+		fmt.Fprintf(&b, "- %s\n", p)
+	}
+	b.WriteString("\nThis pull request will be marked as ready for review once the release is out.\n")
+	return prmeta.Body(b.String(), prmeta.Metadata{
+		Kind:        "kernel",
+		Flavor:      flavor,
+		Version:     path.Base(upstreamURL),
+		UpstreamURL: upstreamURL,
+	}, []string{prmeta.BootTested})
+}
+
+// proposePreview opens a draft pull request for the next point release
+// after upstreamURL if stable-queue has patches queued for it.
+func proposePreview(ctx context.Context, client *github.Client, flavor, owner, repo, upstreamURL string, rules []replacement) error {
+	series, next, err := nextPointRelease(upstreamURL)
+	if err != nil {
+		return err
+	}
+	queued, err := queuedPatches(ctx, series)
+	if err != nil {
+		return err
+	}
+	if len(queued) == 0 {
+		log.Printf("stable-queue: no patches queued for %s", path.Base(next))
+		return nil
+	}
+	log.Printf("stable-queue: %d patches queued for %s", len(queued), path.Base(next))
+	return proposeUpdate(ctx, client, flavor, owner, repo, next, rules, queued)
+}
+
+// updatePreviewManifest replaces the -manifest_path committed to the draft
+// pull request branch with m, which contains the upstream hash of the now
+// released version, keeping the previous version of the committed manifest.
+func updatePreviewManifest(ctx context.Context, client *github.Client, owner, repo, branch string, m *prmeta.Metadata) error {
+	ref, _, err := client.Git.GetRef(ctx, owner, repo, "heads/"+branch)
+	if err != nil {
+		return err
+	}
+	head, _, err := client.Git.GetCommit(ctx, owner, repo, ref.GetObject().GetSHA())
+	if err != nil {
+		return err
+	}
+	tree, _, err := client.Git.GetTree(ctx, owner, repo, head.GetSHA(), true)
+	if err != nil {
+		return err
+	}
+	var manifestSHA string
+	for _, entry := range tree.Entries {
+		if entry.GetPath() == *manifestPath {
+			manifestSHA = entry.GetSHA()
+			break
+		}
+	}
+	if manifestSHA == "" {
+		return fmt.Errorf("%s not found on branch %s", *manifestPath, branch)
+	}
+	blob, _, err := client.Git.GetBlob(ctx, owner, repo, manifestSHA)
+	if err != nil {
+		return err
+	}
+	b, err := base64.StdEncoding.DecodeString(blob.GetContent())
+	if err != nil {
+		return err
+	}
+	committed, err := prmeta.ParseManifest(b)
+	if err != nil {
+		return err
+	}
+	m.PreviousVersion = committed.PreviousVersion
+	m.PreviousURL = committed.PreviousURL
+	manifest, err := prmeta.Manifest(*m)
+	if err != nil {
+		return err
+	}
+
+	newTree, _, err := client.Git.CreateTree(ctx, owner, repo, tree.GetSHA(), []*github.TreeEntry{
+		{
+			Path:    github.String(*manifestPath),
+			Mode:    github.String("100644"),
+			Type:    github.String("blob"),
+			Content: github.String(string(manifest)),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	newCommit, _, err := client.Git.CreateCommit(ctx, owner, repo, &github.Commit{
+		Message: github.String("auto-update to " + m.Version + ": add upstream hash to " + *manifestPath),
+		Tree:    newTree,
+		Parents: []*github.Commit{head},
+	})
+	if err != nil {
+		return err
+	}
+	ref.Object.SHA = newCommit.SHA
+	if _, _, err := client.Git.UpdateRef(ctx, owner, repo, ref, false); err != nil {
+		return err
+	}
+	log.Printf("updated %s on %s: %s", *manifestPath, branch, newCommit.GetSHA())
+	audit.Record(owner+"/"+repo, "update-ref", ref.GetRef())
+	return nil
+}
+
+// markPreviewReady marks the draft pull request which proposePreview
+// opened for the now released upstreamURL as ready for review, and replaces
+// its body with that of a regular update pull request. With -manifest_path,
+// the upstream hash is added to the committed manifest first. It reports
+// whether such a draft was found.
+func markPreviewReady(ctx context.Context, client *github.Client, flavor, owner, repo, upstreamURL string) (bool, error) {
+	branch := "pull-" + path.Base(upstreamURL)
+	open, _, err := client.PullRequests.List(ctx, owner, repo, &github.PullRequestListOptions{
+		State:       "open",
+		Head:        owner + ":" + branch,
+		ListOptions: github.ListOptions{PerPage: 100},
+	})
+	if err != nil {
+		return false, err
+	}
+	var pr *github.PullRequest
+	for _, p := range open {
+		if p.GetHead().GetRef() == branch && p.GetDraft() {
+			pr = p
+			break
+		}
+	}
+	if pr == nil {
+		return false, nil
+	}
+
+	m, err := updateMetadata(ctx, client, flavor, "", upstreamURL, false)
+	if err != nil {
+		return false, err
+	}
+	if *manifestPath != "" {
+		if err := updatePreviewManifest(ctx, client, owner, repo, branch, &m); err != nil {
+			return false, err
+		}
+	}
+	body, err := pullRequestBody(m, "")
+	if err != nil {
+		return false, err
+	}
+
+	// The REST API cannot convert drafts, only the GraphQL API.
+	req, err := client.NewRequest("POST", "graphql", map[string]interface{}{
+		"query": `mutation($id: ID!) {
+  markPullRequestReadyForReview(input: {pullRequestId: $id}) { clientMutationId }
+}`,
+		"variables": map[string]interface{}{"id": pr.GetNodeID()},
+	})
+	if err != nil {
+		return false, err
+	}
+	var resp struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if _, err := client.Do(ctx, req, &resp); err != nil {
+		return false, err
+	}
+	if len(resp.Errors) > 0 {
+		return false, fmt.Errorf("marking %s ready for review: %s", pr.GetHTMLURL(), resp.Errors[0].Message)
+	}
+	audit.Record(owner+"/"+repo, "mark-ready-for-review", pr.GetHTMLURL())
+
+	if _, _, err := client.PullRequests.Edit(ctx, owner, repo, pr.GetNumber(), &github.PullRequest{
+		Body: github.String(body),
+	}); err != nil {
+		return false, err
+	}
+	log.Printf("%s released, marked preview %s as ready for review", path.Base(upstreamURL), pr.GetHTMLURL())
+	return true, nil
+}
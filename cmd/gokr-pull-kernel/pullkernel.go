@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -12,8 +13,18 @@ import (
 	"regexp"
 	"slices"
 	"strings"
+	"time"
 
+	"github.com/gokrazy/autoupdate/internal/audit"
 	"github.com/gokrazy/autoupdate/internal/cienv"
+	"github.com/gokrazy/autoupdate/internal/dedup"
+	"github.com/gokrazy/autoupdate/internal/metrics"
+	"github.com/gokrazy/autoupdate/internal/notify"
+	"github.com/gokrazy/autoupdate/internal/prmeta"
+	"github.com/gokrazy/autoupdate/internal/ratelimit"
+	"github.com/gokrazy/autoupdate/internal/secret"
+	"github.com/gokrazy/autoupdate/internal/settings"
+	"github.com/gokrazy/autoupdate/internal/version"
 	"github.com/google/go-github/v35/github"
 )
 
@@ -25,6 +36,58 @@ var (
 	flavor = flag.String("flavor",
 		"vanilla",
 		"which kernel flavor to pull. one of vanilla (kernel.org) or raspberrypi (https://github.com/raspberrypi/linux/tags)")
+
+	manifestPath = flag.String("manifest_path",
+		"",
+		"if non-empty, path (e.g. update-manifest.json) of a JSON update manifest to commit alongside the change, describing the update (kind, flavor, previous and new version and URL, upstream hash) for downstream tooling such as gokr-tag-release -manifest. Drafts of -stable_queue carry no upstream hash until the release is out, when it is added in a new commit on the draft branch")
+
+	minAge = flag.Duration("min_age",
+		0,
+		"only propose releases which have been out for at least this long (e.g. 48h), so that early regressions get caught upstream first")
+
+	auditLog = flag.String("audit_log",
+		"",
+		"if non-empty, path to a JSON Lines file to which every mutation (PRs opened, commits amended, labels changed, merges) is appended")
+
+	auditBranch = flag.String("audit_branch",
+		"",
+		"if non-empty, name of a branch in the target repository to which the audit log entries of each run are committed as a new file audit/<time>-<tool>-<pid>.jsonl")
+
+	auditS3 = flag.String("audit_s3",
+		"",
+		"if non-empty, path-style URL of an S3-compatible bucket, optionally followed by a key prefix (e.g. https://s3.eu-central-1.amazonaws.com/my-bucket/audit), to which the audit log entries of each run are uploaded as a new object <owner>/<repo>/<time>-<tool>-<pid>.jsonl. Objects are never overwritten, so the bucket can enforce retention with S3 Object Lock. Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+
+	printVersion = flag.Bool("version",
+		false,
+		"print version information and exit")
+
+	metricsListen = flag.String("metrics_listen",
+		"",
+		"if non-empty, host:port on which to serve Prometheus metrics at /metrics while the tool runs (e.g. :9090)")
+
+	metricsTextfile = flag.String("metrics_textfile",
+		"",
+		"if non-empty, path of a file (ending in .prom) to which the metrics are written whenever they change, for the textfile collector of the Prometheus node_exporter on the CI runner, e.g. /var/lib/node_exporter/textfile/gokr-pull-kernel.prom")
+
+	metricsPushgateway = flag.String("metrics_pushgateway",
+		"",
+		"if non-empty, URL of a Prometheus Pushgateway (e.g. http://pushgateway:9091) to which the metrics are pushed whenever they change, grouped by job=gokr-pull-kernel")
+
+	dedupWindow = flag.Duration("dedup_window",
+		14*24*time.Hour,
+		"pull requests for the same upstream version which were closed (merged or not, e.g. as superseded) within this duration prevent opening a new one. 0 disables the check for closed pull requests")
+
+	ratelimitMaxWait = flag.Duration("ratelimit_max_wait",
+		0,
+		"if the remaining GitHub API quota does not suffice for the estimated number of requests, wait up to this long for the quota to reset instead of aborting")
+
+	tokenFile = flag.String("token_file",
+		"",
+		"if non-empty, path of a file containing the forge API token, instead of the GITHUB_AUTH_TOKEN or GH_AUTH_TOKEN environment variables. The variables can also name a file via GH_AUTH_TOKEN_FILE (e.g. a Docker secret) or be provided as systemd credentials")
+
+	autoupdateConfig = flag.String("autoupdate_config",
+		"autoupdate.toml",
+		"path to the autoupdate.toml configuration file shared by all tools (or a .json file of the same structure). A missing file is treated as empty")
 )
 
 func getUpstreamURL(ctx context.Context) (string, error) {
@@ -40,8 +103,11 @@ func getUpstreamURL(ctx context.Context) (string, error) {
 			Version string `json:"version"`
 		} `json:"latest_stable"`
 		Releases []struct {
-			Version string `json:"version"`
-			Source  string `json:"source"`
+			Version  string `json:"version"`
+			Source   string `json:"source"`
+			Released struct {
+				Timestamp int64 `json:"timestamp"`
+			} `json:"released"`
 		} `json:"releases"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&releases); err != nil {
@@ -51,6 +117,9 @@ func getUpstreamURL(ctx context.Context) (string, error) {
 		if release.Version != releases.LatestStable.Version {
 			continue
 		}
+		if age := time.Since(time.Unix(release.Released.Timestamp, 0)); age < *minAge {
+			return "", fmt.Errorf("%w: latest stable release %s is only %v old", errTooRecent, release.Version, age.Round(time.Minute))
+		}
 		return release.Source, nil
 	}
 	return "", fmt.Errorf("malformed releases.json: latest stable release %q not found in releases list", releases.LatestStable.Version)
@@ -76,28 +145,127 @@ func getRaspberryPiURL(ctx context.Context, client *github.Client) (string, erro
 	}
 	slices.Sort(names)
 	slices.Reverse(names)
+	if *minAge > 0 {
+		// Select the latest tag which is at least -min_age old.
+		shas := make(map[string]string)
+		for _, tag := range tags {
+			shas[tag.GetName()] = tag.GetCommit().GetSHA()
+		}
+		for _, name := range names {
+			commit, _, err := client.Repositories.GetCommit(ctx, owner, repo, shas[name])
+			if err != nil {
+				return "", err
+			}
+			age := time.Since(commit.GetCommit().GetCommitter().GetDate())
+			if age >= *minAge {
+				return "https://github.com/raspberrypi/linux/archive/refs/tags/" + name + ".tar.gz", nil
+			}
+			log.Printf("skipping tag %s: only %v old", name, age.Round(time.Minute))
+		}
+		return "", fmt.Errorf("%w: no stable_ tag is at least %v old", errTooRecent, *minAge)
+	}
 	return "https://github.com/raspberrypi/linux/archive/refs/tags/" + names[0] + ".tar.gz", nil
 }
 
+// errTooRecent is returned when no release satisfies -min_age yet.
+var errTooRecent = errors.New("no release old enough")
+
+// updateRequests is the number of GitHub API requests updateKernel makes
+// (upstream tags, ref, commit, tree, blob, new tree, new commit, new ref,
+// upstream tag ref, pull request).
+const updateRequests = 10 + dedup.Requests
+
 func updateKernel(ctx context.Context, client *github.Client, flavor, owner, repo string) error {
+	rules, err := loadReplacements()
+	if err != nil {
+		return err
+	}
+
+	requests := updateRequests + len(rules)
+	if *configAddendum != "" {
+		requests += 2 // addendum blob, pull request comment
+	}
+	if *stableQueue {
+		requests += previewRequests + updateRequests + len(rules)
+		if *manifestPath != "" {
+			requests += previewManifestRequests
+		}
+	}
+	if err := ratelimit.Preflight(ctx, client, requests, *ratelimitMaxWait); err != nil {
+		return err
+	}
+
 	var upstreamURL string
-	var err error
+	pollStart := time.Now()
 	switch flavor {
 	case "vanilla":
 		upstreamURL, err = getUpstreamURL(ctx)
 	case "raspberrypi":
 		upstreamURL, err = getRaspberryPiURL(ctx, client)
 	}
+	metrics.Poll(pollStart, err)
+	if errors.Is(err, errTooRecent) {
+		log.Printf("not proposing an update yet: %v", err)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
 	log.Printf("upstream URL: %s", upstreamURL)
 
-	lastRef, _, err := client.Git.GetRef(ctx, owner, repo, "heads/main")
+	if *stableQueue {
+		ready, err := markPreviewReady(ctx, client, flavor, owner, repo, upstreamURL)
+		if err != nil {
+			return err
+		}
+		if ready {
+			return nil
+		}
+	}
+
+	if err := proposeUpdate(ctx, client, flavor, owner, repo, upstreamURL, rules, nil); err != nil {
+		return err
+	}
+
+	if *stableQueue {
+		return proposePreview(ctx, client, flavor, owner, repo, upstreamURL, rules)
+	}
+	return nil
+}
+
+// proposeUpdate opens a pull request updating to upstreamURL, unless it is
+// current or was already proposed. If queued is non-nil, upstreamURL is a
+// not yet released stable kernel and the pull request is a draft listing
+// the queued stable patches (see -stable_queue).
+func proposeUpdate(ctx context.Context, client *github.Client, flavor, owner, repo, upstreamURL string, rules []replacement, queued []string) error {
+	preview := queued != nil
+	st := loadState(owner, repo, flavor)
+	if !preview && st.Upstream == upstreamURL && st.MainETag != "" {
+		unchanged, err := mainUnchanged(ctx, client, owner, repo, st.MainETag)
+		if err != nil {
+			return err
+		}
+		if unchanged {
+			log.Printf("%s already processed and main unchanged (-state_file)", path.Base(upstreamURL))
+			return nil
+		}
+	}
+	// processed records that upstreamURL needs no further work against the
+	// current main branch.
+	processed := func() {
+		if preview {
+			return // the state tracks released versions only
+		}
+		st.Upstream = upstreamURL
+		saveState(owner, repo, flavor, st)
+	}
+
+	lastRef, resp, err := client.Git.GetRef(ctx, owner, repo, "heads/main")
 	if err != nil {
 		return err
 	}
+	st.MainETag = resp.Header.Get("ETag")
 
 	lastCommit, _, err := client.Git.GetCommit(ctx, owner, repo, *lastRef.Object.SHA)
 	if err != nil {
@@ -124,44 +292,109 @@ func updateKernel(ctx context.Context, client *github.Client, flavor, owner, rep
 		return fmt.Errorf("%s not found in %s/%s", *updaterPath, owner, repo)
 	}
 
-	updaterBlob, _, err := client.Git.GetBlob(ctx, owner, repo, updaterSHA)
-	if err != nil {
-		return err
-	}
+	updaterContent := st.UpdaterContent
+	if st.UpdaterSHA != updaterSHA || updaterContent == nil {
+		updaterBlob, _, err := client.Git.GetBlob(ctx, owner, repo, updaterSHA)
+		if err != nil {
+			return err
+		}
 
-	updaterContent, err := base64.StdEncoding.DecodeString(*updaterBlob.Content)
-	if err != nil {
-		return err
+		updaterContent, err = base64.StdEncoding.DecodeString(*updaterBlob.Content)
+		if err != nil {
+			return err
+		}
+		st.UpdaterSHA = updaterSHA
+		st.UpdaterContent = updaterContent
 	}
 
-	var newContent []byte
+	var (
+		oldURL     string
+		newContent []byte
+	)
 	if strings.HasSuffix(*updaterPath, ".go") {
 		kernelURLRe := regexp.MustCompile(`var latest = "([^"]+)"`)
 		matches := kernelURLRe.FindStringSubmatch(string(updaterContent))
 		if matches == nil {
 			return fmt.Errorf("regexp %v resulted in no matches", kernelURLRe)
 		}
-		if matches[1] == upstreamURL {
+		oldURL = matches[1]
+		if oldURL == upstreamURL {
 			log.Printf("already at latest commit")
+			processed()
 			return nil
 		}
 		newContent = kernelURLRe.ReplaceAllLiteral(updaterContent,
 			[]byte(fmt.Sprintf(`var latest = "%s"`, upstreamURL)))
 	} else {
-		if strings.TrimSpace(string(updaterContent)) == upstreamURL {
+		oldURL = strings.TrimSpace(string(updaterContent))
+		if oldURL == upstreamURL {
 			log.Printf("already at latest commit")
+			processed()
 			return nil
 		}
 		newContent = []byte(upstreamURL)
 	}
 
-	entries := []*github.TreeEntry{
-		{
-			Path:    github.String(*updaterPath),
-			Mode:    github.String("100644"),
-			Type:    github.String("blob"),
-			Content: github.String(string(newContent)),
-		},
+	dup, err := dedup.Check(ctx, client, owner, repo, "pull-"+path.Base(upstreamURL), path.Base(upstreamURL), *dedupWindow)
+	if err != nil {
+		return err
+	}
+	if dup != "" {
+		log.Printf("not proposing %s again: %s", path.Base(upstreamURL), dup)
+		processed()
+		return nil
+	}
+
+	m, err := updateMetadata(ctx, client, flavor, oldURL, upstreamURL, preview)
+	if err != nil {
+		return err
+	}
+	files := map[string][]byte{*updaterPath: newContent}
+	if *manifestPath != "" {
+		manifest, err := prmeta.Manifest(m)
+		if err != nil {
+			return err
+		}
+		files[*manifestPath] = manifest
+	}
+
+	var body string
+	if preview {
+		body, err = previewBody(flavor, upstreamURL, queued)
+		if err != nil {
+			return err
+		}
+	} else if *patchSeries != "" {
+		names, contents, err := fetchSeries(ctx, client, owner, repo, baseTree)
+		if err != nil {
+			return err
+		}
+		results, err := checkPatches(upstreamURL, names, contents)
+		if err != nil {
+			return err
+		}
+		body = patchReport(results)
+	}
+	if !preview {
+		body, err = pullRequestBody(m, body)
+		if err != nil {
+			return err
+		}
+	}
+
+	var kconfigComment string
+	if *configAddendum != "" && !preview {
+		kconfigComment, err = checkConfigAddendum(ctx, client, owner, repo, baseTree, oldURL, upstreamURL)
+		if err != nil {
+			return err
+		}
+	}
+
+	entries, err := applyReplacements(ctx, client, owner, repo, baseTree, rules,
+		newReplacementData(upstreamURL),
+		files)
+	if err != nil {
+		return err
 	}
 
 	newTree, _, err := client.Git.CreateTree(ctx, owner, repo, *baseTree.SHA, entries)
@@ -192,35 +425,83 @@ func updateKernel(ctx context.Context, client *github.Client, flavor, owner, rep
 		return err
 	}
 	log.Printf("newRef = %+v", newRef)
+	audit.Record(owner+"/"+repo, "create-ref", *newRef.Ref)
+
+	if *dispatchWorkflow != "" && !preview {
+		if err := awaitBuild(ctx, client, owner, repo, "pull-"+version); err != nil {
+			deleteBranch(ctx, client, owner, repo, "pull-"+version)
+			return err
+		}
+	}
 
 	pr, _, err := client.PullRequests.Create(ctx, owner, repo, &github.NewPullRequest{
 		Title: github.String("auto-update to " + version),
 		Head:  github.String("pull-" + version),
 		Base:  github.String("main"),
+		Body:  github.String(body),
+		Draft: github.Bool(preview),
 	})
 	if err != nil {
 		return err
 	}
 
 	log.Printf("pr = %+v", pr)
+	audit.Record(owner+"/"+repo, "open-pull-request", pr.GetHTMLURL())
+	processed()
+
+	if kconfigComment != "" {
+		comment, _, err := client.Issues.CreateComment(ctx, owner, repo, pr.GetNumber(), &github.IssueComment{
+			Body: github.String(kconfigComment),
+		})
+		if err != nil {
+			return err
+		}
+		audit.Record(owner+"/"+repo, "add-comment", comment.GetHTMLURL())
+	}
+	notify.Send(ctx, notify.Event{
+		Kind:  notify.PullRequestOpened,
+		Repo:  owner + "/" + repo,
+		Title: pr.GetTitle(),
+		URL:   pr.GetHTMLURL(),
+	})
 
 	return nil
 }
 
 var (
-	githubUser = cienv.MustGetGithubUser()
-	authToken  = cienv.MustGetAuthToken()
-	slug       = cienv.MustGetSlug()
+	githubUser string
+	authToken  string
+	slug       string
 )
 
 func main() {
 	flag.Parse()
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	secret.Install()
+	settings.SetPath(*autoupdateConfig)
+	audit.Configure(audit.Options{
+		Log:    *auditLog,
+		Branch: *auditBranch,
+		S3:     *auditS3,
+	})
+	version.MaybePrint(*printVersion)
+	metrics.Serve(metrics.Options{
+		Listen:      *metricsListen,
+		Textfile:    *metricsTextfile,
+		Pushgateway: *metricsPushgateway,
+	})
+
+	githubUser = cienv.MustGetGithubUser()
+	authToken = cienv.MustGetAuthToken(*tokenFile)
+	slug = cienv.MustGetSlug()
 
 	parts := strings.Split(slug, "/")
 	if got, want := len(parts), 2; got != want {
 		log.Fatalf("unexpected number of /-separated parts in %q: got %d, want %d", slug, got, want)
 	}
+	if *stableQueue && *flavor != "vanilla" {
+		log.Fatalf("-stable_queue requires -flavor=vanilla")
+	}
 
 	ctx := context.Background()
 
@@ -231,7 +512,15 @@ func main() {
 		},
 	})
 
-	if err := updateKernel(ctx, client, *flavor, parts[0], parts[1]); err != nil {
+	err := updateKernel(ctx, client, *flavor, parts[0], parts[1])
+	ratelimit.Report(ctx, client)
+	if err != nil {
+		notify.Failed(ctx, parts[0]+"/"+parts[1], err)
+		log.Fatal(err)
+	}
+	notify.Succeeded(parts[0] + "/" + parts[1])
+
+	if err := audit.Commit(ctx, client, parts[0], parts[1]); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/gokrazy/autoupdate/internal/settings"
+	"github.com/google/go-github/v35/github"
+)
+
+// replacement is an additional rule to keep kernel version references
+// elsewhere in the repository up to date, configured in the "pull-kernel"
+// section of autoupdate.toml:
+//
+//	[[pull-kernel.replacements]]
+//	path = "README.md"
+//	regexp = 'linux-[0-9.]+'
+//	replacement = "linux-{{ .Version }}"
+type replacement struct {
+	// Path is the file to update, relative to the repository root.
+	Path string `json:"path"`
+
+	// Regexp matches the text to replace.
+	Regexp string `json:"regexp"`
+
+	// Replacement is a text/template (see replacementData) whose output
+	// replaces all matches. $1 etc. are expanded to submatches.
+	Replacement string `json:"replacement"`
+}
+
+type pullKernelConfig struct {
+	Replacements []replacement `json:"replacements,omitempty"`
+}
+
+// replacementData is available to the replacement template.
+type replacementData struct {
+	// URL is the upstream URL, e.g.
+	// https://cdn.kernel.org/pub/linux/kernel/v6.x/linux-6.8.1.tar.xz
+	URL string
+
+	// Version is the file name without linux- prefix and archive suffix,
+	// e.g. 6.8.1 or stable_20240423.
+	Version string
+}
+
+func newReplacementData(upstreamURL string) replacementData {
+	v := path.Base(upstreamURL)
+	v = strings.TrimPrefix(v, "linux-")
+	v = strings.TrimSuffix(v, ".tar.xz")
+	v = strings.TrimSuffix(v, ".tar.gz")
+	return replacementData{URL: upstreamURL, Version: v}
+}
+
+func (r replacement) apply(content []byte, data replacementData) ([]byte, error) {
+	re, err := regexp.Compile(r.Regexp)
+	if err != nil {
+		return nil, err
+	}
+	if !re.Match(content) {
+		return nil, fmt.Errorf("%s: regexp %v resulted in no matches", r.Path, re)
+	}
+	tmpl, err := template.New(r.Path).Parse(r.Replacement)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return re.ReplaceAll(content, buf.Bytes()), nil
+}
+
+// applyReplacements applies rules to the files of baseTree and returns a tree
+// entry for each modified file. files holds already modified contents (e.g.
+// of -updater_path), which rules are applied on top of.
+func applyReplacements(ctx context.Context, client *github.Client, owner, repo string, baseTree *github.Tree, rules []replacement, data replacementData, files map[string][]byte) ([]*github.TreeEntry, error) {
+	modes := make(map[string]string)
+	shas := make(map[string]string)
+	for _, entry := range baseTree.Entries {
+		modes[entry.GetPath()] = entry.GetMode()
+		shas[entry.GetPath()] = entry.GetSHA()
+	}
+	var order []string
+	for fn := range files {
+		order = append(order, fn)
+	}
+	for _, r := range rules {
+		content, ok := files[r.Path]
+		if !ok {
+			sha, ok := shas[r.Path]
+			if !ok {
+				return nil, fmt.Errorf("%s not found in %s/%s", r.Path, owner, repo)
+			}
+			blob, _, err := client.Git.GetBlob(ctx, owner, repo, sha)
+			if err != nil {
+				return nil, err
+			}
+			content, err = base64.StdEncoding.DecodeString(blob.GetContent())
+			if err != nil {
+				return nil, err
+			}
+			order = append(order, r.Path)
+		}
+		updated, err := r.apply(content, data)
+		if err != nil {
+			return nil, err
+		}
+		files[r.Path] = updated
+	}
+	var entries []*github.TreeEntry
+	for _, fn := range order {
+		mode := modes[fn]
+		if mode == "" {
+			mode = "100644"
+		}
+		entries = append(entries, &github.TreeEntry{
+			Path:    github.String(fn),
+			Mode:    github.String(mode),
+			Type:    github.String("blob"),
+			Content: github.String(string(files[fn])),
+		})
+	}
+	return entries, nil
+}
+
+func loadReplacements() ([]replacement, error) {
+	var cfg pullKernelConfig
+	if err := settings.Section("pull-kernel", &cfg); err != nil {
+		return nil, err
+	}
+	return cfg.Replacements, nil
+}
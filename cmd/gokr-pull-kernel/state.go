@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/google/go-github/v35/github"
+)
+
+var stateFile = flag.String("state_file",
+	"",
+	"if non-empty, path of a JSON file (e.g. persisted via the CI cache) in which the last processed upstream version, the ETag of the main branch and the updater file are cached. Scheduled runs which find neither a new upstream version nor a changed main branch then make a single conditional GitHub API request (which does not count against the rate limit)")
+
+// pullState is the state of one repository (and flavor) in -state_file.
+type pullState struct {
+	// Upstream is the upstream URL which was last processed (proposed, or
+	// found to be current or already proposed) against main at MainETag.
+	Upstream string `json:"upstream,omitempty"`
+
+	MainETag string `json:"main_etag,omitempty"`
+
+	// UpdaterSHA is the blob SHA of -updater_path, UpdaterContent its
+	// content.
+	UpdaterSHA     string `json:"updater_sha,omitempty"`
+	UpdaterContent []byte `json:"updater_content,omitempty"`
+}
+
+func stateKey(owner, repo, flavor string) string {
+	return owner + "/" + repo + " " + flavor + " " + *updaterPath
+}
+
+func readStates() map[string]pullState {
+	states := make(map[string]pullState)
+	b, err := os.ReadFile(*stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("state: %v", err)
+		}
+		return states
+	}
+	if err := json.Unmarshal(b, &states); err != nil {
+		log.Printf("state: %s: %v", *stateFile, err)
+	}
+	return states
+}
+
+// loadState returns the cached state, or the zero pullState if -state_file
+// is unset or holds no state for the repository.
+func loadState(owner, repo, flavor string) pullState {
+	if *stateFile == "" {
+		return pullState{}
+	}
+	return readStates()[stateKey(owner, repo, flavor)]
+}
+
+// saveState stores st in -state_file. Errors are only logged, as the state
+// is merely a cache.
+func saveState(owner, repo, flavor string, st pullState) {
+	if *stateFile == "" {
+		return
+	}
+	states := readStates()
+	states[stateKey(owner, repo, flavor)] = st
+	b, err := json.Marshal(states)
+	if err != nil {
+		log.Printf("state: %v", err)
+		return
+	}
+	if err := os.WriteFile(*stateFile, b, 0644); err != nil {
+		log.Printf("state: %v", err)
+	}
+}
+
+// mainUnchanged reports whether the main branch still has the ETag etag,
+// using a conditional request.
+func mainUnchanged(ctx context.Context, client *github.Client, owner, repo, etag string) (bool, error) {
+	req, err := client.NewRequest("GET", "repos/"+owner+"/"+repo+"/git/ref/heads/main", nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("If-None-Match", etag)
+	resp, err := client.Do(ctx, req, nil)
+	if resp != nil && resp.StatusCode == http.StatusNotModified {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return false, nil
+}
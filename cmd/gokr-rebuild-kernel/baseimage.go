@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var requirePinnedBaseImage = flag.Bool("require_pinned_base_image",
+	false,
+	"fail unless the base image is pinned by digest (image@sha256:…) in base-image.txt (or zig-base-image.txt for -toolchain=zig), so that every kernel build can be traced to the exact toolchain environment. Keep the pin current with gokr-pull-debian-base")
+
+// baseImage returns the base image of the build container for toolchain.
+// base-image.txt optionally pins it, e.g. to debian:bookworm@sha256:… (see
+// gokr-pull-debian-base). The zig toolchain uses an Alpine base image,
+// optionally pinned in zig-base-image.txt.
+func baseImage(toolchain string) (string, error) {
+	image, fn := "debian:bookworm", "base-image.txt"
+	if toolchain == "zig" {
+		image, fn = "alpine:3.20", "zig-base-image.txt"
+	}
+	if b, err := os.ReadFile(fn); err == nil {
+		image = strings.TrimSpace(string(b))
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if *requirePinnedBaseImage && !strings.Contains(image, "@sha256:") {
+		return "", fmt.Errorf("-require_pinned_base_image: base image %s is not pinned by digest (create %s with gokr-pull-debian-base -image=%s -updater_path=_build/%s)", image, fn, image, fn)
+	}
+	return image, nil
+}
+
+// verifyBaseImage pulls the base image ref and verifies that the local
+// image matches its pinned digest, if any. Pulling by digest verifies the
+// content already, but a local image of the same name (e.g. retagged, or
+// from a registry mirror rewriting manifests) could otherwise be used
+// instead.
+func verifyBaseImage(execName, ref string) error {
+	_, digest, ok := strings.Cut(ref, "@")
+	if !ok {
+		log.Printf("base image %s is not pinned by digest, build is not hermetic", ref)
+		return nil
+	}
+	pull := exec.Command(execName, "pull", "--platform=linux/amd64", ref)
+	pull.Stdout = os.Stdout
+	pull.Stderr = os.Stderr
+	log.Printf("%v", pull.Args)
+	if err := pull.Run(); err != nil {
+		return fmt.Errorf("%s pull: %v (cmd: %v)", execName, err, pull.Args)
+	}
+	inspect := exec.Command(execName, "image", "inspect", "--format={{json .RepoDigests}}", ref)
+	inspect.Stderr = os.Stderr
+	out, err := inspect.Output()
+	if err != nil {
+		return fmt.Errorf("%s image inspect: %v (cmd: %v)", execName, err, inspect.Args)
+	}
+	var repoDigests []string
+	if err := json.Unmarshal(out, &repoDigests); err != nil {
+		return fmt.Errorf("%s image inspect: %v", execName, err)
+	}
+	for _, rd := range repoDigests {
+		if strings.HasSuffix(rd, "@"+digest) {
+			log.Printf("verified base image %s", ref)
+			return nil
+		}
+	}
+	return fmt.Errorf("base image %s does not match its pinned digest: local image has digests %q", ref, repoDigests)
+}
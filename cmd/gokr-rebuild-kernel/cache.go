@@ -0,0 +1,162 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// cacheKey hashes all inputs of a kernel build: the upstream URL and build
+// options, followed by the contents of the generated Dockerfile, the
+// gokr-rebuild-kernel binary, the config addendum and all patches.
+func cacheKey(options []string, files []string) (string, error) {
+	h := sha256.New()
+	for _, o := range options {
+		fmt.Fprintf(h, "%q\n", o)
+	}
+	for _, fn := range files {
+		f, err := os.Open(fn)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%q\n", fn)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// buildOutputs lists the (glob patterns of) files and directories in _build
+// which the build container produces.
+var buildOutputs = []string{
+	"vmlinuz",
+	"metadata.json",
+	"lib",
+	"overlays",
+	"*.dtb",
+	"*.deb",
+}
+
+// packOutputs returns a gzipped tar archive of the build outputs in the
+// current directory.
+func packOutputs() ([]byte, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, pattern := range buildOutputs {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if err := filepath.WalkDir(match, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				var link string
+				if info.Mode()&fs.ModeSymlink != 0 {
+					if link, err = os.Readlink(path); err != nil {
+						return err
+					}
+				}
+				hdr, err := tar.FileInfoHeader(info, link)
+				if err != nil {
+					return err
+				}
+				hdr.Name = filepath.ToSlash(path)
+				if err := tw.WriteHeader(hdr); err != nil {
+					return err
+				}
+				if !info.Mode().IsRegular() {
+					return nil
+				}
+				f, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				_, err = io.Copy(tw, f)
+				return err
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unpackOutputs replaces the build outputs in the current directory with the
+// contents of the archive created by packOutputs.
+func unpackOutputs(b []byte) error {
+	for _, pattern := range buildOutputs {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			if err := os.RemoveAll(match); err != nil {
+				return err
+			}
+		}
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path := filepath.FromSlash(hdr.Name)
+		if !filepath.IsLocal(path) {
+			return fmt.Errorf("refusing to unpack non-local path %q", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fs.FileMode(hdr.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var extraPackages = flag.String("extra_packages",
+	"",
+	"comma-separated list of additional packages to install into the build container, e.g. for patches with additional build dependencies (rustc,bindgen for Rust-for-Linux, libtraceevent-dev). Debian package names, or Alpine package names with -toolchain=zig. Versions may be pinned (pkg=1.2-3), and -toolchain_image is re-built when the list changes")
+
+// packageNameRe matches package names, optionally with an architecture
+// (pkg:arm64) or version (pkg=1.2-3), but no shell metacharacters, as the
+// names are interpolated into a RUN line of the Dockerfile.
+var packageNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9.+_~:=-]*$`)
+
+// parseExtraPackages validates and splits the -extra_packages value.
+func parseExtraPackages(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	var pkgs []string
+	for _, pkg := range strings.Split(list, ",") {
+		pkg = strings.TrimSpace(pkg)
+		if !packageNameRe.MatchString(pkg) {
+			return nil, fmt.Errorf("invalid -extra_packages entry %q: expected a package name", pkg)
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, nil
+}
@@ -1,242 +1,113 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"runtime"
-	"strconv"
 	"strings"
-)
 
-func downloadKernel(latest string) error {
-	out, err := os.Create(filepath.Base(latest))
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-	resp, err := http.Get(latest)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if got, want := resp.StatusCode, http.StatusOK; got != want {
-		return fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", latest, got, want)
-	}
-	if _, err := io.Copy(out, resp.Body); err != nil {
-		return err
-	}
-	return out.Close()
-}
+	"github.com/gokrazy/autoupdate/pkg/kernelbuild"
+)
 
-func applyPatches(srcdir string) error {
-	patches, err := filepath.Glob("*.patch")
-	if err != nil {
-		return err
-	}
-	for _, patch := range patches {
-		log.Printf("applying patch %q", patch)
-		f, err := os.Open(patch)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		cmd := exec.Command("patch", "-p1")
-		cmd.Dir = srcdir
-		cmd.Stdin = f
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			return err
-		}
-		f.Close()
-	}
+func indockerMain() {
+	cross := flag.String("cross",
+		"",
+		"if non-empty, cross-compile for the specified arch (one of 'arm64')")
 
-	return nil
-}
+	flavor := flag.String("flavor",
+		"vanilla",
+		"which kernel flavor to build. one of vanilla (kernel.org) or raspberrypi (https://github.com/raspberrypi/linux/tags)")
 
-func compile(cross, flavor string) error {
-	defconfig := exec.Command("make", "defconfig")
-	if flavor == "raspberrypi" {
-		// TODO(https://github.com/gokrazy/gokrazy/issues/223): is it
-		// necessary/desirable to switch to bcm2712_defconfig?
-		defconfig = exec.Command("make", "ARCH=arm64", "bcm2711_defconfig")
-	}
+	deb := flag.Bool("deb",
+		false,
+		"additionally build Debian packages via make bindeb-pkg")
 
-	defconfig.Stdout = os.Stdout
-	defconfig.Stderr = os.Stderr
-	if err := defconfig.Run(); err != nil {
-		return fmt.Errorf("make defconfig: %v", err)
-	}
+	dtbGlobs := flag.String("dtb_globs",
+		"",
+		"comma-separated list of additional device tree file glob patterns, relative to arch/arm64/boot/dts/")
 
-	// Change answers from mod to no if possible, i.e. disable all modules so
-	// that we end up with a minimal set of modules (from the config addendum).
-	mod2noconfig := exec.Command("make", "mod2noconfig")
-	mod2noconfig.Stdout = os.Stdout
-	mod2noconfig.Stderr = os.Stderr
-	if err := mod2noconfig.Run(); err != nil {
-		return fmt.Errorf("make olddefconfig: %v", err)
-	}
+	board := flag.String("board",
+		"",
+		"board name, available as {{ .Board }} in config.addendum.txt")
 
-	f, err := os.OpenFile(".config", os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	addendum, err := os.ReadFile("/usr/src/config.addendum.txt")
-	if err != nil {
-		return err
-	}
-	if _, err := f.Write(addendum); err != nil {
-		return err
-	}
-	if err := f.Close(); err != nil {
-		return err
-	}
+	source := flag.String("source",
+		"",
+		"if non-empty, path to the already downloaded kernel source tarball (see -no_network)")
 
-	olddefconfig := exec.Command("make", "olddefconfig")
-	olddefconfig.Stdout = os.Stdout
-	olddefconfig.Stderr = os.Stderr
-	if err := olddefconfig.Run(); err != nil {
-		return fmt.Errorf("make olddefconfig: %v", err)
-	}
+	sourceSHA256 := flag.String("source_sha256",
+		"",
+		"if non-empty, expected SHA-256 hash (hex) of the kernel source tarball")
 
-	env := append(os.Environ(),
-		"KBUILD_BUILD_USER=gokrazy",
-		"KBUILD_BUILD_HOST=docker",
-		"KBUILD_BUILD_TIMESTAMP=Wed Mar  1 20:57:29 UTC 2017",
-	)
-	make := exec.Command("make", "bzImage", "modules", "-j"+strconv.Itoa(runtime.NumCPU()))
-	if cross == "arm64" {
-		make = exec.Command("make", "Image.gz", "dtbs", "modules", "-j"+strconv.Itoa(runtime.NumCPU()))
-	}
-	make.Env = env
-	make.Stdout = os.Stdout
-	make.Stderr = os.Stderr
-	if err := make.Run(); err != nil {
-		return fmt.Errorf("make: %v", err)
-	}
+	smoke := flag.String("smoke_test",
+		"",
+		"if non-empty, boot the built kernel in QEMU to verify it reaches userspace")
 
-	make = exec.Command("make", "INSTALL_MOD_PATH=/tmp/buildresult", "modules_install", "-j"+strconv.Itoa(runtime.NumCPU()))
-	make.Env = env
-	make.Stdout = os.Stdout
-	make.Stderr = os.Stderr
-	if err := make.Run(); err != nil {
-		return fmt.Errorf("make: %v", err)
-	}
+	patchList := flag.String("patches",
+		"",
+		"comma-separated list of patches to apply, in series order. If empty, all *.patch files are applied in lexical order")
 
-	return nil
-}
+	toolchain := flag.String("toolchain",
+		"gcc",
+		"gcc or zig (zig cc with the LLVM binutils)")
 
-func indockerMain() {
-	cross := flag.String("cross",
+	baseImage := flag.String("base_image",
 		"",
-		"if non-empty, cross-compile for the specified arch (one of 'arm64')")
+		"base image of the build container, recorded in metadata.json")
 
-	flavor := flag.String("flavor",
-		"vanilla",
-		"which kernel flavor to build. one of vanilla (kernel.org) or raspberrypi (https://github.com/raspberrypi/linux/tags)")
+	logFormat := flag.String("log_format",
+		"plain",
+		"plain or json (one JSON record per line, with stage boundaries and classified warnings/errors)")
 
 	flag.Parse()
+	if *logFormat == "json" {
+		enableJSONLogs()
+	}
 	latest := flag.Arg(0)
 	if latest == "" {
 		log.Fatalf("syntax: %s <upstream-URL>", os.Args[0])
 	}
-	log.Printf("downloading kernel source: %s", latest)
-	if err := downloadKernel(latest); err != nil {
-		log.Fatal(err)
-	}
-
-	log.Printf("unpacking kernel source")
-	untar := exec.Command("tar", "xf", filepath.Base(latest))
-	untar.Stdout = os.Stdout
-	untar.Stderr = os.Stderr
-	if err := untar.Run(); err != nil {
-		log.Fatalf("untar: %v", err)
-	}
-
-	srcdir := strings.TrimSuffix(filepath.Base(latest), ".tar.xz")
-	if *flavor == "raspberrypi" {
-		srcdir = strings.TrimSuffix("linux-"+filepath.Base(latest), ".tar.gz")
-	}
-
-	log.Printf("applying patches")
-	if err := applyPatches(srcdir); err != nil {
-		log.Fatal(err)
-	}
-
-	if err := os.Chdir(srcdir); err != nil {
-		log.Fatal(err)
-	}
 
-	if *cross == "arm64" {
-		log.Printf("exporting ARCH=arm64, CROSS_COMPILE=aarch64-linux-gnu-")
-		os.Setenv("ARCH", "arm64")
-		os.Setenv("CROSS_COMPILE", "aarch64-linux-gnu-")
-	}
-
-	log.Printf("compiling kernel")
-	if err := compile(*cross, *flavor); err != nil {
-		log.Fatal(err)
-	}
-
-	if *cross == "arm64" {
-		if err := copyFile("/tmp/buildresult/vmlinuz", "arch/arm64/boot/Image"); err != nil {
-			log.Fatal(err)
-		}
-
-		switch *flavor {
-		case "vanilla":
-			// copy device tree files from arch/arm64/boot/dts/broadcom/ to buildresult
-			for dest, source := range map[string]string{
-				"bcm2710-rpi-3-b.dtb":      "bcm2837-rpi-3-b.dtb",
-				"bcm2710-rpi-3-b-plus.dtb": "bcm2837-rpi-3-b-plus.dtb",
-				"bcm2710-rpi-cm3.dtb":      "bcm2837-rpi-cm3-io3.dtb",
-				"bcm2711-rpi-4-b.dtb":      "bcm2711-rpi-4-b.dtb",
-				"bcm2711-rpi-cm4-io.dtb":   "bcm2711-rpi-cm4-io.dtb",
-				"bcm2710-rpi-zero-2-w.dtb": "bcm2837-rpi-zero-2-w.dtb",
-				"bcm2710-rpi-zero-2.dtb":   "bcm2837-rpi-zero-2-w.dtb",
-				"bcm2711-rpi-400.dtb":      "bcm2711-rpi-400.dtb",
-			} {
-				if err := copyFile("/tmp/buildresult/"+dest, "arch/arm64/boot/dts/broadcom/"+source); err != nil {
-					log.Fatal(err)
-				}
-			}
-
-		case "raspberrypi":
-			// copy all dtb and dtbos (+ overlay_map) to buildresult
-			dtbs, err := filepath.Glob("arch/arm64/boot/dts/broadcom/*.dtb")
-			if err != nil {
-				log.Fatal(err)
-			}
-			for _, fn := range dtbs {
-				if err := copyFile(filepath.Join("/tmp/buildresult/", filepath.Base(fn)), fn); err != nil {
-					log.Fatal(err)
-				}
-			}
-
-			dtbos, err := filepath.Glob("arch/arm64/boot/dts/overlays/*.dtbo")
-			if err != nil {
-				log.Fatal(err)
-			}
-			dtbos = append(dtbos, "arch/arm64/boot/dts/overlays/overlay_map.dtb")
-			if err := os.MkdirAll("/tmp/buildresult/overlays", 0755); err != nil {
-				log.Fatal(err)
-			}
-			for _, fn := range dtbos {
-				if err := copyFile(filepath.Join("/tmp/buildresult/overlays/", filepath.Base(fn)), fn); err != nil {
-					log.Fatal(err)
-				}
-			}
-		}
+	var patches []string
+	if *patchList != "" {
+		patches = strings.Split(*patchList, ",")
 	} else {
-		if err := copyFile("/tmp/buildresult/vmlinuz", "arch/x86/boot/bzImage"); err != nil {
+		var err error
+		patches, err = filepath.Glob("*.patch")
+		if err != nil {
 			log.Fatal(err)
 		}
 	}
+	var globs []string
+	if *dtbGlobs != "" {
+		globs = strings.Split(*dtbGlobs, ",")
+	}
+	if _, err := kernelbuild.Build(context.Background(), kernelbuild.Config{
+		UpstreamURL:  latest,
+		Source:       *source,
+		SourceSHA256: *sourceSHA256,
+		Flavor:       *flavor,
+		Cross:        *cross,
+		Board:        *board,
+		Toolchain:    *toolchain,
+		BaseImage:    *baseImage,
+		Addendum:     "/usr/src/config.addendum.txt",
+		Patches:      patches,
+		DTBGlobs:     globs,
+		Deb:          *deb,
+		SmokeTest:    *smoke != "",
+		Jobs:         *jobs,
+		WorkDir:      ".",
+		OutputDir:    "/tmp/buildresult",
+		Output:       cmdOutput,
+		Hooks: kernelbuild.Hooks{
+			Stage: func(stage kernelbuild.Stage, msg string) {
+				beginStage(string(stage), "%s", msg)
+			},
+			Logf: log.Printf,
+		},
+	}); err != nil {
+		log.Fatal(err)
+	}
 }
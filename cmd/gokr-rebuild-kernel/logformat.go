@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// cmdOutput receives the output of the commands run inside the container.
+// With -log_format=json, it is a lineLogger.
+var cmdOutput io.Writer = os.Stdout
+
+// currentStage is the build stage (download, unpack, patch, compile, …)
+// which log records are attributed to.
+var currentStage string
+
+// beginStage marks the start of a build stage.
+func beginStage(stage, format string, args ...interface{}) {
+	currentStage = stage
+	if jsonLogs {
+		slog.Info(fmt.Sprintf(format, args...), "stage", stage, "event", "stage-begin")
+		return
+	}
+	log.Printf(format, args...)
+}
+
+var jsonLogs bool
+
+// enableJSONLogs switches all logging (including the log package and
+// command output) to JSON records on stdout, one per line, e.g.
+//
+//	{"time":"…","level":"WARN","msg":"drivers/foo.c:12: warning: …","stage":"compile"}
+func enableJSONLogs() {
+	jsonLogs = true
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+	cmdOutput = &lineLogger{}
+}
+
+var (
+	errorLineRe   = regexp.MustCompile(`(?i)(\berror:|\*\*\* |\bfatal\b)`)
+	warningLineRe = regexp.MustCompile(`(?i)\bwarning:`)
+)
+
+// lineLogger logs each line written to it, classifying compiler warnings
+// and errors by level.
+type lineLogger struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *lineLogger) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		idx := bytes.IndexByte(w.buf, '\n')
+		if idx == -1 {
+			break
+		}
+		w.logLine(string(w.buf[:idx]))
+		w.buf = w.buf[idx+1:]
+	}
+	return len(p), nil
+}
+
+func (w *lineLogger) logLine(line string) {
+	level := slog.LevelInfo
+	switch {
+	case errorLineRe.MatchString(line):
+		level = slog.LevelError
+	case warningLineRe.MatchString(line):
+		level = slog.LevelWarn
+	}
+	slog.Log(context.Background(), level, line, "stage", currentStage, "event", "output")
+}
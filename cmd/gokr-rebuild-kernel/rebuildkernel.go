@@ -1,27 +1,68 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"text/template"
-)
 
-const dockerFileContents = `
-FROM debian:bookworm
+	"github.com/gokrazy/autoupdate/internal/artifactstore"
+	"github.com/gokrazy/autoupdate/internal/secret"
+	"github.com/gokrazy/autoupdate/internal/version"
+	"github.com/gokrazy/autoupdate/pkg/kernelbuild"
+)
 
-RUN apt-get update && apt-get install -y \
+// toolchainFileContents installs the build toolchain. It is part of the
+// Dockerfile, or built separately as -toolchain_image.
+const toolchainFileContents = `
+FROM {{ .BaseImage }}
+{{ if (eq .Toolchain "zig") }}
+RUN apk add --no-cache zig llvm make bash bc bison flex perl python3 tar xz \
+  patch findutils diffutils coreutils openssl-dev elfutils-dev ncurses-dev \
+  linux-headers ca-certificates zstd kmod cpio gzip pixz pigz
+{{- if .ExtraPackages }}
+RUN apk add --no-cache{{ range .ExtraPackages }} {{ . }}{{ end }}
+{{- end }}
+{{ else }}
+RUN {{ .Apt }} update && {{ .Apt }} install -y \
 {{ if (eq .Cross "arm64") -}}
   crossbuild-essential-arm64 \
 {{ end -}}
-  build-essential bc libssl-dev bison flex libelf-dev ncurses-dev ca-certificates zstd kmod python3
+{{ if .Deb -}}
+  dpkg-dev rsync cpio \
+{{ end -}}
+  build-essential bc libssl-dev bison flex libelf-dev ncurses-dev ca-certificates zstd kmod python3 \
+  xz-utils pixz pigz
+{{ if .SmokeTest }}
+RUN {{ if (eq .Cross "arm64") }}dpkg --add-architecture arm64 && {{ .Apt }} update && {{ end }}{{ .Apt }} install -y cpio \
+{{ if (eq .Cross "arm64") -}}
+  qemu-system-arm busybox-static:arm64
+{{- else -}}
+  qemu-system-x86 busybox-static
+{{- end }}
+{{ end }}
+{{- if .ExtraPackages }}
+RUN {{ .Apt }} install -y{{ range .ExtraPackages }} {{ . }}{{ end }}
+{{ end }}
+{{- end }}
+`
 
+const dockerFileContents = `
+{{- if .ToolchainImage }}
+FROM {{ .ToolchainImage }}
+{{ else }}
+{{- template "toolchain" . }}
+{{- end }}
 COPY gokr-rebuild-kernel /usr/bin/gokr-rebuild-kernel
 COPY config.addendum.txt /usr/src/config.addendum.txt
 {{- range $idx, $path := .Patches }}
@@ -45,6 +86,32 @@ var dockerFileTmpl = template.Must(template.New("dockerfile").
 	}).
 	Parse(dockerFileContents))
 
+var toolchainTmpl = template.Must(dockerFileTmpl.New("toolchain").Parse(toolchainFileContents))
+
+// dockerFileData is available to dockerFileContents and
+// toolchainFileContents.
+type dockerFileData struct {
+	BaseImage string
+	Uid       string
+	Gid       string
+	Patches   []string
+	Cross     string
+	Deb       bool
+	SmokeTest bool
+	Toolchain string
+
+	// ExtraPackages are installed in addition to the toolchain, see
+	// -extra_packages.
+	ExtraPackages []string
+
+	// Apt is the apt-get command line, including -apt_proxy options.
+	Apt string
+
+	// ToolchainImage, if non-empty, is the (pre-built) image containing the
+	// toolchain, see -toolchain_image.
+	ToolchainImage string
+}
+
 func copyFile(dest, src string) error {
 	log.Printf("copyFile(dest=%s, src=%s)", dest, src)
 	out, err := os.Create(dest)
@@ -75,6 +142,51 @@ func copyFile(dest, src string) error {
 	return out.Close()
 }
 
+// copyDir recursively copies the directory src to dest, preserving symlinks.
+func copyDir(dest, src string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0755)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return copyFile(target, path)
+		}
+	})
+}
+
+// replaceDir replaces the directory dest with a copy of src.
+func replaceDir(dest, src string) error {
+	log.Printf("replacing %s with %s", dest, src)
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	return copyDir(dest, src)
+}
+
+// rpiKernelName returns the file name under which the Raspberry Pi firmware
+// looks for a 64-bit kernel on the specified board, see
+// https://www.raspberrypi.com/documentation/computers/config_txt.html#kernel
+func rpiKernelName(board string) string {
+	if board == "rpi5" {
+		return "kernel_2712.img"
+	}
+	return "kernel8.img"
+}
+
 func find(filename string) (string, error) {
 	if _, err := os.Stat(filename); err == nil {
 		return filename, nil
@@ -101,6 +213,21 @@ func getContainerExecutable() (string, error) {
 	return "", fmt.Errorf("none of %v found in $PATH", choices)
 }
 
+// buildUser returns the uid and gid as which to run the build inside the
+// container, so that the build results are owned by the current user.
+func buildUser() (uid, gid string, _ error) {
+	if runtime.GOOS == "windows" {
+		// Windows user IDs are SIDs, which cannot be used inside the Linux
+		// container. Docker Desktop maps bind mount ownership on its own.
+		return "1000", "1000", nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "", "", err
+	}
+	return u.Uid, u.Gid, nil
+}
+
 func rebuildKernel() error {
 	overwriteContainerExecutable := flag.String("overwrite_container_executable",
 		"",
@@ -122,17 +249,107 @@ func rebuildKernel() error {
 		"raspberrypi",
 		"which device tree files (.dtb files) to copy. 'raspberrypi' or empty")
 
+	deb := flag.Bool("deb",
+		false,
+		"additionally build Debian packages (linux-image, linux-headers) via make bindeb-pkg into the _build directory")
+
+	dtbGlobs := flag.String("dtb_globs",
+		"",
+		"comma-separated list of additional device tree file glob patterns, relative to arch/arm64/boot/dts/ (e.g. rockchip/rk3399-*.dtb,allwinner/sun50i-h6-*.dtb), to copy for non-Raspberry Pi boards")
+
+	board := flag.String("board",
+		"",
+		"board name (e.g. rpi5) made available as {{ .Board }} to template directives in config.addendum.txt")
+
+	cacheDir := flag.String("cache_dir",
+		"",
+		"if non-empty, directory in which build outputs are cached, keyed by a hash of all build inputs. Builds with identical inputs are skipped")
+
+	cacheS3URL := flag.String("cache_s3_url",
+		"",
+		"like -cache_dir, but caches build outputs in an S3-compatible bucket (path-style URL). Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+
+	cacheStore := flag.String("cache_store",
+		"",
+		"like -cache_dir, but caches build outputs in the specified artifact store: a directory, s3+https://<path-style bucket URL> or oci://<registry>/<repository>")
+
+	noNetwork := flag.Bool("no_network",
+		false,
+		"download the kernel source on the host and run the build container without network access, so that the build of freshly downloaded code cannot reach the network")
+
+	containerRuntime := flag.String("runtime",
+		"",
+		"if non-empty, OCI runtime with which to run the build container, e.g. runsc (gVisor) or kata-runtime (Kata Containers)")
+
+	seccompProfile := flag.String("seccomp_profile",
+		"",
+		"if non-empty, path to a seccomp profile (JSON) to confine the build container with")
+
+	smokeTest := flag.String("smoke_test",
+		"",
+		"if non-empty, boot the built kernel with a minimal initramfs to verify it reaches userspace before installing it. One of 'qemu'")
+
+	logFormat := flag.String("log_format",
+		"plain",
+		"log format of the in-container build phase: plain or json (one JSON record per line with stage boundaries and classified warnings/errors, for parsing by CI)")
+
+	upstreamURLFlag := flag.String("upstream_url",
+		"",
+		"kernel source URL to build. If empty, the URL is read from the var latest declaration in -build_go")
+
+	sourceSHA256 := flag.String("source_sha256",
+		"",
+		"expected SHA-256 hash (hex) of the kernel source tarball. The build fails before patching or compiling if the downloaded source does not match. If empty, the hash is looked up in the sha256sums.asc file which kernel.org publishes next to the tarball (-flavor=vanilla only, the PGP signature is not verified); for -flavor=raspberrypi, the source is not verified")
+
+	buildGo := flag.String("build_go",
+		"../cmd/gokr-build-kernel/build.go",
+		"path (relative to _build) to the build.go file whose var latest declaration contains the kernel source URL")
+
+	toolchain := flag.String("toolchain",
+		"gcc",
+		"compiler toolchain to build with. One of gcc (Debian build container with crossbuild-essential-arm64 for -cross=arm64) or zig (zig cc with the LLVM binutils in a much smaller Alpine build container, no per-architecture cross toolchain needed). zig does not support -deb and -smoke_test")
+
+	outputNaming := flag.String("output_naming",
+		"gokrazy",
+		"file naming of the installed kernel image. One of gokrazy (vmlinuz) or rpi-firmware (kernel8.img, or kernel_2712.img for -board=rpi5, as loaded by the Raspberry Pi firmware without a kernel= line in config.txt). rpi-firmware requires -cross=arm64")
+
+	printVersion := flag.Bool("version",
+		false,
+		"print version information and exit")
+
 	flag.Parse()
+	version.MaybePrint(*printVersion)
 
 	if *cross != "" && *cross != "arm64" {
-		return fmt.Errorf("invalid -cross value %q: expected one of 'arm64'")
+		return fmt.Errorf("invalid -cross value %q: expected one of 'arm64'", *cross)
+	}
+	if *logFormat != "plain" && *logFormat != "json" {
+		return fmt.Errorf("invalid -log_format value %q: expected one of plain or json", *logFormat)
+	}
+	if *outputNaming != "gokrazy" && *outputNaming != "rpi-firmware" {
+		return fmt.Errorf("invalid -output_naming value %q: expected one of gokrazy or rpi-firmware", *outputNaming)
+	}
+	if *outputNaming == "rpi-firmware" && *cross != "arm64" {
+		return fmt.Errorf("-output_naming=rpi-firmware requires -cross=arm64")
+	}
+	if *smokeTest != "" && *smokeTest != "qemu" {
+		return fmt.Errorf("invalid -smoke_test value %q: expected one of 'qemu'", *smokeTest)
+	}
+	if *toolchain != "gcc" && *toolchain != "zig" {
+		return fmt.Errorf("invalid -toolchain value %q: expected one of gcc or zig", *toolchain)
+	}
+	if *toolchain == "zig" && (*deb || *smokeTest != "") {
+		return fmt.Errorf("-toolchain=zig cannot be combined with -deb or -smoke_test")
+	}
+	if err := checkResourceLimits(); err != nil {
+		return err
 	}
 
 	abs, err := os.Getwd()
 	if err != nil {
 		return err
 	}
-	if !strings.HasSuffix(strings.TrimSuffix(abs, "/"), "/_build") {
+	if filepath.Base(abs) != "_build" {
 		return fmt.Errorf("gokr-rebuild-kernel is not run from a _build directory")
 	}
 
@@ -140,7 +357,13 @@ func rebuildKernel() error {
 	if err != nil {
 		return err
 	}
-	patches := strings.Split(strings.TrimSpace(string(series)), "\n")
+	// Patches referenced by URL are fetched now, so that the build
+	// container (which might not have network access) can COPY them.
+	patchPaths, cleanupPatches, err := resolveSeries(context.Background(), series)
+	defer cleanupPatches()
+	if err != nil {
+		return err
+	}
 
 	executable, err := getContainerExecutable()
 	if err != nil {
@@ -152,56 +375,92 @@ func rebuildKernel() error {
 
 	execName := filepath.Base(executable)
 
-	var patchPaths []string
-	for _, filename := range patches {
-		path, err := find(filename)
+	var kernelPath string
+	if *outputNaming == "rpi-firmware" {
+		// The firmware-named image might not exist yet when switching an
+		// existing repository over from vmlinuz.
+		kernelPath = filepath.Join("..", rpiKernelName(*board))
+	} else {
+		kernelPath, err = find(filepath.Join("..", "vmlinuz"))
 		if err != nil {
 			return err
 		}
-		patchPaths = append(patchPaths, path)
 	}
 
-	kernelPath, err := find("../vmlinuz")
+	libPath, err := find(filepath.Join("..", "lib"))
 	if err != nil {
 		return err
 	}
 
-	libPath, err := find("../lib")
-	if err != nil {
+	// TODO: just ensure the file exists, i.e. we are in _build
+	if _, err := find("config.addendum.txt"); err != nil {
 		return err
 	}
 
-	// TODO: just ensure the file exists, i.e. we are in _build
-	if _, err := find("config.addendum.txt"); err != nil {
+	extra, err := parseExtraPackages(*extraPackages)
+	if err != nil {
 		return err
 	}
 
-	u, err := user.Current()
+	uid, gid, err := buildUser()
 	if err != nil {
 		return err
 	}
 
-	upstreamURL, err := os.ReadFile("upstream-url.txt")
+	upstreamURL, err := resolveUpstreamURL(*upstreamURLFlag, *buildGo)
 	if err != nil {
 		return err
 	}
 
+	wantSHA256 := *sourceSHA256
+	if wantSHA256 == "" {
+		if *flavor == "vanilla" {
+			wantSHA256, err = kernelbuild.SourceSHA256Sums(context.Background(), upstreamURL)
+			if err != nil {
+				return fmt.Errorf("looking up the kernel source hash (set -source_sha256 to skip): %v", err)
+			}
+			log.Printf("expecting kernel source SHA-256 %s (from kernel.org sha256sums.asc)", wantSHA256)
+		} else {
+			log.Printf("not verifying the kernel source: -source_sha256 is not set")
+		}
+	}
+
 	dockerFile, err := os.Create("Dockerfile")
 	if err != nil {
 		return err
 	}
 
-	if err := dockerFileTmpl.Execute(dockerFile, struct {
-		Uid     string
-		Gid     string
-		Patches []string
-		Cross   string
-	}{
-		Uid:     u.Uid,
-		Gid:     u.Gid,
-		Patches: patches,
-		Cross:   *cross,
-	}); err != nil {
+	base, err := baseImage(*toolchain)
+	if err != nil {
+		return err
+	}
+
+	data := dockerFileData{
+		BaseImage: base,
+		Uid:       uid,
+		Gid:       gid,
+		Patches:   patchPaths,
+		Cross:     *cross,
+		Deb:       *deb,
+		SmokeTest: *smokeTest != "",
+		Toolchain: *toolchain,
+		Apt:       "apt-get",
+
+		ExtraPackages: extra,
+	}
+	if *toolchainImage != "" {
+		// The tag identifies the toolchain contents, so that changed
+		// packages or base images result in a new image instead of
+		// reusing a stale one. -apt_proxy does not change the contents.
+		data.ToolchainImage, err = toolchainImageRef(*toolchainImage, data)
+		if err != nil {
+			return err
+		}
+	}
+	if *aptProxy != "" {
+		data.Apt = fmt.Sprintf("apt-get -o Acquire::http::Proxy=%q", *aptProxy)
+	}
+	if err := dockerFileTmpl.Execute(dockerFile, data); err != nil {
 		return err
 	}
 
@@ -209,50 +468,172 @@ func rebuildKernel() error {
 		return err
 	}
 
-	log.Printf("building %s container for kernel compilation", execName)
+	// buildInContainer builds the kernel in a container, placing the outputs
+	// in the current (_build) directory.
+	buildInContainer := func() error {
+		var source string
+		if *noNetwork {
+			// Download the source while we still have network access; the
+			// _build directory is available within the container.
+			source = filepath.Base(upstreamURL)
+			log.Printf("downloading kernel source: %s", upstreamURL)
+			got, err := kernelbuild.Download(context.Background(), upstreamURL, source)
+			defer os.Remove(source)
+			if err != nil {
+				return err
+			}
+			if wantSHA256 != "" && !strings.EqualFold(got, wantSHA256) {
+				return fmt.Errorf("kernel source SHA-256 mismatch: got %s, want %s", got, wantSHA256)
+			}
+		}
 
-	dockerBuild := exec.Command(execName,
-		"build",
-		"--platform=linux/amd64",
-		"--rm=true",
-		"--tag=gokr-rebuild-kernel",
-		".")
-	dockerBuild.Stdout = os.Stdout
-	dockerBuild.Stderr = os.Stderr
-	log.Printf("%v", dockerBuild.Args)
-	if err := dockerBuild.Run(); err != nil {
-		return fmt.Errorf("%s build: %v (cmd: %v)", execName, err, dockerBuild.Args)
-	}
+		if data.ToolchainImage != "" {
+			if err := ensureToolchainImage(execName, data); err != nil {
+				return err
+			}
+		} else {
+			if err := verifyBaseImage(execName, data.BaseImage); err != nil {
+				return err
+			}
+		}
+
+		log.Printf("building %s container for kernel compilation", execName)
+
+		dockerBuild := exec.Command(execName,
+			"build",
+			"--platform=linux/amd64",
+			"--rm=true",
+			"--tag=gokr-rebuild-kernel",
+			".")
+		dockerBuild.Stdout = os.Stdout
+		dockerBuild.Stderr = os.Stderr
+		log.Printf("%v", dockerBuild.Args)
+		if err := dockerBuild.Run(); err != nil {
+			return fmt.Errorf("%s build: %v (cmd: %v)", execName, err, dockerBuild.Args)
+		}
+
+		log.Printf("compiling kernel")
 
-	log.Printf("compiling kernel")
+		var dockerRun *exec.Cmd
 
-	var dockerRun *exec.Cmd
+		dockerArgs := []string{
+			"run",
+			"--platform=linux/amd64",
+			"--volume", abs + ":/tmp/buildresult:Z",
+		}
 
-	dockerArgs := []string{
-		"run",
-		"--platform=linux/amd64",
-		"--volume", abs + ":/tmp/buildresult:Z",
+		if !*keepBuildContainer {
+			dockerArgs = append(dockerArgs, "--rm")
+		}
+		if execName == "podman" {
+			dockerArgs = append(dockerArgs, "--userns=keep-id")
+		}
+		if *noNetwork {
+			dockerArgs = append(dockerArgs,
+				"--network=none",
+				"--cap-drop=ALL",
+				"--security-opt=no-new-privileges")
+		}
+		if *containerRuntime != "" {
+			dockerArgs = append(dockerArgs, "--runtime="+*containerRuntime)
+		}
+		if *seccompProfile != "" {
+			dockerArgs = append(dockerArgs, "--security-opt=seccomp="+*seccompProfile)
+		}
+		dockerArgs = append(dockerArgs, resourceArgs()...)
+		dockerArgs = append(dockerArgs,
+			"gokr-rebuild-kernel",
+			"-cross="+*cross,
+			"-flavor="+*flavor,
+			fmt.Sprintf("-deb=%v", *deb),
+			"-dtb_globs="+*dtbGlobs,
+			"-board="+*board,
+			"-smoke_test="+*smokeTest,
+			"-toolchain="+*toolchain,
+			"-base_image="+data.BaseImage,
+			"-patches="+strings.Join(patchPaths, ","),
+			"-log_format="+*logFormat,
+			"-source_sha256="+wantSHA256,
+			fmt.Sprintf("-jobs=%d", *jobs))
+		if *noNetwork {
+			dockerArgs = append(dockerArgs, "-source=/tmp/buildresult/"+filepath.Base(source))
+		}
+		dockerArgs = append(dockerArgs, upstreamURL)
+
+		dockerRun = exec.Command(executable, dockerArgs...)
+
+		var oom oomDetector
+		dockerRun.Stdout = io.MultiWriter(os.Stdout, &oom)
+		dockerRun.Stderr = io.MultiWriter(os.Stderr, &oom)
+		log.Printf("%v", dockerRun.Args)
+		if err := dockerRun.Run(); err != nil {
+			if hint := oom.diagnose(err); hint != "" {
+				return fmt.Errorf("%s run: %v: %s (cmd: %v)", execName, err, hint, dockerRun.Args)
+			}
+			return fmt.Errorf("%s run: %v (cmd: %v)", execName, err, dockerRun.Args)
+		}
+		return nil
 	}
 
-	if !*keepBuildContainer {
-		dockerArgs = append(dockerArgs, "--rm")
+	var cacheSpec string
+	switch {
+	case *cacheStore != "":
+		cacheSpec = *cacheStore
+	case *cacheDir != "":
+		cacheSpec = *cacheDir
+	case *cacheS3URL != "":
+		cacheSpec = "s3+" + *cacheS3URL
 	}
-	if execName == "podman" {
-		dockerArgs = append(dockerArgs, "--userns=keep-id")
+	var cache artifactstore.Store
+	if cacheSpec != "" {
+		cache, err = artifactstore.Open(cacheSpec)
+		if err != nil {
+			return err
+		}
 	}
-	dockerArgs = append(dockerArgs,
-		"gokr-rebuild-kernel",
-		"-cross="+*cross,
-		"-flavor="+*flavor,
-		strings.TrimSpace(string(upstreamURL)))
 
-	dockerRun = exec.Command(executable, dockerArgs...)
+	if cache == nil {
+		if err := buildInContainer(); err != nil {
+			return err
+		}
+	} else {
+		ctx := context.Background()
+		key, err := cacheKey(
+			[]string{upstreamURL, *cross, *flavor, fmt.Sprint(*deb), *dtbGlobs, *board, *toolchain},
+			append([]string{"Dockerfile", "gokr-rebuild-kernel", "config.addendum.txt"}, patchPaths...))
+		if err != nil {
+			return err
+		}
+		outputs, err := cache.Get(ctx, key+".tar.gz")
+		switch {
+		case err == nil:
+			log.Printf("reusing cached build outputs for inputs %s", key)
+			if err := unpackOutputs(outputs); err != nil {
+				return err
+			}
+		case errors.Is(err, os.ErrNotExist):
+			if err := buildInContainer(); err != nil {
+				return err
+			}
+			outputs, err := packOutputs()
+			if err != nil {
+				return err
+			}
+			if _, err := cache.Put(ctx, key+".tar.gz", outputs, "application/gzip"); err != nil {
+				return err
+			}
+			log.Printf("stored build outputs for inputs %s in cache", key)
+		default:
+			return err
+		}
+	}
 
-	dockerRun.Stdout = os.Stdout
-	dockerRun.Stderr = os.Stderr
-	log.Printf("%v", dockerRun.Args)
-	if err := dockerRun.Run(); err != nil {
-		return fmt.Errorf("%s run: %v (cmd: %v)", execName, err, dockerRun.Args)
+	var globs []string
+	if *dtbGlobs != "" {
+		globs = strings.Split(*dtbGlobs, ",")
+	}
+	if err := verifyOutputs(*cross, *flavor, *dtbs == "raspberrypi", globs); err != nil {
+		return err
 	}
 
 	if err := copyFile(kernelPath, "vmlinuz"); err != nil {
@@ -261,7 +642,7 @@ func rebuildKernel() error {
 
 	// remove symlinks that only work when source/build directory are present
 	for _, subdir := range []string{"build", "source"} {
-		matches, err := filepath.Glob(filepath.Join("lib/modules", "*", subdir))
+		matches, err := filepath.Glob(filepath.Join("lib", "modules", "*", subdir))
 		if err != nil {
 			return err
 		}
@@ -274,59 +655,41 @@ func rebuildKernel() error {
 	}
 
 	// replace kernel modules directory
-	rm := exec.Command("rm", "-rf", filepath.Join(libPath, "modules"))
-	rm.Stdout = os.Stdout
-	rm.Stderr = os.Stderr
-	log.Printf("%v", rm.Args)
-	if err := rm.Run(); err != nil {
-		return fmt.Errorf("%v: %v", rm.Args, err)
-	}
-	cp := exec.Command("cp", "-r", filepath.Join("lib/modules"), libPath)
-	cp.Stdout = os.Stdout
-	cp.Stderr = os.Stderr
-	log.Printf("%v", cp.Args)
-	if err := cp.Run(); err != nil {
-		return fmt.Errorf("%v: %v", cp.Args, err)
+	if err := replaceDir(filepath.Join(libPath, "modules"), filepath.Join("lib", "modules")); err != nil {
+		return err
 	}
 
 	if *cross == "arm64" {
-		if *dtbs != "" {
+		if *dtbs != "" || *dtbGlobs != "" {
 			// replace device tree files
-			rm = exec.Command("sh", "-c", "rm ../*.dtb")
-			rm.Stdout = os.Stdout
-			rm.Stderr = os.Stderr
-			log.Printf("%v", rm.Args)
-			if err := rm.Run(); err != nil {
-				return fmt.Errorf("%v: %v", rm.Args, err)
+			old, err := filepath.Glob(filepath.Join("..", "*.dtb"))
+			if err != nil {
+				return err
 			}
-			cp = exec.Command("sh", "-c", "cp *.dtb ..")
-			cp.Stdout = os.Stdout
-			cp.Stderr = os.Stderr
-			log.Printf("%v", cp.Args)
-			if err := cp.Run(); err != nil {
-				return fmt.Errorf("%v: %v", cp.Args, err)
+			for _, fn := range old {
+				if err := os.Remove(fn); err != nil {
+					return err
+				}
+			}
+			dtbFiles, err := filepath.Glob("*.dtb")
+			if err != nil {
+				return err
+			}
+			for _, fn := range dtbFiles {
+				if err := copyFile(filepath.Join("..", fn), fn); err != nil {
+					return err
+				}
 			}
 		}
 
 		if *flavor == "raspberrypi" {
 			// replace overlays directory
-			overlaysPath, err := find("../overlays")
+			overlaysPath, err := find(filepath.Join("..", "overlays"))
 			if err != nil {
 				return err
 			}
-			rm = exec.Command("rm", "-rf", overlaysPath)
-			rm.Stdout = os.Stdout
-			rm.Stderr = os.Stderr
-			log.Printf("%v", rm.Args)
-			if err := rm.Run(); err != nil {
-				return fmt.Errorf("%v: %v", rm.Args, err)
-			}
-			cp = exec.Command("cp", "-r", "overlays", overlaysPath)
-			cp.Stdout = os.Stdout
-			cp.Stderr = os.Stderr
-			log.Printf("%v", cp.Args)
-			if err := cp.Run(); err != nil {
-				return fmt.Errorf("%v: %v", cp.Args, err)
+			if err := replaceDir(overlaysPath, "overlays"); err != nil {
+				return err
 			}
 		}
 	}
@@ -338,6 +701,7 @@ func main() {
 	if os.Getenv("GOKRAZY_IN_DOCKER") == "1" {
 		indockerMain()
 	} else {
+		secret.Install()
 		if err := rebuildKernel(); err != nil {
 			log.Fatal(err)
 		}
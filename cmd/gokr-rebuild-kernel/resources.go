@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+var (
+	memoryLimit = flag.String("memory",
+		"",
+		"if non-empty, memory limit of the kernel compile container (passed as --memory to docker/podman run), e.g. 4g. Builds which run out of memory are reported with a hint to increase the runner memory or lower -jobs")
+
+	cpuLimit = flag.String("cpus",
+		"",
+		"if non-empty, number of CPUs the kernel compile container may use (passed as --cpus to docker/podman run), e.g. 2. Also the default for -jobs")
+
+	jobs = flag.Int("jobs",
+		0,
+		"number of parallel make jobs when compiling the kernel. Each job can need more than 1 GB of memory, so lower values help on small CI runners. If zero, -cpus (rounded up) or the number of CPUs of the runner")
+)
+
+var memoryLimitRe = regexp.MustCompile(`^[0-9]+[bkmgBKMG]?$`)
+
+// checkResourceLimits validates -memory, -cpus and -jobs and derives the
+// default for -jobs from -cpus.
+func checkResourceLimits() error {
+	if *memoryLimit != "" && !memoryLimitRe.MatchString(*memoryLimit) {
+		return fmt.Errorf("invalid -memory value %q: expected a number with an optional unit (b, k, m or g), e.g. 4g", *memoryLimit)
+	}
+	if *cpuLimit != "" {
+		cpus, err := strconv.ParseFloat(*cpuLimit, 64)
+		if err != nil || cpus <= 0 {
+			return fmt.Errorf("invalid -cpus value %q: expected a positive number, e.g. 2 or 1.5", *cpuLimit)
+		}
+		// The CPU quota does not change the number of CPUs which the
+		// build sees, so make would start too many jobs.
+		if *jobs == 0 {
+			*jobs = int(math.Ceil(cpus))
+		}
+	}
+	if *jobs < 0 {
+		return fmt.Errorf("invalid -jobs value %d: must not be negative", *jobs)
+	}
+	return nil
+}
+
+// resourceArgs returns the docker/podman run flags for -memory and -cpus.
+func resourceArgs() []string {
+	var args []string
+	if *memoryLimit != "" {
+		// Without a swap limit, the container would use swap (if any)
+		// instead of running out of memory, which is much slower.
+		args = append(args, "--memory="+*memoryLimit, "--memory-swap="+*memoryLimit)
+	}
+	if *cpuLimit != "" {
+		args = append(args, "--cpus="+*cpuLimit)
+	}
+	return args
+}
+
+// oomLineRe matches the messages of gcc, clang and ld when the OOM killer
+// killed them (or the compiler process they started).
+var oomLineRe = regexp.MustCompile(`Killed signal terminated program|internal compiler error: Killed|terminated with signal 9|clang: error: unable to execute command: Killed`)
+
+// oomDetector scans the output of the compile container for the first line
+// which shows that the OOM killer struck.
+type oomDetector struct {
+	mu   sync.Mutex
+	buf  []byte
+	line string
+}
+
+func (d *oomDetector) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.line == "" {
+		d.buf = append(d.buf, p...)
+		for {
+			idx := bytes.IndexByte(d.buf, '\n')
+			if idx == -1 {
+				break
+			}
+			if line := d.buf[:idx]; oomLineRe.Match(line) {
+				d.line = string(bytes.TrimSpace(line))
+				d.buf = nil
+				break
+			}
+			d.buf = d.buf[idx+1:]
+		}
+	}
+	return len(p), nil
+}
+
+// diagnose returns a hint if err (of the compile container run) was caused
+// by running out of memory, or the empty string.
+func (d *oomDetector) diagnose(err error) string {
+	const advice = "increase the runner memory (or -memory) or lower -jobs"
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.line != "" {
+		return fmt.Sprintf("the build ran out of memory (%q): %s", d.line, advice)
+	}
+	// Exit status 137 means the container was killed with SIGKILL, which
+	// the OOM killer does if the memory limit is reached.
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.ExitCode() == 137 {
+		return "the compile container was killed (exit status 137), most likely because it ran out of memory: " + advice
+	}
+	return ""
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// seriesEntry is a line of the series file: either the file name of a patch
+// in the _build directory, or the URL of a patch with its pinned SHA-256
+// hash, e.g.:
+//
+//	https://lore.kernel.org/all/<message-id>/raw sha256:<hex>
+type seriesEntry struct {
+	path   string
+	url    string
+	sha256 string
+}
+
+func parseSeries(b []byte) ([]seriesEntry, error) {
+	var entries []seriesEntry
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "https://") && !strings.HasPrefix(line, "http://") {
+			entries = append(entries, seriesEntry{path: line})
+			continue
+		}
+		url, pin, _ := strings.Cut(line, " ")
+		hash, ok := strings.CutPrefix(strings.TrimSpace(pin), "sha256:")
+		if _, err := hex.DecodeString(hash); !ok || err != nil || len(hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("series: patch URL %s must be pinned with sha256:<hex>", url)
+		}
+		entries = append(entries, seriesEntry{url: url, sha256: strings.ToLower(hash)})
+	}
+	return entries, nil
+}
+
+// fetchPatch downloads the patch at e.url into the current directory,
+// verifies its pinned hash and returns its file name.
+func fetchPatch(ctx context.Context, e seriesEntry) (string, error) {
+	log.Printf("fetching patch %s", e.url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", e.url, got, want)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(b)
+	if got, want := hex.EncodeToString(h[:]), e.sha256; got != want {
+		return "", fmt.Errorf("patch %s: SHA-256 mismatch: got %s, want %s", e.url, got, want)
+	}
+	fn := "fetched-" + e.sha256[:16] + ".patch"
+	if err := os.WriteFile(fn, b, 0644); err != nil {
+		return "", err
+	}
+	return fn, nil
+}
+
+// resolveSeries returns the file names of all patches listed in the series
+// file, in order, fetching URL entries into the current directory. The
+// returned cleanup function removes the fetched patches.
+func resolveSeries(ctx context.Context, b []byte) (patches []string, cleanup func(), _ error) {
+	var fetched []string
+	cleanup = func() {
+		for _, fn := range fetched {
+			os.Remove(fn)
+		}
+	}
+	entries, err := parseSeries(b)
+	if err != nil {
+		return nil, cleanup, err
+	}
+	for _, e := range entries {
+		if e.url == "" {
+			path, err := find(e.path)
+			if err != nil {
+				return nil, cleanup, err
+			}
+			patches = append(patches, path)
+			continue
+		}
+		fn, err := fetchPatch(ctx, e)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		fetched = append(fetched, fn)
+		patches = append(patches, fn)
+	}
+	return patches, cleanup, nil
+}
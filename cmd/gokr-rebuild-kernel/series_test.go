@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSeries(t *testing.T) {
+	hash := strings.Repeat("ab", sha256.Size)
+	for _, tt := range []struct {
+		name    string
+		series  string
+		want    []seriesEntry
+		wantErr bool
+	}{
+		{
+			name:   "local patches",
+			series: "# comment\n\n0001-fix.patch\n  0002-feature.patch  \n",
+			want: []seriesEntry{
+				{path: "0001-fix.patch"},
+				{path: "0002-feature.patch"},
+			},
+		},
+		{
+			name:   "pinned URL",
+			series: "0001-fix.patch\nhttps://lore.kernel.org/all/123@example.org/raw sha256:" + strings.ToUpper(hash) + "\n",
+			want: []seriesEntry{
+				{path: "0001-fix.patch"},
+				{url: "https://lore.kernel.org/all/123@example.org/raw", sha256: hash},
+			},
+		},
+		{
+			name:    "unpinned URL",
+			series:  "https://lore.kernel.org/all/123@example.org/raw\n",
+			wantErr: true,
+		},
+		{
+			name:    "other hash algorithm",
+			series:  "https://example.org/fix.patch sha512:" + hash + "\n",
+			wantErr: true,
+		},
+		{
+			name:    "short hash",
+			series:  "https://example.org/fix.patch sha256:" + hash[:40] + "\n",
+			wantErr: true,
+		},
+		{
+			name:    "not hex",
+			series:  "https://example.org/fix.patch sha256:" + strings.Repeat("zz", sha256.Size) + "\n",
+			wantErr: true,
+		},
+		{
+			name:    "trailing text",
+			series:  "http://example.org/fix.patch sha256:" + hash + " # fixes boot\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSeries([]byte(tt.series))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSeries = %v, want error: %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSeries = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchPatch(t *testing.T) {
+	const patch = "--- a/Makefile\n+++ b/Makefile\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(patch))
+	}))
+	defer srv.Close()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	h := sha256.Sum256([]byte(patch))
+	fn, err := fetchPatch(context.Background(), seriesEntry{url: srv.URL, sha256: hex.EncodeToString(h[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != patch {
+		t.Errorf("fetched patch = %q, want %q", b, patch)
+	}
+
+	if _, err := fetchPatch(context.Background(), seriesEntry{url: srv.URL, sha256: strings.Repeat("00", sha256.Size)}); err == nil {
+		t.Errorf("fetchPatch with a mismatching hash unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+var (
+	aptProxy = flag.String("apt_proxy",
+		"",
+		"if non-empty, URL of an HTTP proxy (e.g. apt-cacher-ng at http://apt-cache.example.net:3142) through which the build container fetches Debian packages. Not used by -toolchain=zig")
+
+	toolchainImage = flag.String("toolchain_image",
+		"",
+		"if non-empty, image name (e.g. ghcr.io/example/gokr-kernel-toolchain) under which the build toolchain is pre-baked, tagged by a hash of its contents. The image is reused if present locally or pullable, and built otherwise, so that cold CI runners do not download the toolchain packages on every run")
+
+	pushToolchainImage = flag.Bool("push_toolchain_image",
+		false,
+		"push a newly built -toolchain_image, so that subsequent runs (on other runners) can pull it")
+)
+
+// toolchainImageRef returns the reference of the -toolchain_image for data:
+// name, tagged with a hash of the toolchain Dockerfile.
+func toolchainImageRef(name string, data dockerFileData) (string, error) {
+	data.Apt = "apt-get" // -apt_proxy does not change the image contents
+	var buf bytes.Buffer
+	if err := toolchainTmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(buf.Bytes())
+	return name + ":" + hex.EncodeToString(h[:])[:16], nil
+}
+
+// ensureToolchainImage makes data.ToolchainImage available locally:
+// present images are reused, otherwise the image is pulled or, if that
+// fails, built (and pushed with -push_toolchain_image).
+func ensureToolchainImage(execName string, data dockerFileData) error {
+	ref := data.ToolchainImage
+	run := func(args ...string) error {
+		cmd := exec.Command(execName, args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		log.Printf("%v", cmd.Args)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s %s: %v (cmd: %v)", execName, args[0], err, cmd.Args)
+		}
+		return nil
+	}
+
+	inspect := exec.Command(execName, "image", "inspect", ref)
+	if err := inspect.Run(); err == nil {
+		log.Printf("reusing local toolchain image %s", ref)
+		return nil
+	}
+	err := run("pull", "--platform=linux/amd64", ref)
+	if err == nil {
+		log.Printf("reusing pulled toolchain image %s", ref)
+		return nil
+	}
+	log.Printf("toolchain image %s not available (%v), building it", ref, err)
+	// Reused images need no verification: their tag covers the pinned
+	// base image reference.
+	if err := verifyBaseImage(execName, data.BaseImage); err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "gokr-rebuild-kernel-toolchain")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	data.ToolchainImage = ""
+	var buf bytes.Buffer
+	if err := toolchainTmpl.Execute(&buf, data); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := run("build", "--platform=linux/amd64", "--tag="+ref, dir); err != nil {
+		return err
+	}
+	if *pushToolchainImage {
+		if err := run("push", ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
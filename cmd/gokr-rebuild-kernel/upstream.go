@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var latestRe = regexp.MustCompile(`var latest = "([^"]+)"`)
+
+// resolveUpstreamURL returns the kernel source URL to build. Unless
+// overridden, it is read from the var latest declaration in build.go (which
+// gokr-pull-kernel keeps up to date), so that downstream repositories do
+// not need to maintain a separate upstream-url.txt. upstream-url.txt is
+// still honored if build.go cannot be found.
+func resolveUpstreamURL(override, buildGo string) (string, error) {
+	if override != "" {
+		return override, nil
+	}
+	b, err := os.ReadFile(buildGo)
+	if err == nil {
+		matches := latestRe.FindSubmatch(b)
+		if matches == nil {
+			return "", fmt.Errorf("%s: var latest declaration not found", buildGo)
+		}
+		return string(matches[1]), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	b, err = os.ReadFile("upstream-url.txt")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("neither %s nor upstream-url.txt found, specify -upstream_url", filepath.Clean(buildGo))
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/autoupdate/pkg/kernelbuild"
+)
+
+// kernelImageRelease checks the magic of the kernel image in fn and returns
+// the kernel release embedded in its header, if the image format carries
+// one (bzImage does, arm64 Image does not).
+func kernelImageRelease(fn, cross string) (string, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return "", err
+	}
+	if cross == "arm64" {
+		// See Documentation/arch/arm64/booting.rst
+		if len(b) < 64 || !bytes.Equal(b[56:60], []byte("ARM\x64")) {
+			return "", fmt.Errorf("%s: not an arm64 kernel Image (magic ARM\\x64 not found at offset 56)", fn)
+		}
+		return "", nil
+	}
+	// See Documentation/arch/x86/boot.rst
+	if len(b) < 0x210 || !bytes.Equal(b[0x202:0x206], []byte("HdrS")) {
+		return "", fmt.Errorf("%s: not an x86 bzImage (magic HdrS not found at offset 0x202)", fn)
+	}
+	off := int(binary.LittleEndian.Uint16(b[0x20e:])) + 0x200
+	if off >= len(b) {
+		return "", fmt.Errorf("%s: kernel_version offset %#x out of bounds", fn, off)
+	}
+	version := b[off:]
+	if idx := bytes.IndexByte(version, 0); idx > -1 {
+		version = version[:idx]
+	}
+	release, _, _ := strings.Cut(string(version), " ")
+	return release, nil
+}
+
+// verifyOutputs checks that the build produced all expected artifacts in
+// the current (_build) directory, returning an error which lists
+// everything that is missing or invalid.
+func verifyOutputs(cross, flavor string, rpiDTBs bool, dtbGlobs []string) error {
+	var problems []string
+
+	release, err := kernelImageRelease("vmlinuz", cross)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	var manifest kernelbuild.Manifest
+	if b, err := os.ReadFile("metadata.json"); err != nil {
+		problems = append(problems, err.Error())
+	} else if err := json.Unmarshal(b, &manifest); err != nil {
+		problems = append(problems, fmt.Sprintf("metadata.json: %v", err))
+	}
+	if release != "" && manifest.KernelRelease != "" && release != manifest.KernelRelease {
+		problems = append(problems, fmt.Sprintf("vmlinuz: kernel release %q does not match metadata.json kernel release %q", release, manifest.KernelRelease))
+	}
+	if release == "" {
+		release = manifest.KernelRelease
+	}
+
+	modules, err := os.ReadDir(filepath.Join("lib", "modules"))
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		var releases []string
+		for _, m := range modules {
+			releases = append(releases, m.Name())
+		}
+		switch {
+		case len(releases) == 0:
+			problems = append(problems, "lib/modules: empty")
+		case release != "" && (len(releases) != 1 || releases[0] != release):
+			problems = append(problems, fmt.Sprintf("lib/modules: got kernel release(s) %q, want %q", releases, release))
+		default:
+			dir := filepath.Join("lib", "modules", releases[0])
+			if entries, err := os.ReadDir(dir); err != nil {
+				problems = append(problems, err.Error())
+			} else if len(entries) == 0 {
+				problems = append(problems, dir+": empty")
+			}
+		}
+	}
+
+	if cross == "arm64" {
+		if rpiDTBs {
+			switch flavor {
+			case "vanilla":
+				var names []string
+				for dest := range kernelbuild.VanillaDTBs {
+					names = append(names, dest)
+				}
+				sort.Strings(names)
+				for _, dest := range names {
+					if _, err := os.Stat(dest); err != nil {
+						problems = append(problems, err.Error())
+					}
+				}
+
+			case "raspberrypi":
+				if matches, _ := filepath.Glob("bcm27*.dtb"); len(matches) == 0 {
+					problems = append(problems, "no bcm27*.dtb device tree files found")
+				}
+				if matches, _ := filepath.Glob(filepath.Join("overlays", "*.dtbo")); len(matches) == 0 {
+					problems = append(problems, "no overlays/*.dtbo device tree overlays found")
+				}
+			}
+		}
+		for _, pattern := range dtbGlobs {
+			// copyDTBs flattens the directory structure.
+			if matches, _ := filepath.Glob(path.Base(pattern)); len(matches) == 0 {
+				problems = append(problems, fmt.Sprintf("no device tree files found for -dtb_globs pattern %q", pattern))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("build result incomplete:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
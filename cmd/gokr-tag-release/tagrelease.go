@@ -0,0 +1,309 @@
+// gokr-tag-release publishes a versioned GitHub release of the latest
+// auto-update merged into a downstream repository, so that image builders
+// can pin to releases instead of tracking the main branch.
+//
+// Run it after gokr-merge landed an auto-update, e.g. in a workflow
+// triggered by pushes to main, once the artifacts were built.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/autoupdate/internal/artifactstore"
+	"github.com/gokrazy/autoupdate/internal/audit"
+	"github.com/gokrazy/autoupdate/internal/cienv"
+	"github.com/gokrazy/autoupdate/internal/notify"
+	"github.com/gokrazy/autoupdate/internal/prmeta"
+	"github.com/gokrazy/autoupdate/internal/ratelimit"
+	"github.com/gokrazy/autoupdate/internal/secret"
+	"github.com/gokrazy/autoupdate/internal/settings"
+	"github.com/gokrazy/autoupdate/internal/version"
+	"github.com/google/go-github/v35/github"
+)
+
+var (
+	artifacts = flag.String("artifacts",
+		"vmlinuz,*.dtb",
+		"comma-separated list of glob patterns of local files (e.g. vmlinuz, *.dtb, firmware manifests) to attach to the release")
+
+	tagPrefix = flag.String("tag_prefix",
+		"v",
+		"prefix of the release tag, which is followed by the commit date and abbreviated commit hash, e.g. v2024.05.01-0123abcd")
+
+	onlyAutoUpdates = flag.Bool("only_auto_updates",
+		true,
+		"only create a release if the head commit is an auto-update")
+
+	manifest = flag.String("manifest",
+		"",
+		"if non-empty, path of the update manifest committed by gokr-pull-kernel -manifest_path (e.g. update-manifest.json), whose previous and new version and upstream hash are listed in the release notes. The manifest is only used if the released commit modified it, as it stays in the repository after the update it describes")
+
+	artifactStore = flag.String("artifact_store",
+		"",
+		"if non-empty, additionally store the artifacts as <tag>/<file name> in this artifact store: a directory, s3+https://<path-style bucket URL> or oci://<registry>/<repository>")
+
+	auditLog = flag.String("audit_log",
+		"",
+		"if non-empty, path to a JSON Lines file to which every mutation (PRs opened, commits amended, labels changed, merges) is appended")
+
+	auditBranch = flag.String("audit_branch",
+		"",
+		"if non-empty, name of a branch in the target repository to which the audit log entries of each run are committed as a new file audit/<time>-<tool>-<pid>.jsonl")
+
+	auditS3 = flag.String("audit_s3",
+		"",
+		"if non-empty, path-style URL of an S3-compatible bucket, optionally followed by a key prefix (e.g. https://s3.eu-central-1.amazonaws.com/my-bucket/audit), to which the audit log entries of each run are uploaded as a new object <owner>/<repo>/<time>-<tool>-<pid>.jsonl. Objects are never overwritten, so the bucket can enforce retention with S3 Object Lock. Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+
+	printVersion = flag.Bool("version",
+		false,
+		"print version information and exit")
+
+	ratelimitMaxWait = flag.Duration("ratelimit_max_wait",
+		0,
+		"if the remaining GitHub API quota does not suffice for the estimated number of requests, wait up to this long for the quota to reset instead of aborting")
+
+	tokenFile = flag.String("token_file",
+		"",
+		"if non-empty, path of a file containing the forge API token, instead of the GITHUB_AUTH_TOKEN or GH_AUTH_TOKEN environment variables. The variables can also name a file via GH_AUTH_TOKEN_FILE (e.g. a Docker secret) or be provided as systemd credentials")
+
+	autoupdateConfig = flag.String("autoupdate_config",
+		"autoupdate.toml",
+		"path to the autoupdate.toml configuration file shared by all tools (or a .json file of the same structure). A missing file is treated as empty")
+)
+
+func sha256File(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readManifest returns the -manifest, or nil if there is none or if the
+// released commit sha did not modify it (e.g. a firmware update after a
+// kernel update, whose manifest would be stale).
+func readManifest(ctx context.Context, client *github.Client, owner, repo, sha string) (*prmeta.Metadata, error) {
+	if *manifest == "" {
+		return nil, nil
+	}
+	commit, _, err := client.Repositories.GetCommit(ctx, owner, repo, sha)
+	if err != nil {
+		return nil, err
+	}
+	modified := false
+	for _, f := range commit.Files {
+		if f.GetFilename() == filepath.ToSlash(filepath.Clean(*manifest)) {
+			modified = true
+			break
+		}
+	}
+	if !modified {
+		log.Printf("commit %s did not modify %s, not using it", sha, *manifest)
+		return nil, nil
+	}
+	b, err := os.ReadFile(*manifest)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return prmeta.ParseManifest(b)
+}
+
+// releaseNotes describes the release of commit (and the update described
+// by m, if non-nil), listing the attached files.
+func releaseNotes(commit *github.Commit, m *prmeta.Metadata, files []string) (string, error) {
+	var b strings.Builder
+	subject, _, _ := strings.Cut(commit.GetMessage(), "\n")
+	fmt.Fprintf(&b, "%s\n\nCommit: %s\n", subject, commit.GetSHA())
+	if m != nil {
+		from := m.PreviousVersion
+		if from == "" {
+			from = "(unknown)"
+		}
+		fmt.Fprintf(&b, "\nUpdates %s from %s to %s\n", strings.TrimSpace(m.Kind+" "+m.Flavor), from, m.Version)
+		if m.UpstreamURL != "" {
+			fmt.Fprintf(&b, "Upstream: %s\n", m.UpstreamURL)
+		}
+		if m.UpstreamHash != "" {
+			fmt.Fprintf(&b, "Upstream hash: `%s`\n", m.UpstreamHash)
+		}
+	}
+	if len(files) > 0 {
+		b.WriteString("\n| File | SHA-256 |\n|---|---|\n")
+	}
+	for _, fn := range files {
+		h, err := sha256File(fn)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "| `%s` | `%s` |\n", filepath.Base(fn), h)
+	}
+	return b.String(), nil
+}
+
+func tagRelease(ctx context.Context, client *github.Client, owner, repo string) error {
+	var store artifactstore.Store
+	if *artifactStore != "" {
+		var err error
+		store, err = artifactstore.Open(*artifactStore)
+		if err != nil {
+			return err
+		}
+	}
+
+	var files []string
+	for _, pattern := range strings.Split(*artifacts, ",") {
+		matches, err := filepath.Glob(strings.TrimSpace(pattern))
+		if err != nil {
+			return err
+		}
+		files = append(files, matches...)
+	}
+
+	// ref, commit, release lookup, changed files, release creation, plus one
+	// upload per file.
+	if err := ratelimit.Preflight(ctx, client, 5+len(files), *ratelimitMaxWait); err != nil {
+		return err
+	}
+
+	lastRef, _, err := client.Git.GetRef(ctx, owner, repo, "heads/main")
+	if err != nil {
+		return err
+	}
+
+	lastCommit, _, err := client.Git.GetCommit(ctx, owner, repo, *lastRef.Object.SHA)
+	if err != nil {
+		return err
+	}
+	if *onlyAutoUpdates && !strings.HasPrefix(lastCommit.GetMessage(), "auto-update") {
+		log.Printf("head commit %s is not an auto-update, not creating a release", lastCommit.GetSHA())
+		return nil
+	}
+
+	tag := *tagPrefix + lastCommit.GetCommitter().GetDate().UTC().Format("2006.01.02") + "-" + lastCommit.GetSHA()[:8]
+	if _, resp, err := client.Repositories.GetReleaseByTag(ctx, owner, repo, tag); err == nil {
+		log.Printf("release %s already exists", tag)
+		return nil
+	} else if resp == nil || resp.StatusCode != http.StatusNotFound {
+		return err
+	}
+
+	m, err := readManifest(ctx, client, owner, repo, lastCommit.GetSHA())
+	if err != nil {
+		return err
+	}
+	notes, err := releaseNotes(lastCommit, m, files)
+	if err != nil {
+		return err
+	}
+	subject, _, _ := strings.Cut(lastCommit.GetMessage(), "\n")
+	release, _, err := client.Repositories.CreateRelease(ctx, owner, repo, &github.RepositoryRelease{
+		TagName:         github.String(tag),
+		TargetCommitish: lastCommit.SHA,
+		Name:            github.String(tag + ": " + subject),
+		Body:            github.String(notes),
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("release = %s", release.GetHTMLURL())
+	audit.Record(owner+"/"+repo, "create-release", release.GetHTMLURL())
+
+	for _, fn := range files {
+		f, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		asset, _, err := client.Repositories.UploadReleaseAsset(ctx, owner, repo, release.GetID(), &github.UploadOptions{
+			Name: filepath.Base(fn),
+		}, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("uploading %s: %v", fn, err)
+		}
+		log.Printf("uploaded %s", asset.GetBrowserDownloadURL())
+		audit.Record(owner+"/"+repo, "upload-release-asset", asset.GetBrowserDownloadURL())
+	}
+
+	if store != nil {
+		for _, fn := range files {
+			b, err := os.ReadFile(fn)
+			if err != nil {
+				return err
+			}
+			u, err := store.Put(ctx, tag+"/"+filepath.Base(fn), b, "application/octet-stream")
+			if err != nil {
+				return fmt.Errorf("storing %s: %v", fn, err)
+			}
+			log.Printf("stored %s %s", fn, u)
+		}
+	}
+
+	return nil
+}
+
+var (
+	githubUser string
+	authToken  string
+	slug       string
+)
+
+func main() {
+	flag.Parse()
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	secret.Install()
+	settings.SetPath(*autoupdateConfig)
+	audit.Configure(audit.Options{
+		Log:    *auditLog,
+		Branch: *auditBranch,
+		S3:     *auditS3,
+	})
+	version.MaybePrint(*printVersion)
+
+	githubUser = cienv.MustGetGithubUser()
+	authToken = cienv.MustGetAuthToken(*tokenFile)
+	slug = cienv.MustGetSlug()
+
+	parts := strings.Split(slug, "/")
+	if got, want := len(parts), 2; got != want {
+		log.Fatalf("unexpected number of /-separated parts in %q: got %d, want %d", slug, got, want)
+	}
+
+	ctx := context.Background()
+
+	client := github.NewClient(&http.Client{
+		Transport: &github.BasicAuthTransport{
+			Username: githubUser,
+			Password: authToken,
+		},
+	})
+
+	err := tagRelease(ctx, client, parts[0], parts[1])
+	ratelimit.Report(ctx, client)
+	if err != nil {
+		notify.Failed(ctx, parts[0]+"/"+parts[1], err)
+		log.Fatal(err)
+	}
+	notify.Succeeded(parts[0] + "/" + parts[1])
+
+	if err := audit.Commit(ctx, client, parts[0], parts[1]); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -3,13 +3,16 @@ module github.com/gokrazy/autoupdate
 go 1.22
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/gokrazy/internal v0.0.0-20250126213949-423a5b587b57
 	github.com/google/go-github/v35 v35.3.0
 	github.com/google/renameio/v2 v2.0.0
+	golang.org/x/crypto v0.31.0
+	golang.org/x/mod v0.20.0
 )
 
 require (
 	github.com/google/go-querystring v1.0.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/crypto v0.31.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
 )
@@ -0,0 +1,105 @@
+// Package artifactstore stores build artifacts (boot logs, build cache
+// entries, release files) by key in a local directory, an S3-compatible
+// bucket or an OCI registry.
+//
+// Stores are specified as:
+//
+//	/var/cache/gokrazy            (or file:///var/cache/gokrazy)
+//	s3+https://s3.eu-central-1.amazonaws.com/bucket/prefix
+//	oci://ghcr.io/owner/artifacts
+//
+// S3 credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY,
+// registry credentials from REGISTRY_USER and REGISTRY_PASSWORD.
+package artifactstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/autoupdate/internal/s3"
+)
+
+// A Store stores artifacts by key.
+type Store interface {
+	// Get returns the artifact key, or an error wrapping os.ErrNotExist.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Put stores content as the artifact key and returns a URL (or, for
+	// registries, a reference) under which it is available, if any.
+	Put(ctx context.Context, key string, content []byte, contentType string) (string, error)
+}
+
+// Open returns the Store for spec.
+func Open(spec string) (Store, error) {
+	switch {
+	case strings.HasPrefix(spec, "s3+"):
+		bucket, err := s3.FromEnv(strings.TrimPrefix(spec, "s3+"))
+		if err != nil {
+			return nil, err
+		}
+		return &S3{Bucket: bucket}, nil
+
+	case strings.HasPrefix(spec, "oci://"):
+		return newOCI(strings.TrimPrefix(spec, "oci://"))
+
+	case strings.HasPrefix(spec, "file://"):
+		return &Local{Dir: strings.TrimPrefix(spec, "file://")}, nil
+
+	case strings.Contains(spec, "://"):
+		return nil, fmt.Errorf("unsupported artifact store %q: expected a directory, s3+https://… or oci://…", spec)
+
+	default:
+		return &Local{Dir: spec}, nil
+	}
+}
+
+// Local stores artifacts as files in a directory.
+type Local struct {
+	Dir string
+}
+
+func (l *Local) path(key string) (string, error) {
+	fn := filepath.FromSlash(key)
+	if !filepath.IsLocal(fn) {
+		return "", fmt.Errorf("invalid artifact key %q", key)
+	}
+	return filepath.Join(l.Dir, fn), nil
+}
+
+func (l *Local) Get(ctx context.Context, key string) ([]byte, error) {
+	fn, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(fn)
+}
+
+func (l *Local) Put(ctx context.Context, key string, content []byte, contentType string) (string, error) {
+	fn, err := l.path(key)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(fn, content, 0644); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// S3 stores artifacts as objects in an S3-compatible bucket.
+type S3 struct {
+	Bucket *s3.Bucket
+}
+
+func (s *S3) Get(ctx context.Context, key string) ([]byte, error) {
+	return s.Bucket.Get(ctx, key)
+}
+
+func (s *S3) Put(ctx context.Context, key string, content []byte, contentType string) (string, error) {
+	return s.Bucket.Put(ctx, key, content, contentType)
+}
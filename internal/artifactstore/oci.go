@@ -0,0 +1,287 @@
+package artifactstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gokrazy/autoupdate/internal/secret"
+)
+
+const (
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociEmptyType    = "application/vnd.oci.empty.v1+json"
+
+	// artifactType identifies manifests pushed by this package.
+	artifactType = "application/vnd.gokrazy.autoupdate.artifact.v1"
+
+	titleAnnotation = "org.opencontainers.image.title"
+)
+
+// ociEmpty is the empty JSON config blob of OCI artifacts.
+var ociEmpty = []byte("{}")
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int               `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	ArtifactType  string          `json:"artifactType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// OCI stores each artifact as a single-layer OCI artifact, tagged with the
+// (sanitized) key, in a registry repository.
+type OCI struct {
+	Registry   string // e.g. ghcr.io
+	Repository string // e.g. owner/artifacts
+
+	user, password string
+
+	mu    sync.Mutex
+	token string
+}
+
+func newOCI(ref string) (*OCI, error) {
+	registry, repository, ok := strings.Cut(ref, "/")
+	if !ok || repository == "" {
+		return nil, fmt.Errorf("invalid OCI artifact store %q: expected oci://<registry>/<repository>", ref)
+	}
+	return &OCI{
+		Registry:   registry,
+		Repository: repository,
+		user:       os.Getenv("REGISTRY_USER"),
+		password:   secret.Get("REGISTRY_PASSWORD"),
+	}, nil
+}
+
+var invalidTagChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// tag returns the tag for key. Tags are limited to 128 characters of
+// [A-Za-z0-9_.-].
+func tag(key string) string {
+	t := invalidTagChars.ReplaceAllString(key, "_")
+	if len(t) > 128 {
+		h := sha256.Sum256([]byte(key))
+		t = t[:128-17] + "-" + hex.EncodeToString(h[:8])
+	}
+	return t
+}
+
+func digest(b []byte) string {
+	h := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+var challengeParamRe = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authenticate obtains a bearer token according to the WWW-Authenticate
+// challenge of a 401 response (see the distribution token authentication
+// specification).
+func (o *OCI) authenticate(ctx context.Context, challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("unsupported registry authentication scheme %q", scheme)
+	}
+	p := make(map[string]string)
+	for _, m := range challengeParamRe.FindAllStringSubmatch(params, -1) {
+		p[m[1]] = m[2]
+	}
+	u, err := url.Parse(p["realm"])
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	if p["service"] != "" {
+		q.Set("service", p["service"])
+	}
+	q.Set("scope", "repository:"+o.Repository+":pull,push")
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if o.user != "" {
+		req.SetBasicAuth(o.user, o.password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("registry token: unexpected HTTP status code: got %d (%s), want %d", got, strings.TrimSpace(string(body)), want)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.token = token.Token
+	if o.token == "" {
+		o.token = token.AccessToken
+	}
+	return nil
+}
+
+// do sends a request to the registry (authenticating if challenged) and
+// returns the response if its status code is one of want.
+func (o *OCI) do(ctx context.Context, method, u string, header http.Header, body []byte, want ...int) (*http.Response, error) {
+	if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+		u = "https://" + o.Registry + u
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		o.mu.Lock()
+		if o.token != "" {
+			req.Header.Set("Authorization", "Bearer "+o.token)
+		}
+		o.mu.Unlock()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			resp.Body.Close()
+			if err := o.authenticate(ctx, resp.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		for _, w := range want {
+			if resp.StatusCode == w {
+				return resp, nil
+			}
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%s %s: %w", method, u, os.ErrNotExist)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s %s: unexpected HTTP status code: got %d (%s), want %v", method, u, resp.StatusCode, strings.TrimSpace(string(b)), want)
+	}
+}
+
+func (o *OCI) pushBlob(ctx context.Context, content []byte) error {
+	d := digest(content)
+	if resp, err := o.do(ctx, "HEAD", "/v2/"+o.Repository+"/blobs/"+d, nil, nil, http.StatusOK); err == nil {
+		resp.Body.Close()
+		return nil // already present
+	}
+	resp, err := o.do(ctx, "POST", "/v2/"+o.Repository+"/blobs/uploads/", nil, nil, http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	loc, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return err
+	}
+	q := loc.Query()
+	q.Set("digest", d)
+	loc.RawQuery = q.Encode()
+	resp, err = o.do(ctx, "PUT", loc.String(), http.Header{
+		"Content-Type": {"application/octet-stream"},
+	}, content, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (o *OCI) Put(ctx context.Context, key string, content []byte, contentType string) (string, error) {
+	if err := o.pushBlob(ctx, ociEmpty); err != nil {
+		return "", err
+	}
+	if err := o.pushBlob(ctx, content); err != nil {
+		return "", err
+	}
+	manifest, err := json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		ArtifactType:  artifactType,
+		Config: ociDescriptor{
+			MediaType: ociEmptyType,
+			Digest:    digest(ociEmpty),
+			Size:      len(ociEmpty),
+		},
+		Layers: []ociDescriptor{{
+			MediaType:   contentType,
+			Digest:      digest(content),
+			Size:        len(content),
+			Annotations: map[string]string{titleAnnotation: key},
+		}},
+	})
+	if err != nil {
+		return "", err
+	}
+	t := tag(key)
+	resp, err := o.do(ctx, "PUT", "/v2/"+o.Repository+"/manifests/"+t, http.Header{
+		"Content-Type": {ociManifestType},
+	}, manifest, http.StatusCreated)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return o.Registry + "/" + o.Repository + ":" + t, nil
+}
+
+func (o *OCI) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := o.do(ctx, "GET", "/v2/"+o.Repository+"/manifests/"+tag(key), http.Header{
+		"Accept": {ociManifestType},
+	}, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ociManifest
+	err = json.NewDecoder(resp.Body).Decode(&manifest)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if got, want := len(manifest.Layers), 1; got != want {
+		return nil, fmt.Errorf("%s: unexpected number of layers: got %d, want %d", key, got, want)
+	}
+	layer := manifest.Layers[0]
+	resp, err = o.do(ctx, "GET", "/v2/"+o.Repository+"/blobs/"+layer.Digest, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if got := digest(b); got != layer.Digest {
+		return nil, fmt.Errorf("%s: digest mismatch: got %s, want %s", key, got, layer.Digest)
+	}
+	return b, nil
+}
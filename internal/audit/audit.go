@@ -0,0 +1,227 @@
+// Package audit records every mutation performed by the autoupdate tools
+// (pull requests opened, commits amended, labels changed, merges) in an
+// append-only JSON Lines file, in new files on a branch of the target
+// repository or in an S3-compatible bucket, so that organizations can account
+// for bot activity.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/s3"
+	"github.com/google/go-github/v35/github"
+)
+
+// Options configures where the audit log is written. The zero value only
+// keeps entries in memory.
+type Options struct {
+	// Log is the path to a JSON Lines file to which every entry is appended.
+	Log string
+
+	// Branch is the name of a branch in the target repository to which the
+	// entries of each run are committed as a new file
+	// audit/<time>-<tool>-<pid>.jsonl.
+	Branch string
+
+	// S3 is the path-style URL of an S3-compatible bucket, optionally
+	// followed by a key prefix, to which the entries of each run are uploaded
+	// as a new object <owner>/<repo>/<time>-<tool>-<pid>.jsonl. Credentials
+	// are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+	S3 string
+}
+
+// Entry is one line of the audit log.
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Tool   string    `json:"tool"`
+	Repo   string    `json:"repo"`
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"`
+}
+
+var (
+	mu      sync.Mutex
+	opts    Options
+	entries []Entry
+	// uploaded is the number of entries which were already uploaded to
+	// opts.S3, in case committing them to opts.Branch failed.
+	uploaded int
+)
+
+// Configure sets where subsequent calls to Record and Commit write the audit
+// log.
+func Configure(o Options) {
+	mu.Lock()
+	defer mu.Unlock()
+	opts = o
+}
+
+// Record appends an entry for action (e.g. "merge") on target (e.g. a pull
+// request URL or ref) in repo (owner/repo) to the audit log.
+func Record(repo, action, target string) {
+	e := Entry{
+		Time:   time.Now().UTC(),
+		Tool:   filepath.Base(os.Args[0]),
+		Repo:   repo,
+		Action: action,
+		Target: target,
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	entries = append(entries, e)
+	if opts.Log == "" {
+		return
+	}
+	if err := appendTo(opts.Log, e); err != nil {
+		log.Printf("recording audit log entry: %v", err)
+	}
+}
+
+func appendTo(path string, e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func marshal(entries []Entry) ([]byte, error) {
+	var content []byte
+	for _, e := range entries {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, b...)
+		content = append(content, '\n')
+	}
+	return content, nil
+}
+
+// Commit commits the entries recorded so far as a new file on the
+// Options.Branch branch of owner/repo, creating the branch if needed, and
+// uploads them to Options.S3. It is a no-op if neither is set or nothing was
+// recorded. client is nil for repositories not hosted on GitHub.
+func Commit(ctx context.Context, client *github.Client, owner, repo string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+	if opts.S3 != "" && uploaded < len(entries) {
+		if err := upload(ctx, owner, repo, entries[uploaded:]); err != nil {
+			return err
+		}
+		uploaded = len(entries)
+	}
+	if opts.Branch != "" {
+		if err := commitBranch(ctx, client, owner, repo); err != nil {
+			return err
+		}
+	}
+	entries = nil
+	uploaded = 0
+	return nil
+}
+
+// runFile returns a file name for the entries of this run which no other run
+// uses, so that existing audit logs never need to be read or rewritten.
+func runFile() string {
+	return time.Now().UTC().Format("20060102T150405.000000000Z") + "-" + filepath.Base(os.Args[0]) + "-" + strconv.Itoa(os.Getpid()) + ".jsonl"
+}
+
+// upload stores entries as a new object in the Options.S3 bucket.
+func upload(ctx context.Context, owner, repo string, entries []Entry) error {
+	bucket, err := s3.FromEnv(opts.S3)
+	if err != nil {
+		return fmt.Errorf("audit S3 bucket: %v", err)
+	}
+	content, err := marshal(entries)
+	if err != nil {
+		return err
+	}
+	key := owner + "/" + repo + "/" + runFile()
+	if _, err := bucket.Put(ctx, key, content, "application/jsonl"); err != nil {
+		return fmt.Errorf("uploading audit log to %s: %v", key, err)
+	}
+	return nil
+}
+
+// commitBranch commits entries as a new file in the audit directory of the
+// Options.Branch branch. mu must be held.
+func commitBranch(ctx context.Context, client *github.Client, owner, repo string) error {
+	if client == nil {
+		return fmt.Errorf("committing the audit log to branch %q is only supported on GitHub", opts.Branch)
+	}
+
+	var (
+		parents  []*github.Commit
+		baseTree string
+	)
+	lastRef, resp, err := client.Git.GetRef(ctx, owner, repo, "heads/"+opts.Branch)
+	if err != nil && (resp == nil || resp.StatusCode != http.StatusNotFound) {
+		return err
+	}
+	if err == nil {
+		lastCommit, _, err := client.Git.GetCommit(ctx, owner, repo, *lastRef.Object.SHA)
+		if err != nil {
+			return err
+		}
+		parents = []*github.Commit{lastCommit}
+		baseTree = *lastCommit.Tree.SHA
+	}
+
+	content, err := marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	newTree, _, err := client.Git.CreateTree(ctx, owner, repo, baseTree, []*github.TreeEntry{
+		{
+			Path:    github.String("audit/" + runFile()),
+			Mode:    github.String("100644"),
+			Type:    github.String("blob"),
+			Content: github.String(string(content)),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	newCommit, _, err := client.Git.CreateCommit(ctx, owner, repo, &github.Commit{
+		Message: github.String("audit: " + filepath.Base(os.Args[0])),
+		Tree:    newTree,
+		Parents: parents,
+	})
+	if err != nil {
+		return err
+	}
+
+	if lastRef == nil {
+		_, _, err = client.Git.CreateRef(ctx, owner, repo, &github.Reference{
+			Ref:    github.String("refs/heads/" + opts.Branch),
+			Object: &github.GitObject{SHA: newCommit.SHA},
+		})
+	} else {
+		lastRef.Object.SHA = newCommit.SHA
+		_, _, err = client.Git.UpdateRef(ctx, owner, repo, lastRef, false)
+	}
+	return err
+}
@@ -1,8 +1,12 @@
 package cienv
 
 import (
+	"encoding/json"
 	"log"
 	"os"
+	"sync"
+
+	"github.com/gokrazy/autoupdate/internal/secret"
 )
 
 func MustGetGithubUser() string {
@@ -16,10 +20,23 @@ func MustGetGithubUser() string {
 	return githubUser
 }
 
-func MustGetAuthToken() string {
-	authToken := os.Getenv("GITHUB_AUTH_TOKEN") // Travis CI
+// MustGetAuthToken returns the forge API token, read from tokenFile if
+// non-empty, or from the GITHUB_AUTH_TOKEN or GH_AUTH_TOKEN secrets
+// otherwise.
+func MustGetAuthToken(tokenFile string) string {
+	if tokenFile != "" {
+		authToken, err := secret.File(tokenFile)
+		if err != nil {
+			log.Fatalf("reading token file: %v", err)
+		}
+		if authToken == "" {
+			log.Fatalf("token file %s is empty", tokenFile)
+		}
+		return authToken
+	}
+	authToken := secret.Get("GITHUB_AUTH_TOKEN") // Travis CI
 	if authToken == "" {
-		authToken = os.Getenv("GH_AUTH_TOKEN") // GitHub actions
+		authToken = secret.Get("GH_AUTH_TOKEN") // GitHub actions
 	}
 	if authToken == "" {
 		log.Fatal("required environment variable GITHUB_AUTH_TOKEN (or GH_AUTH_TOKEN) empty")
@@ -46,6 +63,18 @@ func MustGetPullRequest() string {
 	return pullRequest
 }
 
+// GetPullRequest returns the pull request number, or the empty string if the
+// run was not triggered by a pull request (e.g. schedule or
+// workflow_dispatch events on GitHub Actions, or push builds on Travis CI,
+// which set TRAVIS_PULL_REQUEST=false).
+func GetPullRequest() string {
+	pullRequest := os.Getenv("TRAVIS_PULL_REQUEST")
+	if pullRequest == "false" {
+		return ""
+	}
+	return pullRequest
+}
+
 func MustGetPullRequestBranch() string {
 	pullRequestBranch := os.Getenv("TRAVIS_PULL_REQUEST_BRANCH")
 	if pullRequestBranch == "" {
@@ -53,3 +82,137 @@ func MustGetPullRequestBranch() string {
 	}
 	return pullRequestBranch
 }
+
+// GetBranch returns the branch which is being built outside of pull
+// requests (e.g. main for push builds), or the empty string if unknown.
+func GetBranch() string {
+	if branch := os.Getenv("GITHUB_REF_NAME"); branch != "" {
+		return branch // GitHub actions
+	}
+	if os.Getenv("TRAVIS") == "true" {
+		return os.Getenv("TRAVIS_BRANCH")
+	}
+	return ""
+}
+
+// pullRequestEvent is the subset of the GitHub Actions pull_request (and
+// issue_comment) event payload (at $GITHUB_EVENT_PATH) which cienv exposes.
+type pullRequestEvent struct {
+	Action string `json:"action"`
+
+	Issue struct {
+		Number      int       `json:"number"`
+		PullRequest *struct{} `json:"pull_request"`
+	} `json:"issue"`
+
+	Comment struct {
+		ID   int64  `json:"id"`
+		Body string `json:"body"`
+		User struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	} `json:"comment"`
+
+	PullRequest struct {
+		Base struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+		Head struct {
+			SHA  string `json:"sha"`
+			Repo struct {
+				FullName string `json:"full_name"`
+			} `json:"repo"`
+		} `json:"head"`
+	} `json:"pull_request"`
+}
+
+var (
+	eventOnce sync.Once
+	event     pullRequestEvent
+)
+
+// getEvent returns the GitHub Actions event payload, or an empty event when
+// not running on GitHub Actions.
+func getEvent() *pullRequestEvent {
+	eventOnce.Do(func() {
+		fn := os.Getenv("GITHUB_EVENT_PATH")
+		if fn == "" {
+			return
+		}
+		b, err := os.ReadFile(fn)
+		if err != nil {
+			log.Printf("reading GitHub event payload: %v", err)
+			return
+		}
+		if err := json.Unmarshal(b, &event); err != nil {
+			log.Printf("parsing GitHub event payload %s: %v", fn, err)
+		}
+	})
+	return &event
+}
+
+// GetBaseBranch returns the branch the pull request is targeting (e.g. main),
+// or the empty string if unknown.
+func GetBaseBranch() string {
+	if os.Getenv("TRAVIS_PULL_REQUEST_BRANCH") != "" && os.Getenv("TRAVIS") == "true" {
+		return os.Getenv("TRAVIS_BRANCH") // Travis CI: target branch of PR builds
+	}
+	if base := os.Getenv("GITHUB_BASE_REF"); base != "" {
+		return base // GitHub actions
+	}
+	return getEvent().PullRequest.Base.Ref
+}
+
+// GetHeadSHA returns the commit ID of the pull request head (not of the
+// merge commit CI systems typically build), or the empty string if unknown.
+func GetHeadSHA() string {
+	if sha := os.Getenv("TRAVIS_PULL_REQUEST_SHA"); sha != "" {
+		return sha // Travis CI
+	}
+	return getEvent().PullRequest.Head.SHA
+}
+
+// GetHeadSlug returns the owner/repo slug of the repository containing the
+// pull request branch, or the empty string if unknown.
+func GetHeadSlug() string {
+	if slug := os.Getenv("TRAVIS_PULL_REQUEST_SLUG"); slug != "" {
+		return slug // Travis CI
+	}
+	return getEvent().PullRequest.Head.Repo.FullName
+}
+
+// IssueComment is the comment which triggered a GitHub Actions issue_comment
+// event.
+type IssueComment struct {
+	ID int64
+
+	// Issue is the number of the issue or pull request commented on.
+	Issue         int
+	IsPullRequest bool
+
+	Author string
+	Body   string
+}
+
+// GetIssueComment returns the newly created comment of an issue_comment
+// event, or false when not running for such an event.
+func GetIssueComment() (IssueComment, bool) {
+	ev := getEvent()
+	if ev.Action != "created" || ev.Comment.ID == 0 {
+		return IssueComment{}, false
+	}
+	return IssueComment{
+		ID:            ev.Comment.ID,
+		Issue:         ev.Issue.Number,
+		IsPullRequest: ev.Issue.PullRequest != nil,
+		Author:        ev.Comment.User.Login,
+		Body:          ev.Comment.Body,
+	}, true
+}
+
+// IsFork reports whether the pull request branch lives in a fork of the
+// repository (slug) instead of the repository itself.
+func IsFork(slug string) bool {
+	head := GetHeadSlug()
+	return head != "" && head != slug
+}
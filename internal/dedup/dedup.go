@@ -0,0 +1,81 @@
+// Package dedup detects update work which was already done, so that the
+// pullers do not open the same pull request over and over again (e.g. when
+// a CI cache holding state was lost, or a human closed the pull request as
+// superseded).
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v35/github"
+)
+
+// Requests is the number of GitHub API requests Check makes (branch, open
+// pull requests, closed pull requests).
+const Requests = 3
+
+// Check returns a non-empty reason if an update to candidate (an upstream
+// version or commit SHA) was already proposed in owner/repo: branch (e.g.
+// pull-<version>) exists, an open pull request has branch as head or
+// mentions candidate in its title, or such a pull request was closed
+// (merged or not, e.g. as superseded) within window. A window of 0 disables
+// the check for closed pull requests.
+func Check(ctx context.Context, client *github.Client, owner, repo, branch, candidate string, window time.Duration) (string, error) {
+	_, resp, err := client.Git.GetRef(ctx, owner, repo, "heads/"+branch)
+	if err == nil {
+		return fmt.Sprintf("branch %s already exists", branch), nil
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		return "", err
+	}
+
+	matches := func(pr *github.PullRequest) bool {
+		return pr.GetHead().GetRef() == branch ||
+			strings.Contains(pr.GetTitle(), candidate)
+	}
+
+	open, _, err := client.PullRequests.List(ctx, owner, repo, &github.PullRequestListOptions{
+		State:       "open",
+		ListOptions: github.ListOptions{PerPage: 100},
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, pr := range open {
+		if matches(pr) {
+			return fmt.Sprintf("pull request %s is already open", pr.GetHTMLURL()), nil
+		}
+	}
+
+	if window == 0 {
+		return "", nil
+	}
+	since := time.Now().Add(-window)
+	closed, _, err := client.PullRequests.List(ctx, owner, repo, &github.PullRequestListOptions{
+		State:       "closed",
+		Sort:        "updated",
+		Direction:   "desc",
+		ListOptions: github.ListOptions{PerPage: 100},
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, pr := range closed {
+		if pr.GetUpdatedAt().Before(since) {
+			break // sorted by update time, no more candidates
+		}
+		if pr.GetClosedAt().Before(since) || !matches(pr) {
+			continue
+		}
+		state := "closed"
+		if pr.MergedAt != nil {
+			state = "merged"
+		}
+		return fmt.Sprintf("pull request %s was %s on %s", pr.GetHTMLURL(), state, pr.GetClosedAt().Format(time.RFC3339)), nil
+	}
+	return "", nil
+}
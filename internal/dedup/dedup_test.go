@@ -0,0 +1,130 @@
+package dedup
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/githubtest"
+	"github.com/google/go-github/v35/github"
+)
+
+// fakeGitHub serves the API endpoints which Check uses.
+func fakeGitHub(t *testing.T, branches []string, open, closed []*github.PullRequest) *github.Client {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/o/r/git/ref/", func(w http.ResponseWriter, r *http.Request) {
+		branch := strings.TrimPrefix(r.URL.Path, "/repos/o/r/git/ref/heads/")
+		for _, b := range branches {
+			if b == branch {
+				json.NewEncoder(w).Encode(&github.Reference{Ref: github.String("refs/heads/" + b)})
+				return
+			}
+		}
+		http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+	})
+	mux.HandleFunc("/repos/o/r/pulls", func(w http.ResponseWriter, r *http.Request) {
+		switch r.FormValue("state") {
+		case "open":
+			json.NewEncoder(w).Encode(open)
+		case "closed":
+			json.NewEncoder(w).Encode(closed)
+		default:
+			t.Errorf("unexpected state %q", r.FormValue("state"))
+		}
+	})
+	return githubtest.NewClient(t, mux)
+}
+
+func pr(head, title string, closedAgo time.Duration, merged bool) *github.PullRequest {
+	p := &github.PullRequest{
+		HTMLURL: github.String("https://github.com/o/r/pull/" + head),
+		Title:   github.String(title),
+		Head:    &github.PullRequestBranch{Ref: github.String(head)},
+	}
+	if closedAgo > 0 {
+		closed := time.Now().Add(-closedAgo)
+		p.ClosedAt = &closed
+		p.UpdatedAt = &closed
+		if merged {
+			p.MergedAt = &closed
+		}
+	}
+	return p
+}
+
+func TestCheck(t *testing.T) {
+	const day = 24 * time.Hour
+	for _, tt := range []struct {
+		name     string
+		branches []string
+		open     []*github.PullRequest
+		closed   []*github.PullRequest
+		window   time.Duration
+		want     string // substring of the reason, empty if no duplicate
+	}{
+		{
+			name:     "nothing proposed",
+			branches: []string{"main"},
+			open:     []*github.PullRequest{pr("pull-go1.22.1", "update to go1.22.1", 0, false)},
+			window:   14 * day,
+		},
+		{
+			name:     "branch exists",
+			branches: []string{"pull-go1.22.2"},
+			window:   14 * day,
+			want:     "branch pull-go1.22.2 already exists",
+		},
+		{
+			name:   "open pull request by branch",
+			open:   []*github.PullRequest{pr("pull-go1.22.2", "update Go", 0, false)},
+			window: 14 * day,
+			want:   "is already open",
+		},
+		{
+			name:   "open pull request by title",
+			open:   []*github.PullRequest{pr("renamed", "update to go1.22.2", 0, false)},
+			window: 14 * day,
+			want:   "is already open",
+		},
+		{
+			name:   "closed within window",
+			closed: []*github.PullRequest{pr("pull-go1.22.2", "update to go1.22.2", day, false)},
+			window: 14 * day,
+			want:   "was closed",
+		},
+		{
+			name:   "merged within window",
+			closed: []*github.PullRequest{pr("pull-go1.22.2", "update to go1.22.2", day, true)},
+			window: 14 * day,
+			want:   "was merged",
+		},
+		{
+			name:   "closed before window",
+			closed: []*github.PullRequest{pr("pull-go1.22.2", "update to go1.22.2", 30*day, false)},
+			window: 14 * day,
+		},
+		{
+			name:   "window disabled",
+			closed: []*github.PullRequest{pr("pull-go1.22.2", "update to go1.22.2", day, false)},
+			window: 0,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fakeGitHub(t, tt.branches, tt.open, tt.closed)
+			got, err := Check(context.Background(), client, "o", "r", "pull-go1.22.2", "go1.22.2", tt.window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" && got != "" {
+				t.Errorf("Check = %q, want no duplicate", got)
+			}
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("Check = %q, want a reason containing %q", got, tt.want)
+			}
+		})
+	}
+}
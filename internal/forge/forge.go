@@ -0,0 +1,178 @@
+// Package forge abstracts the code forge operations of the label-gated
+// test-and-merge pipeline (labels, comments, checks, merges, branches), so
+// that gokr-amend, gokr-boot, gokr-has-label and gokr-merge can run against
+// Gitea and GitLab in addition to GitHub.
+//
+// The tools select the forge with -forge. For Gitea and GitLab, -forge_url
+// specifies the instance, e.g. -forge=gitea -forge_url=https://gitea.example.com
+package forge
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v35/github"
+)
+
+// Check is the result of a CI check, reported on the head commit of a pull
+// request.
+type Check struct {
+	Name      string
+	Success   bool
+	StartedAt time.Time
+
+	// Title is a one-line summary, Summary a Markdown description.
+	Title   string
+	Summary string
+
+	Annotations []Annotation
+
+	// HeadSHA is the commit to report the check on. If empty, the check is
+	// reported on the current head of the pull request.
+	HeadSHA string
+}
+
+// Annotation is a detail of a Check. Forges without annotation support only
+// report the Check summary.
+type Annotation struct {
+	Title   string
+	Message string
+	Failure bool
+}
+
+// Forge is a repository on a code forge. Pull requests (GitLab: merge
+// requests) are identified by their number (GitLab: IID).
+type Forge interface {
+	// Title returns the title of pull request pr.
+	Title(ctx context.Context, pr int) (string, error)
+
+	// Body returns the description of pull request pr.
+	Body(ctx context.Context, pr int) (string, error)
+
+	// Author returns the login of the user who opened pull request pr. The
+	// body is only trustworthy if the author is the automation user, as
+	// the author can edit it.
+	Author(ctx context.Context, pr int) (string, error)
+
+	// IsOpen reports whether pull request pr is still open, i.e. neither
+	// closed nor merged.
+	IsOpen(ctx context.Context, pr int) (bool, error)
+
+	// HeadSHA returns the commit ID of the head of pull request pr.
+	HeadSHA(ctx context.Context, pr int) (string, error)
+
+	// SetBody replaces the description of pull request pr.
+	SetBody(ctx context.Context, pr int, body string) error
+
+	// SetMilestone sets the milestone of pull request pr, creating the
+	// milestone if it does not exist yet.
+	SetMilestone(ctx context.Context, pr int, milestone string) error
+
+	// Labels returns the names of the labels of pull request pr.
+	Labels(ctx context.Context, pr int) ([]string, error)
+	AddLabel(ctx context.Context, pr int, label string) error
+	RemoveLabel(ctx context.Context, pr int, label string) error
+
+	// Comment adds a comment to pull request pr and returns its URL.
+	Comment(ctx context.Context, pr int, body string) (string, error)
+
+	// UpsertComment replaces the body of the first comment of the
+	// automation user on pull request pr which contains marker (e.g. an HTML
+	// comment), or adds a comment if there is none. It returns the URL of
+	// the comment.
+	UpsertComment(ctx context.Context, pr int, marker, body string) (string, error)
+
+	// BotComment returns the body of the first comment of the automation
+	// user on pull request pr which contains marker, or the empty string if
+	// there is none. Unlike the pull request body, such comments cannot be
+	// edited by pull request authors without write access.
+	BotComment(ctx context.Context, pr int, marker string) (string, error)
+
+	// ChangedFiles returns the paths of the files changed by pull request pr.
+	ChangedFiles(ctx context.Context, pr int) ([]string, error)
+
+	// ReportCheck reports c on the head commit of pull request pr and returns
+	// its URL, if any. On GitHub, the Checks API only accepts GitHub App
+	// installation tokens (including GITHUB_TOKEN); personal access tokens
+	// get HTTP 403.
+	ReportCheck(ctx context.Context, pr int, c Check) (string, error)
+
+	// CheckPassed reports whether the most recent check (or commit status)
+	// named name on commit sha succeeded. Unlike the pull request body,
+	// checks cannot be edited by pull request authors without write access.
+	//
+	// As any workflow can report a check of any name, only checks reported
+	// by the automation tools are considered: on GitHub, check runs created
+	// by the GitHub App with ID app (e.g. 15368, GitHub Actions, for checks
+	// reported with GITHUB_TOKEN); on Gitea and GitLab, commit statuses set
+	// by the automation user.
+	CheckPassed(ctx context.Context, sha, name string, app int64) (bool, error)
+
+	// Merge squash-merges pull request pr. If sha is non-empty, the merge
+	// fails unless the head of pull request pr is still sha.
+	Merge(ctx context.Context, pr int, message, sha string) error
+
+	DeleteBranch(ctx context.Context, branch string) error
+
+	// CloneURL returns an authenticated git URL of the repository.
+	CloneURL() string
+
+	// PullRequestURL returns the web URL of pull request pr.
+	PullRequestURL(pr int) string
+}
+
+// New returns the implementation of forge kind (github, gitea or gitlab) for
+// the repository owner/repo, authenticating as user with token. baseURL
+// specifies the Gitea or GitLab instance and is ignored for GitHub.
+func New(kind, baseURL, owner, repo, user, token string) (Forge, error) {
+	switch kind {
+	case "github":
+		return newGitHub(owner, repo, user, token), nil
+	case "gitea":
+		if baseURL == "" {
+			return nil, fmt.Errorf("forge gitea requires a base URL")
+		}
+		return newGitea(strings.TrimSuffix(baseURL, "/"), owner, repo, user, token), nil
+	case "gitlab":
+		if baseURL == "" {
+			return nil, fmt.Errorf("forge gitlab requires a base URL")
+		}
+		return newGitLab(strings.TrimSuffix(baseURL, "/"), owner, repo, user, token), nil
+	default:
+		return nil, fmt.Errorf("invalid forge %q: expected one of github, gitea or gitlab", kind)
+	}
+}
+
+// GitHubClient returns the GitHub API client of f, or nil if f is not a
+// GitHub repository. GitHub-only features (e.g. gists, the audit branch) use
+// it directly.
+func GitHubClient(f Forge) *github.Client {
+	if gh, ok := f.(*gitHub); ok {
+		return gh.client
+	}
+	return nil
+}
+
+// checkHead returns the commit on which c is to be reported.
+func checkHead(ctx context.Context, f Forge, pr int, c Check) (string, error) {
+	if c.HeadSHA != "" {
+		return c.HeadSHA, nil
+	}
+	return f.HeadSHA(ctx, pr)
+}
+
+// HasLabel reports whether pull request pr has label.
+func HasLabel(ctx context.Context, f Forge, pr int, label string) (bool, error) {
+	labels, err := f.Labels(ctx, pr)
+	if err != nil {
+		return false, err
+	}
+	for _, l := range labels {
+		if l == label {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,321 @@
+package forge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type gitea struct {
+	rest        *restClient
+	baseURL     string
+	owner, repo string
+	user, token string
+}
+
+func newGitea(baseURL, owner, repo, user, token string) *gitea {
+	return &gitea{
+		rest: &restClient{
+			apiURL: baseURL + "/api/v1/repos/" + url.PathEscape(owner) + "/" + url.PathEscape(repo),
+			auth: func(req *http.Request) {
+				req.Header.Set("Authorization", "token "+token)
+			},
+		},
+		baseURL: baseURL,
+		owner:   owner,
+		repo:    repo,
+		user:    user,
+		token:   token,
+	}
+}
+
+func (g *gitea) Title(ctx context.Context, pr int) (string, error) {
+	var p struct {
+		Title string `json:"title"`
+	}
+	if err := g.rest.do(ctx, "GET", fmt.Sprintf("/pulls/%d", pr), nil, &p, http.StatusOK); err != nil {
+		return "", err
+	}
+	return p.Title, nil
+}
+
+func (g *gitea) Body(ctx context.Context, pr int) (string, error) {
+	var p struct {
+		Body string `json:"body"`
+	}
+	if err := g.rest.do(ctx, "GET", fmt.Sprintf("/pulls/%d", pr), nil, &p, http.StatusOK); err != nil {
+		return "", err
+	}
+	return p.Body, nil
+}
+
+func (g *gitea) Author(ctx context.Context, pr int) (string, error) {
+	var p struct {
+		User struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	}
+	if err := g.rest.do(ctx, "GET", fmt.Sprintf("/pulls/%d", pr), nil, &p, http.StatusOK); err != nil {
+		return "", err
+	}
+	return p.User.Login, nil
+}
+
+func (g *gitea) IsOpen(ctx context.Context, pr int) (bool, error) {
+	var p struct {
+		State string `json:"state"`
+	}
+	if err := g.rest.do(ctx, "GET", fmt.Sprintf("/pulls/%d", pr), nil, &p, http.StatusOK); err != nil {
+		return false, err
+	}
+	return p.State == "open", nil
+}
+
+func (g *gitea) HeadSHA(ctx context.Context, pr int) (string, error) {
+	var p struct {
+		Head struct {
+			SHA string `json:"sha"`
+		} `json:"head"`
+	}
+	if err := g.rest.do(ctx, "GET", fmt.Sprintf("/pulls/%d", pr), nil, &p, http.StatusOK); err != nil {
+		return "", err
+	}
+	return p.Head.SHA, nil
+}
+
+func (g *gitea) SetBody(ctx context.Context, pr int, body string) error {
+	return g.rest.do(ctx, "PATCH", fmt.Sprintf("/pulls/%d", pr), map[string]string{
+		"body": body,
+	}, nil, http.StatusCreated)
+}
+
+func (g *gitea) SetMilestone(ctx context.Context, pr int, milestone string) error {
+	var milestones []struct {
+		ID    int64  `json:"id"`
+		Title string `json:"title"`
+	}
+	if err := g.rest.do(ctx, "GET", "/milestones?state=all&limit=50&name="+url.QueryEscape(milestone), nil, &milestones, http.StatusOK); err != nil {
+		return err
+	}
+	var id int64
+	for _, m := range milestones {
+		if m.Title == milestone {
+			id = m.ID
+		}
+	}
+	if id == 0 {
+		var created struct {
+			ID int64 `json:"id"`
+		}
+		if err := g.rest.do(ctx, "POST", "/milestones", map[string]string{
+			"title": milestone,
+		}, &created, http.StatusCreated); err != nil {
+			return err
+		}
+		id = created.ID
+	}
+	return g.rest.do(ctx, "PATCH", fmt.Sprintf("/issues/%d", pr), map[string]int64{
+		"milestone": id,
+	}, nil, http.StatusCreated)
+}
+
+type giteaLabel struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+func (g *gitea) Labels(ctx context.Context, pr int) ([]string, error) {
+	var labels []giteaLabel
+	if err := g.rest.do(ctx, "GET", fmt.Sprintf("/issues/%d/labels", pr), nil, &labels, http.StatusOK); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(labels))
+	for _, l := range labels {
+		names = append(names, l.Name)
+	}
+	return names, nil
+}
+
+// labelID resolves a label name to its ID, which older Gitea versions
+// require in label requests.
+func (g *gitea) labelID(ctx context.Context, label string) (int64, error) {
+	var labels []giteaLabel
+	if err := g.rest.do(ctx, "GET", "/labels?limit=1000", nil, &labels, http.StatusOK); err != nil {
+		return 0, err
+	}
+	for _, l := range labels {
+		if l.Name == label {
+			return l.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("label %q not found in %s/%s", label, g.owner, g.repo)
+}
+
+func (g *gitea) AddLabel(ctx context.Context, pr int, label string) error {
+	id, err := g.labelID(ctx, label)
+	if err != nil {
+		return err
+	}
+	return g.rest.do(ctx, "POST", fmt.Sprintf("/issues/%d/labels", pr), map[string]interface{}{
+		"labels": []int64{id},
+	}, nil, http.StatusOK)
+}
+
+func (g *gitea) RemoveLabel(ctx context.Context, pr int, label string) error {
+	id, err := g.labelID(ctx, label)
+	if err != nil {
+		return err
+	}
+	return g.rest.do(ctx, "DELETE", fmt.Sprintf("/issues/%d/labels/%d", pr, id), nil, nil, http.StatusNoContent)
+}
+
+func (g *gitea) Comment(ctx context.Context, pr int, body string) (string, error) {
+	var comment struct {
+		HTMLURL string `json:"html_url"`
+	}
+	if err := g.rest.do(ctx, "POST", fmt.Sprintf("/issues/%d/comments", pr), map[string]string{
+		"body": body,
+	}, &comment, http.StatusCreated); err != nil {
+		return "", err
+	}
+	return comment.HTMLURL, nil
+}
+
+type giteaComment struct {
+	ID   int64  `json:"id"`
+	Body string `json:"body"`
+	User struct {
+		Login string `json:"login"`
+	} `json:"user"`
+}
+
+// botComment returns the first comment of g.user on pull request pr which
+// contains marker, or nil.
+func (g *gitea) botComment(ctx context.Context, pr int, marker string) (*giteaComment, error) {
+	var comments []giteaComment
+	if err := g.rest.do(ctx, "GET", fmt.Sprintf("/issues/%d/comments", pr), nil, &comments, http.StatusOK); err != nil {
+		return nil, err
+	}
+	for _, c := range comments {
+		if strings.EqualFold(c.User.Login, g.user) && strings.Contains(c.Body, marker) {
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+func (g *gitea) UpsertComment(ctx context.Context, pr int, marker, body string) (string, error) {
+	c, err := g.botComment(ctx, pr, marker)
+	if err != nil {
+		return "", err
+	}
+	if c == nil {
+		return g.Comment(ctx, pr, body)
+	}
+	var comment struct {
+		HTMLURL string `json:"html_url"`
+	}
+	if err := g.rest.do(ctx, "PATCH", fmt.Sprintf("/issues/comments/%d", c.ID), map[string]string{
+		"body": body,
+	}, &comment, http.StatusOK); err != nil {
+		return "", err
+	}
+	return comment.HTMLURL, nil
+}
+
+func (g *gitea) BotComment(ctx context.Context, pr int, marker string) (string, error) {
+	c, err := g.botComment(ctx, pr, marker)
+	if err != nil || c == nil {
+		return "", err
+	}
+	return c.Body, nil
+}
+
+func (g *gitea) ChangedFiles(ctx context.Context, pr int) ([]string, error) {
+	var files []string
+	for page := 1; ; page++ {
+		var fs []struct {
+			Filename string `json:"filename"`
+		}
+		if err := g.rest.do(ctx, "GET", fmt.Sprintf("/pulls/%d/files?limit=50&page=%d", pr, page), nil, &fs, http.StatusOK); err != nil {
+			return nil, err
+		}
+		if len(fs) == 0 {
+			break
+		}
+		for _, f := range fs {
+			files = append(files, f.Filename)
+		}
+	}
+	return files, nil
+}
+
+// ReportCheck sets a commit status, as Gitea has no check runs.
+func (g *gitea) ReportCheck(ctx context.Context, pr int, c Check) (string, error) {
+	sha, err := checkHead(ctx, g, pr, c)
+	if err != nil {
+		return "", err
+	}
+	state := "success"
+	if !c.Success {
+		state = "failure"
+	}
+	if err := g.rest.do(ctx, "POST", "/statuses/"+sha, map[string]string{
+		"state":       state,
+		"context":     c.Name,
+		"description": checkDescription(c),
+	}, nil, http.StatusCreated); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+func (g *gitea) CheckPassed(ctx context.Context, sha, name string, app int64) (bool, error) {
+	var statuses []struct {
+		Context string `json:"context"`
+		Status  string `json:"status"`
+		Creator struct {
+			Login string `json:"login"`
+		} `json:"creator"`
+	}
+	// Statuses are listed newest first.
+	if err := g.rest.do(ctx, "GET", "/commits/"+sha+"/statuses?sort=recentupdate", nil, &statuses, http.StatusOK); err != nil {
+		return false, err
+	}
+	for _, s := range statuses {
+		if s.Context == name && strings.EqualFold(s.Creator.Login, g.user) {
+			return s.Status == "success", nil
+		}
+	}
+	return false, nil
+}
+
+func (g *gitea) Merge(ctx context.Context, pr int, message, sha string) error {
+	req := map[string]string{
+		"Do":                "squash",
+		"MergeMessageField": message,
+	}
+	if sha != "" {
+		req["head_commit_id"] = sha
+	}
+	return g.rest.do(ctx, "POST", fmt.Sprintf("/pulls/%d/merge", pr), req, nil, http.StatusOK)
+}
+
+func (g *gitea) DeleteBranch(ctx context.Context, branch string) error {
+	return g.rest.do(ctx, "DELETE", "/branches/"+url.PathEscape(branch), nil, nil, http.StatusNoContent)
+}
+
+func (g *gitea) CloneURL() string {
+	u, err := url.Parse(g.baseURL + "/" + g.owner + "/" + g.repo + ".git")
+	if err != nil {
+		return ""
+	}
+	u.User = url.UserPassword(g.user, g.token)
+	return u.String()
+}
+
+func (g *gitea) PullRequestURL(pr int) string {
+	return fmt.Sprintf("%s/%s/%s/pulls/%d", g.baseURL, g.owner, g.repo, pr)
+}
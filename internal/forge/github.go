@@ -0,0 +1,301 @@
+package forge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v35/github"
+)
+
+type gitHub struct {
+	client      *github.Client
+	owner, repo string
+	user, token string
+}
+
+func newGitHub(owner, repo, user, token string) *gitHub {
+	return &gitHub{
+		client: github.NewClient(&http.Client{
+			Transport: &github.BasicAuthTransport{
+				Username: user,
+				Password: token,
+			},
+		}),
+		owner: owner,
+		repo:  repo,
+		user:  user,
+		token: token,
+	}
+}
+
+func (g *gitHub) Title(ctx context.Context, pr int) (string, error) {
+	p, _, err := g.client.PullRequests.Get(ctx, g.owner, g.repo, pr)
+	if err != nil {
+		return "", err
+	}
+	return p.GetTitle(), nil
+}
+
+func (g *gitHub) Body(ctx context.Context, pr int) (string, error) {
+	p, _, err := g.client.PullRequests.Get(ctx, g.owner, g.repo, pr)
+	if err != nil {
+		return "", err
+	}
+	return p.GetBody(), nil
+}
+
+func (g *gitHub) Author(ctx context.Context, pr int) (string, error) {
+	p, _, err := g.client.PullRequests.Get(ctx, g.owner, g.repo, pr)
+	if err != nil {
+		return "", err
+	}
+	return p.GetUser().GetLogin(), nil
+}
+
+func (g *gitHub) IsOpen(ctx context.Context, pr int) (bool, error) {
+	p, _, err := g.client.PullRequests.Get(ctx, g.owner, g.repo, pr)
+	if err != nil {
+		return false, err
+	}
+	return p.GetState() == "open", nil
+}
+
+func (g *gitHub) HeadSHA(ctx context.Context, pr int) (string, error) {
+	p, _, err := g.client.PullRequests.Get(ctx, g.owner, g.repo, pr)
+	if err != nil {
+		return "", err
+	}
+	return p.GetHead().GetSHA(), nil
+}
+
+func (g *gitHub) SetBody(ctx context.Context, pr int, body string) error {
+	_, _, err := g.client.PullRequests.Edit(ctx, g.owner, g.repo, pr, &github.PullRequest{
+		Body: github.String(body),
+	})
+	return err
+}
+
+func (g *gitHub) SetMilestone(ctx context.Context, pr int, milestone string) error {
+	var number int
+	opts := &github.MilestoneListOptions{
+		State:       "all",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for number == 0 {
+		milestones, resp, err := g.client.Issues.ListMilestones(ctx, g.owner, g.repo, opts)
+		if err != nil {
+			return err
+		}
+		for _, m := range milestones {
+			if m.GetTitle() == milestone {
+				number = m.GetNumber()
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	if number == 0 {
+		m, _, err := g.client.Issues.CreateMilestone(ctx, g.owner, g.repo, &github.Milestone{
+			Title: github.String(milestone),
+		})
+		if err != nil {
+			return err
+		}
+		number = m.GetNumber()
+	}
+	_, _, err := g.client.Issues.Edit(ctx, g.owner, g.repo, pr, &github.IssueRequest{
+		Milestone: github.Int(number),
+	})
+	return err
+}
+
+func (g *gitHub) Labels(ctx context.Context, pr int) ([]string, error) {
+	labels, _, err := g.client.Issues.ListLabelsByIssue(ctx, g.owner, g.repo, pr, nil)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(labels))
+	for _, l := range labels {
+		names = append(names, l.GetName())
+	}
+	return names, nil
+}
+
+func (g *gitHub) AddLabel(ctx context.Context, pr int, label string) error {
+	_, _, err := g.client.Issues.AddLabelsToIssue(ctx, g.owner, g.repo, pr, []string{label})
+	return err
+}
+
+func (g *gitHub) RemoveLabel(ctx context.Context, pr int, label string) error {
+	_, err := g.client.Issues.RemoveLabelForIssue(ctx, g.owner, g.repo, pr, label)
+	return err
+}
+
+func (g *gitHub) Comment(ctx context.Context, pr int, body string) (string, error) {
+	comment, _, err := g.client.Issues.CreateComment(ctx, g.owner, g.repo, pr, &github.IssueComment{
+		Body: github.String(body),
+	})
+	if err != nil {
+		return "", err
+	}
+	return comment.GetHTMLURL(), nil
+}
+
+// botComment returns the first comment of g.user on pull request pr which
+// contains marker, or nil.
+func (g *gitHub) botComment(ctx context.Context, pr int, marker string) (*github.IssueComment, error) {
+	opts := &github.IssueListCommentsOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		comments, resp, err := g.client.Issues.ListComments(ctx, g.owner, g.repo, pr, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range comments {
+			if strings.EqualFold(c.GetUser().GetLogin(), g.user) && strings.Contains(c.GetBody(), marker) {
+				return c, nil
+			}
+		}
+		if resp.NextPage == 0 {
+			return nil, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func (g *gitHub) UpsertComment(ctx context.Context, pr int, marker, body string) (string, error) {
+	c, err := g.botComment(ctx, pr, marker)
+	if err != nil {
+		return "", err
+	}
+	if c == nil {
+		return g.Comment(ctx, pr, body)
+	}
+	comment, _, err := g.client.Issues.EditComment(ctx, g.owner, g.repo, c.GetID(), &github.IssueComment{
+		Body: github.String(body),
+	})
+	if err != nil {
+		return "", err
+	}
+	return comment.GetHTMLURL(), nil
+}
+
+func (g *gitHub) BotComment(ctx context.Context, pr int, marker string) (string, error) {
+	c, err := g.botComment(ctx, pr, marker)
+	if err != nil {
+		return "", err
+	}
+	return c.GetBody(), nil
+}
+
+func (g *gitHub) ChangedFiles(ctx context.Context, pr int) ([]string, error) {
+	var files []string
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		fs, resp, err := g.client.PullRequests.ListFiles(ctx, g.owner, g.repo, pr, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fs {
+			files = append(files, f.GetFilename())
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return files, nil
+}
+
+// ReportCheck creates a completed check run with one (file-less) annotation
+// per Annotation, so that the PR Checks tab shows them at a glance.
+func (g *gitHub) ReportCheck(ctx context.Context, pr int, c Check) (string, error) {
+	sha, err := checkHead(ctx, g, pr, c)
+	if err != nil {
+		return "", err
+	}
+	conclusion := "success"
+	if !c.Success {
+		conclusion = "failure"
+	}
+	annotations := make([]*github.CheckRunAnnotation, 0, len(c.Annotations))
+	for _, a := range c.Annotations {
+		level := "notice"
+		if a.Failure {
+			level = "failure"
+		}
+		// Annotations must reference a path, but the results do not relate
+		// to any file, so refer to the repository root.
+		annotations = append(annotations, &github.CheckRunAnnotation{
+			Path:            github.String(".github"),
+			StartLine:       github.Int(1),
+			EndLine:         github.Int(1),
+			AnnotationLevel: github.String(level),
+			Title:           github.String(a.Title),
+			Message:         github.String(a.Message),
+		})
+	}
+	checkRun, _, err := g.client.Checks.CreateCheckRun(ctx, g.owner, g.repo, github.CreateCheckRunOptions{
+		Name:        c.Name,
+		HeadSHA:     sha,
+		Status:      github.String("completed"),
+		Conclusion:  github.String(conclusion),
+		StartedAt:   &github.Timestamp{Time: c.StartedAt},
+		CompletedAt: &github.Timestamp{Time: time.Now()},
+		Output: &github.CheckRunOutput{
+			Title:       github.String(c.Title),
+			Summary:     github.String(c.Summary),
+			Annotations: annotations,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return checkRun.GetHTMLURL(), nil
+}
+
+func (g *gitHub) CheckPassed(ctx context.Context, sha, name string, app int64) (bool, error) {
+	runs, _, err := g.client.Checks.ListCheckRunsForRef(ctx, g.owner, g.repo, sha, &github.ListCheckRunsOptions{
+		CheckName: github.String(name),
+		Filter:    github.String("latest"),
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, run := range runs.CheckRuns {
+		if run.GetApp().GetID() != app {
+			continue
+		}
+		if run.GetHeadSHA() == sha && run.GetStatus() == "completed" {
+			return run.GetConclusion() == "success", nil
+		}
+	}
+	return false, nil
+}
+
+func (g *gitHub) Merge(ctx context.Context, pr int, message, sha string) error {
+	_, _, err := g.client.PullRequests.Merge(ctx, g.owner, g.repo, pr, message, &github.PullRequestOptions{
+		MergeMethod: "squash",
+		SHA:         sha,
+	})
+	return err
+}
+
+func (g *gitHub) DeleteBranch(ctx context.Context, branch string) error {
+	_, err := g.client.Git.DeleteRef(ctx, g.owner, g.repo, "heads/"+branch)
+	return err
+}
+
+func (g *gitHub) CloneURL() string {
+	return "https://" + g.user + ":" + g.token + "@github.com/" + g.owner + "/" + g.repo
+}
+
+func (g *gitHub) PullRequestURL(pr int) string {
+	return fmt.Sprintf("https://github.com/%s/%s/pull/%d", g.owner, g.repo, pr)
+}
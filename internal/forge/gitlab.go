@@ -0,0 +1,297 @@
+package forge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type gitLab struct {
+	rest        *restClient
+	baseURL     string
+	owner, repo string
+	user, token string
+}
+
+func newGitLab(baseURL, owner, repo, user, token string) *gitLab {
+	return &gitLab{
+		rest: &restClient{
+			apiURL: baseURL + "/api/v4/projects/" + url.PathEscape(owner+"/"+repo),
+			auth: func(req *http.Request) {
+				req.Header.Set("PRIVATE-TOKEN", token)
+			},
+		},
+		baseURL: baseURL,
+		owner:   owner,
+		repo:    repo,
+		user:    user,
+		token:   token,
+	}
+}
+
+type gitLabMergeRequest struct {
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Labels      []string `json:"labels"`
+	SHA         string   `json:"sha"`
+	State       string   `json:"state"`
+	WebURL      string   `json:"web_url"`
+	Author      struct {
+		Username string `json:"username"`
+	} `json:"author"`
+}
+
+func (g *gitLab) mergeRequest(ctx context.Context, pr int) (*gitLabMergeRequest, error) {
+	var mr gitLabMergeRequest
+	if err := g.rest.do(ctx, "GET", fmt.Sprintf("/merge_requests/%d", pr), nil, &mr, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &mr, nil
+}
+
+func (g *gitLab) Title(ctx context.Context, pr int) (string, error) {
+	mr, err := g.mergeRequest(ctx, pr)
+	if err != nil {
+		return "", err
+	}
+	return mr.Title, nil
+}
+
+func (g *gitLab) Body(ctx context.Context, pr int) (string, error) {
+	mr, err := g.mergeRequest(ctx, pr)
+	if err != nil {
+		return "", err
+	}
+	return mr.Description, nil
+}
+
+func (g *gitLab) Author(ctx context.Context, pr int) (string, error) {
+	mr, err := g.mergeRequest(ctx, pr)
+	if err != nil {
+		return "", err
+	}
+	return mr.Author.Username, nil
+}
+
+func (g *gitLab) IsOpen(ctx context.Context, pr int) (bool, error) {
+	mr, err := g.mergeRequest(ctx, pr)
+	if err != nil {
+		return false, err
+	}
+	return mr.State == "opened", nil
+}
+
+func (g *gitLab) HeadSHA(ctx context.Context, pr int) (string, error) {
+	mr, err := g.mergeRequest(ctx, pr)
+	if err != nil {
+		return "", err
+	}
+	return mr.SHA, nil
+}
+
+func (g *gitLab) SetBody(ctx context.Context, pr int, body string) error {
+	return g.rest.do(ctx, "PUT", fmt.Sprintf("/merge_requests/%d", pr), map[string]string{
+		"description": body,
+	}, nil, http.StatusOK)
+}
+
+func (g *gitLab) SetMilestone(ctx context.Context, pr int, milestone string) error {
+	var milestones []struct {
+		ID    int64  `json:"id"`
+		Title string `json:"title"`
+	}
+	if err := g.rest.do(ctx, "GET", "/milestones?title="+url.QueryEscape(milestone), nil, &milestones, http.StatusOK); err != nil {
+		return err
+	}
+	var id int64
+	for _, m := range milestones {
+		if m.Title == milestone {
+			id = m.ID
+		}
+	}
+	if id == 0 {
+		var created struct {
+			ID int64 `json:"id"`
+		}
+		if err := g.rest.do(ctx, "POST", "/milestones", map[string]string{
+			"title": milestone,
+		}, &created, http.StatusCreated); err != nil {
+			return err
+		}
+		id = created.ID
+	}
+	return g.rest.do(ctx, "PUT", fmt.Sprintf("/merge_requests/%d", pr), map[string]int64{
+		"milestone_id": id,
+	}, nil, http.StatusOK)
+}
+
+func (g *gitLab) Labels(ctx context.Context, pr int) ([]string, error) {
+	mr, err := g.mergeRequest(ctx, pr)
+	if err != nil {
+		return nil, err
+	}
+	return mr.Labels, nil
+}
+
+func (g *gitLab) AddLabel(ctx context.Context, pr int, label string) error {
+	return g.rest.do(ctx, "PUT", fmt.Sprintf("/merge_requests/%d", pr), map[string]string{
+		"add_labels": label,
+	}, nil, http.StatusOK)
+}
+
+func (g *gitLab) RemoveLabel(ctx context.Context, pr int, label string) error {
+	return g.rest.do(ctx, "PUT", fmt.Sprintf("/merge_requests/%d", pr), map[string]string{
+		"remove_labels": label,
+	}, nil, http.StatusOK)
+}
+
+func (g *gitLab) Comment(ctx context.Context, pr int, body string) (string, error) {
+	var note struct {
+		ID int64 `json:"id"`
+	}
+	if err := g.rest.do(ctx, "POST", fmt.Sprintf("/merge_requests/%d/notes", pr), map[string]string{
+		"body": body,
+	}, &note, http.StatusCreated); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s#note_%d", g.PullRequestURL(pr), note.ID), nil
+}
+
+type gitLabNote struct {
+	ID     int64  `json:"id"`
+	Body   string `json:"body"`
+	Author struct {
+		Username string `json:"username"`
+	} `json:"author"`
+}
+
+// botNote returns the first note of g.user on merge request pr which
+// contains marker, or nil.
+func (g *gitLab) botNote(ctx context.Context, pr int, marker string) (*gitLabNote, error) {
+	for page := 1; ; page++ {
+		var notes []gitLabNote
+		if err := g.rest.do(ctx, "GET", fmt.Sprintf("/merge_requests/%d/notes?per_page=100&page=%d", pr, page), nil, &notes, http.StatusOK); err != nil {
+			return nil, err
+		}
+		if len(notes) == 0 {
+			return nil, nil
+		}
+		for _, n := range notes {
+			if strings.EqualFold(n.Author.Username, g.user) && strings.Contains(n.Body, marker) {
+				return &n, nil
+			}
+		}
+	}
+}
+
+func (g *gitLab) UpsertComment(ctx context.Context, pr int, marker, body string) (string, error) {
+	n, err := g.botNote(ctx, pr, marker)
+	if err != nil {
+		return "", err
+	}
+	if n == nil {
+		return g.Comment(ctx, pr, body)
+	}
+	if err := g.rest.do(ctx, "PUT", fmt.Sprintf("/merge_requests/%d/notes/%d", pr, n.ID), map[string]string{
+		"body": body,
+	}, nil, http.StatusOK); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s#note_%d", g.PullRequestURL(pr), n.ID), nil
+}
+
+func (g *gitLab) BotComment(ctx context.Context, pr int, marker string) (string, error) {
+	n, err := g.botNote(ctx, pr, marker)
+	if err != nil || n == nil {
+		return "", err
+	}
+	return n.Body, nil
+}
+
+func (g *gitLab) ChangedFiles(ctx context.Context, pr int) ([]string, error) {
+	var changes struct {
+		Changes []struct {
+			OldPath string `json:"old_path"`
+			NewPath string `json:"new_path"`
+		} `json:"changes"`
+	}
+	if err := g.rest.do(ctx, "GET", fmt.Sprintf("/merge_requests/%d/changes", pr), nil, &changes, http.StatusOK); err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(changes.Changes))
+	for _, c := range changes.Changes {
+		files = append(files, c.NewPath)
+	}
+	return files, nil
+}
+
+// ReportCheck sets a commit status, which GitLab shows as an external job
+// in the merge request pipeline.
+func (g *gitLab) ReportCheck(ctx context.Context, pr int, c Check) (string, error) {
+	sha, err := checkHead(ctx, g, pr, c)
+	if err != nil {
+		return "", err
+	}
+	state := "success"
+	if !c.Success {
+		state = "failed"
+	}
+	if err := g.rest.do(ctx, "POST", "/statuses/"+sha, map[string]string{
+		"state":       state,
+		"name":        c.Name,
+		"description": checkDescription(c),
+	}, nil, http.StatusCreated); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+func (g *gitLab) CheckPassed(ctx context.Context, sha, name string, app int64) (bool, error) {
+	var statuses []struct {
+		Name   string `json:"name"`
+		Status string `json:"status"`
+		Author struct {
+			Username string `json:"username"`
+		} `json:"author"`
+	}
+	// Without all=true, only the latest status of each name is listed.
+	if err := g.rest.do(ctx, "GET", "/repository/commits/"+sha+"/statuses?name="+url.QueryEscape(name), nil, &statuses, http.StatusOK); err != nil {
+		return false, err
+	}
+	for _, s := range statuses {
+		if s.Name == name && strings.EqualFold(s.Author.Username, g.user) {
+			return s.Status == "success", nil
+		}
+	}
+	return false, nil
+}
+
+func (g *gitLab) Merge(ctx context.Context, pr int, message, sha string) error {
+	req := map[string]interface{}{
+		"squash":                true,
+		"squash_commit_message": message,
+	}
+	if sha != "" {
+		req["sha"] = sha
+	}
+	return g.rest.do(ctx, "PUT", fmt.Sprintf("/merge_requests/%d/merge", pr), req, nil, http.StatusOK)
+}
+
+func (g *gitLab) DeleteBranch(ctx context.Context, branch string) error {
+	return g.rest.do(ctx, "DELETE", "/repository/branches/"+url.PathEscape(branch), nil, nil, http.StatusNoContent)
+}
+
+func (g *gitLab) CloneURL() string {
+	u, err := url.Parse(g.baseURL + "/" + g.owner + "/" + g.repo + ".git")
+	if err != nil {
+		return ""
+	}
+	u.User = url.UserPassword("oauth2", g.token)
+	return u.String()
+}
+
+func (g *gitLab) PullRequestURL(pr int) string {
+	return fmt.Sprintf("%s/%s/%s/-/merge_requests/%d", g.baseURL, g.owner, g.repo, pr)
+}
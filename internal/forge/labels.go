@@ -0,0 +1,67 @@
+package forge
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/go-github/v35/github"
+)
+
+// LabelInfo describes a label of a pull request and who applied it.
+type LabelInfo struct {
+	Name string `json:"name"`
+
+	// SetBy is the login of the user who most recently applied the label,
+	// and SetAt when. Both are only known on GitHub (from the issue events
+	// API), and only if the label was applied after the pull request was
+	// opened.
+	SetBy string     `json:"set_by,omitempty"`
+	SetAt *time.Time `json:"set_at,omitempty"`
+}
+
+// ListLabels returns the labels of pull request pr, including who applied
+// them where the forge records it.
+func ListLabels(ctx context.Context, f Forge, pr int) ([]LabelInfo, error) {
+	names, err := f.Labels(ctx, pr)
+	if err != nil {
+		return nil, err
+	}
+	labels := make([]LabelInfo, 0, len(names))
+	for _, name := range names {
+		labels = append(labels, LabelInfo{Name: name})
+	}
+	gh, ok := f.(*gitHub)
+	if !ok {
+		return labels, nil
+	}
+	setters := make(map[string]*github.IssueEvent)
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		events, resp, err := gh.client.Issues.ListIssueEvents(ctx, gh.owner, gh.repo, pr, opts)
+		if err != nil {
+			return nil, err
+		}
+		// Events are listed in chronological order.
+		for _, ev := range events {
+			if ev.GetEvent() == "labeled" {
+				setters[ev.GetLabel().GetName()] = ev
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	for i, l := range labels {
+		ev, ok := setters[l.Name]
+		if !ok {
+			continue
+		}
+		labels[i].SetBy = ev.GetActor().GetLogin()
+		if ev.CreatedAt != nil {
+			t := ev.GetCreatedAt()
+			labels[i].SetAt = &t
+		}
+	}
+	return labels, nil
+}
@@ -0,0 +1,66 @@
+package forge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// restClient makes JSON requests to the REST API of Gitea or GitLab.
+type restClient struct {
+	apiURL string
+	auth   func(*http.Request)
+}
+
+// do sends a request with body (JSON-encoded, unless nil) to path, checks
+// that the reply has status code want and decodes it into v (unless nil).
+func (c *restClient) do(ctx context.Context, method, path string, body, v interface{}, want int) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.apiURL+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	c.auth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if got := resp.StatusCode; got != want {
+		return fmt.Errorf("%s %s: unexpected HTTP status code: got %d (%s), want %d", method, path, got, strings.TrimSpace(string(b)), want)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(b, v)
+}
+
+// checkDescription returns a one-line description of c for commit statuses,
+// which are limited in length and do not support Markdown.
+func checkDescription(c Check) string {
+	const maxLen = 140
+	desc := c.Title
+	if len(desc) > maxLen {
+		desc = desc[:maxLen]
+	}
+	return desc
+}
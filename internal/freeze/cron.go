@@ -0,0 +1,127 @@
+package freeze
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronField is the set of values matched by one field of a cron expression.
+type cronField struct {
+	any    bool // *, which matters for the day of month/week semantics
+	values map[int]bool
+}
+
+// cronExpr is a parsed standard (5 field) cron expression: minute, hour,
+// day of month, month, day of week.
+type cronExpr struct {
+	minute, hour, dom, month, dow cronField
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseCronValue parses a number or (with names) a name like mon or jan.
+func parseCronValue(s string, names []string, offset int) (int, error) {
+	for idx, name := range names {
+		if strings.EqualFold(s, name) {
+			return idx + offset, nil
+		}
+	}
+	return strconv.Atoi(s)
+}
+
+func parseCronField(s string, min, max int, names []string) (cronField, error) {
+	f := cronField{values: make(map[int]bool)}
+	for _, part := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step < 1 {
+				return f, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+		lo, hi := min, max
+		if rng == "*" {
+			if !hasStep {
+				f.any = true
+			}
+		} else {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+			var err error
+			lo, err = parseCronValue(loStr, names, min)
+			if err != nil {
+				return f, fmt.Errorf("invalid value %q", loStr)
+			}
+			hi = lo
+			if isRange {
+				hi, err = parseCronValue(hiStr, names, min)
+				if err != nil {
+					return f, fmt.Errorf("invalid value %q", hiStr)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return f, fmt.Errorf("%q out of range [%d, %d]", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			f.values[v] = true
+		}
+	}
+	return f, nil
+}
+
+func parseCron(s string) (*cronExpr, error) {
+	fields := strings.Fields(s)
+	if got, want := len(fields), 5; got != want {
+		return nil, fmt.Errorf("cron expression %q: got %d fields, want %d (minute hour day-of-month month day-of-week)", s, got, want)
+	}
+	var (
+		e   cronExpr
+		err error
+	)
+	for _, f := range []struct {
+		dest     *cronField
+		min, max int
+		names    []string
+	}{
+		{&e.minute, 0, 59, nil},
+		{&e.hour, 0, 23, nil},
+		{&e.dom, 1, 31, nil},
+		{&e.month, 1, 12, monthNames},
+		{&e.dow, 0, 7, dayNames},
+	} {
+		*f.dest, err = parseCronField(fields[0], f.min, f.max, f.names)
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q: %v", s, err)
+		}
+		fields = fields[1:]
+	}
+	if e.dow.values[7] {
+		e.dow.values[0] = true // both 0 and 7 are Sunday
+	}
+	return &e, nil
+}
+
+// matches reports whether t (truncated to the minute) matches e.
+func (e *cronExpr) matches(t time.Time) bool {
+	if !e.minute.values[t.Minute()] ||
+		!e.hour.values[t.Hour()] ||
+		!e.month.values[int(t.Month())] {
+		return false
+	}
+	dom := e.dom.values[t.Day()]
+	dow := e.dow.values[int(t.Weekday())]
+	// As in cron(8): if both day fields are restricted, either matches.
+	if !e.dom.any && !e.dow.any {
+		return dom || dow
+	}
+	return dom && dow
+}
@@ -0,0 +1,163 @@
+// Package freeze implements the freeze calendar configured in the "freeze"
+// section of autoupdate.toml: time windows during which changes are not
+// rolled out unattended (e.g. gokr-merge holds pull requests instead of
+// merging them), for operators who are traveling or at an event.
+//
+// Example configuration:
+//
+//	[freeze]
+//	timezone = "Europe/Zurich"
+//	windows = [
+//	  {reason = "weekend", cron = "* * * * sat,sun"},
+//	  {reason = "37C3", from = 2023-12-26, until = 2023-12-31},
+//	]
+//
+// A cron window is active during every minute its (5 field) cron expression
+// matches. from and until are dates (inclusive) or RFC 3339 timestamps.
+// Combining both restricts the cron window to the date range.
+package freeze
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/settings"
+)
+
+// Window is one entry of the freeze calendar.
+type Window struct {
+	// Reason explains the freeze, e.g. in pull request comments.
+	Reason string `json:"reason"`
+
+	// Cron, if non-empty, is a cron expression matching the minutes during
+	// which the window is active.
+	Cron string `json:"cron,omitempty"`
+
+	// From and Until, if non-empty, are the start and end (inclusive) of
+	// the window as date (2006-01-02) or RFC 3339 timestamp.
+	From  string `json:"from,omitempty"`
+	Until string `json:"until,omitempty"`
+}
+
+// Config is the "freeze" section of autoupdate.toml.
+type Config struct {
+	// Timezone is the IANA time zone (e.g. Europe/Zurich) in which cron
+	// expressions and dates are interpreted. Defaults to UTC.
+	Timezone string   `json:"timezone,omitempty"`
+	Windows  []Window `json:"windows"`
+}
+
+// window is a parsed Window.
+type window struct {
+	reason      string
+	cron        *cronExpr
+	from, until time.Time // zero if unbounded
+}
+
+var (
+	loadOnce sync.Once
+	windows  []window
+	location = time.UTC
+	loadErr  error
+)
+
+func parseTime(s string, loc *time.Location, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q: expected 2006-01-02 or RFC 3339", s)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return t, nil
+}
+
+func load() {
+	var cfg Config
+	if err := settings.Section("freeze", &cfg); err != nil {
+		loadErr = err
+		return
+	}
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			loadErr = fmt.Errorf("freeze: %v", err)
+			return
+		}
+		location = loc
+	}
+	for idx, w := range cfg.Windows {
+		fail := func(format string, args ...interface{}) {
+			loadErr = fmt.Errorf("freeze: windows[%d]: %s", idx, fmt.Sprintf(format, args...))
+		}
+		if w.Cron == "" && w.From == "" && w.Until == "" {
+			fail("one of cron, from or until must be specified")
+			return
+		}
+		parsed := window{reason: w.Reason}
+		if w.Cron != "" {
+			e, err := parseCron(w.Cron)
+			if err != nil {
+				fail("%v", err)
+				return
+			}
+			parsed.cron = e
+		}
+		if w.From != "" {
+			t, err := parseTime(w.From, location, false)
+			if err != nil {
+				fail("from: %v", err)
+				return
+			}
+			parsed.from = t
+		}
+		if w.Until != "" {
+			t, err := parseTime(w.Until, location, true)
+			if err != nil {
+				fail("until: %v", err)
+				return
+			}
+			parsed.until = t
+		}
+		if parsed.reason == "" {
+			parsed.reason = strings.TrimSpace(strings.Join([]string{w.Cron, w.From, w.Until}, " "))
+		}
+		windows = append(windows, parsed)
+	}
+}
+
+// Active returns the reasons of all freeze windows which are active at t,
+// or nil if changes may be rolled out.
+func Active(t time.Time) ([]string, error) {
+	loadOnce.Do(load)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	t = t.In(location)
+	var reasons []string
+	for _, w := range windows {
+		if !w.from.IsZero() && t.Before(w.from) {
+			continue
+		}
+		if !w.until.IsZero() && t.After(w.until) {
+			continue
+		}
+		if w.cron != nil && !w.cron.matches(t) {
+			continue
+		}
+		reasons = append(reasons, w.reason)
+	}
+	return reasons, nil
+}
+
+// Check validates the "freeze" section of autoupdate.toml, e.g. that cron
+// expressions and dates parse.
+func Check() error {
+	loadOnce.Do(load)
+	return loadErr
+}
@@ -0,0 +1,26 @@
+// Package githubtest provides GitHub API clients for tests.
+package githubtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-github/v35/github"
+)
+
+// NewClient returns a GitHub client whose API requests are served by h. The
+// server is closed when the test finishes.
+func NewClient(t testing.TB, h http.Handler) *github.Client {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	client := github.NewClient(nil)
+	u, err := url.Parse(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.BaseURL = u
+	return client
+}
@@ -0,0 +1,249 @@
+// Package metrics exposes counters and gauges of the autoupdate pipeline in
+// the Prometheus text exposition format, so that operators can alert on
+// stuck automation.
+//
+// Metrics are served at /metrics on Options.Listen, if set, which suits
+// tools running as long-lived services. Tools running as short-lived CI
+// jobs export them to Options.Textfile (for the node_exporter textfile
+// collector) or push them to Options.Pushgateway instead.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options configures how metrics are exported. The zero value only keeps
+// them in memory.
+type Options struct {
+	// Listen is the host:port on which to serve /metrics, e.g. :9090.
+	Listen string
+
+	// Textfile is the path of a file (ending in .prom) to which the metrics
+	// are written whenever they change, for the node_exporter textfile
+	// collector.
+	Textfile string
+
+	// Pushgateway is the URL of a Prometheus Pushgateway to which the metrics
+	// are pushed whenever they change, grouped by job=<tool name>.
+	Pushgateway string
+}
+
+// opts is set by Serve before any metric is updated.
+var opts Options
+
+// pushClient bounds how long pushing to Options.Pushgateway may delay the
+// tool.
+var pushClient = &http.Client{Timeout: 10 * time.Second}
+
+// Metric names.
+const (
+	Events             = "gokrazy_autoupdate_events_total"
+	BootTests          = "gokrazy_autoupdate_boot_tests_total"
+	GitHubQuotaLeft    = "gokrazy_autoupdate_github_api_remaining"
+	GitHubQuotaLimit   = "gokrazy_autoupdate_github_api_limit"
+	UpstreamPollTime   = "gokrazy_autoupdate_upstream_poll_duration_seconds"
+	UpstreamPollErrors = "gokrazy_autoupdate_upstream_poll_errors_total"
+)
+
+type desc struct {
+	typ  string // counter or gauge
+	help string
+}
+
+var descs = map[string]desc{
+	Events:             {"counter", "Pipeline events (pull-request-opened, merged, boot-failed, error) by kind and repository."},
+	BootTests:          {"counter", "Boot tests run, by host and result (passed, failed, budget exceeded)."},
+	GitHubQuotaLeft:    {"gauge", "Remaining GitHub API requests in the current rate limit window."},
+	GitHubQuotaLimit:   {"gauge", "GitHub API requests per rate limit window."},
+	UpstreamPollTime:   {"gauge", "Duration of the most recent upstream version poll."},
+	UpstreamPollErrors: {"counter", "Failed upstream version polls."},
+}
+
+var (
+	mu     sync.Mutex
+	values = make(map[string]map[string]float64) // name → labels → value
+)
+
+// labelString renders key/value pairs as {k1="v1",k2="v2"}.
+func labelString(kv []string) string {
+	if len(kv) == 0 {
+		return ""
+	}
+	if len(kv)%2 != 0 {
+		panic("metrics: odd number of label key/value arguments")
+	}
+	parts := make([]string, 0, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", kv[i], kv[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func update(name string, kv []string, f func(float64) float64) {
+	if _, ok := descs[name]; !ok {
+		panic("metrics: unknown metric " + name)
+	}
+	labels := labelString(kv)
+	mu.Lock()
+	if values[name] == nil {
+		values[name] = make(map[string]float64)
+	}
+	values[name][labels] = f(values[name][labels])
+	mu.Unlock()
+	export()
+}
+
+// export writes the metrics to Options.Textfile and pushes them to
+// Options.Pushgateway, if set. The tools exit via log.Fatal and os.Exit in
+// many places, so metrics are exported whenever they change instead of at
+// exit. Errors are only logged, as metrics must not fail the tool.
+func export() {
+	if opts.Textfile == "" && opts.Pushgateway == "" {
+		return
+	}
+	var buf bytes.Buffer
+	if err := WriteTo(&buf); err != nil {
+		log.Printf("exporting metrics: %v", err)
+		return
+	}
+	if opts.Textfile != "" {
+		if err := writeTextfile(buf.Bytes()); err != nil {
+			log.Printf("writing metrics to %s: %v", opts.Textfile, err)
+		}
+	}
+	if opts.Pushgateway != "" {
+		if err := push(buf.Bytes()); err != nil {
+			log.Printf("pushing metrics to %s: %v", opts.Pushgateway, err)
+		}
+	}
+}
+
+// writeTextfile atomically replaces Options.Textfile with b, so that the
+// node_exporter never reads a partially written file.
+func writeTextfile(b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(opts.Textfile), ".metrics-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), opts.Textfile)
+}
+
+// push replaces the metrics of the job group of this tool on the
+// Options.Pushgateway with b.
+func push(b []byte) error {
+	u := strings.TrimSuffix(opts.Pushgateway, "/") + "/metrics/job/" + url.PathEscape(filepath.Base(os.Args[0]))
+	req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected HTTP status code: got %d (%s), want %d or %d", resp.StatusCode, strings.TrimSpace(string(body)), http.StatusOK, http.StatusAccepted)
+	}
+	return nil
+}
+
+// Inc increments the counter name with the specified label key/value pairs.
+func Inc(name string, kv ...string) {
+	update(name, kv, func(v float64) float64 { return v + 1 })
+}
+
+// Set sets the gauge name with the specified label key/value pairs.
+func Set(name string, value float64, kv ...string) {
+	update(name, kv, func(float64) float64 { return value })
+}
+
+// Since sets the gauge name to the number of seconds since start.
+func Since(name string, start time.Time, kv ...string) {
+	Set(name, time.Since(start).Seconds(), kv...)
+}
+
+// WriteTo writes all metrics to w in the Prometheus text exposition format.
+func WriteTo(w io.Writer) error {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := descs[name]
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, d.help, name, d.typ); err != nil {
+			return err
+		}
+		series := make([]string, 0, len(values[name]))
+		for labels := range values[name] {
+			series = append(series, labels)
+		}
+		sort.Strings(series)
+		for _, labels := range series {
+			if _, err := fmt.Fprintf(w, "%s%s %v\n", name, labels, values[name][labels]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Serve configures how metrics are exported and starts serving /metrics on
+// o.Listen in the background, if set. It must be called before any metric is
+// updated.
+func Serve(o Options) {
+	opts = o
+	if opts.Listen == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := WriteTo(w); err != nil {
+			log.Printf("writing metrics: %v", err)
+		}
+	})
+	go func() {
+		log.Printf("serving metrics on http://%s/metrics", opts.Listen)
+		if err := http.ListenAndServe(opts.Listen, mux); err != nil {
+			log.Printf("serving metrics: %v", err)
+		}
+	}()
+}
+
+// Poll records the duration of an upstream version poll which started at
+// start, and counts it as failed if err is non-nil.
+func Poll(start time.Time, err error) {
+	tool := filepath.Base(os.Args[0])
+	Since(UpstreamPollTime, start, "tool", tool)
+	if err != nil {
+		Inc(UpstreamPollErrors, "tool", tool)
+	}
+}
@@ -0,0 +1,264 @@
+// Package notify sends notifications about events in the autoupdate pipeline
+// (pull requests opened, boot test results, merges, repeated errors) to the
+// sinks configured in the "notify" section of autoupdate.toml, and to sinks
+// which tools add via AddSink (e.g. from flags).
+//
+// Example configuration:
+//
+//	[[notify.sinks]]
+//	type = "slack"
+//	url = "https://hooks.slack.com/services/…"
+//
+//	[[notify.sinks]]
+//	type = "matrix"
+//	url = "https://matrix.org"
+//	room = "!abc:matrix.org"
+//	token = "…"
+//	events = ["boot-failed", "error"]
+//
+//	[notify.templates]
+//	merged = "{{ .Repo }}: merged {{ .URL }} 🎉"
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+
+	"github.com/gokrazy/autoupdate/internal/metrics"
+	"github.com/gokrazy/autoupdate/internal/settings"
+)
+
+// Event kinds, usable in the events filter of a sink and as keys of the
+// templates map.
+const (
+	PullRequestOpened = "pull-request-opened"
+	BootFailed        = "boot-failed"
+	BootSucceeded     = "boot-succeeded"
+	Merged            = "merged"
+	Error             = "error"
+)
+
+// Event describes something that happened in the pipeline.
+type Event struct {
+	Kind   string `json:"kind"`
+	Tool   string `json:"tool"`
+	Repo   string `json:"repo"`
+	Title  string `json:"title,omitempty"`
+	URL    string `json:"url,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+var defaultTemplates = map[string]string{
+	PullRequestOpened: `{{ .Repo }}: opened {{ .URL }} ({{ .Title }})`,
+	BootFailed:        `{{ .Repo }}: boot test failed{{ with .URL }} for {{ . }}{{ end }}: {{ .Detail }}`,
+	BootSucceeded:     `{{ .Repo }}: boot test successful{{ with .URL }} for {{ . }}{{ end }}: {{ .Detail }}`,
+	Merged:            `{{ .Repo }}: merged {{ .URL }}`,
+	Error:             `{{ .Repo }}: {{ .Tool }} failed: {{ .Detail }}`,
+}
+
+// SinkConfig configures one notification sink.
+type SinkConfig struct {
+	// Type is one of slack, matrix, email or webhook.
+	Type string `json:"type"`
+
+	// Events restricts the sink to the listed event kinds. Empty means all.
+	Events []string `json:"events,omitempty"`
+
+	// URL is the incoming webhook URL (slack, webhook) or the homeserver
+	// base URL (matrix).
+	URL string `json:"url,omitempty"`
+
+	// Room and Token are used by the matrix sink.
+	Room  string `json:"room,omitempty"`
+	Token string `json:"token,omitempty"`
+
+	// SMTP, From, To, Username and Password are used by the email sink.
+	SMTP     string   `json:"smtp,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+}
+
+type config struct {
+	Sinks     []SinkConfig      `json:"sinks"`
+	Templates map[string]string `json:"templates,omitempty"`
+
+	// ErrorThreshold is the number of consecutive failures of a tool after
+	// which an error event is sent. Defaults to 1.
+	ErrorThreshold int `json:"error_threshold,omitempty"`
+
+	// StateFile keeps the consecutive failure counts across runs. Without
+	// it, every failure counts as the first one.
+	StateFile string `json:"state_file,omitempty"`
+}
+
+// A Sink delivers a rendered notification message.
+type Sink interface {
+	Notify(ctx context.Context, ev Event, msg string) error
+}
+
+var (
+	loadOnce sync.Once
+	cfg      config
+	sinks    []Sink
+	loadErr  error
+)
+
+func load() {
+	if err := settings.Section("notify", &cfg); err != nil {
+		loadErr = err
+		return
+	}
+	for _, sc := range cfg.Sinks {
+		s, err := newSink(sc)
+		if err != nil {
+			loadErr = err
+			return
+		}
+		sinks = append(sinks, s)
+	}
+}
+
+// AddSink adds a sink in addition to those configured in autoupdate.toml.
+func AddSink(sc SinkConfig) error {
+	loadOnce.Do(load)
+	if loadErr != nil {
+		return loadErr
+	}
+	s, err := newSink(sc)
+	if err != nil {
+		return err
+	}
+	cfg.Sinks = append(cfg.Sinks, sc)
+	sinks = append(sinks, s)
+	return nil
+}
+
+func render(ev Event) (string, error) {
+	text, ok := cfg.Templates[ev.Kind]
+	if !ok {
+		text = defaultTemplates[ev.Kind]
+	}
+	tmpl, err := template.New(ev.Kind).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, ev); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func wants(sc SinkConfig, kind string) bool {
+	if len(sc.Events) == 0 {
+		return true
+	}
+	for _, e := range sc.Events {
+		if e == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Send delivers ev to all configured sinks which are interested in its kind.
+// Delivery errors are logged, but do not fail the calling tool.
+func Send(ctx context.Context, ev Event) {
+	metrics.Inc(metrics.Events, "kind", ev.Kind, "repo", ev.Repo)
+	loadOnce.Do(load)
+	if loadErr != nil {
+		log.Printf("notify: %v", loadErr)
+		return
+	}
+	if len(sinks) == 0 {
+		return
+	}
+	if ev.Tool == "" {
+		ev.Tool = filepath.Base(os.Args[0])
+	}
+	msg, err := render(ev)
+	if err != nil {
+		log.Printf("notify: rendering %s message: %v", ev.Kind, err)
+		return
+	}
+	for idx, s := range sinks {
+		if !wants(cfg.Sinks[idx], ev.Kind) {
+			continue
+		}
+		if err := s.Notify(ctx, ev, msg); err != nil {
+			log.Printf("notify: %s sink: %v", cfg.Sinks[idx].Type, err)
+		}
+	}
+}
+
+// Failed records a failure of the calling tool for repo and sends an error
+// event once the configured number of consecutive failures is reached.
+func Failed(ctx context.Context, repo string, err error) {
+	loadOnce.Do(load)
+	n := updateFailures(repo, func(n int) int { return n + 1 })
+	threshold := cfg.ErrorThreshold
+	if threshold == 0 {
+		threshold = 1
+	}
+	if n < threshold {
+		return
+	}
+	detail := err.Error()
+	if n > 1 {
+		detail = fmt.Sprintf("%s (%d consecutive failures)", detail, n)
+	}
+	Send(ctx, Event{
+		Kind:   Error,
+		Repo:   repo,
+		Detail: detail,
+	})
+}
+
+// Succeeded resets the consecutive failure count of the calling tool for
+// repo.
+func Succeeded(repo string) {
+	loadOnce.Do(load)
+	updateFailures(repo, func(int) int { return 0 })
+}
+
+func updateFailures(repo string, update func(int) int) int {
+	if cfg.StateFile == "" {
+		return update(0)
+	}
+	counts := make(map[string]int)
+	if b, err := os.ReadFile(cfg.StateFile); err == nil {
+		if err := json.Unmarshal(b, &counts); err != nil {
+			log.Printf("notify: %s: %v", cfg.StateFile, err)
+		}
+	}
+	key := filepath.Base(os.Args[0]) + " " + repo
+	counts[key] = update(counts[key])
+	if counts[key] == 0 {
+		delete(counts, key)
+	}
+	b, err := json.Marshal(counts)
+	if err != nil {
+		log.Printf("notify: %v", err)
+		return counts[key]
+	}
+	if err := os.WriteFile(cfg.StateFile, b, 0644); err != nil {
+		log.Printf("notify: %v", err)
+	}
+	return counts[key]
+}
+
+// Check validates the "notify" section of autoupdate.toml, e.g. that each
+// sink has the fields its type requires.
+func Check() error {
+	loadOnce.Do(load)
+	return loadErr
+}
@@ -0,0 +1,70 @@
+package notify
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gokrazy/autoupdate/internal/settings"
+)
+
+func TestSchemaListsEvents(t *testing.T) {
+	var schema struct {
+		Properties struct {
+			Notify struct {
+				Properties struct {
+					Sinks struct {
+						Items struct {
+							Properties struct {
+								Events struct {
+									Items struct {
+										Enum []string `json:"enum"`
+									} `json:"items"`
+								} `json:"events"`
+							} `json:"properties"`
+						} `json:"items"`
+					} `json:"sinks"`
+					Templates struct {
+						PropertyNames struct {
+							Enum []string `json:"enum"`
+						} `json:"propertyNames"`
+					} `json:"templates"`
+				} `json:"properties"`
+			} `json:"notify"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(settings.Schema, &schema); err != nil {
+		t.Fatal(err)
+	}
+	notify := schema.Properties.Notify.Properties
+	for _, tt := range []struct {
+		name string
+		enum []string
+	}{
+		{"notify.sinks[].events", notify.Sinks.Items.Properties.Events.Items.Enum},
+		{"notify.templates", notify.Templates.PropertyNames.Enum},
+	} {
+		listed := make(map[string]bool)
+		for _, kind := range tt.enum {
+			listed[kind] = true
+		}
+		for _, kind := range []string{
+			PullRequestOpened,
+			BootFailed,
+			BootSucceeded,
+			Merged,
+			Error,
+		} {
+			if !listed[kind] {
+				t.Errorf("schema of %s does not list event %q", tt.name, kind)
+			}
+		}
+		for kind := range defaultTemplates {
+			if !listed[kind] {
+				t.Errorf("schema of %s does not list event %q (from defaultTemplates)", tt.name, kind)
+			}
+		}
+		if got, want := len(tt.enum), len(defaultTemplates); got != want {
+			t.Errorf("schema of %s lists %d events, want %d", tt.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func newSink(sc SinkConfig) (Sink, error) {
+	switch sc.Type {
+	case "slack":
+		if sc.URL == "" {
+			return nil, fmt.Errorf("slack sink: url is required")
+		}
+		return &slackSink{url: sc.URL}, nil
+
+	case "webhook":
+		if sc.URL == "" {
+			return nil, fmt.Errorf("webhook sink: url is required")
+		}
+		return &webhookSink{url: sc.URL}, nil
+
+	case "matrix":
+		if sc.URL == "" || sc.Room == "" || sc.Token == "" {
+			return nil, fmt.Errorf("matrix sink: url, room and token are required")
+		}
+		return &matrixSink{homeserver: strings.TrimSuffix(sc.URL, "/"), room: sc.Room, token: sc.Token}, nil
+
+	case "email":
+		if sc.SMTP == "" || sc.From == "" || len(sc.To) == 0 {
+			return nil, fmt.Errorf("email sink: smtp, from and to are required")
+		}
+		return &emailSink{cfg: sc}, nil
+	}
+	return nil, fmt.Errorf("unknown sink type %q: expected one of slack, matrix, email or webhook", sc.Type)
+}
+
+func postJSON(ctx context.Context, method, u string, header http.Header, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	for k, vals := range header {
+		req.Header[k] = vals
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected HTTP status code: got %d (%s), want 2xx", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// slackSink posts to a Slack (or Slack-compatible, e.g. Mattermost) incoming
+// webhook.
+type slackSink struct {
+	url string
+}
+
+func (s *slackSink) Notify(ctx context.Context, ev Event, msg string) error {
+	return postJSON(ctx, http.MethodPost, s.url, nil, struct {
+		Text string `json:"text"`
+	}{Text: msg})
+}
+
+// webhookSink posts the event along with the rendered message as JSON.
+type webhookSink struct {
+	url string
+}
+
+func (s *webhookSink) Notify(ctx context.Context, ev Event, msg string) error {
+	return postJSON(ctx, http.MethodPost, s.url, nil, struct {
+		Event
+		Text string `json:"text"`
+	}{Event: ev, Text: msg})
+}
+
+// matrixSink sends an m.text message to a Matrix room using the
+// client-server API.
+type matrixSink struct {
+	homeserver string
+	room       string
+	token      string
+}
+
+func (s *matrixSink) Notify(ctx context.Context, ev Event, msg string) error {
+	txnID := strconv.FormatInt(time.Now().UnixNano(), 10)
+	u := s.homeserver + "/_matrix/client/v3/rooms/" + url.PathEscape(s.room) + "/send/m.room.message/" + txnID
+	return postJSON(ctx, http.MethodPut, u, http.Header{
+		"Authorization": []string{"Bearer " + s.token},
+	}, struct {
+		MsgType string `json:"msgtype"`
+		Body    string `json:"body"`
+	}{MsgType: "m.text", Body: msg})
+}
+
+// emailSink sends a plain text email via SMTP.
+type emailSink struct {
+	cfg SinkConfig
+}
+
+func (s *emailSink) Notify(ctx context.Context, ev Event, msg string) error {
+	var auth smtp.Auth
+	if s.cfg.Username != "" {
+		host, _, err := net.SplitHostPort(s.cfg.SMTP)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, host)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", s.cfg.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(s.cfg.To, ", "))
+	fmt.Fprintf(&buf, "Subject: [%s] %s %s\r\n", ev.Repo, ev.Tool, ev.Kind)
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&buf, "\r\n%s\r\n", msg)
+	return smtp.SendMail(s.cfg.SMTP, auth, s.cfg.From, s.cfg.To, buf.Bytes())
+}
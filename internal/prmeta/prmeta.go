@@ -0,0 +1,168 @@
+// Package prmeta embeds machine-parsable metadata (what is being updated, to
+// which version, from which upstream source) and a pipeline checklist in the
+// body of the pull requests opened by the gokr-pull-* tools, so that
+// gokr-boot and gokr-merge do not need to rely solely on labels.
+//
+// A pull request body looks like this:
+//
+//	<free-form text, e.g. the patch report>
+//
+//	- [ ] boot-tested
+//
+//	<!-- gokrazy-autoupdate {"kind":"kernel","flavor":"vanilla",…} -->
+//
+// Checklist items are ticked by the tools (or by hand, in the web UI).
+//
+// The same metadata can be committed alongside the change as an update
+// manifest (see Manifest), for tools which work on a checkout of the
+// repository instead of the pull request, e.g. gokr-tag-release.
+package prmeta
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// BootTested is the checklist item which gokr-boot ticks once the boot test
+// passed.
+const BootTested = "boot-tested"
+
+// Metadata describes the update proposed by a pull request.
+type Metadata struct {
+	// Kind is the updated component, e.g. kernel.
+	Kind string `json:"kind"`
+
+	// Flavor is the kernel flavor (vanilla or raspberrypi), if any.
+	Flavor string `json:"flavor,omitempty"`
+
+	// Version is the proposed version, e.g. linux-6.6.7.tar.xz.
+	Version string `json:"version"`
+
+	UpstreamURL string `json:"upstream_url,omitempty"`
+
+	// UpstreamHash identifies the upstream source, e.g. sha256:… of a
+	// tarball or the git commit of a tag.
+	UpstreamHash string `json:"upstream_hash,omitempty"`
+
+	// PreviousVersion and PreviousURL describe the version which is
+	// replaced, if known.
+	PreviousVersion string `json:"previous_version,omitempty"`
+	PreviousURL     string `json:"previous_url,omitempty"`
+}
+
+// Manifest returns m formatted as an update manifest file.
+func Manifest(m Metadata) ([]byte, error) {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// ParseManifest parses an update manifest file written by Manifest.
+func ParseManifest(b []byte) (*Metadata, error) {
+	var m Metadata
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("update manifest: %v", err)
+	}
+	return &m, nil
+}
+
+// ErrNotFound is returned by Parse for bodies without metadata, e.g. of pull
+// requests opened by hand.
+var ErrNotFound = errors.New("pull request body contains no gokrazy-autoupdate metadata")
+
+const marker = "gokrazy-autoupdate"
+
+var (
+	metadataRe  = regexp.MustCompile(`<!-- ` + marker + ` (\{.*\}) -->`)
+	checklistRe = regexp.MustCompile(`(?m)^- \[([ xX])\] ([A-Za-z0-9_.-]+)[ \t]*$`)
+)
+
+// Body returns a pull request body consisting of text, a checklist of the
+// (unticked) items and the metadata m.
+func Body(text string, m Metadata, checklist []string) (string, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	if text = strings.TrimSpace(text); text != "" {
+		sb.WriteString(text + "\n\n")
+	}
+	for _, item := range checklist {
+		sb.WriteString("- [ ] " + item + "\n")
+	}
+	if len(checklist) > 0 {
+		sb.WriteString("\n")
+	}
+	fmt.Fprintf(&sb, "<!-- %s %s -->\n", marker, b)
+	return sb.String(), nil
+}
+
+// Parse returns the metadata embedded in body.
+func Parse(body string) (*Metadata, error) {
+	matches := metadataRe.FindStringSubmatch(body)
+	if matches == nil {
+		return nil, ErrNotFound
+	}
+	var m Metadata
+	if err := json.Unmarshal([]byte(matches[1]), &m); err != nil {
+		return nil, fmt.Errorf("pull request metadata: %v", err)
+	}
+	return &m, nil
+}
+
+// Checklist returns the checklist items of body and whether they are
+// ticked.
+func Checklist(body string) map[string]bool {
+	items := make(map[string]bool)
+	for _, matches := range checklistRe.FindAllStringSubmatch(body, -1) {
+		items[matches[2]] = matches[1] != " "
+	}
+	return items
+}
+
+// Tick returns body with checklist item ticked, or an error if body has no
+// such item.
+func Tick(body, item string) (string, error) {
+	found := false
+	body = checklistRe.ReplaceAllStringFunc(body, func(line string) string {
+		matches := checklistRe.FindStringSubmatch(line)
+		if matches[2] != item {
+			return line
+		}
+		found = true
+		return "- [x] " + item
+	})
+	if !found {
+		return "", fmt.Errorf("pull request body has no checklist item %q", item)
+	}
+	return body, nil
+}
+
+// Facts returns the metadata and ticked checklist items as names, which
+// label expressions and hardware matrices can refer to like labels:
+// kind:kernel, flavor:raspberrypi, checked:boot-tested.
+func Facts(body string) []string {
+	var facts []string
+	if m, err := Parse(body); err == nil {
+		if m.Kind != "" {
+			facts = append(facts, "kind:"+m.Kind)
+		}
+		if m.Flavor != "" {
+			facts = append(facts, "flavor:"+m.Flavor)
+		}
+	}
+	for item, ticked := range Checklist(body) {
+		if ticked {
+			facts = append(facts, "checked:"+item)
+		}
+	}
+	sort.Strings(facts)
+	return facts
+}
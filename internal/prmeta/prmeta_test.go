@@ -0,0 +1,91 @@
+package prmeta
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFacts(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		body string
+		want []string
+	}{
+		{
+			name: "opened by hand",
+			body: "Please update the kernel.",
+			want: nil,
+		},
+		{
+			name: "metadata only",
+			body: `<!-- gokrazy-autoupdate {"kind":"kernel","flavor":"vanilla","version":"linux-6.6.7.tar.xz"} -->`,
+			want: []string{"flavor:vanilla", "kind:kernel"},
+		},
+		{
+			name: "without flavor",
+			body: `<!-- gokrazy-autoupdate {"kind":"go","version":"go1.22.2"} -->`,
+			want: []string{"kind:go"},
+		},
+		{
+			name: "checklist",
+			body: `patch report
+
+- [x] boot-tested
+- [X] reviewed
+- [ ] soaked
+
+<!-- gokrazy-autoupdate {"kind":"firmware","version":"abc123"} -->
+`,
+			want: []string{"checked:boot-tested", "checked:reviewed", "kind:firmware"},
+		},
+		{
+			name: "checklist item with trailing text",
+			body: "- [x] boot-tested on rpi4\n",
+			want: nil,
+		},
+		{
+			name: "invalid metadata",
+			body: "- [x] boot-tested\n<!-- gokrazy-autoupdate {\"kind\": -->\n",
+			want: []string{"checked:boot-tested"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Facts(tt.body); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Facts(%q) = %q, want %q", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBodyRoundTrip(t *testing.T) {
+	m := Metadata{
+		Kind:    "kernel",
+		Flavor:  "raspberrypi",
+		Version: "linux-6.6.7.tar.xz",
+	}
+	body, err := Body("patch report", m, []string{BootTested})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Parse(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != m {
+		t.Errorf("Parse(Body(%+v)) = %+v", m, *got)
+	}
+	if want := map[string]bool{BootTested: false}; !reflect.DeepEqual(Checklist(body), want) {
+		t.Errorf("Checklist = %v, want %v", Checklist(body), want)
+	}
+
+	ticked, err := Tick(body, BootTested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{BootTested: true}; !reflect.DeepEqual(Checklist(ticked), want) {
+		t.Errorf("Checklist after Tick = %v, want %v", Checklist(ticked), want)
+	}
+	if _, err := Tick(body, "soaked"); err == nil {
+		t.Errorf("Tick(soaked) unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,59 @@
+// Package ratelimit checks the remaining GitHub API quota before long
+// multi-call operations and reports it when a tool exits.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/go-github/v35/github"
+
+	"github.com/gokrazy/autoupdate/internal/metrics"
+)
+
+// Preflight ensures that at least estimate GitHub API requests can be made.
+// If the quota does not suffice, Preflight waits for the quota to reset when
+// that happens within maxWait (the -ratelimit_max_wait flag of the tools),
+// and returns an error otherwise.
+//
+// Querying the rate limit does not count against the quota.
+func Preflight(ctx context.Context, client *github.Client, estimate int, maxWait time.Duration) error {
+	limits, _, err := client.RateLimits(ctx)
+	if err != nil {
+		return err
+	}
+	core := limits.GetCore()
+	metrics.Set(metrics.GitHubQuotaLeft, float64(core.Remaining))
+	metrics.Set(metrics.GitHubQuotaLimit, float64(core.Limit))
+	log.Printf("GitHub API quota: %d of %d requests remaining, need ~%d", core.Remaining, core.Limit, estimate)
+	if core.Remaining >= estimate {
+		return nil
+	}
+	wait := time.Until(core.Reset.Time)
+	if wait > maxWait {
+		return fmt.Errorf("GitHub API rate limit: need ~%d requests, but only %d of %d remain until %v (in %v). Retry later or set -ratelimit_max_wait=%v",
+			estimate, core.Remaining, core.Limit, core.Reset.Time, wait.Round(time.Second), wait.Round(time.Minute)+time.Minute)
+	}
+	log.Printf("waiting %v for the GitHub API quota to reset", wait.Round(time.Second))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+	}
+	return nil
+}
+
+// Report logs the remaining GitHub API quota.
+func Report(ctx context.Context, client *github.Client) {
+	limits, _, err := client.RateLimits(ctx)
+	if err != nil {
+		log.Printf("querying GitHub API quota: %v", err)
+		return
+	}
+	core := limits.GetCore()
+	metrics.Set(metrics.GitHubQuotaLeft, float64(core.Remaining))
+	metrics.Set(metrics.GitHubQuotaLimit, float64(core.Limit))
+	log.Printf("GitHub API quota remaining: %d of %d (resets at %v)", core.Remaining, core.Limit, core.Reset.Time)
+}
@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/githubtest"
+	"github.com/google/go-github/v35/github"
+)
+
+// fakeGitHub serves a rate limit of remaining out of 5000 requests, which
+// resets at reset.
+func fakeGitHub(t *testing.T, remaining int, reset time.Time) *github.Client {
+	t.Helper()
+	return githubtest.NewClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rate_limit" {
+			t.Errorf("unexpected request %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"resources": {"core": {"limit": 5000, "remaining": %d, "reset": %d}}}`, remaining, reset.Unix())
+	}))
+}
+
+func TestPreflight(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		remaining int
+		reset     time.Duration // from now
+		maxWait   time.Duration
+		wantErr   bool
+	}{
+		{
+			name:      "enough quota",
+			remaining: 100,
+			reset:     time.Hour,
+		},
+		{
+			name:      "exactly enough quota",
+			remaining: 10,
+			reset:     time.Hour,
+		},
+		{
+			name:      "not enough quota",
+			remaining: 9,
+			reset:     time.Hour,
+			wantErr:   true,
+		},
+		{
+			name:      "reset after max wait",
+			remaining: 0,
+			reset:     time.Hour,
+			maxWait:   30 * time.Minute,
+			wantErr:   true,
+		},
+		{
+			name:      "already reset",
+			remaining: 0,
+			reset:     -time.Minute,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fakeGitHub(t, tt.remaining, time.Now().Add(tt.reset))
+			err := Preflight(context.Background(), client, 10, tt.maxWait)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Preflight = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPreflightCancelled(t *testing.T) {
+	client := fakeGitHub(t, 0, time.Now().Add(time.Hour))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := Preflight(ctx, client, 10, 2*time.Hour)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Preflight = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
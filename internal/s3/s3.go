@@ -0,0 +1,149 @@
+// Package s3 uploads objects to S3-compatible object stores (AWS S3, MinIO,
+// Ceph RGW, …) using path-style URLs and AWS Signature Version 4.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/autoupdate/internal/secret"
+)
+
+// Bucket is a location within an S3-compatible bucket.
+type Bucket struct {
+	// URL is the path-style bucket URL, optionally followed by a key prefix,
+	// e.g. https://s3.eu-central-1.amazonaws.com/my-bucket/boot-logs
+	URL string
+
+	// Region is the signing region, e.g. eu-central-1. MinIO uses us-east-1.
+	Region string
+
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// FromEnv returns a Bucket for bucketURL with region and credentials taken
+// from the standard AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+// environment variables.
+func FromEnv(bucketURL string) (*Bucket, error) {
+	b := &Bucket{
+		URL:             strings.TrimSuffix(bucketURL, "/"),
+		Region:          os.Getenv("AWS_REGION"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: secret.Get("AWS_SECRET_ACCESS_KEY"),
+	}
+	if b.Region == "" {
+		b.Region = "us-east-1"
+	}
+	if b.AccessKeyID == "" || b.SecretAccessKey == "" {
+		return nil, fmt.Errorf("required environment variables AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY empty")
+	}
+	return b, nil
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds AWS Signature Version 4 headers to req, whose body hashes to
+// payloadHash.
+func (b *Bucket) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + b.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+b.SecretAccessKey), date)
+	key = hmacSHA256(key, b.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// ObjectURL returns the URL of the object with the specified key.
+func (b *Bucket) ObjectURL(key string) string {
+	return b.URL + "/" + (&url.URL{Path: key}).EscapedPath()
+}
+
+// Put uploads content as the object key and returns its URL.
+func (b *Bucket) Put(ctx context.Context, key string, content []byte, contentType string) (string, error) {
+	u := b.ObjectURL(key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	b.sign(req, sha256Hex(content), time.Now())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("PUT %s: unexpected HTTP status code: got %d (%s), want %d", u, got, strings.TrimSpace(string(body)), want)
+	}
+	return u, nil
+}
+
+// Get downloads the object key.
+func (b *Bucket) Get(ctx context.Context, key string) ([]byte, error) {
+	u := b.ObjectURL(key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	b.sign(req, sha256Hex(nil), time.Now())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return nil, fmt.Errorf("GET %s: unexpected HTTP status code: got %d (%s), want %d", u, got, strings.TrimSpace(string(body)), want)
+	}
+	return body, nil
+}
@@ -0,0 +1,167 @@
+package settings
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"text/template"
+)
+
+// Schema is the JSON schema of autoupdate.toml. Editors can use it for
+// completion, e.g. with a #:schema comment (Taplo) or, in .json files, the
+// $schema key.
+//
+//go:embed schema.json
+var Schema []byte
+
+// schema is the subset of JSON schema used in schema.json.
+type schema struct {
+	Type                 string             `json:"type"`
+	Enum                 []interface{}      `json:"enum"`
+	Format               string             `json:"format"`
+	MinLength            *int               `json:"minLength"`
+	Minimum              *float64           `json:"minimum"`
+	Required             []string           `json:"required"`
+	Properties           map[string]*schema `json:"properties"`
+	PropertyNames        *schema            `json:"propertyNames"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+}
+
+// Check validates autoupdate.toml against Schema and returns all problems
+// found, e.g. misspelled keys or invalid regular expressions. A missing
+// file is valid.
+func Check() ([]string, error) {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	doc, err := parse(path)
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+	var s schema
+	if err := json.Unmarshal(Schema, &s); err != nil {
+		return nil, err
+	}
+	var problems []string
+	s.validate(path, doc, &problems)
+	return problems, nil
+}
+
+func typeOf(v interface{}) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func (s *schema) validate(at string, v interface{}, problems *[]string) {
+	fail := func(format string, args ...interface{}) {
+		*problems = append(*problems, at+": "+fmt.Sprintf(format, args...))
+	}
+	if s.Type != "" {
+		got := typeOf(v)
+		if got != s.Type && !(s.Type == "number" && got == "integer") {
+			fail("got %s, want %s", got, s.Type)
+			return
+		}
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if e == v {
+				found = true
+			}
+		}
+		if !found {
+			fail("got %v, want one of %v", v, s.Enum)
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		if s.MinLength != nil && len(v) < *s.MinLength {
+			fail("must not be empty")
+		}
+		switch s.Format {
+		case "regex":
+			if _, err := regexp.Compile(v); err != nil {
+				fail("%v", err)
+			}
+		case "template":
+			if _, err := template.New("").Parse(v); err != nil {
+				fail("%v", err)
+			}
+		}
+
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			fail("got %v, want >= %v", v, *s.Minimum)
+		}
+
+	case []interface{}:
+		if s.Items != nil {
+			for idx, item := range v {
+				s.Items.validate(fmt.Sprintf("%s[%d]", at, idx), item, problems)
+			}
+		}
+
+	case map[string]interface{}:
+		for _, key := range s.Required {
+			if _, ok := v[key]; !ok {
+				fail("missing required key %q", key)
+			}
+		}
+		var additional *schema
+		if len(s.AdditionalProperties) > 0 && string(s.AdditionalProperties) != "false" && string(s.AdditionalProperties) != "true" {
+			additional = new(schema)
+			if err := json.Unmarshal(s.AdditionalProperties, additional); err != nil {
+				fail("invalid schema: %v", err)
+				return
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if key == "$schema" {
+				continue
+			}
+			if s.PropertyNames != nil {
+				s.PropertyNames.validate(at+"."+key+" (key)", key, problems)
+			}
+			if prop, ok := s.Properties[key]; ok {
+				prop.validate(at+"."+key, v[key], problems)
+				continue
+			}
+			if additional != nil {
+				additional.validate(at+"."+key, v[key], problems)
+				continue
+			}
+			if string(s.AdditionalProperties) == "false" {
+				fail("unknown key %q (typo?)", key)
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Package settings loads autoupdate.toml, the configuration file shared by
+// all autoupdate tools. Each tool (or internal package) reads its own
+// top-level table, so that e.g. notification sinks are configured once
+// instead of in every workflow:
+//
+//	[[notify.sinks]]
+//	type = "slack"
+//	url = "https://hooks.slack.com/services/…"
+//
+// Files whose name ends in .json are read as JSON instead, with the same
+// structure.
+package settings
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// path is the configuration file which Section and Check read.
+var path = "autoupdate.toml"
+
+// SetPath sets the path of the configuration file (autoupdate.toml by
+// default). It must be called before the first call to Section.
+func SetPath(p string) {
+	path = p
+}
+
+var (
+	loadOnce sync.Once
+	sections map[string]interface{}
+	loadErr  error
+)
+
+// parse reads the configuration file fn. A missing file results in a nil map.
+func parse(fn string) (map[string]interface{}, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if strings.HasSuffix(fn, ".json") {
+		err = json.Unmarshal(b, &doc)
+	} else {
+		doc, err = parseTOML(b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return doc, nil
+}
+
+func load() {
+	sections, loadErr = parse(path)
+}
+
+// Section decodes the top-level table name of autoupdate.toml into v, using
+// the json struct tags of v. v is left untouched if the file or the section
+// does not exist. Unknown fields are rejected to catch typos early.
+func Section(name string, v interface{}) error {
+	loadOnce.Do(load)
+	if loadErr != nil {
+		return loadErr
+	}
+	section, ok := sections[name]
+	if !ok {
+		return nil
+	}
+	raw, err := json.Marshal(section)
+	if err != nil {
+		return fmt.Errorf("%s: section %q: %v", path, name, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%s: section %q: %v", path, name, err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package settings
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// parseTOML decodes the TOML document b into the values which encoding/json
+// decodes into an interface{}: map[string]interface{}, []interface{},
+// string, float64 and bool. This way, TOML documents can be validated
+// against Schema and their sections decoded like JSON.
+//
+// Dates and times are returned as strings in their TOML (i.e. RFC 3339)
+// notation. Integers beyond ±2^53 lose precision, like in JSON.
+func parseTOML(b []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	md, err := toml.Decode(string(b), &doc)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRedefinitions(md); err != nil {
+		return nil, err
+	}
+	v, err := jsonValue("", doc)
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string]interface{}), nil
+}
+
+// checkRedefinitions rejects table headers which define a table again that
+// dotted keys already defined, which is invalid TOML that the toml package
+// accepts:
+//
+//	[a]
+//	b.c = 1
+//	[a.b]
+func checkRedefinitions(md toml.MetaData) error {
+	// Keys are joined with NUL, as key parts may contain dots.
+	join := func(key toml.Key) string { return strings.Join(key, "\x00") }
+	var tables []toml.Key           // table keys (headers and inline tables), in order
+	dotted := make(map[string]bool) // tables defined by dotted keys
+	for _, key := range md.Keys() {
+		switch md.Type(key...) {
+		case "Hash":
+			if dotted[join(key)] {
+				return fmt.Errorf("table %s already defined by dotted keys", key)
+			}
+			tables = append(tables, key)
+		case "ArrayHash":
+			// A new element of an array of tables starts over.
+			for t := range dotted {
+				if strings.HasPrefix(t, join(key)+"\x00") {
+					delete(dotted, t)
+				}
+			}
+			tables = append(tables, key)
+		default:
+			// The tables between the enclosing table and the value are
+			// defined by its dotted key.
+			var parent toml.Key
+			for idx := len(tables) - 1; idx >= 0; idx-- {
+				if strings.HasPrefix(join(key), join(tables[idx])+"\x00") {
+					parent = tables[idx]
+					break
+				}
+			}
+			for n := len(parent) + 1; n < len(key); n++ {
+				dotted[join(key[:n])] = true
+			}
+		}
+	}
+	return nil
+}
+
+// jsonValue converts v, the value at path as decoded by the toml package,
+// into the types encoding/json uses.
+func jsonValue(path string, v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			sub := key
+			if path != "" {
+				sub = path + "." + key
+			}
+			converted, err := jsonValue(sub, val)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = converted
+		}
+		return m, nil
+
+	case []map[string]interface{}: // array of tables
+		l := make([]interface{}, len(v))
+		for idx, val := range v {
+			converted, err := jsonValue(fmt.Sprintf("%s[%d]", path, idx), val)
+			if err != nil {
+				return nil, err
+			}
+			l[idx] = converted
+		}
+		return l, nil
+
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for idx, val := range v {
+			converted, err := jsonValue(fmt.Sprintf("%s[%d]", path, idx), val)
+			if err != nil {
+				return nil, err
+			}
+			l[idx] = converted
+		}
+		return l, nil
+
+	case int64:
+		return float64(v), nil
+
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return nil, fmt.Errorf("%s: inf and nan are not supported", path)
+		}
+		return v, nil
+
+	case time.Time:
+		// The toml package marks local dates and times with these zones.
+		switch v.Location().String() {
+		case "date-local":
+			return v.Format(time.DateOnly), nil
+		case "time-local":
+			return v.Format("15:04:05.999999999"), nil
+		case "datetime-local":
+			return v.Format("2006-01-02T15:04:05.999999999"), nil
+		}
+		return v.Format(time.RFC3339Nano), nil
+
+	case string, bool:
+		return v, nil
+
+	default:
+		return nil, fmt.Errorf("%s: unsupported value of type %T", path, v)
+	}
+}
@@ -0,0 +1,159 @@
+package settings
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		toml string
+		want string // JSON
+	}{
+		{
+			name: "empty",
+			toml: "# nothing configured yet\n",
+			want: `{}`,
+		},
+		{
+			name: "scalars",
+			toml: `
+str = "tab\tquote\" \u00e9"
+lit = 'C:\path\*.tar.xz'
+int = 1_000
+neg = -17
+hex = 0xff
+float = 2.5e3
+yes = true
+no = false
+date = 2023-12-26
+datetime = 2023-12-26T10:00:00+01:00 # comment
+`,
+			want: `{"str": "tab\tquote\" é", "lit": "C:\\path\\*.tar.xz", "int": 1000, "neg": -17, "hex": 255, "float": 2500, "yes": true, "no": false, "date": "2023-12-26", "datetime": "2023-12-26T10:00:00+01:00"}`,
+		},
+		{
+			name: "multi-line strings",
+			toml: `
+basic = """
+first \
+  second
+third"""
+literal = '''
+raw \n'''
+`,
+			want: `{"basic": "first second\nthird", "literal": "raw \\n"}`,
+		},
+		{
+			name: "tables",
+			toml: `
+top = 1
+
+[freeze]
+timezone = "Europe/Zurich"
+windows = [
+  {reason = "weekend", cron = "* * * * sat,sun"},
+  {reason = "37C3", from = 2023-12-26, until = 2023-12-31}, # trailing comma
+]
+
+[notify.templates]
+merged = "{{ .Repo }}: merged"
+
+["pull-kernel"]
+a.b = "dotted"
+`,
+			want: `{
+  "top": 1,
+  "freeze": {
+    "timezone": "Europe/Zurich",
+    "windows": [
+      {"reason": "weekend", "cron": "* * * * sat,sun"},
+      {"reason": "37C3", "from": "2023-12-26", "until": "2023-12-31"}
+    ]
+  },
+  "notify": {"templates": {"merged": "{{ .Repo }}: merged"}},
+  "pull-kernel": {"a": {"b": "dotted"}}
+}`,
+		},
+		{
+			name: "array of tables",
+			toml: `
+[[notify.sinks]]
+type = "slack"
+url = "https://hooks.slack.com/services/x"
+
+[[notify.sinks]]
+type = "matrix"
+events = ["boot-failed", "error"]
+
+[notify]
+error_threshold = 3
+`,
+			want: `{"notify": {"sinks": [{"type": "slack", "url": "https://hooks.slack.com/services/x"}, {"type": "matrix", "events": ["boot-failed", "error"]}], "error_threshold": 3}}`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML([]byte(tt.toml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("parseTOML: got %#v, want %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLTables(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		toml string
+	}{
+		{"header after sub-table header", "[a.b]\nc = 1\n[a]\nd = 2\n"},
+		{"sub-table of dotted table", "[a]\nb.c = 1\n[a.b.d]\ne = 2\n"},
+		{"dotted table in previous array element", "[[a]]\nb.c = 1\n[[a]]\n[a.b]\nc = 2\n"},
+		{"quoted key with dot", "[a]\n\"b.c\" = 1\n[a.b]\nc = 2\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseTOML([]byte(tt.toml)); err != nil {
+				t.Errorf("parseTOML(%q): %v", tt.toml, err)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		toml string
+	}{
+		{"duplicate key", "a = 1\na = 2\n"},
+		{"duplicate table", "[a]\n[a]\n"},
+		{"key is not a table", "a = 1\n[a.b]\n"},
+		{"missing value", "a =\n"},
+		{"missing equals", "a 1\n"},
+		{"unterminated string", "a = \"abc\n"},
+		{"invalid escape", `a = "\x"`},
+		{"trailing garbage", "a = 1 2\n"},
+		{"leading zero", "a = 007\n"},
+		{"bare word", "a = yes\n"},
+		{"unterminated array", "a = [1, 2\n"},
+		{"inf", "a = inf\n"},
+		{"table in empty array", "x = []\n[x.y]\n"},
+		{"array of tables in empty array", "x = []\n[[x.y]]\n"},
+		{"table defined by dotted key", "[a]\nb.c = 1\n[a.b]\n"},
+		{"table defined by dotted key at the top level", "a.b = 1\n[a]\n"},
+		{"table defined by dotted key in array element", "[[a]]\nb.c = 1\n[a.b]\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := parseTOML([]byte(tt.toml)); err == nil {
+				t.Errorf("parseTOML(%q) = %v, want error", tt.toml, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+// Package version reports the version of the autoupdate tools, based on the
+// module and VCS information which the Go toolchain embeds into binaries.
+package version
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+)
+
+// Module returns the module version of the running binary, e.g. v0.3.0, or
+// (devel) for binaries built from a source checkout.
+func Module() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(unknown)"
+	}
+	return info.Main.Version
+}
+
+// Read returns a human-readable version string, e.g.
+// v0.3.0 (vcs revision 1a2b3c4d5e6f, 2024-05-01T10:00:00Z, go1.22.2).
+func Read() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(unknown) (" + runtime.Version() + ")"
+	}
+	var revision, vcsTime, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+			if len(revision) > 12 {
+				revision = revision[:12]
+			}
+		case "vcs.time":
+			vcsTime = s.Value
+		case "vcs.modified":
+			if s.Value == "true" {
+				modified = "+modified"
+			}
+		}
+	}
+	if revision == "" {
+		return fmt.Sprintf("%s (%s)", info.Main.Version, info.GoVersion)
+	}
+	return fmt.Sprintf("%s (vcs revision %s%s, %s, %s)", info.Main.Version, revision, modified, vcsTime, info.GoVersion)
+}
+
+// MaybePrint prints the version and exits if print is true, i.e. if the
+// -version flag of the calling tool was specified.
+func MaybePrint(print bool) {
+	if !print {
+		return
+	}
+	fmt.Println(filepath.Base(os.Args[0]), Read())
+	os.Exit(0)
+}
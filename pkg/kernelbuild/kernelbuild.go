@@ -0,0 +1,641 @@
+// Package kernelbuild implements the kernel build pipeline of
+// gokr-rebuild-kernel: downloading and unpacking the kernel source, applying
+// patches, configuring (defconfig plus config addendum), compiling and
+// installing the build results into an output directory.
+//
+// Build runs the toolchain of the host it is called on, so callers typically
+// run it within a build container (as gokr-rebuild-kernel does) or on a
+// dedicated build machine:
+//
+//	res, err := kernelbuild.Build(ctx, kernelbuild.Config{
+//		UpstreamURL: "https://cdn.kernel.org/pub/linux/kernel/v6.x/linux-6.6.7.tar.xz",
+//		Cross:       "arm64",
+//		Addendum:    "config.addendum.txt",
+//		OutputDir:   "/tmp/buildresult",
+//	})
+//	if err != nil { … }
+//	log.Printf("built kernel %s", res.Manifest.KernelRelease)
+package kernelbuild
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Stage identifies a step of the build pipeline.
+type Stage string
+
+const (
+	StageDownload  Stage = "download"
+	StageUnpack    Stage = "unpack"
+	StagePatch     Stage = "patch"
+	StageCompile   Stage = "compile"
+	StageSmokeTest Stage = "smoke-test"
+	StageInstall   Stage = "install"
+)
+
+// Hooks are called by Build while the pipeline runs. All fields are
+// optional.
+type Hooks struct {
+	// Stage is called at the start of each build stage with a
+	// human-readable description.
+	Stage func(stage Stage, msg string)
+
+	// Logf receives progress messages which are not stage boundaries,
+	// e.g. which patch is being applied.
+	Logf func(format string, args ...interface{})
+
+	// Configure is called with the path of the kernel .config after the
+	// config addendum was appended, before make olddefconfig resolves the
+	// configuration. It can modify the file to adjust the configuration.
+	Configure func(config string) error
+}
+
+// Config describes a kernel build.
+type Config struct {
+	// UpstreamURL is the URL of the kernel source tarball, e.g.
+	// https://cdn.kernel.org/pub/linux/kernel/v6.x/linux-6.6.7.tar.xz or
+	// https://github.com/raspberrypi/linux/archive/refs/tags/….tar.gz.
+	UpstreamURL string
+
+	// Source, if non-empty, is the path to the already downloaded kernel
+	// source tarball. UpstreamURL is then only recorded in the manifest.
+	Source string
+
+	// SourceSHA256, if non-empty, is the expected SHA-256 hash (hex) of the
+	// kernel source tarball, e.g. from SourceSHA256Sums. Build fails before
+	// applying patches if the tarball does not match. The tarball is hashed
+	// while it is extracted, so it is extracted into a staging directory
+	// which only becomes the kernel source directory once the hash matched.
+	SourceSHA256 string
+
+	// Flavor is one of vanilla (kernel.org, the default) or raspberrypi.
+	Flavor string
+
+	// Cross, if non-empty, is the architecture to cross-compile for. Only
+	// arm64 is supported.
+	Cross string
+
+	// Board is available as {{ .Board }} in the config addendum.
+	Board string
+
+	// Toolchain is one of gcc (the default, using the GNU cross toolchain
+	// for Cross) or zig, which compiles with zig cc and uses the LLVM
+	// binutils (LLVM=1), so that no per-architecture toolchain needs to be
+	// installed.
+	Toolchain string
+
+	// BaseImage is the (container) image of the build environment, e.g.
+	// debian:bookworm@sha256:…. It is only recorded in the manifest.
+	BaseImage string
+
+	// Addendum, if non-empty, is the path to a config addendum (template)
+	// which is appended to the default configuration.
+	Addendum string
+
+	// Patches are the paths of the patches to apply (with patch -p1), in
+	// order.
+	Patches []string
+
+	// DTBGlobs are additional device tree file glob patterns, relative to
+	// arch/arm64/boot/dts/, to install.
+	DTBGlobs []string
+
+	// Deb additionally builds Debian packages via make bindeb-pkg.
+	Deb bool
+
+	// SmokeTest boots the built kernel in QEMU to verify it reaches
+	// userspace before installing it.
+	SmokeTest bool
+
+	// Jobs is the number of parallel make jobs. If zero, the number of CPUs
+	// is used. Lower values need less memory.
+	Jobs int
+
+	// WorkDir is the directory in which the source is downloaded and
+	// unpacked. If empty, a temporary directory is used and removed after
+	// the build.
+	WorkDir string
+
+	// OutputDir is the directory in which the build results (vmlinuz,
+	// lib/modules, device tree files, metadata.json) are installed.
+	OutputDir string
+
+	// Output receives the output of all commands. If nil, it is discarded.
+	Output io.Writer
+
+	Hooks Hooks
+}
+
+// Result describes a successful build.
+type Result struct {
+	// Manifest is the content of metadata.json in the output directory.
+	Manifest Manifest
+
+	// Kernel is the path of the installed kernel image.
+	Kernel string
+
+	// DTBs are the paths of the installed device tree files (including
+	// overlays).
+	DTBs []string
+
+	// Debs are the paths of the installed Debian packages, if any.
+	Debs []string
+}
+
+// VanillaDTBs maps the device tree file names expected by the Raspberry Pi
+// firmware to their name in arch/arm64/boot/dts/broadcom/ of a vanilla
+// (kernel.org) kernel.
+var VanillaDTBs = map[string]string{
+	"bcm2710-rpi-3-b.dtb":      "bcm2837-rpi-3-b.dtb",
+	"bcm2710-rpi-3-b-plus.dtb": "bcm2837-rpi-3-b-plus.dtb",
+	"bcm2710-rpi-cm3.dtb":      "bcm2837-rpi-cm3-io3.dtb",
+	"bcm2711-rpi-4-b.dtb":      "bcm2711-rpi-4-b.dtb",
+	"bcm2711-rpi-cm4-io.dtb":   "bcm2711-rpi-cm4-io.dtb",
+	"bcm2710-rpi-zero-2-w.dtb": "bcm2837-rpi-zero-2-w.dtb",
+	"bcm2710-rpi-zero-2.dtb":   "bcm2837-rpi-zero-2-w.dtb",
+	"bcm2711-rpi-400.dtb":      "bcm2711-rpi-400.dtb",
+}
+
+// Download downloads the kernel source tarball from url to dest and returns
+// its SHA-256 hash.
+func Download(ctx context.Context, url, dest string) (string, error) {
+	out, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", url, got, want)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), resp.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), out.Close()
+}
+
+// builder holds the state of a single Build call.
+type builder struct {
+	cfg    Config
+	out    io.Writer
+	srcdir string // absolute path of the unpacked kernel source
+	env    []string
+	// makeVars are passed to every make invocation. Variables like CC need
+	// to be passed on the command line, as the kernel Makefile overrides
+	// them when set in the environment.
+	makeVars []string
+}
+
+func (b *builder) stage(stage Stage, format string, args ...interface{}) {
+	if b.cfg.Hooks.Stage != nil {
+		b.cfg.Hooks.Stage(stage, fmt.Sprintf(format, args...))
+	}
+}
+
+func (b *builder) logf(format string, args ...interface{}) {
+	if b.cfg.Hooks.Logf != nil {
+		b.cfg.Hooks.Logf(format, args...)
+	}
+}
+
+// command returns a command running in the kernel source directory.
+func (b *builder) command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = b.srcdir
+	cmd.Env = b.env
+	cmd.Stdout = b.out
+	cmd.Stderr = b.out
+	return cmd
+}
+
+// make runs make with args in the kernel source directory.
+func (b *builder) make(ctx context.Context, args ...string) error {
+	if err := b.command(ctx, "make", append(b.makeVars, args...)...).Run(); err != nil {
+		return fmt.Errorf("make %s: %v", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// Build runs the kernel build pipeline described by cfg.
+func Build(ctx context.Context, cfg Config) (*Result, error) {
+	if cfg.UpstreamURL == "" {
+		return nil, fmt.Errorf("kernelbuild: UpstreamURL is required")
+	}
+	if cfg.OutputDir == "" {
+		return nil, fmt.Errorf("kernelbuild: OutputDir is required")
+	}
+	if cfg.Flavor == "" {
+		cfg.Flavor = "vanilla"
+	}
+	if cfg.Flavor != "vanilla" && cfg.Flavor != "raspberrypi" {
+		return nil, fmt.Errorf("kernelbuild: invalid Flavor %q: expected one of vanilla or raspberrypi", cfg.Flavor)
+	}
+	if cfg.Cross != "" && cfg.Cross != "arm64" {
+		return nil, fmt.Errorf("kernelbuild: invalid Cross %q: expected one of 'arm64'", cfg.Cross)
+	}
+	if cfg.Toolchain == "" {
+		cfg.Toolchain = "gcc"
+	}
+	if cfg.Toolchain != "gcc" && cfg.Toolchain != "zig" {
+		return nil, fmt.Errorf("kernelbuild: invalid Toolchain %q: expected one of gcc or zig", cfg.Toolchain)
+	}
+	if cfg.Toolchain == "zig" && cfg.Deb {
+		return nil, fmt.Errorf("kernelbuild: Deb is not supported with Toolchain zig")
+	}
+	outputDir, err := filepath.Abs(cfg.OutputDir)
+	if err != nil {
+		return nil, err
+	}
+	cfg.OutputDir = outputDir
+	workDir := cfg.WorkDir
+	if workDir == "" {
+		workDir, err = os.MkdirTemp("", "kernelbuild")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(workDir)
+	}
+	workDir, err = filepath.Abs(workDir)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &builder{
+		cfg: cfg,
+		out: cfg.Output,
+		env: append(os.Environ(),
+			"KBUILD_BUILD_USER=gokrazy",
+			"KBUILD_BUILD_HOST=docker",
+			"KBUILD_BUILD_TIMESTAMP=Wed Mar  1 20:57:29 UTC 2017",
+		),
+	}
+	if b.out == nil {
+		b.out = io.Discard
+	}
+	if cfg.Cross == "arm64" {
+		b.env = append(b.env, "ARCH=arm64")
+	}
+	switch cfg.Toolchain {
+	case "gcc":
+		if cfg.Cross == "arm64" {
+			b.env = append(b.env, "CROSS_COMPILE=aarch64-linux-gnu-")
+		}
+	case "zig":
+		b.makeVars = zigMakeVars(cfg.Cross)
+	}
+
+	manifest := Manifest{
+		UpstreamURL: cfg.UpstreamURL,
+		Flavor:      cfg.Flavor,
+		Cross:       cfg.Cross,
+		BaseImage:   cfg.BaseImage,
+		BuildStart:  time.Now(),
+	}
+
+	srcdir := strings.TrimSuffix(filepath.Base(cfg.UpstreamURL), ".tar.xz")
+	if cfg.Flavor == "raspberrypi" {
+		srcdir = strings.TrimSuffix("linux-"+filepath.Base(cfg.UpstreamURL), ".tar.gz")
+	}
+	b.srcdir = filepath.Join(workDir, srcdir)
+
+	staging, err := os.MkdirTemp(workDir, "unpack")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+	if cfg.Source != "" {
+		b.stage(StageUnpack, "unpacking kernel source")
+		manifest.SourceSHA256, err = b.unpackFile(ctx, cfg.Source, staging)
+	} else {
+		// The download is streamed into the extraction, so there is no
+		// separate StageUnpack.
+		b.stage(StageDownload, "downloading and unpacking kernel source: %s", cfg.UpstreamURL)
+		manifest.SourceSHA256, err = b.downloadAndUnpack(ctx, cfg.UpstreamURL, staging)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if want := cfg.SourceSHA256; want != "" {
+		if !strings.EqualFold(manifest.SourceSHA256, want) {
+			return nil, fmt.Errorf("kernel source SHA-256 mismatch: got %s, want %s", manifest.SourceSHA256, want)
+		}
+		b.logf("kernel source SHA-256 verified: %s", manifest.SourceSHA256)
+	}
+	if err := os.RemoveAll(b.srcdir); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(filepath.Join(staging, srcdir), b.srcdir); err != nil {
+		return nil, err
+	}
+
+	b.stage(StagePatch, "applying patches")
+	if err := b.applyPatches(ctx); err != nil {
+		return nil, err
+	}
+
+	b.stage(StageCompile, "compiling kernel")
+	if err := b.compile(ctx); err != nil {
+		return nil, err
+	}
+
+	if cfg.SmokeTest {
+		b.stage(StageSmokeTest, "smoke testing kernel")
+		if err := b.smokeTest(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	b.stage(StageInstall, "copying build results")
+	res, err := b.install(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.completeManifest(ctx, &manifest); err != nil {
+		return nil, err
+	}
+	if err := manifest.write(filepath.Join(cfg.OutputDir, "metadata.json")); err != nil {
+		return nil, err
+	}
+	res.Manifest = manifest
+	return res, nil
+}
+
+func (b *builder) applyPatches(ctx context.Context) error {
+	for _, patch := range b.cfg.Patches {
+		b.logf("applying patch %q", patch)
+		f, err := os.Open(patch)
+		if err != nil {
+			return err
+		}
+		cmd := b.command(ctx, "patch", "-p1")
+		cmd.Stdin = f
+		err = cmd.Run()
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("applying patch %s: %v", patch, err)
+		}
+	}
+	return nil
+}
+
+// addendumData is available to template directives in the config addendum,
+// e.g. {{ if eq .Board "rpi5" }}CONFIG_…=y{{ end }}.
+type addendumData struct {
+	Board  string
+	Flavor string
+	Cross  string
+}
+
+func renderAddendum(fn string, data addendumData) ([]byte, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filepath.Base(fn)).Option("missingkey=error").Parse(string(b))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (b *builder) compile(ctx context.Context) error {
+	defconfig := []string{"defconfig"}
+	if b.cfg.Flavor == "raspberrypi" {
+		// TODO(https://github.com/gokrazy/gokrazy/issues/223): is it
+		// necessary/desirable to switch to bcm2712_defconfig?
+		defconfig = []string{"ARCH=arm64", "bcm2711_defconfig"}
+	}
+	if err := b.make(ctx, defconfig...); err != nil {
+		return err
+	}
+
+	// Change answers from mod to no if possible, i.e. disable all modules so
+	// that we end up with a minimal set of modules (from the config addendum).
+	if err := b.make(ctx, "mod2noconfig"); err != nil {
+		return err
+	}
+
+	config := filepath.Join(b.srcdir, ".config")
+	if b.cfg.Addendum != "" {
+		addendum, err := renderAddendum(b.cfg.Addendum, addendumData{
+			Board:  b.cfg.Board,
+			Flavor: b.cfg.Flavor,
+			Cross:  b.cfg.Cross,
+		})
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(config, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := f.Write(addendum); err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	if b.cfg.Hooks.Configure != nil {
+		if err := b.cfg.Hooks.Configure(config); err != nil {
+			return err
+		}
+	}
+
+	if err := b.make(ctx, "olddefconfig"); err != nil {
+		return err
+	}
+
+	n := b.cfg.Jobs
+	if n == 0 {
+		n = runtime.NumCPU()
+	}
+	jobs := "-j" + strconv.Itoa(n)
+	targets := []string{"bzImage", "modules"}
+	if b.cfg.Cross == "arm64" {
+		targets = []string{"Image.gz", "dtbs", "modules"}
+	}
+	if err := b.make(ctx, append(targets, jobs)...); err != nil {
+		return err
+	}
+	if err := b.make(ctx, "INSTALL_MOD_PATH="+b.cfg.OutputDir, "modules_install", jobs); err != nil {
+		return err
+	}
+	if b.cfg.Deb {
+		if err := b.make(ctx, "bindeb-pkg", jobs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zigMakeVars returns the make variables which select zig cc as the
+// compiler for the kernel (targeting cross, or x86_64 if empty) and for host
+// programs. Tools which zig does not provide (e.g. nm, strip) are taken
+// from the LLVM toolchain.
+func zigMakeVars(cross string) []string {
+	target := "x86_64-linux-gnu"
+	if cross == "arm64" {
+		target = "aarch64-linux-gnu"
+	}
+	return []string{
+		"LLVM=1",
+		"CC=zig cc -target " + target,
+		"HOSTCC=zig cc",
+		"HOSTCXX=zig c++",
+		"LD=zig ld.lld",
+		"AR=zig ar",
+		"OBJCOPY=zig objcopy",
+	}
+}
+
+// kernelImage returns the path of the compiled kernel image, relative to the
+// kernel source directory.
+func (b *builder) kernelImage() string {
+	if b.cfg.Cross == "arm64" {
+		return "arch/arm64/boot/Image"
+	}
+	return "arch/x86/boot/bzImage"
+}
+
+// install copies the build results into the output directory.
+func (b *builder) install(ctx context.Context) (*Result, error) {
+	src := func(path string) string { return filepath.Join(b.srcdir, path) }
+	dest := func(path string) string { return filepath.Join(b.cfg.OutputDir, path) }
+
+	res := &Result{Kernel: dest("vmlinuz")}
+	if err := copyFile(res.Kernel, src(b.kernelImage())); err != nil {
+		return nil, err
+	}
+
+	if b.cfg.Deb {
+		// make bindeb-pkg places the packages in the parent directory.
+		debs, err := filepath.Glob(filepath.Join(b.srcdir, "..", "*.deb"))
+		if err != nil {
+			return nil, err
+		}
+		for _, fn := range debs {
+			if err := copyFile(dest(filepath.Base(fn)), fn); err != nil {
+				return nil, err
+			}
+			res.Debs = append(res.Debs, dest(filepath.Base(fn)))
+		}
+	}
+
+	if b.cfg.Cross != "arm64" {
+		return res, nil
+	}
+
+	switch b.cfg.Flavor {
+	case "vanilla":
+		// copy device tree files from arch/arm64/boot/dts/broadcom/
+		for name, source := range VanillaDTBs {
+			if err := copyFile(dest(name), src("arch/arm64/boot/dts/broadcom/"+source)); err != nil {
+				return nil, err
+			}
+			res.DTBs = append(res.DTBs, dest(name))
+		}
+
+	case "raspberrypi":
+		// copy all dtb and dtbos (+ overlay_map)
+		dtbs, err := filepath.Glob(src("arch/arm64/boot/dts/broadcom/*.dtb"))
+		if err != nil {
+			return nil, err
+		}
+		for _, fn := range dtbs {
+			if err := copyFile(dest(filepath.Base(fn)), fn); err != nil {
+				return nil, err
+			}
+			res.DTBs = append(res.DTBs, dest(filepath.Base(fn)))
+		}
+
+		dtbos, err := filepath.Glob(src("arch/arm64/boot/dts/overlays/*.dtbo"))
+		if err != nil {
+			return nil, err
+		}
+		dtbos = append(dtbos, src("arch/arm64/boot/dts/overlays/overlay_map.dtb"))
+		if err := os.MkdirAll(dest("overlays"), 0755); err != nil {
+			return nil, err
+		}
+		for _, fn := range dtbos {
+			target := dest(filepath.Join("overlays", filepath.Base(fn)))
+			if err := copyFile(target, fn); err != nil {
+				return nil, err
+			}
+			res.DTBs = append(res.DTBs, target)
+		}
+	}
+
+	// copy additional device tree files, flattening the directory structure
+	for _, pattern := range b.cfg.DTBGlobs {
+		matches, err := filepath.Glob(filepath.Join(b.srcdir, "arch/arm64/boot/dts", strings.TrimSpace(pattern)))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("device tree pattern %q did not match any files", pattern)
+		}
+		for _, fn := range matches {
+			if err := copyFile(dest(filepath.Base(fn)), fn); err != nil {
+				return nil, err
+			}
+			res.DTBs = append(res.DTBs, dest(filepath.Base(fn)))
+		}
+	}
+
+	return res, nil
+}
+
+func copyFile(dest, src string) error {
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	st, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err := out.Chmod(st.Mode()); err != nil {
+		return err
+	}
+	return out.Close()
+}
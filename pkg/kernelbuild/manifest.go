@@ -0,0 +1,100 @@
+package kernelbuild
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Manifest is written to metadata.json in the output directory, describing
+// how the kernel was built.
+type Manifest struct {
+	KernelRelease string          `json:"kernel_release"`
+	UpstreamURL   string          `json:"upstream_url"`
+	SourceSHA256  string          `json:"source_sha256"`
+	Flavor        string          `json:"flavor"`
+	Cross         string          `json:"cross,omitempty"`
+	Patches       []ManifestPatch `json:"patches"`
+	ConfigSHA256  string          `json:"config_sha256"`
+	Toolchain     string          `json:"toolchain"`
+	BaseImage     string          `json:"base_image,omitempty"`
+	BuildStart    time.Time       `json:"build_start"`
+	BuildDuration string          `json:"build_duration"`
+}
+
+// ManifestPatch describes a patch which was applied to the kernel source.
+type ManifestPatch struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+}
+
+func fileSHA256(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// commandOutput returns the first line of the output of cmd.
+func commandOutput(cmd *exec.Cmd) string {
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = nil
+	if err := cmd.Run(); err != nil {
+		return ""
+	}
+	line, _, _ := strings.Cut(stdout.String(), "\n")
+	return strings.TrimSpace(line)
+}
+
+// completeManifest fills in the fields which are known once the kernel was
+// compiled.
+func (b *builder) completeManifest(ctx context.Context, m *Manifest) error {
+	m.BuildDuration = time.Since(m.BuildStart).Round(time.Second).String()
+	m.KernelRelease = commandOutput(b.command(ctx, "make", append(b.makeVars, "-s", "kernelrelease")...))
+	if b.cfg.Toolchain == "zig" {
+		m.Toolchain = "zig " + commandOutput(b.command(ctx, "zig", "version"))
+	} else {
+		gcc := "gcc"
+		if b.cfg.Cross == "arm64" {
+			gcc = "aarch64-linux-gnu-gcc"
+		}
+		m.Toolchain = commandOutput(b.command(ctx, gcc, "--version"))
+	}
+	configHash, err := fileSHA256(filepath.Join(b.srcdir, ".config"))
+	if err != nil {
+		return err
+	}
+	m.ConfigSHA256 = configHash
+	m.Patches = make([]ManifestPatch, 0, len(b.cfg.Patches))
+	for _, patch := range b.cfg.Patches {
+		h, err := fileSHA256(patch)
+		if err != nil {
+			return err
+		}
+		m.Patches = append(m.Patches, ManifestPatch{Name: filepath.Base(patch), SHA256: h})
+	}
+	return nil
+}
+
+func (m *Manifest) write(fn string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fn, append(b, '\n'), 0644)
+}
@@ -0,0 +1,66 @@
+package kernelbuild
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// SourceSHA256Sums looks up the SHA-256 hash of the kernel.org source
+// tarball upstreamURL in the sha256sums.asc file which kernel.org publishes
+// in the same directory, e.g.
+// https://cdn.kernel.org/pub/linux/kernel/v6.x/sha256sums.asc.
+//
+// The PGP signature of sha256sums.asc is not verified and the file is
+// fetched from the same host as the tarball, so the hash protects against
+// corrupted or truncated downloads, not against a compromised host.
+func SourceSHA256Sums(ctx context.Context, upstreamURL string) (string, error) {
+	u, err := url.Parse(upstreamURL)
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(u.Path)
+	u.Path = path.Join(path.Dir(u.Path), "sha256sums.asc")
+	sumsURL := u.String()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sumsURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", sumsURL, got, want)
+	}
+	hash, err := parseSHA256Sums(resp.Body, name)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", sumsURL, err)
+	}
+	return hash, nil
+}
+
+// parseSHA256Sums returns the hash of name in the sha256sum(1) output r,
+// which may be wrapped in a PGP clear-signed message.
+func parseSHA256Sums(r io.Reader, name string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || len(fields[0]) != 64 {
+			continue
+		}
+		if strings.TrimPrefix(fields[1], "*") == name {
+			return fields[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no SHA-256 hash for %s found", name)
+}
@@ -0,0 +1,43 @@
+package kernelbuild
+
+import (
+	"strings"
+	"testing"
+)
+
+const sha256SumsAsc = `-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA256
+
+1111111111111111111111111111111111111111111111111111111111111111  ChangeLog-6.6.7
+2222222222222222222222222222222222222222222222222222222222222222  linux-6.6.7.tar.gz
+3333333333333333333333333333333333333333333333333333333333333333  linux-6.6.7.tar.xz
+4444444444444444444444444444444444444444444444444444444444444444 *linux-6.6.8.tar.xz
+-----BEGIN PGP SIGNATURE-----
+
+iQIzBAEBCAAdFiEEZH8oZUiU471FcZm+ONu9yGCSaT4FAmV6x1cACgkQONu9yGCS
+-----END PGP SIGNATURE-----
+`
+
+func TestParseSHA256Sums(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "linux-6.6.7.tar.xz", want: strings.Repeat("3", 64)},
+		{name: "linux-6.6.7.tar.gz", want: strings.Repeat("2", 64)},
+		{name: "linux-6.6.8.tar.xz", want: strings.Repeat("4", 64)},
+		{name: "linux-6.6.9.tar.xz", wantErr: true},
+		{name: "6.6.7.tar.xz", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSHA256Sums(strings.NewReader(sha256SumsAsc), tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSHA256Sums(%q) = %v, want error: %v", tt.name, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseSHA256Sums(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
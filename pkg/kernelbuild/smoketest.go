@@ -0,0 +1,101 @@
+package kernelbuild
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// smokeTestMarker is printed by the smoke test init once userspace is
+// reached.
+const smokeTestMarker = "gokr-rebuild-kernel: smoke test reached userspace"
+
+const smokeTestInit = `#!/bin/busybox sh
+/bin/busybox echo "` + smokeTestMarker + `"
+/bin/busybox poweroff -f
+`
+
+// buildInitramfs creates a minimal initramfs (newc cpio) in dir containing
+// a statically linked busybox and an init script printing smokeTestMarker.
+func (b *builder) buildInitramfs(ctx context.Context, dir string) (string, error) {
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "bin"), 0755); err != nil {
+		return "", err
+	}
+	if err := copyFile(filepath.Join(root, "bin", "busybox"), "/bin/busybox"); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(root, "init"), []byte(smokeTestInit), 0755); err != nil {
+		return "", err
+	}
+	initramfs := filepath.Join(dir, "initramfs.cpio")
+	out, err := os.Create(initramfs)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	cpio := exec.CommandContext(ctx, "sh", "-c", "find . | cpio --quiet -o -H newc")
+	cpio.Dir = root
+	cpio.Stdout = out
+	cpio.Stderr = b.out
+	if err := cpio.Run(); err != nil {
+		return "", fmt.Errorf("cpio: %v", err)
+	}
+	return initramfs, out.Close()
+}
+
+// smokeTest boots the compiled kernel in QEMU and verifies that it reaches
+// userspace.
+func (b *builder) smokeTest(ctx context.Context) error {
+	tmp, err := os.MkdirTemp("", "gokr-smoke-test")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	initramfs, err := b.buildInitramfs(ctx, tmp)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	args := []string{
+		"-m", "512",
+		"-nographic",
+		"-no-reboot",
+		"-initrd", initramfs,
+		"-kernel", b.kernelImage(),
+	}
+	qemu := "qemu-system-x86_64"
+	if b.cfg.Cross == "arm64" {
+		qemu = "qemu-system-aarch64"
+		args = append(args,
+			"-machine", "virt",
+			"-cpu", "cortex-a72",
+			"-append", "console=ttyAMA0 panic=-1")
+	} else {
+		args = append(args,
+			"-append", "console=ttyS0 panic=-1")
+	}
+	var output bytes.Buffer
+	cmd := b.command(ctx, qemu, args...)
+	cmd.Stdout = io.MultiWriter(b.out, &output)
+	b.logf("%v", cmd.Args)
+	err = cmd.Run()
+	if strings.Contains(output.String(), smokeTestMarker) {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("smoke test: kernel did not reach userspace within 5 minutes")
+	}
+	if err != nil {
+		return fmt.Errorf("smoke test: %v: %v", cmd.Args, err)
+	}
+	return fmt.Errorf("smoke test: kernel did not reach userspace")
+}
@@ -0,0 +1,124 @@
+package kernelbuild
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// decompressor returns the command line which decompresses the tarball name
+// from stdin to stdout, preferring parallel implementations where installed.
+func decompressor(name string) ([]string, error) {
+	// candidates are tried in order; the first one found in $PATH is used.
+	var candidates [][]string
+	switch {
+	case strings.HasSuffix(name, ".tar.xz"):
+		candidates = [][]string{
+			{"pixz", "-d"},
+			{"xz", "-d", "-T0"},
+		}
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		candidates = [][]string{
+			{"pigz", "-d"},
+			{"gzip", "-d"},
+		}
+	case strings.HasSuffix(name, ".tar.zst"):
+		candidates = [][]string{
+			{"zstd", "-d", "-T0"},
+		}
+	default:
+		return nil, fmt.Errorf("unsupported kernel source archive %s: expected .tar.xz, .tar.gz or .tar.zst", name)
+	}
+	for _, c := range candidates {
+		if _, err := exec.LookPath(c[0]); err == nil {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("no decompressor for %s found in $PATH (tried %s)", name, candidates[len(candidates)-1][0])
+}
+
+// unpack extracts the tarball name, read from r, into dir. Decompression
+// runs in a separate process so that it overlaps with both reading r and
+// extracting.
+func (b *builder) unpack(ctx context.Context, r io.Reader, name, dir string) error {
+	args, err := decompressor(name)
+	if err != nil {
+		return err
+	}
+	b.logf("decompressing with %s", strings.Join(args, " "))
+	decompress := exec.CommandContext(ctx, args[0], args[1:]...)
+	decompress.Stdin = r
+	decompress.Stderr = b.out
+	untar := exec.CommandContext(ctx, "tar", "xf", "-")
+	untar.Dir = dir
+	untar.Stdout = b.out
+	untar.Stderr = b.out
+	untar.Stdin, err = decompress.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := untar.Start(); err != nil {
+		return fmt.Errorf("untar: %v", err)
+	}
+	if err := decompress.Run(); err != nil {
+		untar.Process.Kill()
+		untar.Wait()
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+	if err := untar.Wait(); err != nil {
+		return fmt.Errorf("untar: %v", err)
+	}
+	return nil
+}
+
+// downloadAndUnpack streams the kernel source tarball from url into unpack,
+// hashing it on the fly, and returns its SHA-256 hash. Compared to Download
+// followed by unpack, extraction does not wait for the download to finish.
+func (b *builder) downloadAndUnpack(ctx context.Context, url, dir string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", url, got, want)
+	}
+	h := sha256.New()
+	if err := b.unpack(ctx, io.TeeReader(resp.Body, h), url, dir); err != nil {
+		return "", err
+	}
+	// The decompressor might stop reading before the end of the body (e.g.
+	// trailing padding), so hash whatever remains.
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// unpackFile extracts the kernel source tarball fn into dir and returns its
+// SHA-256 hash, computed while reading.
+func (b *builder) unpackFile(ctx context.Context, fn, dir string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if err := b.unpack(ctx, io.TeeReader(f, h), fn, dir); err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}